@@ -47,7 +47,7 @@ func getStatus(s runner.Status) int {
 		return int(StatusOLE)
 	case runner.StatusDisallowedSyscall:
 		return int(StatusBan)
-	case runner.StatusSignalled, runner.StatusNonzeroExitStatus:
+	case runner.StatusSignalled, runner.StatusNonzeroExitStatus, runner.StatusForkLimitExceeded:
 		return int(StatusRE)
 	default:
 		return int(StatusFatal)
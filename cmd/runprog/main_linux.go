@@ -3,11 +3,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -28,10 +30,14 @@ import (
 )
 
 var (
-	addReadable, addWritable, addRawReadable, addRawWritable       arrayFlags
-	allowProc, unsafe, showDetails, useCGroup, memfile, cred       bool
-	timeLimit, realTimeLimit, memoryLimit, outputLimit, stackLimit uint64
-	inputFileName, outputFileName, errorFileName, workPath, runt   string
+	addReadable, addWritable, addRawReadable, addRawWritable, rewritePaths   arrayFlags
+	allowProc, unsafe, showDetails, useCGroup, memfile, cred, audit, softBan bool
+	noSwap, profile, loopback                                                bool
+	timeLimit, realTimeLimit, memoryLimit, outputLimit, stackLimit           uint64
+	processLimit                                                             uint64
+	cpuLimit                                                                 float64
+	inputFileName, outputFileName, errorFileName, workPath, runt             string
+	cpuset, ioMax, mountsFile, overlayLower                                  string
 
 	pType, result string
 	args          []string
@@ -49,6 +55,11 @@ func main() {
 	flag.Uint64Var(&memoryLimit, "ml", 256, "Set memory limit (in mb)")
 	flag.Uint64Var(&outputLimit, "ol", 64, "Set output limit (in mb)")
 	flag.Uint64Var(&stackLimit, "sl", 1024, "Set stack limit (in mb)")
+	flag.Uint64Var(&processLimit, "pl", 0, "Set process limit by pids cgroup (0 for unlimited)")
+	flag.Float64Var(&cpuLimit, "cpus", 0, "Set cpu bandwidth limit (in number of cpus) by cpu cgroup (0 for unlimited)")
+	flag.StringVar(&cpuset, "cpuset", "", "Restrict cpus (e.g. 0-1) by cpuset cgroup")
+	flag.StringVar(&ioMax, "io-max", "", "Throttle block device io by io cgroup (e.g. \"8:0 rbps=1048576 wbps=1048576\")")
+	flag.BoolVar(&noSwap, "no-swap", false, "Disable swap by memory cgroup so that memory limit could not be evaded")
 	flag.StringVar(&inputFileName, "in", "", "Set input file name")
 	flag.StringVar(&outputFileName, "out", "", "Set output file name")
 	flag.StringVar(&errorFileName, "err", "", "Set error file name")
@@ -66,6 +77,13 @@ func main() {
 	flag.BoolVar(&memfile, "memfd", false, "Use memfd as exec file")
 	flag.StringVar(&runt, "runner", "ptrace", "Runner for the program (ptrace, ns, container)")
 	flag.BoolVar(&cred, "cred", false, "Generate credential for containers (uid=10000)")
+	flag.BoolVar(&audit, "audit", false, "Report syscalls would have been denied instead of killing (ptrace), or log them by the kernel (ns)")
+	flag.Var(&rewritePaths, "rewrite", "Rewrite the file path accessed by the program (e.g. /etc/passwd:/w/passwd) (ptrace)")
+	flag.BoolVar(&softBan, "soft-ban", false, "Fail disallowed syscalls with ENOSYS instead of killing")
+	flag.StringVar(&mountsFile, "mounts", "", "Load the mount table from JSON list of mount.Spec instead of the default one, which should mount w as work dir (ns / container)")
+	flag.StringVar(&overlayLower, "overlay", "", "Use writable overlay of the directory (e.g. rootfs image) as root, changes are discarded (ns)")
+	flag.BoolVar(&loopback, "loopback", false, "Bring up loopback in the network namespace (ns)")
+	flag.BoolVar(&profile, "profile", false, "Report the count and the time stopped of traced syscalls (ptrace)")
 	flag.Parse()
 
 	args = flag.Args()
@@ -109,6 +127,12 @@ func main() {
 	if err == nil && rt.Status != runner.StatusNormal {
 		err = rt.Status
 	}
+	if len(rt.DeniedSyscalls) > 0 {
+		fmt.Fprintln(os.Stderr, "denied syscalls:", strings.Join(rt.DeniedSyscalls, " "))
+	}
+	for _, s := range rt.SyscallProfile {
+		fmt.Fprintf(os.Stderr, "syscall %s: %d calls, %v\n", s.Name, s.Count, s.Time)
+	}
 	debug("setupTime: ", rt.SetUpTime)
 	debug("runningTime: ", rt.RunningTime)
 	if err != nil {
@@ -139,7 +163,7 @@ func (r *containerRunner) Run(c context.Context) <-chan runner.Result {
 func start() (*runner.Result, error) {
 	var (
 		r        runner.Runner
-		cg       *cgroup.Cgroup
+		cg       *cgroup.Run
 		err      error
 		execFile uintptr
 		rt       runner.Result
@@ -160,18 +184,24 @@ func start() (*runner.Result, error) {
 		// it is fine since open that file will be a EPERM
 		// changing the fs uid and gid would be a good idea
 		WithProc().
+		WithProcMask().
 		// some compiler have multiple version
 		WithBind("/etc/alternatives", "etc/alternatives", true).
 		// fpc wants /etc/fpc.cfg
 		WithBind("/etc/fpc.cfg", "etc/fpc.cfg", true).
-		// go wants /dev/null
-		WithBind("/dev/null", "dev/null", false).
+		// go wants /dev/null, and some runtimes want /dev/urandom
+		WithDev().
 		// ghc wants /var/lib/ghc
 		WithBind("/var/lib/ghc", "var/lib/ghc", true).
 		// work dir
 		WithTmpfs("w", "size=8m,nr_inodes=4k").
 		// tmp dir
 		WithTmpfs("tmp", "size=8m,nr_inodes=4k")
+	if mountsFile != "" {
+		if mb, err = loadMounts(mountsFile); err != nil {
+			return nil, err
+		}
+	}
 
 	mt, err := mb.Build(true)
 	if err != nil {
@@ -179,28 +209,62 @@ func start() (*runner.Result, error) {
 	}
 
 	if useCGroup {
-		b, err := cgroup.NewBuilder("runprog").WithCPUAcct().WithMemory().WithPids().FilterByEnv()
+		b := cgroup.NewBuilder("runprog")
+		if f := cgroup.DetectFeatures(); f.Delegated {
+			debug(f)
+			root, err := cgroup.EnableDelegation()
+			if err != nil {
+				return nil, err
+			}
+			b.WithRoot(root)
+		}
+		b.WithCPUAcct().WithMemory().WithPidsMax(processLimit)
+		if cpuLimit > 0 {
+			const period = 100000 // 100ms
+			b.WithCPUMax(uint64(cpuLimit*period), period)
+		}
+		if cpuset != "" {
+			b.WithCpuset(cpuset, "")
+		}
+		if ioMax != "" {
+			l, err := cgroup.ParseIOLimit(ioMax)
+			if err != nil {
+				return nil, err
+			}
+			b.WithIOMax(l)
+		} else {
+			b.WithIO()
+		}
+		b, err := b.FilterByEnv()
 		if err != nil {
 			return nil, err
 		}
 		debug(b)
-		cg, err = b.Build()
+		cg, err = b.Start()
 		if err != nil {
 			return nil, err
 		}
-		defer cg.Destroy()
+		defer cg.Close()
 		if err = cg.SetMemoryLimitInBytes(memoryLimit << 20); err != nil {
 			return nil, err
 		}
-	}
-
-	syncFunc := func(pid int) error {
-		if cg != nil {
-			if err := cg.AddProc(pid); err != nil {
-				return err
+		if noSwap {
+			if err = cg.SetMemorySwapMax(0); err != nil {
+				return nil, fmt.Errorf("cgroup swap: %v", err)
 			}
 		}
-		return nil
+	}
+
+	var (
+		syncFunc                func(int) error
+		oomKilled, forkLimitHit func() bool
+		killFunc                func() error
+	)
+	if cg != nil {
+		syncFunc = cg.Attach
+		oomKilled = cg.OOMKilled
+		forkLimitHit = cg.ForkLimitHit
+		killFunc = cg.Kill
 	}
 
 	if memfile {
@@ -247,6 +311,20 @@ func start() (*runner.Result, error) {
 	if showDetails {
 		actionDefault = seccomp.ActionTrace.WithReturnCode(seccomp.MsgDisallow)
 	}
+	var banErrno syscall.Errno
+	if softBan {
+		banErrno = syscall.ENOSYS
+		actionDefault = seccomp.ActionTrace.WithReturnCode(seccomp.MsgDisallow)
+		if runt != "ptrace" {
+			actionDefault = seccomp.ActionErrno.WithReturnCode(int16(banErrno))
+		}
+	}
+	if audit {
+		actionDefault = seccomp.ActionTrace.WithReturnCode(seccomp.MsgDisallow)
+		if runt == "ns" {
+			actionDefault = seccomp.ActionLog
+		}
+	}
 
 	limit := runner.Limit{
 		TimeLimit:   time.Duration(timeLimit) * time.Second,
@@ -270,6 +348,8 @@ func start() (*runner.Result, error) {
 			Mounts:        mt,
 			CredGenerator: credG,
 			CloneFlags:    forkexec.UnshareFlags,
+			Stderr:        showDetails,
+			Verbose:       showDetails,
 		}
 
 		m, err := b.Build()
@@ -284,12 +364,14 @@ func start() (*runner.Result, error) {
 		r = &containerRunner{
 			Environment: m,
 			ExecveParam: container.ExecveParam{
-				Args:     args,
-				Env:      []string{pathEnv},
-				Files:    fds,
-				ExecFile: execFile,
-				RLimits:  rlims.PrepareRLimit(),
-				SyncFunc: syncFunc,
+				Args:         args,
+				Env:          []string{pathEnv},
+				Files:        fds,
+				ExecFile:     execFile,
+				RLimits:      rlims.PrepareRLimit(),
+				SyncFunc:     syncFunc,
+				OOMKilled:    oomKilled,
+				ForkLimitHit: forkLimitHit,
 			},
 		}
 	} else if runt == "ns" {
@@ -307,20 +389,23 @@ func start() (*runner.Result, error) {
 		}
 		defer os.RemoveAll(root)
 		r = &unshare.Runner{
-			Args:        args,
-			Env:         []string{pathEnv},
-			ExecFile:    execFile,
-			WorkDir:     "/w",
-			Files:       fds,
-			RLimits:     rlims.PrepareRLimit(),
-			Limit:       limit,
-			Seccomp:     filter,
-			Root:        root,
-			Mounts:      mt,
-			ShowDetails: showDetails,
-			SyncFunc:    syncFunc,
-			HostName:    "run_program",
-			DomainName:  "run_program",
+			Args:         args,
+			Env:          []string{pathEnv},
+			ExecFile:     execFile,
+			WorkDir:      "/w",
+			Files:        fds,
+			RLimits:      rlims.PrepareRLimit(),
+			Limit:        limit,
+			Seccomp:      filter,
+			Root:         root,
+			OverlayLower: overlayLower,
+			Mounts:       mt,
+			ShowDetails:  showDetails,
+			SyncFunc:     syncFunc,
+			KillFunc:     killFunc,
+			HostName:     "run_program",
+			DomainName:   "run_program",
+			Loopback:     loopback,
 		}
 	} else if runt == "ptrace" {
 		builder := libseccomp.Builder{
@@ -332,6 +417,18 @@ func start() (*runner.Result, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to create seccomp filter %v", err)
 		}
+		var rewrite func(string) string
+		if len(rewritePaths) > 0 {
+			m := filehandler.NewPathRemap("")
+			for _, p := range rewritePaths {
+				f := strings.SplitN(p, ":", 2)
+				if len(f) != 2 {
+					return nil, fmt.Errorf("invalid rewrite path: %s", p)
+				}
+				m.Add(f[0], f[1])
+			}
+			rewrite = m.Rewrite
+		}
 		r = &ptrace.Runner{
 			Args:        args,
 			Env:         []string{pathEnv},
@@ -343,6 +440,10 @@ func start() (*runner.Result, error) {
 			Seccomp:     filter,
 			ShowDetails: showDetails,
 			Unsafe:      unsafe,
+			Audit:       audit,
+			SoftBan:     banErrno,
+			Rewrite:     rewrite,
+			Profile:     profile,
 			Handler:     h,
 			SyncFunc:    syncFunc,
 		}
@@ -380,21 +481,29 @@ func start() (*runner.Result, error) {
 	debug("results:", rt, err)
 
 	if useCGroup {
-		cpu, err := cg.CpuacctUsage()
+		st, err := cg.Stat()
 		if err != nil {
-			return nil, fmt.Errorf("cgroup cpu: %v", err)
+			return nil, fmt.Errorf("cgroup: %v", err)
 		}
-		memory, err := cg.MemoryMaxUsageInBytes()
-		if err != nil {
-			return nil, fmt.Errorf("cgroup memory: %v", err)
-		}
-		cache, err := cg.FindMemoryStatProperty("cache")
-		if err != nil {
-			return nil, fmt.Errorf("cgroup cache %v", err)
+		debug("cgroup: ", st)
+		rt.Time = st.CPUUsage
+		rt.Memory = runner.Size(st.MemoryPeak - st.MemoryCache)
+		rt.Swap = runner.Size(st.SwapPeak)
+		rt.IORead = runner.Size(st.IO.ReadBytes)
+		rt.IOWrite = runner.Size(st.IO.WriteBytes)
+		if p := st.Pressure; p != nil {
+			stall := func(p cgroup.Pressure) runner.Stall {
+				return runner.Stall{
+					Some: time.Duration(p.Some) * time.Microsecond,
+					Full: time.Duration(p.Full) * time.Microsecond,
+				}
+			}
+			rt.Pressure = &runner.Pressure{
+				CPU:    stall(p.CPU),
+				Memory: stall(p.Memory),
+				IO:     stall(p.IO),
+			}
 		}
-		debug("cgroup: cpu: ", cpu, " memory: ", memory, "cache: ", cache)
-		rt.Time = time.Duration(cpu)
-		rt.Memory = runner.Size(memory - cache)
 		debug("cgroup:", rt)
 	}
 	return &rt, nil
@@ -415,3 +524,16 @@ func (c *credGen) Get() syscall.Credential {
 		Gid: n,
 	}
 }
+
+// loadMounts reads the mount table from the JSON list of mount.Spec
+func loadMounts(fn string) (*mount.Builder, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var specs []mount.Spec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("invalid mounts %s: %v", fn, err)
+	}
+	return mount.NewBuilder().WithSpecs(specs)
+}
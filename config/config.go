@@ -84,6 +84,7 @@ var (
 		// file open
 		"open",
 		"openat",
+		"openat2",
 
 		// file delete
 		"unlink",
@@ -98,6 +99,8 @@ var (
 		"stat",
 		"access",
 		"faccessat",
+		"faccessat2",
+		"statx",
 	}
 
 	// process related syscall if allowProc enabled
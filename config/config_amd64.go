@@ -10,5 +10,7 @@ var (
 
 	archSyscallAllows = []string{}
 
-	archSyscallTraces = []string{}
+	archSyscallTraces = []string{
+		"newfstatat",
+	}
 )
@@ -20,7 +20,8 @@ var (
 	}
 
 	archSyscallTraces = []string{
-		"lstat64", // 32-bit
-		"stat64",  // 32-bit
+		"lstat64",   // 32-bit
+		"stat64",    // 32-bit
+		"fstatat64", // 32-bit
 	}
 )
@@ -8,9 +8,9 @@ var (
 		"/usr/lib/aarch64-linux-gnu/",
 	}
 
-	archSyscallAllows = []string{
+	archSyscallAllows = []string{}
+
+	archSyscallTraces = []string{
 		"newfstatat",
 	}
-
-	archSyscallTraces = []string{}
 )
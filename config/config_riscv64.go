@@ -0,0 +1,16 @@
+package config
+
+// This file includes configs for the run program settings
+
+var (
+	archReadableFiles = []string{
+		"/lib/riscv64-linux-gnu/",
+		"/usr/lib/riscv64-linux-gnu/",
+	}
+
+	archSyscallAllows = []string{}
+
+	archSyscallTraces = []string{
+		"newfstatat",
+	}
+)
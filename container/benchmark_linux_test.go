@@ -3,9 +3,16 @@ package container
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/criyle/go-sandbox/pkg/seccomp"
 	"github.com/criyle/go-sandbox/runner"
 )
 
@@ -45,6 +52,56 @@ func BenchmarkContainer(b *testing.B) {
 	}
 }
 
+func BenchmarkCodecGob(b *testing.B) {
+	benchmarkCodec(b, CodecGob)
+}
+
+func BenchmarkCodecBinary(b *testing.B) {
+	benchmarkCodec(b, CodecBinary)
+}
+
+func benchmarkCodec(b *testing.B, c Codec) {
+	// encoder and decoder are on different side of the socket
+	enc, _ := newCodec(c)
+	dec, _ := newCodec(c)
+	cm := cmd{
+		Cmd: cmdExecve,
+		ExecCmd: &execCmd{
+			Argv:    []string{"/bin/echo", "hello"},
+			Env:     []string{"PATH=/bin"},
+			WorkDir: "/w",
+		},
+	}
+	rep := reply{
+		ExecReply: &execReply{
+			Status: runner.StatusNormal,
+			Time:   time.Millisecond,
+			Memory: 4 << 20,
+		},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := enc.Encode(&cm)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var cm2 cmd
+		if err := dec.Decode(buf, &cm2); err != nil {
+			b.Fatal(err)
+		}
+		buf, err = dec.Encode(&rep)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var rep2 reply
+		if err := enc.Decode(buf, &rep2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestContainerSuccess(t *testing.T) {
 	m := getEnv(t)
 	if m == nil {
@@ -97,15 +154,514 @@ func TestContainerSyncFuncFail(t *testing.T) {
 	}
 }
 
+func TestContainerBinaryCodec(t *testing.T) {
+	m := getEnvCodec(t, CodecBinary)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+	if err := m.Ping(); err != nil {
+		t.Error(err)
+		return
+	}
+	rt := m.Execve(context.TODO(), ExecveParam{
+		Args: []string{"/bin/echo"},
+		Env:  []string{"PATH=/bin"},
+	})
+	r := <-rt
+	if r.Status != runner.StatusNormal {
+		t.Error(r.Status, r.Error)
+		return
+	}
+}
+
+func TestContainerExecveTime(t *testing.T) {
+	m := getEnv(t)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+	const syncTime, runTime = 100 * time.Millisecond, 200 * time.Millisecond
+	r := <-m.Execve(context.TODO(), ExecveParam{
+		Args: []string{"/bin/sleep", "0.2"},
+		Env:  []string{"PATH=/bin"},
+		SyncFunc: func(int) error {
+			time.Sleep(syncTime)
+			return nil
+		},
+	})
+	if r.Status != runner.StatusNormal {
+		t.Fatal(r.Status, r.Error)
+	}
+	// the sync is part of the set up
+	if r.SetUpTime < syncTime || r.SetUpTime > syncTime+time.Second {
+		t.Errorf("SetUpTime = %v, want about %v", r.SetUpTime, syncTime)
+	}
+	if r.RunningTime < runTime || r.RunningTime > runTime+time.Second {
+		t.Errorf("RunningTime = %v, want about %v", r.RunningTime, runTime)
+	}
+}
+
+func TestContainerExecveTimeout(t *testing.T) {
+	m := getEnv(t)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	rt := m.Execve(ctx, ExecveParam{
+		Args: []string{"/bin/sleep", "10"},
+		Env:  []string{"PATH=/bin"},
+	})
+	r := <-rt
+	if r.Status != runner.StatusTimeLimitExceeded {
+		t.Error(r.Status, r.Error)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("killed after %v", d)
+	}
+}
+
+func TestContainerExecveConcurrent(t *testing.T) {
+	m := getEnv(t)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+	errSync := errors.New("sync failed")
+	tests := []struct {
+		name string
+		args []string
+		sync func(cancel func()) error
+		kill bool // cancel while running
+		want []runner.Status
+	}{
+		{
+			name: "ok",
+			args: []string{"/bin/echo"},
+			want: []runner.Status{runner.StatusNormal},
+		},
+		{
+			name: "killed while running",
+			args: []string{"/bin/sleep", "10"},
+			kill: true,
+			want: []runner.Status{runner.StatusTimeLimitExceeded},
+		},
+		{
+			name: "kill before ok",
+			args: []string{"/bin/sleep", "10"},
+			sync: func(cancel func()) error { return errSync },
+			want: []runner.Status{runner.StatusRunnerError},
+		},
+		{
+			// kill sent right after ok, the process may finish before it
+			name: "kill after ok",
+			args: []string{"/bin/echo"},
+			sync: func(cancel func()) error {
+				cancel()
+				return nil
+			},
+			want: []runner.Status{runner.StatusNormal, runner.StatusTimeLimitExceeded},
+		},
+	}
+	const rounds = 4
+	var wg sync.WaitGroup
+	for i := 0; i < rounds; i++ {
+		for _, tc := range tests {
+			tc := tc
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithCancel(context.TODO())
+				defer cancel()
+				p := ExecveParam{
+					Args: tc.args,
+					Env:  []string{"PATH=/bin"},
+				}
+				if tc.sync != nil {
+					p.SyncFunc = func(int) error { return tc.sync(cancel) }
+				}
+				rt := m.Execve(ctx, p)
+				if tc.kill {
+					time.AfterFunc(100*time.Millisecond, cancel)
+				}
+				var r runner.Result
+				select {
+				case r = <-rt:
+				case <-time.After(5 * time.Second):
+					t.Errorf("%s: no result", tc.name)
+					return
+				}
+				for _, s := range tc.want {
+					if r.Status == s {
+						return
+					}
+				}
+				t.Errorf("%s: got %v %v, want %v", tc.name, r.Status, r.Error, tc.want)
+			}()
+		}
+	}
+	wg.Wait()
+	// the container keeps serving
+	if err := m.Ping(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestContainerExecveSyncNotBlocking(t *testing.T) {
+	m := getEnv(t)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+
+	// Execve returns after the sync
+	execve := func(syncFunc func(int) error) <-chan runner.Result {
+		rt := make(chan runner.Result, 1)
+		go func() {
+			rt <- <-m.Execve(context.TODO(), ExecveParam{
+				Args:     []string{"/bin/echo"},
+				Env:      []string{"PATH=/bin"},
+				SyncFunc: syncFunc,
+			})
+		}()
+		return rt
+	}
+
+	// the first execve waits in SyncFunc until the second one finished
+	synced, release := make(chan struct{}), make(chan struct{})
+	rt1 := execve(func(int) error {
+		close(synced)
+		<-release
+		return nil
+	})
+	<-synced
+	rt2 := execve(nil)
+	select {
+	case r := <-rt2:
+		if r.Status != runner.StatusNormal {
+			t.Error(r.Status, r.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("execve blocked by the sync of another one")
+		close(release)
+		<-rt2
+		<-rt1
+		return
+	}
+	close(release)
+	if r := <-rt1; r.Status != runner.StatusNormal {
+		t.Error(r.Status, r.Error)
+	}
+}
+
+func TestContainerExecveTooLarge(t *testing.T) {
+	for _, codec := range []Codec{CodecGob, CodecBinary} {
+		t.Run(codec.String(), func(t *testing.T) {
+			m := getEnvCodec(t, codec)
+			if m == nil {
+				return
+			}
+			defer m.Destroy()
+
+			// valid filter of 32k allowing everything
+			filter := make(seccomp.Filter, 4096)
+			for i := range filter {
+				filter[i] = syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: 0x7fff0000}
+			}
+			r := <-m.Execve(context.TODO(), ExecveParam{
+				Args:    []string{"/bin/echo"},
+				Env:     []string{"PATH=/bin"},
+				Seccomp: filter,
+			})
+			if r.Status != runner.StatusRunnerError || !strings.Contains(r.Error, "exceeds") {
+				t.Error(r.Status, r.Error)
+			}
+			// the container keeps serving
+			r = <-m.Execve(context.TODO(), ExecveParam{
+				Args: []string{"/bin/echo"},
+				Env:  []string{"PATH=/bin"},
+			})
+			if r.Status != runner.StatusNormal {
+				t.Error(r.Status, r.Error)
+			}
+		})
+	}
+}
+
+func TestContainerExecveCopyInMany(t *testing.T) {
+	m := getEnv(t)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+
+	src, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	src.WriteString("data")
+	src.Close()
+
+	// more fds than single message holds
+	copyIn := make([]CopyInCmd, 300)
+	for i := range copyIn {
+		f, err := os.Open(src.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		copyIn[i] = CopyInCmd{Src: f, Path: fmt.Sprintf("f%d", i), Perm: 0644}
+	}
+	r := <-m.Execve(context.TODO(), ExecveParam{
+		Args:   []string{"/bin/cat", "f0", "f299"},
+		Env:    []string{"PATH=/bin"},
+		CopyIn: copyIn,
+	})
+	if r.Status != runner.StatusNormal {
+		t.Fatal(r.Status, r.Error)
+	}
+
+	// batch is not atomic, files before the failed one are kept
+	for i := range copyIn {
+		if _, err := copyIn[i].Src.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		copyIn[i].Path = fmt.Sprintf("g%d", i)
+	}
+	copyIn[280].MaxSize = 1
+	r = <-m.Execve(context.TODO(), ExecveParam{
+		Args:   []string{"/bin/echo"},
+		Env:    []string{"PATH=/bin"},
+		CopyIn: copyIn,
+	})
+	if r.Status != runner.StatusRunnerError {
+		t.Error(r.Status, r.Error)
+	}
+	for _, tc := range []struct {
+		path   string
+		exists bool
+	}{{"g0", true}, {"g279", true}, {"g280", false}, {"g281", false}} {
+		if _, err := m.Stat(tc.path); (err == nil) != tc.exists {
+			t.Errorf("%s: got %v, want exists %v", tc.path, err, tc.exists)
+		}
+	}
+}
+
+func TestContainerCopyInConcurrent(t *testing.T) {
+	m := getEnv(t)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+
+	// copyin blocked on pipes more than workers
+	var ws []*os.File
+	errs := make(chan error, copyInWorkers+1)
+	for i := 0; i < copyInWorkers+1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		defer w.Close()
+		ws = append(ws, w)
+		go func(i int) {
+			_, err := m.CopyIn(CopyInCmd{Src: r, Path: fmt.Sprintf("f%d", i), Perm: 0644})
+			errs <- err
+		}(i)
+	}
+	// serve loop is not blocked by the copyin waiting for a worker
+	time.Sleep(50 * time.Millisecond)
+	if err := m.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reset waits for the copyin in flight
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for _, w := range ws {
+			w.WriteString("data")
+			w.Close()
+		}
+	}()
+	if err := m.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	for range ws {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	for i := range ws {
+		if _, err := m.Stat(fmt.Sprintf("f%d", i)); err == nil {
+			t.Errorf("f%d: exists after reset", i)
+		}
+	}
+}
+
+func TestContainerExecveOOMScoreAdj(t *testing.T) {
+	m := getEnv(t)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+
+	var adj []byte
+	r := <-m.Execve(context.TODO(), ExecveParam{
+		Args:        []string{"/bin/echo"},
+		Env:         []string{"PATH=/bin"},
+		OOMScoreAdj: 1000,
+		SyncFunc: func(pid int) (err error) {
+			adj, err = ioutil.ReadFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid))
+			return err
+		},
+	})
+	if r.Status != runner.StatusNormal {
+		t.Fatal(r.Status, r.Error)
+	}
+	if string(adj) != "1000\n" {
+		t.Errorf("got %q, want 1000", adj)
+	}
+}
+
+func TestContainerExecveErrorReply(t *testing.T) {
+	m := getEnv(t)
+	if m == nil {
+		return
+	}
+	defer m.Destroy()
+	c := m.(*container)
+
+	recvError := func(cl *call) error {
+		rep, msg, err := cl.recv()
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			closeFds(msg.Fds)
+		}
+		if rep.Error == nil {
+			return errors.New("no error replied")
+		}
+		return rep.Error
+	}
+	for _, tc := range []struct {
+		name string
+		cmd  cmd
+	}{
+		{"no parameter", cmd{Cmd: cmdExecve}},
+		{"no fexecve fd", cmd{Cmd: cmdExecve, ExecCmd: &execCmd{Argv: []string{"/bin/echo"}, FdExec: true}}},
+	} {
+		cl, err := c.request(&tc.cmd, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := recvError(cl); !errors.Is(err, ErrProtocol) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, ErrProtocol)
+		}
+		c.endCall(cl)
+	}
+
+	// execve with the id of a running session
+	exec := cmd{Cmd: cmdExecve, ExecCmd: &execCmd{Argv: []string{"/bin/sleep", "10"}}}
+	cl, err := c.request(&exec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sync reply with pid
+	if _, msg, err := cl.recv(); err != nil || msg == nil || msg.Cred == nil {
+		t.Fatalf("sync: %v %v", msg, err)
+	}
+	if err := c.sendCall(cl, &exec, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := recvError(cl); !errors.Is(err, ErrProtocol) {
+		t.Errorf("duplicated id: got %v, want %v", err, ErrProtocol)
+	}
+	// kill before ok fails the session, then kill to finish it
+	c.execveSyncKill(cl)
+	c.execveSyncKill(cl)
+	c.endCall(cl)
+
+	// the container keeps serving
+	if err := m.Ping(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestContainerCmdTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(m Environment) error
+	}{
+		{
+			// open on fifo blocks without writer
+			name: "open",
+			run: func(m Environment) error {
+				rt := m.Execve(context.TODO(), ExecveParam{
+					Args: []string{"/usr/bin/mkfifo", "fifo"},
+					Env:  []string{"PATH=/usr/bin:/bin"},
+				})
+				if r := <-rt; r.Status != runner.StatusNormal {
+					return fmt.Errorf("mkfifo: %v %v", r.Status, r.Error)
+				}
+				_, err := m.Open([]OpenCmd{{Path: "fifo", Flag: os.O_RDONLY}})
+				return err
+			},
+		},
+		{
+			// copyin is handled concurrently, blocks on pipe without data
+			name: "copyin",
+			run: func(m Environment) error {
+				r, w, err := os.Pipe()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				defer w.Close()
+				_, err = m.CopyIn(CopyInCmd{Src: r, Path: "f", Perm: 0644})
+				return err
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := getEnvBuilder(t, &Builder{CmdTimeout: 100 * time.Millisecond})
+			if m == nil {
+				return
+			}
+			defer m.Destroy()
+			if err := tc.run(m); !errors.Is(err, ErrTimeout) {
+				t.Errorf("got %v, want %v", err, ErrTimeout)
+				return
+			}
+			// container exits after the timeout
+			if err := m.Ping(); err == nil {
+				t.Error("ping: container alive after timeout")
+			}
+		})
+	}
+}
+
 func getEnv(t *testing.T) Environment {
+	return getEnvCodec(t, CodecGob)
+}
+
+func getEnvCodec(t *testing.T, c Codec) Environment {
+	return getEnvBuilder(t, &Builder{Codec: c})
+}
+
+func getEnvBuilder(t *testing.T, builder *Builder) Environment {
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Error(err)
 		return nil
 	}
-	builder := &Builder{
-		Root: tmpDir,
-	}
+	builder.Root = tmpDir
 	m, err := builder.Build()
 	if err != nil {
 		t.Error(err)
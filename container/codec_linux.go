@@ -0,0 +1,750 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/criyle/go-sandbox/pkg/rlimit"
+	"github.com/criyle/go-sandbox/pkg/seccomp"
+	"github.com/criyle/go-sandbox/runner"
+)
+
+// Codec defines the encoding used for cmd / reply messages between
+// host and container
+type Codec uint32
+
+// Codec options
+const (
+	CodecGob    Codec = iota // encoding/gob (default)
+	CodecBinary              // compact hand-rolled binary encoding
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecGob:
+		return "gob"
+	case CodecBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("Codec(%d)", uint32(c))
+	}
+}
+
+// codec encodes / decodes single message
+type codec interface {
+	Encode(e interface{}) ([]byte, error)
+	Decode(b []byte, e interface{}) error
+}
+
+func newCodec(c Codec) (codec, error) {
+	switch c {
+	case CodecGob:
+		return newGobCodec(), nil
+	case CodecBinary:
+		return &binaryCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %v", c)
+	}
+}
+
+// gobCodec uses gob stream, type information is sent with the first message
+// of each type, thus messages must be decoded in order
+type gobCodec struct {
+	recvBuff bytes.Buffer
+	decoder  *gob.Decoder
+
+	sendBuff bytes.Buffer
+	encoder  *gob.Encoder
+}
+
+func newGobCodec() *gobCodec {
+	c := new(gobCodec)
+	c.decoder = gob.NewDecoder(&c.recvBuff)
+	c.encoder = gob.NewEncoder(&c.sendBuff)
+	return c
+}
+
+func (c *gobCodec) Encode(e interface{}) ([]byte, error) {
+	c.sendBuff.Reset()
+	if err := c.encoder.Encode(e); err != nil {
+		return nil, err
+	}
+	return c.sendBuff.Bytes(), nil
+}
+
+func (c *gobCodec) Decode(b []byte, e interface{}) error {
+	c.recvBuff.Reset()
+	c.recvBuff.Write(b)
+	return c.decoder.Decode(e)
+}
+
+var errBinaryShort = errors.New("binary: message too short")
+
+// binaryCodec encodes cmd / reply with varint fields in fixed order,
+// pointer fields are prefixed with presence flag
+type binaryCodec struct {
+	w binaryWriter
+}
+
+func (c *binaryCodec) Encode(e interface{}) ([]byte, error) {
+	c.w.Reset()
+	switch e := e.(type) {
+	case *cmd:
+		c.w.encodeCmd(e)
+	case *reply:
+		c.w.encodeReply(e)
+	default:
+		return nil, fmt.Errorf("binary: unsupported type %T", e)
+	}
+	return c.w.Bytes(), nil
+}
+
+func (c *binaryCodec) Decode(b []byte, e interface{}) error {
+	r := binaryReader{b: b}
+	switch e := e.(type) {
+	case *cmd:
+		r.decodeCmd(e)
+	case *reply:
+		r.decodeReply(e)
+	default:
+		return fmt.Errorf("binary: unsupported type %T", e)
+	}
+	if r.err == nil && len(r.b) != 0 {
+		r.err = fmt.Errorf("binary: %d bytes remains", len(r.b))
+	}
+	return r.err
+}
+
+type binaryWriter struct {
+	bytes.Buffer
+}
+
+func (w *binaryWriter) uint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.Write(b[:n])
+}
+
+func (w *binaryWriter) int(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	w.Write(b[:n])
+}
+
+func (w *binaryWriter) bool(v bool) {
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.uint(uint64(len(b)))
+	w.Write(b)
+}
+
+func (w *binaryWriter) strings(s []string) {
+	w.uint(uint64(len(s)))
+	for _, v := range s {
+		w.string(v)
+	}
+}
+
+func (w *binaryWriter) cred(c *execCred) {
+	w.bool(c != nil)
+	if c == nil {
+		return
+	}
+	w.uint(uint64(c.UID))
+	w.uint(uint64(c.GID))
+	w.uint(uint64(len(c.Groups)))
+	for _, g := range c.Groups {
+		w.uint(uint64(g))
+	}
+}
+
+func (w *binaryWriter) encodeCmd(c *cmd) {
+	w.uint(c.ID)
+	w.string(c.Cmd)
+	w.int(int64(c.Timeout))
+
+	w.uint(uint64(len(c.OpenCmd)))
+	for _, o := range c.OpenCmd {
+		w.string(o.Path)
+		w.int(int64(o.Flag))
+		w.uint(uint64(o.Perm))
+	}
+
+	w.bool(c.DeleteCmd != nil)
+	if c.DeleteCmd != nil {
+		w.string(c.DeleteCmd.Path)
+	}
+
+	w.bool(c.StatCmd != nil)
+	if c.StatCmd != nil {
+		w.string(c.StatCmd.Path)
+	}
+
+	w.bool(c.LinkCmd != nil)
+	if c.LinkCmd != nil {
+		w.string(c.LinkCmd.Old)
+		w.string(c.LinkCmd.New)
+	}
+
+	w.bool(c.CopyOutCmd != nil)
+	if c.CopyOutCmd != nil {
+		w.strings(c.CopyOutCmd.Paths)
+		w.bool(c.CopyOutCmd.Tar)
+	}
+
+	w.bool(c.CopyInCmd != nil)
+	if c.CopyInCmd != nil {
+		w.string(c.CopyInCmd.Path)
+		w.uint(uint64(c.CopyInCmd.Perm))
+		w.int(c.CopyInCmd.MaxSize)
+		w.bytes(c.CopyInCmd.Checksum)
+		w.bool(c.CopyInCmd.Tar)
+	}
+
+	w.bool(c.MountCmd != nil)
+	if c.MountCmd != nil {
+		w.string(c.MountCmd.Target)
+		w.bool(c.MountCmd.Readonly)
+	}
+
+	w.bool(c.CacheCmd != nil)
+	if c.CacheCmd != nil {
+		w.string(c.CacheCmd.Key)
+		w.bool(c.CacheCmd.Drop)
+	}
+
+	w.bool(c.WorkDirCmd != nil)
+	if c.WorkDirCmd != nil {
+		w.string(c.WorkDirCmd.Path)
+		w.cred(c.WorkDirCmd.Cred)
+	}
+
+	w.bool(c.ExecCmd != nil)
+	if e := c.ExecCmd; e != nil {
+		w.strings(e.Argv)
+		w.strings(e.Env)
+		w.uint(uint64(len(e.RLimits)))
+		for _, r := range e.RLimits {
+			w.int(int64(r.Res))
+			w.uint(r.Rlim.Cur)
+			w.uint(r.Rlim.Max)
+		}
+		w.bool(e.FdExec)
+		w.string(e.Cached)
+		w.string(e.WorkDir)
+		w.bool(e.StreamOutput)
+		w.bool(e.StreamInput)
+		w.bool(e.TTY)
+		w.cred(e.Cred)
+		w.uint(uint64(len(e.Seccomp)))
+		for _, f := range e.Seccomp {
+			w.uint(uint64(f.Code))
+			w.uint(uint64(f.Jt))
+			w.uint(uint64(f.Jf))
+			w.uint(uint64(f.K))
+		}
+		w.int(e.CoreLimit)
+		w.bool(e.DisableASLR)
+		w.uint(e.AmbientCaps)
+	}
+
+	w.bool(c.ConfCmd != nil)
+	if c.ConfCmd != nil {
+		w.bool(c.ConfCmd.Conf.Cred)
+		w.strings(c.ConfCmd.Conf.ResetPaths)
+		w.strings(c.ConfCmd.Conf.Roots)
+		w.int(c.ConfCmd.Conf.MaxSize)
+		w.bool(c.ConfCmd.Conf.Verbose)
+	}
+
+	w.bool(c.SignalCmd != nil)
+	if c.SignalCmd != nil {
+		w.int(int64(c.SignalCmd.Signal))
+		w.bool(c.SignalCmd.Group)
+	}
+
+	w.bool(c.StdinCmd != nil)
+	if c.StdinCmd != nil {
+		w.bytes(c.StdinCmd.Data)
+		w.bool(c.StdinCmd.Close)
+	}
+
+	w.uint(uint64(len(c.BatchCmd)))
+	for i := range c.BatchCmd {
+		w.encodeCmd(&c.BatchCmd[i])
+	}
+}
+
+func (w *binaryWriter) encodeReply(r *reply) {
+	w.uint(r.ID)
+	w.bool(r.Error != nil)
+	if e := r.Error; e != nil {
+		w.int(int64(e.Code))
+		w.string(e.Msg)
+		w.uint(uint64(e.Errno))
+	}
+
+	w.bool(r.ExecReply != nil)
+	if e := r.ExecReply; e != nil {
+		w.int(int64(e.ExitStatus))
+		w.int(int64(e.Status))
+		w.int(int64(e.Time))
+		w.uint(uint64(e.Memory))
+		w.int(int64(e.Rusage.UserTime))
+		w.int(int64(e.Rusage.SystemTime))
+		w.uint(uint64(e.Rusage.MaxRss))
+		w.uint(e.Rusage.MinorFault)
+		w.uint(e.Rusage.MajorFault)
+		w.uint(e.Rusage.VoluntaryCtxSwitch)
+		w.uint(e.Rusage.InvoluntaryCtxSwitch)
+		w.int(int64(e.SetUpTime))
+		w.int(int64(e.WallTime))
+		w.bool(e.Crash != nil)
+		if c := e.Crash; c != nil {
+			w.int(int64(c.Signal))
+			w.bool(c.CoreDumped)
+			w.string(c.CorePath)
+			w.int(c.CoreSize)
+			w.bytes(c.Core)
+		}
+	}
+
+	w.bool(r.CopyInReply != nil)
+	if c := r.CopyInReply; c != nil {
+		w.bool(c.Unchanged)
+	}
+
+	w.bool(r.WorkDirReply != nil)
+	if c := r.WorkDirReply; c != nil {
+		w.string(c.Path)
+	}
+
+	w.bool(r.CopyOutReply != nil)
+	if c := r.CopyOutReply; c != nil {
+		w.strings(c.Names)
+		w.bool(c.More)
+	}
+
+	w.bool(r.StatReply != nil)
+	if s := r.StatReply; s != nil {
+		w.string(s.Name)
+		w.int(s.Size)
+		w.uint(uint64(s.Mode))
+		w.int(s.ModTime.UnixNano())
+	}
+
+	w.bool(r.OutputReply != nil)
+	if o := r.OutputReply; o != nil {
+		w.int(int64(o.Fd))
+		w.bytes(o.Data)
+	}
+
+	w.bool(r.InfoReply != nil)
+	if i := r.InfoReply; i != nil {
+		w.strings(i.Mounts)
+		w.uint(uint64(len(i.PIDs)))
+		for _, p := range i.PIDs {
+			w.int(int64(p))
+		}
+		w.uint(uint64(len(i.Disk)))
+		for _, d := range i.Disk {
+			w.string(d.Path)
+			w.uint(d.Size)
+			w.uint(d.Free)
+			w.uint(d.Files)
+			w.uint(d.FreeFiles)
+		}
+		w.string(i.UIDMap)
+		w.string(i.GIDMap)
+	}
+
+	w.bool(r.BatchReply != nil)
+	if b := r.BatchReply; b != nil {
+		w.uint(uint64(len(b.Replies)))
+		for i := range b.Replies {
+			w.encodeReply(&b.Replies[i])
+		}
+		w.uint(uint64(len(b.Fds)))
+		for _, n := range b.Fds {
+			w.int(int64(n))
+		}
+	}
+}
+
+// binaryReader records the first error and returns zero values afterwards
+type binaryReader struct {
+	b   []byte
+	err error
+}
+
+func (r *binaryReader) uint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errBinaryShort
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binaryReader) int() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errBinaryShort
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binaryReader) bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.b) < 1 {
+		r.err = errBinaryShort
+		return false
+	}
+	v := r.b[0] != 0
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	n := r.uint()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(len(r.b)) < n {
+		r.err = errBinaryShort
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.length()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.b)
+	r.b = r.b[n:]
+	return b
+}
+
+// length reads slice length, each element takes at least 1 byte
+func (r *binaryReader) length() int {
+	n := r.uint()
+	if r.err == nil && uint64(len(r.b)) < n {
+		r.err = errBinaryShort
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) strings() []string {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	s := make([]string, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		s = append(s, r.string())
+	}
+	return s
+}
+
+func (r *binaryReader) cred() *execCred {
+	if !r.bool() {
+		return nil
+	}
+	c := &execCred{
+		UID: uint32(r.uint()),
+		GID: uint32(r.uint()),
+	}
+	if n := r.length(); n > 0 {
+		c.Groups = make([]uint32, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			c.Groups = append(c.Groups, uint32(r.uint()))
+		}
+	}
+	return c
+}
+
+func (r *binaryReader) decodeCmd(c *cmd) {
+	c.ID = r.uint()
+	c.Cmd = r.string()
+	c.Timeout = time.Duration(r.int())
+
+	if n := r.length(); n > 0 {
+		c.OpenCmd = make([]OpenCmd, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			c.OpenCmd = append(c.OpenCmd, OpenCmd{
+				Path: r.string(),
+				Flag: int(r.int()),
+				Perm: os.FileMode(r.uint()),
+			})
+		}
+	}
+
+	if r.bool() {
+		c.DeleteCmd = &deleteCmd{Path: r.string()}
+	}
+
+	if r.bool() {
+		c.StatCmd = &statCmd{Path: r.string()}
+	}
+
+	if r.bool() {
+		c.LinkCmd = &linkCmd{
+			Old: r.string(),
+			New: r.string(),
+		}
+	}
+
+	if r.bool() {
+		c.CopyOutCmd = &copyOutCmd{
+			Paths: r.strings(),
+			Tar:   r.bool(),
+		}
+	}
+
+	if r.bool() {
+		c.CopyInCmd = &copyInCmd{
+			Path:     r.string(),
+			Perm:     os.FileMode(r.uint()),
+			MaxSize:  r.int(),
+			Checksum: r.bytes(),
+			Tar:      r.bool(),
+		}
+	}
+
+	if r.bool() {
+		c.MountCmd = &mountCmd{
+			Target:   r.string(),
+			Readonly: r.bool(),
+		}
+	}
+
+	if r.bool() {
+		c.CacheCmd = &cacheCmd{
+			Key:  r.string(),
+			Drop: r.bool(),
+		}
+	}
+
+	if r.bool() {
+		c.WorkDirCmd = &workDirCmd{
+			Path: r.string(),
+			Cred: r.cred(),
+		}
+	}
+
+	if r.bool() {
+		e := new(execCmd)
+		e.Argv = r.strings()
+		e.Env = r.strings()
+		if n := r.length(); n > 0 {
+			e.RLimits = make([]rlimit.RLimit, 0, n)
+			for i := 0; i < n && r.err == nil; i++ {
+				e.RLimits = append(e.RLimits, rlimit.RLimit{
+					Res:  int(r.int()),
+					Rlim: syscall.Rlimit{Cur: r.uint(), Max: r.uint()},
+				})
+			}
+		}
+		e.FdExec = r.bool()
+		e.Cached = r.string()
+		e.WorkDir = r.string()
+		e.StreamOutput = r.bool()
+		e.StreamInput = r.bool()
+		e.TTY = r.bool()
+		e.Cred = r.cred()
+		if n := r.length(); n > 0 {
+			e.Seccomp = make(seccomp.Filter, 0, n)
+			for i := 0; i < n && r.err == nil; i++ {
+				e.Seccomp = append(e.Seccomp, syscall.SockFilter{
+					Code: uint16(r.uint()),
+					Jt:   uint8(r.uint()),
+					Jf:   uint8(r.uint()),
+					K:    uint32(r.uint()),
+				})
+			}
+		}
+		e.CoreLimit = r.int()
+		e.DisableASLR = r.bool()
+		e.AmbientCaps = r.uint()
+		c.ExecCmd = e
+	}
+
+	if r.bool() {
+		c.ConfCmd = &confCmd{Conf: containerConfig{
+			Cred:       r.bool(),
+			ResetPaths: r.strings(),
+			Roots:      r.strings(),
+			MaxSize:    r.int(),
+			Verbose:    r.bool(),
+		}}
+	}
+
+	if r.bool() {
+		c.SignalCmd = &SignalCmd{
+			Signal: syscall.Signal(r.int()),
+			Group:  r.bool(),
+		}
+	}
+
+	if r.bool() {
+		c.StdinCmd = &stdinCmd{
+			Data:  r.bytes(),
+			Close: r.bool(),
+		}
+	}
+
+	if n := r.length(); n > 0 {
+		c.BatchCmd = make([]cmd, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			r.decodeCmd(&c.BatchCmd[i])
+		}
+	}
+}
+
+func (r *binaryReader) decodeReply(rep *reply) {
+	rep.ID = r.uint()
+	if r.bool() {
+		rep.Error = &Error{
+			Code:  ErrorCode(r.int()),
+			Msg:   r.string(),
+			Errno: syscall.Errno(r.uint()),
+		}
+	}
+
+	if r.bool() {
+		rep.ExecReply = &execReply{
+			ExitStatus: int(r.int()),
+			Status:     runner.Status(r.int()),
+			Time:       time.Duration(r.int()),
+			Memory:     runner.Size(r.uint()),
+			Rusage: runner.Rusage{
+				UserTime:             time.Duration(r.int()),
+				SystemTime:           time.Duration(r.int()),
+				MaxRss:               runner.Size(r.uint()),
+				MinorFault:           r.uint(),
+				MajorFault:           r.uint(),
+				VoluntaryCtxSwitch:   r.uint(),
+				InvoluntaryCtxSwitch: r.uint(),
+			},
+			SetUpTime: time.Duration(r.int()),
+			WallTime:  time.Duration(r.int()),
+		}
+		if r.bool() {
+			rep.ExecReply.Crash = &runner.CrashInfo{
+				Signal:     int(r.int()),
+				CoreDumped: r.bool(),
+				CorePath:   r.string(),
+				CoreSize:   r.int(),
+				Core:       r.bytes(),
+			}
+		}
+	}
+
+	if r.bool() {
+		rep.CopyInReply = &copyInReply{Unchanged: r.bool()}
+	}
+
+	if r.bool() {
+		rep.WorkDirReply = &workDirReply{Path: r.string()}
+	}
+
+	if r.bool() {
+		rep.CopyOutReply = &copyOutReply{
+			Names: r.strings(),
+			More:  r.bool(),
+		}
+	}
+
+	if r.bool() {
+		rep.StatReply = &FileStat{
+			Name:    r.string(),
+			Size:    r.int(),
+			Mode:    os.FileMode(r.uint()),
+			ModTime: time.Unix(0, r.int()),
+		}
+	}
+
+	if r.bool() {
+		rep.OutputReply = &outputReply{
+			Fd:   int(r.int()),
+			Data: r.bytes(),
+		}
+	}
+
+	if r.bool() {
+		i := new(Info)
+		i.Mounts = r.strings()
+		if n := r.length(); n > 0 {
+			i.PIDs = make([]int, 0, n)
+			for j := 0; j < n && r.err == nil; j++ {
+				i.PIDs = append(i.PIDs, int(r.int()))
+			}
+		}
+		if n := r.length(); n > 0 {
+			i.Disk = make([]DiskUsage, 0, n)
+			for j := 0; j < n && r.err == nil; j++ {
+				i.Disk = append(i.Disk, DiskUsage{
+					Path:      r.string(),
+					Size:      r.uint(),
+					Free:      r.uint(),
+					Files:     r.uint(),
+					FreeFiles: r.uint(),
+				})
+			}
+		}
+		i.UIDMap = r.string()
+		i.GIDMap = r.string()
+		rep.InfoReply = i
+	}
+
+	if r.bool() {
+		b := new(batchReply)
+		if n := r.length(); n > 0 {
+			b.Replies = make([]reply, n)
+			for i := 0; i < n && r.err == nil; i++ {
+				r.decodeReply(&b.Replies[i])
+			}
+		}
+		if n := r.length(); n > 0 {
+			b.Fds = make([]int, 0, n)
+			for i := 0; i < n && r.err == nil; i++ {
+				b.Fds = append(b.Fds, int(r.int()))
+			}
+		}
+		rep.BatchReply = b
+	}
+}
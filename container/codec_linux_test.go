@@ -0,0 +1,112 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/criyle/go-sandbox/pkg/unixsocket"
+)
+
+// fill sets every field of v to distinct non-zero values, nested cmd / reply
+// (batch) are filled up to depth
+func fill(v reflect.Value, n *int, depth int) {
+	*n++
+	switch v.Kind() {
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem(), n, depth)
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Unix(0, int64(*n)*1e9+int64(*n))))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			fill(v.Field(i), n, depth)
+		}
+	case reflect.Slice:
+		e := v.Type().Elem()
+		if (e == reflect.TypeOf(cmd{}) || e == reflect.TypeOf(reply{})) && depth == 0 {
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), 2, 2)
+		for i := 0; i < s.Len(); i++ {
+			fill(s.Index(i), n, depth-1)
+		}
+		v.Set(s)
+	case reflect.String:
+		v.SetString("s" + string(rune('a'+*n%26)))
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(*n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(uint64(*n))
+	default:
+		panic("fill: unsupported kind " + v.Kind().String())
+	}
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	c, err := newCodec(CodecBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []interface{}{new(cmd), new(reply)} {
+		n := 0
+		fill(reflect.ValueOf(e).Elem(), &n, 1)
+		b, err := c.Encode(e)
+		if err != nil {
+			t.Fatalf("encode %T: %v", e, err)
+		}
+		d := reflect.New(reflect.TypeOf(e).Elem())
+		if err := c.Decode(b, d.Interface()); err != nil {
+			t.Fatalf("decode %T: %v", e, err)
+		}
+		diff(t, reflect.TypeOf(e).Elem().Name(), d.Elem(), reflect.ValueOf(e).Elem())
+	}
+}
+
+// diff reports the path of fields differ
+func diff(t *testing.T, path string, got, want reflect.Value) {
+	t.Helper()
+	switch {
+	case reflect.DeepEqual(got.Interface(), want.Interface()):
+	case want.Kind() == reflect.Ptr && !got.IsNil() && !want.IsNil():
+		diff(t, path, got.Elem(), want.Elem())
+	case want.Kind() == reflect.Struct && want.Type() != reflect.TypeOf(time.Time{}):
+		for i := 0; i < want.NumField(); i++ {
+			diff(t, path+"."+want.Type().Field(i).Name, got.Field(i), want.Field(i))
+		}
+	case want.Kind() == reflect.Slice && got.Len() == want.Len():
+		for i := 0; i < want.Len(); i++ {
+			diff(t, fmt.Sprintf("%s[%d]", path, i), got.Index(i), want.Index(i))
+		}
+	default:
+		t.Errorf("%s: got %v, want %v", path, got.Interface(), want.Interface())
+	}
+}
+
+func TestHandshakeVersion1(t *testing.T) {
+	hs, cs, err := unixsocket.NewSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	defer cs.Close()
+
+	// container init of version 1 replies magic and version only
+	go func() {
+		s := newSocket(cs)
+		if _, _, err := s.RecvVersion(); err != nil {
+			return
+		}
+		s.SendVersionV1(1)
+	}()
+	c := &container{socket: newSocket(hs)}
+	if err := c.handshake(CodecBinary); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("handshake: got %v, want %v", err, ErrProtocolVersion)
+	}
+}
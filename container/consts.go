@@ -1,15 +1,30 @@
 package container
 
 const (
-	cmdPing   = "ping"
-	cmdCopyIn = "copyin"
-	cmdOpen   = "open"
-	cmdDelete = "delete"
-	cmdReset  = "reset"
-	cmdExecve = "execve"
-	cmdOk     = "ok"
-	cmdKill   = "kill"
-	cmdConf   = "conf"
+	cmdPing     = "ping"
+	cmdCopyIn   = "copyin"
+	cmdCopyOut  = "copyout"
+	cmdOpen     = "open"
+	cmdStat     = "stat"
+	cmdDelete   = "delete"
+	cmdReset    = "reset"
+	cmdExecve   = "execve"
+	cmdOk       = "ok"
+	cmdKill     = "kill"
+	cmdSignal   = "signal"
+	cmdStdin    = "stdin"
+	cmdConf     = "conf"
+	cmdShutdown = "shutdown"
+	cmdInfo     = "info"
+	cmdBatch    = "batch"
+	cmdMount    = "mount"
+	cmdRename   = "rename"
+	cmdLink     = "link"
+	cmdSymlink  = "symlink"
+	cmdCache    = "cache"
+
+	cmdMkWorkDir = "mkworkdir"
+	cmdRmWorkDir = "rmworkdir"
 
 	initArg = "init"
 
@@ -22,4 +37,11 @@ const (
 	containerWD   = "/w"
 
 	containerMaxProc = 1
+
+	// protocolVersion should be increased when cmd / reply changes in an
+	// incompatible way
+	protocolVersion = 2
 )
+
+// defaultResetPaths are cleaned by reset if not specified
+var defaultResetPaths = []string{"/tmp", containerWD}
@@ -0,0 +1,143 @@
+package container
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/criyle/go-sandbox/pkg/unixsocket"
+	"golang.org/x/sys/unix"
+)
+
+// batchCollector collects replies of sub-commands of batch. Fds are
+// duplicated since handlers close their files after reply
+type batchCollector struct {
+	replies []reply
+	nfds    []int
+	fds     []int
+	err     *Error // error of the first failed sub-command
+}
+
+func (b *batchCollector) add(rep *reply, msg *unixsocket.Msg) error {
+	n := 0
+	if msg != nil {
+		for _, fd := range msg.Fds {
+			nfd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+			if err != nil {
+				return fmt.Errorf("batch: dup %v", err)
+			}
+			b.fds = append(b.fds, nfd)
+			n++
+		}
+	}
+	if rep.Error != nil && b.err == nil {
+		b.err = rep.Error
+	}
+	b.replies = append(b.replies, *rep)
+	b.nfds = append(b.nfds, n)
+	return nil
+}
+
+// handleBatch runs sub-commands in order and stops at the first failed one.
+// It is not atomic, effects of sub-commands before the failed one are kept.
+// Replies are combined into single reply. A trailing execve is started after
+// the combined reply if all others succeeded, and runs as an execve session
+// with the batch id
+func (c *containerServer) handleBatch(cmds []cmd, msg *unixsocket.Msg, timeout time.Duration) error {
+	var fds []int
+	if msg != nil {
+		fds = msg.Fds
+	}
+	if err := checkBatch(cmds, len(fds)); err != nil {
+		closeFds(fds)
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "batch: %v", err)
+	}
+
+	// sub-commands run after the copyin sent before the batch
+	c.copyInWg.Wait()
+
+	var exec *cmd
+	if last := &cmds[len(cmds)-1]; last.Cmd == cmdExecve {
+		exec = last
+		cmds = cmds[:len(cmds)-1]
+	}
+
+	b := new(batchCollector)
+	c.batch = b
+	err := c.runBatch(cmds, &fds, timeout)
+	c.batch = nil
+	if err != nil {
+		closeFds(b.fds)
+		closeFds(fds)
+		return err
+	}
+
+	rep := &reply{
+		Error:      b.err,
+		BatchReply: &batchReply{Replies: b.replies, Fds: b.nfds},
+	}
+	repMsg := &unixsocket.Msg{Fds: b.fds}
+	if len(b.fds) > copyOutMaxFds {
+		rep = &reply{Error: newError(ErrorCodeProtocol, "batch: too many fds in reply (%d)", len(b.fds))}
+		repMsg = nil
+	}
+	err = c.sendReply(rep, repMsg)
+	closeFds(b.fds)
+	if err != nil || rep.Error != nil || exec == nil {
+		closeFds(fds)
+		return err
+	}
+	return c.handleExecve(exec.ExecCmd, &unixsocket.Msg{Fds: fds})
+}
+
+// runBatch handles sub-commands with replies collected, fds are consumed
+// by copyin. Sub-commands without timeout inherit the batch timeout
+func (c *containerServer) runBatch(cmds []cmd, fds *[]int, timeout time.Duration) error {
+	for i := range cmds {
+		sub := &cmds[i]
+		sub.ID = c.id
+		if sub.Timeout == 0 {
+			sub.Timeout = timeout
+		}
+
+		var subMsg *unixsocket.Msg
+		if sub.Cmd == cmdCopyIn {
+			subMsg = &unixsocket.Msg{Fds: (*fds)[:1]}
+			*fds = (*fds)[1:]
+		}
+		if err := c.handleCmd(sub, subMsg); err != nil {
+			return err
+		}
+		if c.batch.err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// checkBatch validates sub-commands and number of fds received
+func checkBatch(cmds []cmd, nfds int) error {
+	if len(cmds) == 0 {
+		return fmt.Errorf("no sub-command provided")
+	}
+	copyIn, exec := 0, false
+	for i, sub := range cmds {
+		switch sub.Cmd {
+		case cmdPing, cmdOpen, cmdDelete, cmdStat, cmdCopyOut, cmdReset, cmdInfo,
+			cmdRename, cmdLink, cmdSymlink:
+		case cmdCopyIn:
+			copyIn++
+		case cmdExecve:
+			if i != len(cmds)-1 {
+				return fmt.Errorf("execve must be the last sub-command")
+			}
+			exec = true
+		default:
+			return fmt.Errorf("sub-command %q not supported", sub.Cmd)
+		}
+	}
+	// the rest fds belongs to execve
+	if nfds < copyIn || (!exec && nfds != copyIn) {
+		return fmt.Errorf("unexpected number of fds %d", nfds)
+	}
+	return nil
+}
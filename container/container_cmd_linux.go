@@ -1,9 +1,15 @@
 package container
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/criyle/go-sandbox/pkg/unixsocket"
 )
@@ -15,49 +21,386 @@ func (c *containerServer) handlePing() error {
 func (c *containerServer) handleConf(conf *confCmd) error {
 	if conf != nil {
 		c.containerConfig = conf.Conf
+		c.log.setVerbose(conf.Conf.Verbose)
 	}
 	return c.sendReply(&reply{}, nil)
 }
 
-func (c *containerServer) handleOpen(open []OpenCmd) error {
+func (c *containerServer) handleOpen(open []OpenCmd, timeout time.Duration) error {
 	if len(open) == 0 {
-		return c.sendErrorReply("open: no open parameter received")
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "open: no open parameter received")
 	}
 
-	// open files
-	fds := make([]int, 0, len(open))
-	for _, o := range open {
-		outFile, err := os.OpenFile(o.Path, o.Flag, o.Perm)
-		if err != nil {
-			return c.sendErrorReply("open: %v", err)
+	// open files (open on fifo may block)
+	var files []*os.File
+	err := c.runTimeout(timeout, func() error {
+		for _, o := range open {
+			outFile, err := c.openBeneath(o.Path, o.Flag, o.Perm)
+			if err != nil {
+				return err
+			}
+			files = append(files, outFile)
 		}
-		defer outFile.Close()
-		fds = append(fds, int(outFile.Fd()))
+		return nil
+	})
+	if err != nil {
+		return c.sendErrorReply("open: %v", err)
 	}
+	defer closeFiles(files)
 
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
 	return c.sendReply(&reply{}, &unixsocket.Msg{Fds: fds})
 }
 
-func (c *containerServer) handleDelete(delete *deleteCmd) error {
+func (c *containerServer) handleDelete(delete *deleteCmd, timeout time.Duration) error {
 	if delete == nil {
-		return c.sendErrorReply("delete: no parameter provided")
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "delete: no parameter provided")
 	}
-	if err := os.Remove(delete.Path); err != nil {
+	if err := c.runTimeout(timeout, func() error {
+		return c.removeBeneath(delete.Path)
+	}); err != nil {
 		return c.sendErrorReply("delete: %v", err)
 	}
 	return c.sendReply(&reply{}, nil)
 }
 
-func (c *containerServer) handleReset() error {
-	if err := removeContents("/tmp"); err != nil {
-		return c.sendErrorReply("reset: /tmp %v", err)
+// handleLink handles rename / link / symlink
+func (c *containerServer) handleLink(name string, link *linkCmd, timeout time.Duration) error {
+	if link == nil {
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "%s: no parameter provided", name)
+	}
+	if err := c.runTimeout(timeout, func() error {
+		switch name {
+		case cmdRename:
+			return c.renameBeneath(link.Old, link.New)
+		case cmdLink:
+			return c.linkBeneath(link.Old, link.New)
+		default:
+			return c.symlinkBeneath(link.Old, link.New)
+		}
+	}); err != nil {
+		return c.sendErrorReply("%s: %v", name, err)
+	}
+	return c.sendReply(&reply{}, nil)
+}
+
+func (c *containerServer) handleStat(stat *statCmd, timeout time.Duration) error {
+	if stat == nil {
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "stat: no parameter provided")
+	}
+	var fi os.FileInfo
+	if err := c.runTimeout(timeout, func() (err error) {
+		fi, err = c.lstatBeneath(stat.Path)
+		return err
+	}); err != nil {
+		return c.sendErrorReply("stat: %v", err)
+	}
+	return c.sendReply(&reply{
+		StatReply: &FileStat{
+			Name:    fi.Name(),
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+		},
+	}, nil)
+}
+
+func (c *containerServer) handleCopyIn(copyIn *copyInCmd, msg *unixsocket.Msg, timeout time.Duration) error {
+	if msg == nil || len(msg.Fds) != 1 {
+		if msg != nil {
+			closeFds(msg.Fds)
+		}
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "copyin: expect 1 source fd")
+	}
+	src := os.NewFile(uintptr(msg.Fds[0]), "copyin")
+	if copyIn == nil {
+		src.Close()
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "copyin: no parameter provided")
+	}
+
+	maxSize := copyIn.MaxSize
+	if maxSize <= 0 {
+		maxSize = c.MaxSize
+	}
+	// src is closed after copy finished even if timeout exceeded
+	var unchanged bool
+	run := func() error {
+		return c.runTimeout(timeout, func() (err error) {
+			defer src.Close()
+			unchanged, err = c.copyIn(src, copyIn, maxSize)
+			return err
+		})
+	}
+	if c.batch != nil {
+		if err := run(); err != nil {
+			return c.sendErrorReply("copyin: %v", err)
+		}
+		return c.sendReply(&reply{CopyInReply: &copyInReply{Unchanged: unchanged}}, nil)
+	}
+
+	// copy concurrently with at most copyInWorkers running, the serve loop
+	// is not blocked while waiting for a worker
+	id := c.id
+	c.copyInWg.Add(1)
+	go func() {
+		defer c.copyInWg.Done()
+		c.copyInSem <- struct{}{}
+		defer func() { <-c.copyInSem }()
+		rep := &reply{}
+		if err := run(); err != nil {
+			rep.Error = newError(ErrorCodeUnknown, "copyin: %v", err)
+		} else {
+			rep.CopyInReply = &copyInReply{Unchanged: unchanged}
+		}
+		c.sendReplyTo(id, rep, nil)
+		// wake up serve loop to exit
+		if c.isTimedOut() {
+			(*net.UnixConn)(c.socket.Socket).CloseRead()
+		}
+	}()
+	return nil
+}
+
+// copyIn copies src into path, if src exceeds maxSize (positive), the
+// incomplete file is removed and EFBIG is returned. Copy is skipped and
+// unchanged is true if the file checksum matched
+func (c *containerServer) copyIn(src *os.File, cp *copyInCmd, maxSize int64) (unchanged bool, err error) {
+	if cp.Tar {
+		return false, c.extractTar(src, cp.Path, maxSize)
+	}
+	p := cp.Path
+	var key string
+	if len(cp.Checksum) > 0 {
+		root, rel, err := c.resolvePath(p)
+		if err != nil {
+			return false, err
+		}
+		key = path.Join(root, rel)
+		if fi, err := c.lstatBeneath(p); err == nil && c.copyInCache.lookup(key, cp.Checksum, fi) {
+			return true, nil
+		}
+	}
+
+	dst, err := c.openBeneath(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, cp.Perm)
+	if err != nil {
+		return false, err
+	}
+	defer dst.Close()
+
+	limit := int64(-1)
+	if maxSize > 0 {
+		limit = maxSize + 1
+	}
+	n, err := copyFile(dst, src, limit)
+	if err == nil && maxSize > 0 && n > maxSize {
+		err = &os.PathError{Op: "copyin", Path: p, Err: syscall.EFBIG}
+	}
+	if err != nil {
+		c.removeBeneath(p)
+		return false, err
+	}
+	if key != "" {
+		if fi, err := dst.Stat(); err == nil {
+			c.copyInCache.store(key, cp.Checksum, fi)
+		}
+	}
+	return false, nil
+}
+
+const (
+	// copyInWorkers limits concurrent copyin inside container
+	copyInWorkers = 8
+
+	// copyOutMaxFds limits fds sent in single copyout reply (kernel SCM_MAX_FD is 253)
+	copyOutMaxFds = 128
+	// copyOutMaxNames limits total length of names in single copyout reply
+	copyOutMaxNames = bufferSize / 2
+)
+
+func (c *containerServer) handleCopyOut(copyOut *copyOutCmd, msg *unixsocket.Msg, timeout time.Duration) error {
+	if copyOut != nil && copyOut.Tar {
+		return c.handleCopyOutTar(copyOut, msg, timeout)
+	}
+	if msg != nil {
+		closeFds(msg.Fds)
+	}
+	if copyOut == nil || len(copyOut.Paths) == 0 {
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "copyout: no parameter provided")
+	}
+
+	// collect regular files
+	var names []string
+	if err := c.runTimeout(timeout, func() error {
+		for _, p := range copyOut.Paths {
+			if _, _, err := c.resolvePath(p); err != nil {
+				return err
+			}
+			n, err := collectFiles(p)
+			if err != nil {
+				return err
+			}
+			names = append(names, n...)
+		}
+		return nil
+	}); err != nil {
+		return c.sendErrorReply("copyout: %v", err)
+	}
+
+	// send back in batches, the last one with More unset
+	for {
+		n, size := 0, 0
+		for n < len(names) && n < copyOutMaxFds && (n == 0 || size+len(names[n]) <= copyOutMaxNames) {
+			size += len(names[n])
+			n++
+		}
+		if err := c.sendCopyOutBatch(names[:n], n < len(names)); err != nil {
+			return err
+		}
+		names = names[n:]
+		if len(names) == 0 {
+			return nil
+		}
+	}
+}
+
+// handleCopyOutTar writes files as gzip compressed tar into the fd in msg,
+// the fd is closed before reply so that host reads until EOF
+func (c *containerServer) handleCopyOutTar(copyOut *copyOutCmd, msg *unixsocket.Msg, timeout time.Duration) error {
+	if msg == nil || len(msg.Fds) != 1 {
+		if msg != nil {
+			closeFds(msg.Fds)
+		}
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "copyout: expect 1 destination fd")
+	}
+	dst := os.NewFile(uintptr(msg.Fds[0]), "copyout")
+	if len(copyOut.Paths) == 0 {
+		dst.Close()
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "copyout: no parameter provided")
+	}
+	if err := c.runTimeout(timeout, func() error {
+		defer dst.Close()
+		return c.writeTar(dst, copyOut.Paths)
+	}); err != nil {
+		return c.sendErrorReply("copyout: %v", err)
+	}
+	return c.sendReply(&reply{}, nil)
+}
+
+// sendCopyOutBatch opens files and sends them as single reply
+func (c *containerServer) sendCopyOutBatch(names []string, more bool) error {
+	fds := make([]int, 0, len(names))
+	for _, n := range names {
+		f, err := c.openBeneath(n, os.O_RDONLY, 0)
+		if err != nil {
+			return c.sendErrorReply("copyout: %v", err)
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
 	}
-	if err := removeContents("/w"); err != nil {
-		return c.sendErrorReply("reset: /w %v", err)
+	return c.sendReply(&reply{
+		CopyOutReply: &copyOutReply{Names: names, More: more},
+	}, &unixsocket.Msg{Fds: fds})
+}
+
+// collectFiles collects regular files under given path (relative to work dir)
+func collectFiles(p string) ([]string, error) {
+	var names []string
+	root := workPath(p)
+	err := filepath.Walk(root, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, fp)
+		if err != nil {
+			return err
+		}
+		names = append(names, path.Join(p, rel))
+		return nil
+	})
+	return names, err
+}
+
+// workPath resolves path relative to container work dir
+func workPath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(containerWD, p)
+}
+
+func (c *containerServer) handleReset(timeout time.Duration) error {
+	resetPaths := c.ResetPaths
+	if len(resetPaths) == 0 {
+		resetPaths = defaultResetPaths
+	}
+	// copyin in flight would recreate files and cache entries after reset
+	c.copyInWg.Wait()
+	c.copyInCache.reset()
+	for _, p := range resetPaths {
+		if err := c.detachMounts(p); err != nil {
+			return c.sendErrorReply("reset: %s %v", p, err)
+		}
+		c.resetWorkDirs(p)
+		if err := c.runTimeout(timeout, func() error {
+			return removeContents(p)
+		}); err != nil {
+			return c.sendErrorReply("reset: %s %v", p, err)
+		}
 	}
 	return c.sendReply(&reply{}, nil)
 }
 
+// errShutdown signals the serve loop to exit gracefully
+var errShutdown = errors.New("shutdown")
+
+// handleShutdown waits for copyin in flight, kills all processes inside
+// container and exits after reply
+func (c *containerServer) handleShutdown() error {
+	c.copyInWg.Wait()
+	syscall.Kill(-1, syscall.SIGKILL)
+	if err := c.sendReply(&reply{}, nil); err != nil {
+		return err
+	}
+	return errShutdown
+}
+
+// runTimeout runs f and waits at most timeout (no limit if not positive).
+// The file operations can not be cancelled, thus when timeout exceeded, f
+// keeps running in background and the container is marked as timed out to
+// exit after the reply (the whole container is killed with it)
+func (c *containerServer) runTimeout(timeout time.Duration, f func() error) error {
+	if timeout <= 0 {
+		return f()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		atomic.StoreInt32(&c.timedOut, 1)
+		return errTimeout
+	}
+}
+
+// isTimedOut reports whether any command timed out
+func (c *containerServer) isTimedOut() bool {
+	return atomic.LoadInt32(&c.timedOut) != 0
+}
+
 func (c *containerServer) recvCmd() (*cmd, *unixsocket.Msg, error) {
 	cm := new(cmd)
 	msg, err := c.socket.RecvMsg(cm)
@@ -67,20 +410,57 @@ func (c *containerServer) recvCmd() (*cmd, *unixsocket.Msg, error) {
 	return cm, msg, nil
 }
 
+// sendReply sends reply for the command handled by serve loop, replies are
+// collected instead if handling batch
 func (c *containerServer) sendReply(rep *reply, msg *unixsocket.Msg) error {
+	if c.batch != nil {
+		return c.batch.add(rep, msg)
+	}
+	return c.sendReplyTo(c.id, rep, msg)
+}
+
+// sendReplyTo sends reply for the command with given id
+func (c *containerServer) sendReplyTo(id uint64, rep *reply, msg *unixsocket.Msg) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	rep.ID = id
 	return c.socket.SendMsg(rep, msg)
 }
 
-// sendErrorReply sends error reply
+// sendErrorReply sends error reply, error code is derived from the errno in v
 func (c *containerServer) sendErrorReply(ft string, v ...interface{}) error {
-	errRep := &errorReply{
-		Msg: fmt.Sprintf(ft, v...),
+	return c.sendErrorCodeReply(ErrorCodeUnknown, ft, v...)
+}
+
+// sendErrorCodeReply sends error reply with error code
+func (c *containerServer) sendErrorCodeReply(code ErrorCode, ft string, v ...interface{}) error {
+	return c.sendReply(&reply{Error: newError(code, ft, v...)}, nil)
+}
+
+// newError creates error reply, if code is unknown, it is derived from
+// the error in v
+func newError(code ErrorCode, ft string, v ...interface{}) *Error {
+	errRep := &Error{
+		Code: code,
+		Msg:  fmt.Sprintf(ft, v...),
 	}
 	// store errno
-	if len(v) == 1 {
-		if errno, ok := v[0].(syscall.Errno); ok {
-			errRep.Errno = &errno
+	timeout := false
+	for _, e := range v {
+		if err, ok := e.(error); ok {
+			timeout = timeout || errors.Is(err, errTimeout)
+			if errors.As(err, &errRep.Errno) {
+				break
+			}
+		}
+	}
+	if errRep.Code == ErrorCodeUnknown {
+		if timeout {
+			errRep.Code = ErrorCodeTimeout
+		} else {
+			errRep.Code = errnoToCode(errRep.Errno)
 		}
 	}
-	return c.sendReply(&reply{Error: errRep}, nil)
+	return errRep
 }
@@ -0,0 +1,49 @@
+package container
+
+import (
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/criyle/go-sandbox/runner"
+)
+
+const (
+	// coreFileName is the core file name with default kernel.core_pattern,
+	// created at the work dir of the process
+	coreFileName = "core"
+
+	// coreReplySize limits the leading bytes of core file sent in reply
+	coreReplySize = bufferSize / 4
+)
+
+// crashInfo collects crash information of the signalled process, core file is
+// collected from its work dir if dumped
+func crashInfo(ws syscall.WaitStatus, workDir string, collectCore bool) *runner.CrashInfo {
+	c := &runner.CrashInfo{
+		Signal:     int(ws.Signal()),
+		CoreDumped: ws.CoreDump(),
+	}
+	if !c.CoreDumped || !collectCore {
+		return c
+	}
+
+	p := path.Join(workDir, coreFileName)
+	f, err := os.Open(p)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return c
+	}
+	buf := make([]byte, coreReplySize)
+	n, _ := io.ReadFull(f, buf)
+	c.CorePath = p
+	c.CoreSize = fi.Size()
+	c.Core = buf[:n]
+	return c
+}
@@ -2,40 +2,204 @@ package container
 
 import (
 	"fmt"
+	"os"
 	"syscall"
 	"time"
 
 	"github.com/criyle/go-sandbox/pkg/forkexec"
+	"github.com/criyle/go-sandbox/pkg/rlimit"
 	"github.com/criyle/go-sandbox/pkg/unixsocket"
 	"github.com/criyle/go-sandbox/runner"
+	"golang.org/x/sys/unix"
 )
 
+// execSession is a running execve, host commands (ok / kill) with the same id
+// are routed to it by the serve loop
+type execSession struct {
+	id   uint64
+	cmds chan *cmd
+	pid  int // pid of the running process, 0 if not running (protected by mu)
+
+	input *inputRelay // stdin of the process if stream input
+}
+
+func newExecSession(id uint64) *execSession {
+	return &execSession{
+		id: id,
+		// at most ok / kill and kill will be sent for a session
+		cmds: make(chan *cmd, 2),
+	}
+}
+
 func (c *containerServer) handleExecve(cmd *execCmd, msg *unixsocket.Msg) error {
-	var (
-		files    []uintptr
-		execFile uintptr
-		cred     *syscall.Credential
-	)
+	var files []int
 	if cmd == nil {
-		return c.sendErrorReply("execve: no parameter provided")
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "execve: no parameter provided")
 	}
 	if msg != nil {
-		files = intSliceToUintptr(msg.Fds)
+		files = msg.Fds
 		// don't leak fds to child
-		closeOnExecFds(msg.Fds)
-		// release files after execve
-		defer closeFds(msg.Fds)
+		closeOnExecFds(files)
 	}
 
 	// if fexecve, then the first fd must be executable
-	if cmd.FdExec {
-		if len(files) == 0 {
-			return fmt.Errorf("execve: expected fexecve fd")
+	if cmd.FdExec && len(files) == 0 {
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "execve: expected fexecve fd")
+	}
+
+	s := newExecSession(c.id)
+	c.mu.Lock()
+	if _, ok := c.sessions[s.id]; ok {
+		c.mu.Unlock()
+		closeFds(files)
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "execve: duplicated id %d", s.id)
+	}
+	c.sessions[s.id] = s
+	c.mu.Unlock()
+
+	go c.runExecve(s, cmd, files)
+	return nil
+}
+
+// handleSessionCmd routes ok / kill to the execve session
+func (c *containerServer) handleSessionCmd(cmd *cmd, msg *unixsocket.Msg) error {
+	if msg != nil {
+		closeFds(msg.Fds)
+	}
+	c.mu.Lock()
+	s, ok := c.sessions[cmd.ID]
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: no execve session with id %d", cmd.Cmd, cmd.ID)
+	}
+	s.cmds <- cmd
+	return nil
+}
+
+// handleSignal sends signal to the running process of the execve session,
+// no reply is sent since the session replies with its result
+func (c *containerServer) handleSignal(sig *SignalCmd) error {
+	if sig == nil {
+		return fmt.Errorf("signal: no parameter provided")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.sessions[c.id]
+	if !ok || s.pid <= 0 {
+		// process may already exited
+		return nil
+	}
+	pid := s.pid
+	if sig.Group {
+		pid = -pid
+	}
+	syscall.Kill(pid, sig.Signal)
+	return nil
+}
+
+// handleStdin writes data to stdin of the execve session, no reply is sent
+func (c *containerServer) handleStdin(stdin *stdinCmd) error {
+	if stdin == nil {
+		return fmt.Errorf("stdin: no parameter provided")
+	}
+	c.mu.Lock()
+	s, ok := c.sessions[c.id]
+	c.mu.Unlock()
+	if !ok || s.input == nil {
+		return nil
+	}
+	s.input.push(stdin.Data, stdin.Close)
+	return nil
+}
+
+// checkRLimits validates rlimits of the process, resource should be supported
+// and set at most once, soft limit should not exceed hard limit
+func checkRLimits(rlimits []rlimit.RLimit) error {
+	set := make(map[int]bool, len(rlimits))
+	for _, r := range rlimits {
+		switch r.Res {
+		case syscall.RLIMIT_CPU, syscall.RLIMIT_DATA, syscall.RLIMIT_FSIZE, syscall.RLIMIT_STACK,
+			syscall.RLIMIT_AS, syscall.RLIMIT_NOFILE, unix.RLIMIT_NPROC, syscall.RLIMIT_CORE:
+		default:
+			return fmt.Errorf("rlimit: unsupported resource %d", r.Res)
+		}
+		if set[r.Res] {
+			return fmt.Errorf("rlimit: duplicated resource %v", r)
 		}
+		set[r.Res] = true
+		if r.Rlim.Cur > r.Rlim.Max {
+			return fmt.Errorf("rlimit: soft limit exceeds hard limit %v", r)
+		}
+	}
+	return nil
+}
+
+// runExecve runs single execve session, replies are sent with session id
+func (c *containerServer) runExecve(s *execSession, cmd *execCmd, fds []int) {
+	var (
+		execFile uintptr
+		cred     *syscall.Credential
+		relay    *outputRelay
+		pid      int
+		waitCh   <-chan waitStatus
+		err      error
+	)
+	// release files after execve
+	defer closeFds(fds)
+	files := intSliceToUintptr(fds)
+
+	// if fexecve, then the first fd must be executable
+	if cmd.FdExec {
 		execFile = files[0]
 		files = files[1:]
+	} else if cmd.Cached != "" {
+		var fd int
+		if fd, err = c.execCache.dup(cmd.Cached); err == nil {
+			defer syscall.Close(fd)
+			execFile = uintptr(fd)
+		}
 	}
 
+	// allocate pseudo terminal, the master is sent back with the pid
+	var (
+		ttyFds []int
+		ttys   []*os.File
+	)
+	if cmd.TTY {
+		if cmd.StreamInput || cmd.StreamOutput {
+			err = fmt.Errorf("tty could not be used with stream input / output")
+		} else {
+			var master, slave *os.File
+			if master, slave, err = openPty(); err == nil {
+				ttys = []*os.File{master, slave}
+				ttyFds = []int{int(master.Fd())}
+				tty := []uintptr{slave.Fd(), slave.Fd(), slave.Fd()}
+				if len(files) > 3 {
+					tty = append(tty, files[3:]...)
+				}
+				files = tty
+			}
+		}
+	}
+
+	// stream stdin through pipe
+	if cmd.StreamInput && err == nil {
+		var input *inputRelay
+		if input, files, err = newInputRelay(files); err == nil {
+			c.mu.Lock()
+			s.input = input
+			c.mu.Unlock()
+			defer input.stop()
+		}
+	}
+
+	// stream stdout / stderr through pipes
+	if cmd.StreamOutput && err == nil {
+		relay, files, err = c.newOutputRelay(s.id, files)
+	}
+
+	var forkTime, execTime time.Time
 	syncFunc := func(pid int) error {
 		msg := &unixsocket.Msg{
 			Cred: &syscall.Ucred{
@@ -43,21 +207,33 @@ func (c *containerServer) handleExecve(cmd *execCmd, msg *unixsocket.Msg) error
 				Uid: uint32(syscall.Getuid()),
 				Gid: uint32(syscall.Getgid()),
 			},
+			Fds: ttyFds,
 		}
-		if err := c.sendReply(&reply{}, msg); err != nil {
+		if err := c.sendReplyTo(s.id, &reply{}, msg); err != nil {
 			return fmt.Errorf("syncFunc: sendReply %v", err)
 		}
-		cmd, _, err := c.recvCmd()
-		if err != nil {
-			return fmt.Errorf("syncFunc: recvCmd %v", err)
-		}
+		cmd := <-s.cmds
 		if cmd.Cmd == cmdKill {
 			return fmt.Errorf("syncFunc: received kill")
 		}
+		// the process calls execve right after sync
+		execTime = time.Now()
 		return nil
 	}
 
-	if c.Cred {
+	workDir := containerWD
+	if cmd.WorkDir != "" {
+		workDir = workPath(cmd.WorkDir)
+	}
+
+	if cmd.Cred != nil {
+		cred = &syscall.Credential{
+			Uid:         cmd.Cred.UID,
+			Gid:         cmd.Cred.GID,
+			Groups:      cmd.Cred.Groups,
+			NoSetGroups: len(cmd.Cred.Groups) == 0,
+		}
+	} else if c.Cred {
 		cred = &syscall.Credential{
 			Uid:         containerUID,
 			Gid:         containerGID,
@@ -65,76 +241,130 @@ func (c *containerServer) handleExecve(cmd *execCmd, msg *unixsocket.Msg) error
 		}
 	}
 
+	// keep only the ambient capabilities requested
+	var caps *forkexec.CapSet
+	if cmd.AmbientCaps != 0 {
+		caps = &forkexec.CapSet{
+			Bounding:  cmd.AmbientCaps,
+			Permitted: cmd.AmbientCaps,
+			Ambient:   cmd.AmbientCaps,
+		}
+	}
+
+	var filter *syscall.SockFprog
+	if len(cmd.Seccomp) > 0 {
+		filter = cmd.Seccomp.SockFprog()
+	}
+
+	if err == nil {
+		err = checkRLimits(cmd.RLimits)
+	}
+	rlimits := cmd.RLimits
+	if cmd.CoreLimit > 0 {
+		rlimits = append(rlimits[:len(rlimits):len(rlimits)], rlimit.RLimit{
+			Res:  syscall.RLIMIT_CORE,
+			Rlim: syscall.Rlimit{Cur: uint64(cmd.CoreLimit), Max: uint64(cmd.CoreLimit)},
+		})
+	}
+
 	r := forkexec.Runner{
 		Args:       cmd.Argv,
 		Env:        cmd.Env,
 		ExecFile:   execFile,
-		RLimits:    cmd.RLimits,
+		RLimits:    rlimits,
 		Files:      files,
-		WorkDir:    "/w",
+		WorkDir:    workDir,
 		NoNewPrivs: true,
 		DropCaps:   true,
+		Caps:       caps,
 		SyncFunc:   syncFunc,
 		Credential: cred,
+		Seccomp:    filter,
+
+		DisableASLR: cmd.DisableASLR,
+
+		// pty slave at stdin acquired as controlling terminal
+		Setctty: len(ttys) > 0,
+		Ctty:    0,
 
 		UnshareCgroupAfterSync: true,
 	}
 	// starts the runner, error is handled same as wait4 to make communication equal
-	pid, err := r.Start()
+	forkTime = time.Now()
+	if err == nil {
+		pid, waitCh, err = c.reaper.start(func(register func(int)) (int, error) {
+			// the child could not exit while waiting for the sync
+			r.SyncFunc = func(pid int) error {
+				register(pid)
+				return syncFunc(pid)
+			}
+			return r.Start()
+		})
+	}
+	c.setSessionPid(s, pid)
+	// the master is sent and the slave is hold by the process
+	closeFiles(ttys)
+	if relay != nil {
+		if err == nil {
+			relay.start()
+		} else {
+			relay.closeAll()
+		}
+	}
+	if s.input != nil && err == nil {
+		s.input.start()
+	}
 
 	// done is to signal kill goroutine exits
 	killDone := make(chan struct{})
-	// waitDone is to signal kill goroutine to collect zombies
-	waitDone := make(chan struct{})
 
 	// recv kill
 	go func() {
 		// signal done
 		defer close(killDone)
 		// msg must be kill
-		c.recvCmd()
-		// kill all
-		syscall.Kill(-1, syscall.SIGKILL)
-		// make sure collect zombie does not consume the exit status
-		<-waitDone
-		// collect zombies
-		for {
-			if _, err := syscall.Wait4(-1, nil, syscall.WNOHANG, nil); err != nil && err != syscall.EINTR {
-				break
-			}
-		}
+		<-s.cmds
+		c.killSession(s)
 	}()
 
 	// wait pid if no error encountered for execve
-	var wstatus syscall.WaitStatus
-	var rusage syscall.Rusage
+	var (
+		ws       waitStatus
+		exitTime time.Time
+	)
 	if err == nil {
-		_, err = syscall.Wait4(pid, &wstatus, 0, &rusage)
-		for err == syscall.EINTR {
-			_, err = syscall.Wait4(pid, &wstatus, 0, &rusage)
+		ws = <-waitCh
+		exitTime = ws.time
+		c.setSessionPid(s, 0)
+		// output must be sent before the result
+		if relay != nil {
+			relay.wait()
 		}
 	}
-	// sync with kill goroutine
-	close(waitDone)
 
 	if err != nil {
-		c.sendErrorReply("execve: wait4 %v", err)
+		c.sendReplyTo(s.id, &reply{Error: newError(ErrorCodeUnknown, "execve: wait4 %v", err)}, nil)
 	} else {
+		wstatus, rusage := ws.wstatus, ws.rusage
 		status := runner.StatusNormal
 		userTime := time.Duration(rusage.Utime.Nano()) // ns
 		userMem := runner.Size(rusage.Maxrss << 10)    // bytes
+		ru := toRusage(&rusage)
 		switch {
 		case wstatus.Exited():
 			exitStatus := wstatus.ExitStatus()
 			if exitStatus != 0 {
 				status = runner.StatusNonzeroExitStatus
 			}
-			c.sendReply(&reply{
+			c.sendReplyTo(s.id, &reply{
 				ExecReply: &execReply{
 					Status:     status,
 					ExitStatus: exitStatus,
 					Time:       userTime,
 					Memory:     userMem,
+					Rusage:     ru,
+					SetUpTime:  execTime.Sub(forkTime),
+					WallTime:   exitTime.Sub(forkTime),
 				},
 			}, nil)
 
@@ -150,21 +380,62 @@ func (c *containerServer) handleExecve(cmd *execCmd, msg *unixsocket.Msg) error
 			default:
 				status = runner.StatusSignalled
 			}
-			c.sendReply(&reply{
+			c.sendReplyTo(s.id, &reply{
 				ExecReply: &execReply{
 					ExitStatus: int(wstatus.Signal()),
 					Status:     status,
 					Time:       userTime,
 					Memory:     userMem,
+					Rusage:     ru,
+					SetUpTime:  execTime.Sub(forkTime),
+					WallTime:   exitTime.Sub(forkTime),
+					Crash:      crashInfo(wstatus, workDir, cmd.CoreLimit > 0),
 				},
 			}, nil)
 
 		default:
-			c.sendErrorReply("execve: unknown status %v", wstatus)
+			c.sendReplyTo(s.id, &reply{Error: newError(ErrorCodeUnknown, "execve: unknown status %v", wstatus)}, nil)
 		}
 	}
 
 	// wait for kill msg and reply done for finish
 	<-killDone
-	return c.sendReply(&reply{}, nil)
+	c.mu.Lock()
+	delete(c.sessions, s.id)
+	c.mu.Unlock()
+	c.sendReplyTo(s.id, &reply{}, nil)
+}
+
+func (c *containerServer) setSessionPid(s *execSession, pid int) {
+	c.mu.Lock()
+	s.pid = pid
+	c.mu.Unlock()
+}
+
+// killSession kills the process group of the session (child calls setsid).
+// If it is the only session, all processes inside container are killed to
+// clean up processes escaped from the process group. The group is not killed
+// once the process is reaped since its pid could be reused by other sessions
+func (c *containerServer) killSession(s *execSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.sessions) <= 1 {
+		syscall.Kill(-1, syscall.SIGKILL)
+	} else if s.pid > 0 {
+		syscall.Kill(-s.pid, syscall.SIGKILL)
+	}
+}
+
+// toRusage converts wait4 rusage to runner rusage
+func toRusage(r *syscall.Rusage) runner.Rusage {
+	return runner.Rusage{
+		UserTime:             time.Duration(r.Utime.Nano()),
+		SystemTime:           time.Duration(r.Stime.Nano()),
+		MaxRss:               runner.Size(r.Maxrss << 10),
+		MinorFault:           uint64(r.Minflt),
+		MajorFault:           uint64(r.Majflt),
+		VoluntaryCtxSwitch:   uint64(r.Nvcsw),
+		InvoluntaryCtxSwitch: uint64(r.Nivcsw),
+	}
 }
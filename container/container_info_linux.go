@@ -0,0 +1,77 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"syscall"
+)
+
+// handleInfo reports mounts, processes and disk usage of the container. Mount
+// table and id maps are only available when proc is mounted, otherwise the
+// host fills them. Without proc, the process list contains init and the
+// running execve sessions only
+func (c *containerServer) handleInfo() error {
+	info := &Info{
+		PIDs: c.livePids(),
+	}
+	if mounts, err := readLines("/proc/self/mountinfo"); err == nil {
+		info.Mounts = mounts
+	}
+	if b, err := ioutil.ReadFile("/proc/self/uid_map"); err == nil {
+		info.UIDMap = string(b)
+	}
+	if b, err := ioutil.ReadFile("/proc/self/gid_map"); err == nil {
+		info.GIDMap = string(b)
+	}
+
+	resetPaths := c.ResetPaths
+	if len(resetPaths) == 0 {
+		resetPaths = defaultResetPaths
+	}
+	for _, p := range resetPaths {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(p, &st); err != nil {
+			return c.sendErrorReply("info: statfs %s %v", p, err)
+		}
+		info.Disk = append(info.Disk, DiskUsage{
+			Path:      p,
+			Size:      st.Blocks * uint64(st.Bsize),
+			Free:      st.Bavail * uint64(st.Bsize),
+			Files:     st.Files,
+			FreeFiles: st.Ffree,
+		})
+	}
+	return c.sendReply(&reply{InfoReply: info}, nil)
+}
+
+// livePids lists processes from /proc, or init and session processes if proc
+// is not mounted
+func (c *containerServer) livePids() []int {
+	var pids []int
+	if d, err := os.Open("/proc"); err == nil {
+		names, _ := d.Readdirnames(-1)
+		d.Close()
+		for _, n := range names {
+			if pid, err := strconv.Atoi(n); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+		if len(pids) > 0 {
+			sort.Ints(pids)
+			return pids
+		}
+	}
+
+	pids = append(pids, 1)
+	c.mu.Lock()
+	for _, s := range c.sessions {
+		if s.pid > 0 {
+			pids = append(pids, s.pid)
+		}
+	}
+	c.mu.Unlock()
+	sort.Ints(pids)
+	return pids
+}
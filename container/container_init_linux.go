@@ -1,16 +1,53 @@
 package container
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/criyle/go-sandbox/pkg/unixsocket"
 )
 
+// exit codes of container init
+const (
+	exitCodeError      = 1 // error or panic
+	exitCodeMasterGone = 2 // socket closed by host, processes are killed
+)
+
+// watchdogReapWait is the time to wait for killed processes to be reaped
+// after the host closed the socket
+const watchdogReapWait = 3 * time.Second
+
+// errMasterGone signals the socket is closed by host
+var errMasterGone = errors.New("master gone (socket closed)")
+
 type containerServer struct {
 	socket *socket
 	containerConfig
+
+	id     uint64     // id of the command handled by serve loop
+	sendMu sync.Mutex // serialize replies from serve loop and exec sessions
+	reaper *reaper    // collect exit status of children
+
+	batch     *batchCollector // collects replies of sub-commands when handling batch
+	copyInSem chan struct{}   // limits concurrent copyin
+	copyInWg  sync.WaitGroup  // concurrent copyin in flight
+
+	copyInCache copyInCache // checksum of files written by copyin
+	mounts      []string    // targets of runtime mounts in mount order
+	execCache   execCache   // executables cached by key
+	workDirs    workDirs    // per-run directories under work dir
+	timedOut    int32       // a command timed out and is still running (atomic)
+
+	log *logger // log to fd passed by host
+
+	mu       sync.Mutex              // protects sessions
+	sessions map[uint64]*execSession // running execve sessions by id
 }
 
 // Init is called for container init process
@@ -24,6 +61,8 @@ func Init() (err error) {
 		return nil
 	}
 
+	log := newInitLogger()
+
 	// exit process (with whole container) upon exit this function
 	// possible reason:
 	// 1. socket broken (parent exit)
@@ -31,14 +70,18 @@ func Init() (err error) {
 	// 3. undefined cmd (possible race condition)
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Fprintf(os.Stderr, "container_exit: panic: %v\n", err)
-			os.Exit(1)
+			log.errorf("container_exit: panic: %v", err)
+			os.Exit(exitCodeError)
+		}
+		if errors.Is(err, errMasterGone) {
+			log.errorf("container_exit: %v", err)
+			os.Exit(exitCodeMasterGone)
 		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "container_exit: %v\n", err)
-			os.Exit(1)
+			log.errorf("container_exit: %v", err)
+			os.Exit(exitCodeError)
 		}
-		fmt.Fprintf(os.Stderr, "container_exit\n")
+		log.infof("container_exit")
 		os.Exit(0)
 	}()
 
@@ -53,23 +96,102 @@ func Init() (err error) {
 	}
 
 	// serve forever
-	cs := &containerServer{socket: newSocket(soc)}
-	return cs.serve()
+	cs := &containerServer{
+		socket:    newSocket(soc),
+		log:       log,
+		reaper:    newReaper(),
+		sessions:  make(map[uint64]*execSession),
+		copyInSem: make(chan struct{}, copyInWorkers),
+	}
+	if err := cs.handshake(); err != nil {
+		return err
+	}
+	if err := cs.serve(); errors.Is(err, errMasterGone) {
+		return cs.watchdog(err)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// watchdog kills all processes inside container after the host closed the
+// socket (e.g. crashed), so that they do not linger while the container exits
+func (c *containerServer) watchdog(err error) error {
+	syscall.Kill(-1, syscall.SIGKILL)
+	if !c.reaper.waitAll(watchdogReapWait) {
+		return fmt.Errorf("%w, processes not reaped after %v", err, watchdogReapWait)
+	}
+	return fmt.Errorf("%w, all processes killed", err)
+}
+
+// handshake receives host protocol version and codec, then replies with
+// container version before any command, mismatched version or unknown codec
+// will cause container exit
+func (c *containerServer) handshake() error {
+	v, cc, err := c.socket.RecvVersion()
+	if err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+	// host of version 1 expects the version message without codec
+	if v == 1 {
+		err = c.socket.SendVersionV1(protocolVersion)
+	} else {
+		err = c.socket.SendVersion(protocolVersion, cc)
+	}
+	if err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+	if v != protocolVersion {
+		return fmt.Errorf("handshake: protocol version mismatch (host %d, container %d)", v, protocolVersion)
+	}
+	if err := c.socket.SetCodec(cc); err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+	return nil
 }
 
 func (c *containerServer) serve() error {
 	for {
 		cmd, msg, err := c.recvCmd()
+		if c.isTimedOut() {
+			return fmt.Errorf("serve: %v", errTimeout)
+		}
+		if errors.Is(err, io.EOF) {
+			return errMasterGone
+		}
 		if err != nil {
 			return fmt.Errorf("serve: recvCmd %v", err)
 		}
-		if err := c.handleCmd(cmd, msg); err != nil {
+		if err := c.handleCmdRecover(cmd, msg); err == errShutdown {
+			return nil
+		} else if err != nil {
 			return fmt.Errorf("serve: failed to execute cmd %v", err)
 		}
+		// state is unknown while the timed out operation is running
+		if c.isTimedOut() {
+			return fmt.Errorf("serve: cmd %d %s: %v", cmd.ID, cmd.Cmd, errTimeout)
+		}
 	}
 }
 
+// handleCmdRecover handles the command and recovers from panic in its handler,
+// the panic is replied as internal error so that the container keeps serving
+func (c *containerServer) handleCmdRecover(cmd *cmd, msg *unixsocket.Msg) (err error) {
+	start := time.Now()
+	c.log.debugf("cmd %d %s: start", cmd.ID, cmd.Cmd)
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.errorf("cmd %d %s: panic: %v", cmd.ID, cmd.Cmd, r)
+			c.batch = nil
+			err = c.sendErrorCodeReply(ErrorCodeInternal, "%s: panic: %v", cmd.Cmd, r)
+		}
+		c.log.debugf("cmd %d %s: done in %v (%v)", cmd.ID, cmd.Cmd, time.Since(start), err)
+	}()
+	return c.handleCmd(cmd, msg)
+}
+
 func (c *containerServer) handleCmd(cmd *cmd, msg *unixsocket.Msg) error {
+	c.id = cmd.ID
 	switch cmd.Cmd {
 	case cmdPing:
 		return c.handlePing()
@@ -78,16 +200,58 @@ func (c *containerServer) handleCmd(cmd *cmd, msg *unixsocket.Msg) error {
 		return c.handleConf(cmd.ConfCmd)
 
 	case cmdOpen:
-		return c.handleOpen(cmd.OpenCmd)
+		return c.handleOpen(cmd.OpenCmd, cmd.Timeout)
 
 	case cmdDelete:
-		return c.handleDelete(cmd.DeleteCmd)
+		return c.handleDelete(cmd.DeleteCmd, cmd.Timeout)
+
+	case cmdStat:
+		return c.handleStat(cmd.StatCmd, cmd.Timeout)
+
+	case cmdRename, cmdLink, cmdSymlink:
+		return c.handleLink(cmd.Cmd, cmd.LinkCmd, cmd.Timeout)
+
+	case cmdCopyIn:
+		return c.handleCopyIn(cmd.CopyInCmd, msg, cmd.Timeout)
+
+	case cmdCopyOut:
+		return c.handleCopyOut(cmd.CopyOutCmd, msg, cmd.Timeout)
 
 	case cmdReset:
-		return c.handleReset()
+		return c.handleReset(cmd.Timeout)
 
 	case cmdExecve:
 		return c.handleExecve(cmd.ExecCmd, msg)
+
+	case cmdOk, cmdKill:
+		return c.handleSessionCmd(cmd, msg)
+
+	case cmdSignal:
+		return c.handleSignal(cmd.SignalCmd)
+
+	case cmdStdin:
+		return c.handleStdin(cmd.StdinCmd)
+
+	case cmdShutdown:
+		return c.handleShutdown()
+
+	case cmdInfo:
+		return c.handleInfo()
+
+	case cmdMkWorkDir:
+		return c.handleMkWorkDir(cmd.WorkDirCmd)
+
+	case cmdRmWorkDir:
+		return c.handleRmWorkDir(cmd.WorkDirCmd, cmd.Timeout)
+
+	case cmdCache:
+		return c.handleCache(cmd.CacheCmd, msg, cmd.Timeout)
+
+	case cmdMount:
+		return c.handleMount(cmd.MountCmd, msg, cmd.Timeout)
+
+	case cmdBatch:
+		return c.handleBatch(cmd.BatchCmd, msg, cmd.Timeout)
 	}
 	return fmt.Errorf("unknown command: %s", cmd.Cmd)
 }
@@ -0,0 +1,104 @@
+package container
+
+import (
+	"os"
+	"sync"
+)
+
+// inputRelay writes stdin data received from host to the process through
+// pipe. Data is queued so that the serve loop is never blocked by a process
+// not reading its stdin
+type inputRelay struct {
+	r *os.File // read end for the process, closed after start
+	w *os.File // write end hold by init
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool // no more data (stdin closed by host)
+	done   chan struct{}
+}
+
+// newInputRelay replaces stdin in files with pipe
+func newInputRelay(files []uintptr) (*inputRelay, []uintptr, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	i := &inputRelay{
+		r:    r,
+		w:    w,
+		done: make(chan struct{}),
+	}
+	i.cond = sync.NewCond(&i.mu)
+
+	ret := make([]uintptr, 1, len(files)+1)
+	ret[0] = r.Fd()
+	if len(files) > 1 {
+		ret = append(ret, files[1:]...)
+	}
+	go i.loop()
+	return i, ret, nil
+}
+
+// push queues data, close indicates end of stdin
+func (i *inputRelay) push(b []byte, close bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.closed {
+		return
+	}
+	if len(b) > 0 {
+		i.queue = append(i.queue, b)
+	}
+	i.closed = close
+	i.cond.Signal()
+}
+
+// start closes the read end hold by init
+func (i *inputRelay) start() {
+	i.r.Close()
+}
+
+// stop discards pending data and closes stdin after the process exited
+func (i *inputRelay) stop() {
+	i.mu.Lock()
+	i.queue = nil
+	i.closed = true
+	i.cond.Signal()
+	i.mu.Unlock()
+
+	// unblock pending write
+	i.w.Close()
+	<-i.done
+	i.r.Close()
+}
+
+func (i *inputRelay) loop() {
+	defer close(i.done)
+	defer i.w.Close()
+
+	for {
+		i.mu.Lock()
+		for len(i.queue) == 0 && !i.closed {
+			i.cond.Wait()
+		}
+		if len(i.queue) == 0 {
+			i.mu.Unlock()
+			return
+		}
+		b := i.queue[0]
+		i.queue = i.queue[1:]
+		i.mu.Unlock()
+
+		// process closed stdin, the remaining are discarded
+		if _, err := i.w.Write(b); err != nil {
+			i.mu.Lock()
+			i.queue = nil
+			i.closed = true
+			i.mu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package container
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/criyle/go-sandbox/pkg/unixsocket"
+	"golang.org/x/sys/unix"
+)
+
+// open_tree / move_mount are not available in older syscall / x/sys packages
+const (
+	sysOpenTree  = 428 // same on all architectures
+	sysMoveMount = 429
+
+	openTreeClone       = 0x1
+	atRecursive         = 0x8000
+	moveMountFEmptyPath = 0x4
+
+	// flags kept on remount since they might be locked in user namespace
+	mountLockedFlags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC |
+		unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME
+)
+
+var (
+	emptyPath = []byte("\000")
+
+	// go does not allow constant uintptr to be negative
+	atFdcwd = unix.AT_FDCWD
+)
+
+func (c *containerServer) handleMount(mount *mountCmd, msg *unixsocket.Msg, timeout time.Duration) error {
+	if msg == nil || len(msg.Fds) != 1 {
+		if msg != nil {
+			closeFds(msg.Fds)
+		}
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "mount: expect 1 mount tree fd")
+	}
+	fd := msg.Fds[0]
+	if mount == nil {
+		syscall.Close(fd)
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "mount: no parameter provided")
+	}
+	target := path.Clean(workPath(mount.Target))
+	if err := c.runTimeout(timeout, func() error {
+		defer syscall.Close(fd)
+		return attachMount(fd, target, mount.Readonly)
+	}); err != nil {
+		return c.sendErrorReply("mount: %v", err)
+	}
+	c.mounts = append(c.mounts, target)
+	return c.sendReply(&reply{}, nil)
+}
+
+// detachMounts unmounts the runtime mounts under dir (in reverse order for
+// nested mounts), so that reset never removes files on the mount source
+func (c *containerServer) detachMounts(dir string) error {
+	dir = path.Clean(dir)
+	var (
+		kept []string
+		err  error
+	)
+	for i := len(c.mounts) - 1; i >= 0; i-- {
+		m := c.mounts[i]
+		if m != dir && !strings.HasPrefix(m, dir+"/") {
+			kept = append([]string{m}, kept...)
+			continue
+		}
+		if err1 := syscall.Unmount(m, syscall.MNT_DETACH); err1 != nil && err1 != syscall.EINVAL && err == nil {
+			err = &os.PathError{Op: "umount", Path: m, Err: err1}
+		}
+	}
+	c.mounts = kept
+	return err
+}
+
+// attachMount creates the mount point and moves the detached mount tree onto
+// it, the mount is remounted nosuid and optionally read-only
+func attachMount(fd int, target string, readonly bool) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	if err := moveMount(fd, target); err != nil {
+		return &os.PathError{Op: "move_mount", Path: target, Err: err}
+	}
+
+	var sfs syscall.Statfs_t
+	if err := syscall.Statfs(target, &sfs); err != nil {
+		return err
+	}
+	// ST_* flags of statfs have the same value as MS_* flags
+	flags := uintptr(sfs.Flags)&mountLockedFlags | unix.MS_BIND | unix.MS_REMOUNT | unix.MS_NOSUID
+	if readonly {
+		flags |= unix.MS_RDONLY
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return &os.PathError{Op: "remount", Path: target, Err: err}
+	}
+	return nil
+}
+
+// openTree clones the mount tree at p into a detached mount (linux 5.2+)
+func openTree(p string) (int, error) {
+	b, err := syscall.BytePtrFromString(p)
+	if err != nil {
+		return -1, err
+	}
+	fd, _, errno := syscall.Syscall(sysOpenTree, uintptr(atFdcwd), uintptr(unsafe.Pointer(b)),
+		uintptr(openTreeClone|atRecursive|unix.O_CLOEXEC))
+	if errno != 0 {
+		return -1, &os.PathError{Op: "open_tree", Path: p, Err: errno}
+	}
+	return int(fd), nil
+}
+
+// moveMount attaches the detached mount fd to target
+func moveMount(fd int, target string) error {
+	b, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(sysMoveMount, uintptr(fd), uintptr(unsafe.Pointer(&emptyPath[0])),
+		uintptr(atFdcwd), uintptr(unsafe.Pointer(b)), moveMountFEmptyPath, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
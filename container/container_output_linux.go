@@ -0,0 +1,105 @@
+package container
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// outputChunkSize limits the size of output data in single reply
+	outputChunkSize = bufferSize / 2
+
+	// outputDrainWait is the time to wait for remaining output after the
+	// process exited, since its children might still hold the pipe
+	outputDrainWait = 100 * time.Millisecond
+)
+
+// outputRelay reads stdout / stderr of the process through pipes and relays
+// them as output replies of the execve session
+type outputRelay struct {
+	c  *containerServer
+	id uint64
+
+	r     []*os.File // read ends, index + 1 is the fd of the process
+	close []*os.File // files for the process, closed after start
+	wg    sync.WaitGroup
+}
+
+// newOutputRelay replaces stdout / stderr in files with pipes, missing stdin
+// is replaced by an empty one
+func (c *containerServer) newOutputRelay(id uint64, files []uintptr) (*outputRelay, []uintptr, error) {
+	o := &outputRelay{c: c, id: id}
+
+	ret := make([]uintptr, 3, len(files)+3)
+	copy(ret, files)
+	if len(files) == 0 {
+		// empty stdin (pipe with write end closed)
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		w.Close()
+		o.close = append(o.close, r)
+		ret[0] = r.Fd()
+	}
+	for i := 1; i <= 2; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			o.closeAll()
+			return nil, nil, err
+		}
+		o.r = append(o.r, r)
+		o.close = append(o.close, w)
+		ret[i] = w.Fd()
+	}
+	if len(files) > 3 {
+		ret = append(ret, files[3:]...)
+	}
+	return o, ret, nil
+}
+
+// start closes the write ends hold by init and starts relay
+func (o *outputRelay) start() {
+	closeFiles(o.close)
+	o.close = nil
+	for i, r := range o.r {
+		o.wg.Add(1)
+		go o.relay(i+1, r)
+	}
+}
+
+// wait waits the remaining output after the process exited
+func (o *outputRelay) wait() {
+	deadline := time.Now().Add(outputDrainWait)
+	for _, r := range o.r {
+		r.SetReadDeadline(deadline)
+	}
+	o.wg.Wait()
+	o.closeAll()
+}
+
+func (o *outputRelay) closeAll() {
+	closeFiles(o.close)
+	closeFiles(o.r)
+}
+
+func (o *outputRelay) relay(fd int, r *os.File) {
+	defer o.wg.Done()
+
+	buf := make([]byte, outputChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			// data is encoded before return, thus buf could be reused
+			if err := o.c.sendReplyTo(o.id, &reply{
+				OutputReply: &outputReply{Fd: fd, Data: buf[:n]},
+			}, nil); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
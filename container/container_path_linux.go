@@ -0,0 +1,251 @@
+package container
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openat2 is not available in older syscall / x/sys packages
+const (
+	sysOpenat2 = 437 // same on all architectures
+
+	resolveNoMagiclinks = 0x02
+	resolveBeneath      = 0x08
+)
+
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// resolvePath canonicalizes p (relative to work dir) and returns the root
+// it belongs to and the path relative to that root. If no root configured,
+// root is empty and rel is the absolute path
+func (c *containerServer) resolvePath(p string) (root, rel string, err error) {
+	abs := path.Clean(workPath(p))
+	if len(c.Roots) == 0 {
+		return "", abs, nil
+	}
+	for _, r := range c.Roots {
+		r = path.Clean(r)
+		if abs == r {
+			return r, ".", nil
+		}
+		prefix := r
+		if r != "/" {
+			prefix += "/"
+		}
+		if strings.HasPrefix(abs, prefix) {
+			return r, abs[len(prefix):], nil
+		}
+	}
+	return "", "", &os.PathError{Op: "resolve", Path: p, Err: syscall.EPERM}
+}
+
+// openBeneath opens p and ensures the result (following symlinks) does not
+// escape from the configured roots
+func (c *containerServer) openBeneath(p string, flag int, perm os.FileMode) (*os.File, error) {
+	root, rel, err := c.resolvePath(p)
+	if err != nil {
+		return nil, err
+	}
+	if root == "" {
+		return os.OpenFile(rel, flag, perm)
+	}
+
+	dirFd, err := syscall.Open(root, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer syscall.Close(dirFd)
+
+	fd, err := openat2(dirFd, rel, flag|syscall.O_CLOEXEC, perm)
+	if err == syscall.ENOSYS {
+		fd, err = openatNoFollow(dirFd, rel, flag|syscall.O_CLOEXEC, perm)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path.Join(root, rel)), nil
+}
+
+// openat2 opens rel beneath dirFd with RESOLVE_BENEATH (linux 5.6+)
+func openat2(dirFd int, rel string, flag int, perm os.FileMode) (int, error) {
+	p, err := syscall.BytePtrFromString(rel)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{
+		flags:   uint64(flag),
+		resolve: resolveBeneath | resolveNoMagiclinks,
+	}
+	if flag&(syscall.O_CREAT|unix.O_TMPFILE) != 0 {
+		how.mode = uint64(syscallMode(perm))
+	}
+	for {
+		fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirFd), uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+		if errno == syscall.EINTR || errno == syscall.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			return -1, errno
+		}
+		return int(fd), nil
+	}
+}
+
+// openatNoFollow is the fallback of openat2 that refuses symlinks in any
+// path component
+func openatNoFollow(dirFd int, rel string, flag int, perm os.FileMode) (int, error) {
+	comps := strings.Split(rel, "/")
+	fd := dirFd
+	for _, n := range comps[:len(comps)-1] {
+		nfd, err := syscall.Openat(fd, n, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if fd != dirFd {
+			syscall.Close(fd)
+		}
+		if err != nil {
+			return -1, err
+		}
+		fd = nfd
+	}
+	if fd != dirFd {
+		defer syscall.Close(fd)
+	}
+	return syscall.Openat(fd, comps[len(comps)-1], flag|syscall.O_NOFOLLOW, syscallMode(perm))
+}
+
+// syscallMode converts os.FileMode to mode bits for open
+func syscallMode(m os.FileMode) uint32 {
+	o := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		o |= syscall.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		o |= syscall.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		o |= syscall.S_ISVTX
+	}
+	return o
+}
+
+// parentBeneath opens the parent directory of p inside the configured roots
+// and returns its fd with the base name of p. If no root configured, fd is
+// AT_FDCWD and name is the absolute path. The root itself is refused
+func (c *containerServer) parentBeneath(p, op string) (fd int, name string, close func(), err error) {
+	root, rel, err := c.resolvePath(p)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if root == "" {
+		return unix.AT_FDCWD, rel, func() {}, nil
+	}
+	if rel == "." {
+		return 0, "", nil, &os.PathError{Op: op, Path: p, Err: syscall.EPERM}
+	}
+
+	dir, err := c.openBeneath(path.Join(root, path.Dir(rel)), unix.O_PATH|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return int(dir.Fd()), path.Base(rel), func() { dir.Close() }, nil
+}
+
+// removeBeneath removes file or empty directory p inside the configured roots
+func (c *containerServer) removeBeneath(p string) error {
+	dirFd, name, close, err := c.parentBeneath(p, "remove")
+	if err != nil {
+		return err
+	}
+	defer close()
+
+	err = unix.Unlinkat(dirFd, name, 0)
+	if err == syscall.EISDIR {
+		err = unix.Unlinkat(dirFd, name, unix.AT_REMOVEDIR)
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: p, Err: err}
+	}
+	return nil
+}
+
+// renameBeneath renames (replaces atomically if exists) oldPath to newPath,
+// both inside the configured roots
+func (c *containerServer) renameBeneath(oldPath, newPath string) error {
+	oldFd, oldName, closeOld, err := c.parentBeneath(oldPath, "rename")
+	if err != nil {
+		return err
+	}
+	defer closeOld()
+	newFd, newName, closeNew, err := c.parentBeneath(newPath, "rename")
+	if err != nil {
+		return err
+	}
+	defer closeNew()
+
+	if err := unix.Renameat(oldFd, oldName, newFd, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// linkBeneath creates hard link newPath to oldPath (symlink is not followed),
+// both inside the configured roots
+func (c *containerServer) linkBeneath(oldPath, newPath string) error {
+	oldFd, oldName, closeOld, err := c.parentBeneath(oldPath, "link")
+	if err != nil {
+		return err
+	}
+	defer closeOld()
+	newFd, newName, closeNew, err := c.parentBeneath(newPath, "link")
+	if err != nil {
+		return err
+	}
+	defer closeNew()
+
+	if err := unix.Linkat(oldFd, oldName, newFd, newName, 0); err != nil {
+		return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// symlinkBeneath creates symbolic link newPath inside the configured roots
+// pointing to target. Target is not checked since following symlinks out of
+// roots is refused by other file commands
+func (c *containerServer) symlinkBeneath(target, newPath string) error {
+	newFd, newName, closeNew, err := c.parentBeneath(newPath, "symlink")
+	if err != nil {
+		return err
+	}
+	defer closeNew()
+
+	if err := unix.Symlinkat(target, newFd, newName); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// lstatBeneath returns the file info of p without following the last symlink
+func (c *containerServer) lstatBeneath(p string) (os.FileInfo, error) {
+	root, _, err := c.resolvePath(p)
+	if err != nil {
+		return nil, err
+	}
+	if root == "" {
+		return os.Lstat(workPath(p))
+	}
+	f, err := c.openBeneath(p, unix.O_PATH|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
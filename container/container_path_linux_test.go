@@ -0,0 +1,193 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestResolvePath(t *testing.T) {
+	c := &containerServer{containerConfig: containerConfig{Roots: []string{"/w", "/tmp/"}}}
+	tests := []struct {
+		path      string
+		root, rel string
+		err       bool
+	}{
+		{path: "a", root: "/w", rel: "a"},
+		{path: "a/../b", root: "/w", rel: "b"},
+		{path: "/w", root: "/w", rel: "."},
+		{path: "/tmp/a/b", root: "/tmp", rel: "a/b"},
+		{path: "../etc/passwd", err: true},
+		{path: "/w/../etc", err: true},
+		{path: "/wx", err: true},
+		{path: "/", err: true},
+	}
+	for _, tc := range tests {
+		root, rel, err := c.resolvePath(tc.path)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: got %s %s, want error", tc.path, root, rel)
+			}
+			continue
+		}
+		if err != nil || root != tc.root || rel != tc.rel {
+			t.Errorf("%s: got %q %q %v, want %q %q", tc.path, root, rel, err, tc.root, tc.rel)
+		}
+	}
+
+	// no root configured
+	c = &containerServer{}
+	if root, rel, err := c.resolvePath("a/../../b"); err != nil || root != "" || rel != "/b" {
+		t.Errorf("no root: got %q %q %v", root, rel, err)
+	}
+}
+
+// pathTestRoot creates layout under temp dir and returns it with the root:
+//
+//	root/dir/file
+//	root/dirlink -> dir
+//	root/filelink -> dir/file
+//	root/abslink -> /
+//	root/rellink -> ..
+//	outside
+func pathTestRoot(t *testing.T) (tmp, root string) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmp) })
+	root = path.Join(tmp, "root")
+	if err := os.MkdirAll(path.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path.Join(root, "dir/file"), path.Join(tmp, "outside")} {
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"dirlink":  "dir",
+		"filelink": "dir/file",
+		"abslink":  "/",
+		"rellink":  "..",
+	} {
+		if err := os.Symlink(target, path.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tmp, root
+}
+
+func TestOpenBeneath(t *testing.T) {
+	tmp, root := pathTestRoot(t)
+	c := &containerServer{containerConfig: containerConfig{Roots: []string{root}}}
+
+	dirFd, err := syscall.Open(root, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirFd)
+	// symlinks inside root are followed by openat2 only
+	fd, err := openat2(dirFd, ".", unix.O_PATH, 0)
+	hasOpenat2 := err != syscall.ENOSYS
+	if err == nil {
+		syscall.Close(fd)
+	}
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"dir/file", true},
+		{"dir/../dir/file", true},
+		{"dirlink/file", hasOpenat2},
+		{"filelink", hasOpenat2},
+		{"../outside", false},
+		{"dir/../../outside", false},
+		{"abslink/" + tmp[1:] + "/outside", false},
+		{"rellink/outside", false},
+	}
+	for _, tc := range tests {
+		f, err := c.openBeneath(path.Join(root, tc.path), os.O_RDONLY, 0)
+		if err == nil {
+			f.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok %v", tc.path, err, tc.ok)
+		}
+	}
+	// created file is inside root
+	f, err := c.openBeneath(path.Join(root, "dir/new"), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(path.Join(root, "dir/new")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenatNoFollow(t *testing.T) {
+	tmp, root := pathTestRoot(t)
+	dirFd, err := syscall.Open(root, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirFd)
+
+	tests := []struct {
+		rel string
+		ok  bool
+	}{
+		{"dir/file", true},
+		{"dirlink/file", false},
+		{"filelink", false},
+		{"abslink/" + tmp[1:] + "/outside", false},
+		{"rellink/outside", false},
+	}
+	for _, tc := range tests {
+		fd, err := openatNoFollow(dirFd, tc.rel, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err == nil {
+			syscall.Close(fd)
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok %v", tc.rel, err, tc.ok)
+		}
+	}
+}
+
+func TestParentBeneath(t *testing.T) {
+	_, root := pathTestRoot(t)
+	c := &containerServer{containerConfig: containerConfig{Roots: []string{root}}}
+
+	// root itself is refused
+	for _, p := range []string{root, root + "/", root + "/dir/.."} {
+		if _, _, _, err := c.parentBeneath(p, "remove"); err == nil {
+			t.Errorf("%s: root not refused", p)
+		}
+	}
+	if err := c.removeBeneath(root); err == nil {
+		t.Error("remove root: not refused")
+	}
+
+	fd, name, close, err := c.parentBeneath(path.Join(root, "dir/file"), "remove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if name != "file" {
+		t.Errorf("got name %q, want file", name)
+	}
+	var st unix.Stat_t
+	if err := unix.Fstatat(fd, name, &st, 0); err != nil {
+		t.Error(err)
+	}
+	// parent through symlink out of root
+	if _, _, _, err := c.parentBeneath(path.Join(root, "rellink/outside"), "remove"); err == nil {
+		t.Error("rellink: parent out of root not refused")
+	}
+}
@@ -0,0 +1,47 @@
+package container
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// ptmxPath is the pseudo terminal multiplexer of devpts mounted at /dev/pts
+const ptmxPath = "/dev/pts/ptmx"
+
+// openPty allocates a pseudo terminal pair
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile(ptmxPath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// unlock slave
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	// get slave number
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); err != 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package container
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workDirPrefix is the name prefix of per-run directories under work dir
+const workDirPrefix = "run"
+
+// workDirs tracks per-run directories created under work dir, so that only
+// they could be removed by rmworkdir
+type workDirs struct {
+	next  int
+	paths map[string]bool
+}
+
+func (c *containerServer) handleMkWorkDir(wd *workDirCmd) error {
+	uid, gid := -1, -1
+	if wd != nil && wd.Cred != nil {
+		uid, gid = int(wd.Cred.UID), int(wd.Cred.GID)
+	} else if c.Cred {
+		uid, gid = containerUID, containerGID
+	}
+
+	p, err := c.mkWorkDir(uid, gid)
+	if err != nil {
+		return c.sendErrorReply("mkworkdir: %v", err)
+	}
+	if c.workDirs.paths == nil {
+		c.workDirs.paths = make(map[string]bool)
+	}
+	c.workDirs.paths[p] = true
+	return c.sendReply(&reply{WorkDirReply: &workDirReply{Path: p}}, nil)
+}
+
+// mkWorkDir creates unique directory under work dir owned by uid / gid
+// (not changed if negative)
+func (c *containerServer) mkWorkDir(uid, gid int) (string, error) {
+	for {
+		c.workDirs.next++
+		p := path.Join(containerWD, workDirPrefix+strconv.Itoa(c.workDirs.next))
+		err := os.Mkdir(p, 0700)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := os.Chown(p, uid, gid); err != nil {
+			os.Remove(p)
+			return "", err
+		}
+		return p, nil
+	}
+}
+
+func (c *containerServer) handleRmWorkDir(wd *workDirCmd, timeout time.Duration) error {
+	if wd == nil || wd.Path == "" {
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "rmworkdir: no parameter provided")
+	}
+	p := path.Clean(workPath(wd.Path))
+	if !c.workDirs.paths[p] {
+		return c.sendErrorCodeReply(ErrorCodeNotExist, "rmworkdir: %q not created by mkworkdir", wd.Path)
+	}
+	delete(c.workDirs.paths, p)
+
+	if err := c.detachMounts(p); err != nil {
+		return c.sendErrorReply("rmworkdir: %v", err)
+	}
+	if err := c.runTimeout(timeout, func() error {
+		return os.RemoveAll(p)
+	}); err != nil {
+		return c.sendErrorReply("rmworkdir: %v", err)
+	}
+	return c.sendReply(&reply{}, nil)
+}
+
+// resetWorkDirs forgets per-run directories removed by reset of dir
+func (c *containerServer) resetWorkDirs(dir string) {
+	dir = path.Clean(dir)
+	for p := range c.workDirs.paths {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			delete(c.workDirs.paths, p)
+		}
+	}
+}
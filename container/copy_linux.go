@@ -0,0 +1,85 @@
+package container
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// zeroCopyChunk is the maximum size of single copy_file_range / splice
+const zeroCopyChunk = 1 << 30
+
+// copyFile copies at most limit (negative means no limit) bytes from src to
+// dst. Data is copied by copy_file_range (regular file) or splice (pipe)
+// inside kernel, and falls back to io.Copy if not supported
+func copyFile(dst, src *os.File, limit int64) (int64, error) {
+	written, handled, err := zeroCopy(dst, src, limit)
+	if handled || err != nil {
+		return written, err
+	}
+	var r io.Reader = src
+	if limit >= 0 {
+		r = io.LimitReader(src, limit)
+	}
+	return io.Copy(dst, r)
+}
+
+// zeroCopy returns handled = false if nothing copied and zero copy is not
+// supported for the files
+func zeroCopy(dst, src *os.File, limit int64) (written int64, handled bool, err error) {
+	fi, err := src.Stat()
+	if err != nil {
+		return 0, false, nil
+	}
+	var copyFn func(rfd, wfd, n int) (int, error)
+	switch {
+	case fi.Mode().IsRegular():
+		copyFn = func(rfd, wfd, n int) (int, error) {
+			return unix.CopyFileRange(rfd, nil, wfd, nil, n, 0)
+		}
+	case fi.Mode()&os.ModeNamedPipe != 0:
+		copyFn = func(rfd, wfd, n int) (int, error) {
+			c, err := unix.Splice(rfd, nil, wfd, nil, n, unix.SPLICE_F_MOVE)
+			return int(c), err
+		}
+	default:
+		return 0, false, nil
+	}
+	rc, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	wfd := int(dst.Fd())
+
+	for limit < 0 || written < limit {
+		chunk := int64(zeroCopyChunk)
+		if limit >= 0 && limit-written < chunk {
+			chunk = limit - written
+		}
+		var (
+			n    int
+			cerr error
+		)
+		// wait until readable if src is non-blocking
+		if err := rc.Read(func(fd uintptr) bool {
+			n, cerr = copyFn(int(fd), wfd, int(chunk))
+			return cerr != unix.EAGAIN
+		}); err != nil {
+			return written, true, err
+		}
+		if cerr != nil {
+			// not supported for the file system or kernel
+			if written == 0 && (cerr == unix.ENOSYS || cerr == unix.EXDEV ||
+				cerr == unix.EINVAL || cerr == unix.EOPNOTSUPP) {
+				return 0, false, nil
+			}
+			return written, true, cerr
+		}
+		if n == 0 {
+			break
+		}
+		written += int64(n)
+	}
+	return written, true, nil
+}
@@ -0,0 +1,75 @@
+package container
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// copyInCache remembers checksum of files written by copyin, so that copyin
+// with the same checksum is skipped if the file is not modified since then
+type copyInCache struct {
+	mu    sync.Mutex
+	files map[string]copyInEntry
+}
+
+// copyInEntry identifies the file content by inode, size, mtime and ctime
+type copyInEntry struct {
+	checksum []byte
+	ino      uint64
+	size     int64
+	mtime    syscall.Timespec
+	ctime    syscall.Timespec
+}
+
+func newCopyInEntry(checksum []byte, fi os.FileInfo) (copyInEntry, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.Mode().IsRegular() {
+		return copyInEntry{}, false
+	}
+	return copyInEntry{
+		checksum: checksum,
+		ino:      st.Ino,
+		size:     st.Size,
+		mtime:    st.Mtim,
+		ctime:    st.Ctim,
+	}, true
+}
+
+// lookup returns true if file at key with fi has the checksum
+func (c *copyInCache) lookup(key string, checksum []byte, fi os.FileInfo) bool {
+	e, ok := newCopyInEntry(checksum, fi)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	o, ok := c.files[key]
+	return ok && bytes.Equal(o.checksum, e.checksum) && o.ino == e.ino &&
+		o.size == e.size && o.mtime == e.mtime && o.ctime == e.ctime
+}
+
+// store records the checksum of file at key, empty checksum removes it
+func (c *copyInCache) store(key string, checksum []byte, fi os.FileInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := newCopyInEntry(checksum, fi)
+	if len(checksum) == 0 || !ok {
+		delete(c.files, key)
+		return
+	}
+	if c.files == nil {
+		c.files = make(map[string]copyInEntry)
+	}
+	c.files[key] = e
+}
+
+// reset forgets all files
+func (c *copyInCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = nil
+}
@@ -5,17 +5,24 @@
 //
 // It creates container within unshared container and communicate
 // with host process using unix socket with
-// oob for fd / pid and commands encoded by gob.
+// oob for fd / pid and commands encoded by gob (default) or compact binary codec.
+// Container init writes leveled log (error / info, and debug trace of commands if verbose)
+// to fd 4 passed by the host.
 //
 // Protocol
 //
-// Host to container communication protocol is single threaded and always initiated by
-// the host:
+// Host to container communication protocol is always initiated by the host. Each command
+// carries a request id and its replies carry the same id. Execve runs concurrently with its
+// "init_finished" / "kill" routed by id, other commands are handled in order:
+//
+//  - handshake (before any command, raw message instead of encoded):
+//      - send: magic, protocol version, codec
+//      - reply: magic, protocol version, codec (container exits if mismatch)
 //
 //  - ping (alive check):
 //      - reply: pong
 //
-//  - conf (set configuration):
+//  - conf (set configuration, file commands are restricted to roots if set):
 //   	- reply pong
 //
 //  - open (open files in given mode inside container):
@@ -26,19 +33,72 @@
 //   	- send: path
 //   	- reply: "finished" / "error"
 //
-//  - reset (clean up container for later use (clear workdir / tmp)):
+//  - rename / link / symlink (rename atomically, create hard / symbolic link inside container):
+//   	- send: old path (link target for symlink), new path
+//   	- reply: "success" / "error"
+//
+//  - stat (get file metadata inside container):
+//   	- send: path
+//   	- reply: "success", size, mode, mtime / "error"
+//
+//  - copyin (copy source fd into file inside container, limited by maximum size, runs concurrently with other commands):
+//   	- send: path, perm, max size, checksum, tar, source fd (gzip compressed tar extracted into path if tar)
+//   	- reply: "success", unchanged (skipped since checksum matched) / "error" (file too large)
+//
+//  - copyout (collect files / directories recursively from work dir):
+//   	- send: paths, tar, destination fd (if tar)
+//   	- reply: "success", names, file fds (more replies if many) / "success" (gzip compressed tar written if tar) / "error"
+//
+//  - cache (store executable into sealed memfd keyed by host, kept after reset, or drop it):
+//   	- send: key, drop, source fd (if not drop)
+//   	- reply: "success" / "error"
+//
+//  - mount (bind mount a detached mount tree (open_tree) from host, optionally read-only):
+//   	- send: target, readonly, mount tree fd
+//   	- reply: "success" / "error"
+//
+//  - mkworkdir (create unique per-run directory under workdir owned by credential or container user):
+//   	- send: credential (optional)
+//   	- reply: "success", path / "error"
+//
+//  - rmworkdir (remove per-run directory created by mkworkdir recursively):
+//   	- send: path
+//   	- reply: "success" / "error"
+//
+//  - reset (clean up container for later use (detach mounts and clear reset paths, default workdir / tmp)):
 //   	- send:
 //   	- reply: "success"
 //
+//  - batch (run file sub-commands in order, stops at the first failure without rollback, a
+//    trailing execve starts as execve session with the batch id if all succeeded):
+//   	- send: sub-commands, fds consumed by copyin in order (rest for execve)
+//   	- reply: "success" / "error", sub-replies with fds combined
+//
+//  - info (report mounts, pids, disk usage of reset paths and uid / gid maps):
+//   	- send:
+//   	- reply: "success", info / "error"
+//
+//  - shutdown (kill all processes and exit container gracefully):
+//   	- send:
+//   	- reply: "success" (container exits with 0 afterwards)
+//
 //  - execve: (execute file inside container):
-//   	- send: argv, env, rLimits, fds
+//   	- send: argv, env, rLimits, cached executable key, workdir, credential, seccomp filter, core limit, disable aslr, fds
 //   	- reply:
-//     		- success: "success", pid
+//     		- success: "success", pid, pty master fd (if tty)
 //     		- failed: "failed"
 //   	- send (success): "init_finished" (as cmd)
-//     	- reply: "finished" / send: "kill" (as cmd)
+//     	- reply: "finished" (setup / wall time, crash info and core if signalled) / send: "kill" (as cmd)
 //     	- send: "kill" (as cmd) / reply: "finished"
 //   	- reply:
+//   	- send (while running): "signal" (as cmd, signal, process group, no reply)
+//   	- reply (while running, if stream output): fd, output data (before result)
+//   	- send (while running, if stream input): "stdin" (as cmd, data, close, no reply)
+//
+// Error reply carries an error code (protocol / not exist / exist / permission / syscall / timeout / file too large / internal), message and errno
+// so that host could check it with errors.Is / errors.As. Panic while handling a command is replied
+// as internal error and the container keeps serving
 //
-// Any socket related error will cause the container exit with all process inside container
+// Any socket related error will cause the container exit with all process inside container.
+// If the socket is closed by host, container init kills all processes, reaps them and exits with 2
 package container
@@ -3,9 +3,11 @@ package container
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/criyle/go-sandbox/pkg/forkexec"
 	"github.com/criyle/go-sandbox/pkg/mount"
@@ -28,6 +30,13 @@ type Builder struct {
 	// Stderr defines whether to dup container stderr to stderr for debug
 	Stderr bool
 
+	// LogFile receives log of container init (passed as fd 4), nil uses stderr
+	// if Stderr is set
+	LogFile *os.File
+
+	// Verbose enables debug log of container init (e.g. trace of commands)
+	Verbose bool
+
 	// ExecFile defines executable that called Init, otherwise defer current
 	// executable (/proc/self/exe)
 	ExecFile string
@@ -37,6 +46,37 @@ type Builder struct {
 
 	// Clone flags defines unshare clone flag to create container
 	CloneFlags uintptr
+
+	// ResetPaths defines directories to be cleaned by reset, empty uses /tmp and /w
+	ResetPaths []string
+
+	// FileRoots restricts paths of file commands (open, delete, stat, rename,
+	// link, symlink, copyout) to be beneath these directories and symlinks are
+	// not followed out of them, empty allows all paths
+	FileRoots []string
+
+	// CopyInMaxSize limits the size of copyin file if not specified by the
+	// command, 0 means no limit
+	CopyInMaxSize int64
+
+	// Codec defines encoding of host / container messages, default uses gob
+	Codec Codec
+
+	// UIDMappings / GIDMappings defines additional id mappings of the container
+	// user namespace (effective with CredGenerator), so that execve could run
+	// as distinct users by ExecveParam.Credential. setgroups is allowed inside
+	// container if GIDMappings is not empty
+	UIDMappings []syscall.SysProcIDMap
+	GIDMappings []syscall.SysProcIDMap
+
+	// NewUIDMap / NewGIDMap are paths of newuidmap / newgidmap helpers used
+	// to write id mappings when the host is unprivileged (rootless)
+	NewUIDMap, NewGIDMap string
+
+	// CmdTimeout limits the time container spent on file commands
+	// (open / delete / stat / rename / link / copyout / reset), 0 means no limit.
+	// The container exits when exceeded, thus the environment should be rebuilt
+	CmdTimeout time.Duration
 }
 
 // CredGenerator generates uid / gid credential used by container
@@ -50,16 +90,41 @@ type Environment interface {
 	Ping() error
 	Open([]OpenCmd) ([]*os.File, error)
 	Delete(p string) error
+	Stat(p string) (*FileStat, error)
+	Rename(oldPath, newPath string) error
+	Link(oldPath, newPath string) error
+	Symlink(target, newPath string) error
+	CopyIn(CopyInCmd) (bool, error)
+	CopyInFiles([]CopyInCmd) error
+	CopyOut([]string) ([]*os.File, error)
+	CopyInTar(dir string, r io.Reader, maxSize int64) error
+	CopyOutTar(paths []string, w io.Writer) error
+	Mount(MountCmd) error
+	CacheExec(key string, src *os.File) error
+	DropExec(key string) error
+	MkWorkDir(cred *syscall.Credential) (string, error)
+	RmWorkDir(p string) error
 	Reset() error
 	Execve(context.Context, ExecveParam) <-chan runner.Result
+	Info() (*Info, error)
+	Shutdown(context.Context) error
 	Destroy() error
 }
 
 // container manages single pre-forked container environment
 type container struct {
-	pid    int        // underlying container init pid
-	socket *socket    // host - container communication
-	mu     sync.Mutex // lock to avoid race condition
+	pid        int           // underlying container init pid
+	socket     *socket       // host - container communication
+	cmdTimeout time.Duration // timeout for file commands
+	sendMu     sync.Mutex    // serialize commands send to container
+	readDone   chan struct{} // closed when reader exits
+	exitOnce   sync.Once     // container process exit
+	exitErr    error         // error of container process exit
+
+	mu     sync.Mutex       // protects fields below
+	nextID uint64           // last request id
+	calls  map[uint64]*call // pending requests by id
+	err    error            // reader error
 }
 
 // Build creates new environment with underlying container
@@ -96,7 +161,7 @@ func (b *Builder) Build() (Environment, error) {
 	}
 	defer devNull.Close()
 
-	files := make([]uintptr, 0, 4)
+	files := make([]uintptr, 0, 5)
 	files = append(files, devNull.Fd(), devNull.Fd())
 	if b.Stderr {
 		files = append(files, os.Stderr.Fd())
@@ -127,10 +192,22 @@ func (b *Builder) Build() (Environment, error) {
 
 	files = append(files, uintptr(outf.Fd()))
 
+	// container init log
+	switch {
+	case b.LogFile != nil:
+		files = append(files, b.LogFile.Fd())
+	case b.Stderr:
+		files = append(files, os.Stderr.Fd())
+	default:
+		files = append(files, devNull.Fd())
+	}
+
 	// prepare container running credential
 	if b.CredGenerator != nil {
 		cred = b.CredGenerator.Get()
 		uidMap, gidMap = getIDMapping(&cred)
+		uidMap = append(uidMap, b.UIDMappings...)
+		gidMap = append(gidMap, b.GIDMappings...)
 	}
 
 	var cloneFlag uintptr
@@ -153,6 +230,10 @@ func (b *Builder) Build() (Environment, error) {
 		PivotRoot:   root,
 		UIDMappings: uidMap,
 		GIDMappings: gidMap,
+		NewUIDMap:   b.NewUIDMap,
+		NewGIDMap:   b.NewGIDMap,
+
+		GIDMappingsEnableSetgroups: len(b.GIDMappings) > 0,
 	}
 	pid, err := r.Start()
 	if err != nil {
@@ -161,13 +242,28 @@ func (b *Builder) Build() (Environment, error) {
 	}
 
 	c := &container{
-		pid:    pid,
-		socket: newSocket(ins),
+		pid:        pid,
+		socket:     newSocket(ins),
+		cmdTimeout: b.CmdTimeout,
+		readDone:   make(chan struct{}),
+		calls:      make(map[uint64]*call),
+	}
+
+	// check container init speaks the same protocol
+	err = c.handshake(b.Codec)
+	go c.readLoop()
+	if err != nil {
+		c.Destroy()
+		return nil, err
 	}
 
 	// set configuration and check if container creation successful
 	if err = c.conf(&containerConfig{
-		Cred: b.CredGenerator != nil,
+		Cred:       b.CredGenerator != nil,
+		ResetPaths: b.ResetPaths,
+		Roots:      b.FileRoots,
+		MaxSize:    b.CopyInMaxSize,
+		Verbose:    b.Verbose,
 	}); err != nil {
 		c.Destroy()
 		return nil, err
@@ -179,22 +275,36 @@ func (b *Builder) Build() (Environment, error) {
 // Destroy kill the container process (with its children)
 // if stderr enabled, collect the output as error
 func (c *container) Destroy() error {
-	// close socket (abort any ongoing command)
-	c.socket.Close()
-
-	// wait commands terminates
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// kill process
-	var wstatus unix.WaitStatus
-	unix.Kill(c.pid, unix.SIGKILL)
-	// wait for container process to exit
-	_, err := unix.Wait4(c.pid, &wstatus, 0, nil)
-	for err == unix.EINTR {
-		_, err = unix.Wait4(c.pid, &wstatus, 0, nil)
-	}
-	return err
+	return c.exit(true)
+}
+
+// exit closes the socket and waits for the container process exits, the
+// container process is killed if kill is true. Only the first call is effective
+// to avoid killing recycled pid
+func (c *container) exit(kill bool) error {
+	c.exitOnce.Do(func() {
+		// close socket (abort any ongoing command)
+		c.socket.Close()
+
+		// wait reader exits (abort pending commands)
+		<-c.readDone
+
+		// kill process
+		var wstatus unix.WaitStatus
+		if kill {
+			unix.Kill(c.pid, unix.SIGKILL)
+		}
+		// wait for container process to exit
+		_, err := unix.Wait4(c.pid, &wstatus, 0, nil)
+		for err == unix.EINTR {
+			_, err = unix.Wait4(c.pid, &wstatus, 0, nil)
+		}
+		if err == nil && !kill && (!wstatus.Exited() || wstatus.ExitStatus() != 0) {
+			err = fmt.Errorf("container exited abnormally %v", wstatus)
+		}
+		c.exitErr = err
+	})
+	return c.exitErr
 }
 
 // exec prepares executable
@@ -0,0 +1,103 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ErrorCode defines the category of the error returned from container
+type ErrorCode int
+
+// Error codes returned from container
+const (
+	ErrorCodeUnknown      ErrorCode = iota // uncategorized error
+	ErrorCodeProtocol                      // missing or malformed command parameter
+	ErrorCodeNotExist                      // file does not exist
+	ErrorCodeExist                         // file already exists
+	ErrorCodePermission                    // permission denied
+	ErrorCodeSyscall                       // other syscall failure (see Errno)
+	ErrorCodeTimeout                       // command timeout exceeded
+	ErrorCodeFileTooLarge                  // copyin file exceeded maximum size
+	ErrorCodeInternal                      // command handler panicked inside container
+)
+
+// ErrProtocol is matched by errors.Is when the container rejected the command parameter
+var ErrProtocol = errors.New("container: protocol error")
+
+// ErrProtocolVersion is returned by Build when the container init speaks
+// a different protocol version
+var ErrProtocolVersion = errors.New("container: protocol version mismatch")
+
+// ErrTimeout is matched by errors.Is when the container command exceeded its timeout.
+// Since the command can not be cancelled, the container exits after the reply
+var ErrTimeout = errors.New("container: command timeout")
+
+// ErrFileTooLarge is matched by errors.Is when the copyin file exceeded its maximum size
+var ErrFileTooLarge = errors.New("container: file too large")
+
+// ErrInternal is matched by errors.Is when the container recovered from a panic
+// while handling the command
+var ErrInternal = errors.New("container: internal error")
+
+// errTimeout is the error returned by runTimeout inside container
+var errTimeout = errors.New("timeout")
+
+// Error is the error returned from container
+type Error struct {
+	Code  ErrorCode     // error category
+	Msg   string        // detailed message
+	Errno syscall.Errno // underlying errno, 0 if not caused by syscall
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// Unwrap returns the underlying errno
+func (e *Error) Unwrap() error {
+	if e.Errno != 0 {
+		return e.Errno
+	}
+	return nil
+}
+
+// Is matches ErrProtocol, ErrTimeout, ErrFileTooLarge, ErrInternal, os.ErrNotExist, os.ErrExist and
+// os.ErrPermission according to the error code
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrProtocol:
+		return e.Code == ErrorCodeProtocol
+	case ErrTimeout:
+		return e.Code == ErrorCodeTimeout
+	case ErrFileTooLarge:
+		return e.Code == ErrorCodeFileTooLarge
+	case ErrInternal:
+		return e.Code == ErrorCodeInternal
+	case os.ErrNotExist:
+		return e.Code == ErrorCodeNotExist
+	case os.ErrExist:
+		return e.Code == ErrorCodeExist
+	case os.ErrPermission:
+		return e.Code == ErrorCodePermission
+	}
+	return false
+}
+
+// errnoToCode categorizes errno
+func errnoToCode(errno syscall.Errno) ErrorCode {
+	switch errno {
+	case 0:
+		return ErrorCodeUnknown
+	case syscall.ENOENT:
+		return ErrorCodeNotExist
+	case syscall.EEXIST, syscall.ENOTEMPTY:
+		return ErrorCodeExist
+	case syscall.EACCES, syscall.EPERM, syscall.EXDEV:
+		return ErrorCodePermission
+	case syscall.EFBIG:
+		return ErrorCodeFileTooLarge
+	default:
+		return ErrorCodeSyscall
+	}
+}
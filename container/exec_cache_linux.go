@@ -0,0 +1,102 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/criyle/go-sandbox/pkg/memfd"
+	"github.com/criyle/go-sandbox/pkg/unixsocket"
+	"golang.org/x/sys/unix"
+)
+
+// execCache holds executables in sealed memfd keyed by host provided key
+// (e.g. hash of content), so that the same binary could be executed many
+// times without passing fd. It is not cleared by reset
+type execCache struct {
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// store copies src into memfd for key, it is noop if key already cached
+func (e *execCache) store(key string, src *os.File) error {
+	e.mu.Lock()
+	_, ok := e.files[key]
+	e.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	f, err := memfd.DupToMemfd(key, src)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.files[key]; ok {
+		f.Close()
+		return nil
+	}
+	if e.files == nil {
+		e.files = make(map[string]*os.File)
+	}
+	e.files[key] = f
+	return nil
+}
+
+// drop removes key from cache
+func (e *execCache) drop(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, ok := e.files[key]
+	if ok {
+		f.Close()
+		delete(e.files, key)
+	}
+	return ok
+}
+
+// dup returns duplicated fd of the cached executable, so that it is still
+// valid even if key dropped before execve
+func (e *execCache) dup(key string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, ok := e.files[key]
+	if !ok {
+		return -1, fmt.Errorf("cached executable %q not found", key)
+	}
+	return unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+}
+
+func (c *containerServer) handleCache(cache *cacheCmd, msg *unixsocket.Msg, timeout time.Duration) error {
+	var fds []int
+	if msg != nil {
+		fds = msg.Fds
+	}
+	if cache == nil || cache.Key == "" {
+		closeFds(fds)
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "cache: no key provided")
+	}
+	if cache.Drop {
+		closeFds(fds)
+		if !c.execCache.drop(cache.Key) {
+			return c.sendErrorCodeReply(ErrorCodeNotExist, "cache: %q not found", cache.Key)
+		}
+		return c.sendReply(&reply{}, nil)
+	}
+	if len(fds) != 1 {
+		closeFds(fds)
+		return c.sendErrorCodeReply(ErrorCodeProtocol, "cache: expect 1 source fd")
+	}
+
+	src := os.NewFile(uintptr(fds[0]), cache.Key)
+	if err := c.runTimeout(timeout, func() error {
+		defer src.Close()
+		return c.execCache.store(cache.Key, src)
+	}); err != nil {
+		return c.sendErrorReply("cache: %v", err)
+	}
+	return c.sendReply(&reply{}, nil)
+}
@@ -1,8 +1,14 @@
 package container
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/criyle/go-sandbox/pkg/unixsocket"
@@ -10,59 +16,75 @@ import (
 
 // Ping send ping message to container
 func (c *container) Ping() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// avoid infinite wait (max 3s)
-	const pingWait = 3 * time.Second
-	c.socket.SetDeadline(time.Now().Add(pingWait))
-	defer c.socket.SetDeadline(time.Time{})
-
 	// send ping
 	cmd := cmd{
 		Cmd: cmdPing,
 	}
-	if err := c.sendCmd(&cmd, nil); err != nil {
+	cl, err := c.request(&cmd, nil)
+	if err != nil {
 		return fmt.Errorf("ping: %v", err)
 	}
+	defer c.endCall(cl)
+
+	// avoid infinite wait (max 3s)
+	const pingWait = 3 * time.Second
+	reply, _, err := cl.recvTimeout(pingWait)
+	if err != nil {
+		return fmt.Errorf("ping: recvAck %v", err)
+	}
 	// receive no error
-	return c.recvAckReply("ping")
+	if reply.Error != nil {
+		return fmt.Errorf("ping: container error %w", reply.Error)
+	}
+	return nil
+}
+
+// handshake exchange protocol version and codec with container (used by builder
+// only), it must be called before the reader starts
+func (c *container) handshake(cc Codec) error {
+	if err := c.socket.SetCodec(cc); err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+	if err := c.socket.SendVersion(protocolVersion, cc); err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+	v, _, err := c.socket.RecvVersion()
+	if err != nil {
+		return fmt.Errorf("handshake: container init may not be compatible: %v", err)
+	}
+	if v != protocolVersion {
+		return fmt.Errorf("handshake: %w (host %d, container %d)", ErrProtocolVersion, protocolVersion, v)
+	}
+	return nil
 }
 
 // conf send configuration to container (used by builder only)
 func (c *container) conf(conf *containerConfig) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	cmd := cmd{
 		Cmd:     cmdConf,
 		ConfCmd: &confCmd{Conf: *conf},
 	}
-	if err := c.sendCmd(&cmd, nil); err != nil {
-		return fmt.Errorf("conf: %v", err)
-	}
-	return c.recvAckReply("conf")
+	return c.requestAck(&cmd, "conf")
 }
 
 // Open open files in container
 func (c *container) Open(p []OpenCmd) ([]*os.File, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	// send copyin
 	cmd := cmd{
 		Cmd:     cmdOpen,
 		OpenCmd: p,
 	}
-	if err := c.sendCmd(&cmd, nil); err != nil {
+	cl, err := c.request(&cmd, nil)
+	if err != nil {
 		return nil, fmt.Errorf("open: %v", err)
 	}
-	reply, msg, err := c.recvReply()
+	defer c.endCall(cl)
+	reply, msg, err := cl.recv()
 	if err != nil {
 		return nil, fmt.Errorf("open: %v", err)
 	}
 	if reply.Error != nil {
-		return nil, fmt.Errorf("open: %v", reply.Error)
+		return nil, fmt.Errorf("open: %w", reply.Error)
 	}
 	if len(msg.Fds) != len(p) {
 		closeFds(msg.Fds)
@@ -81,55 +103,644 @@ func (c *container) Open(p []OpenCmd) ([]*os.File, error) {
 	return ret, nil
 }
 
+// CopyIn copies content of the source file into container, the source
+// file is not closed. It returns true if copy is skipped since the file is
+// unchanged (with the same checksum)
+func (c *container) CopyIn(p CopyInCmd) (bool, error) {
+	cmd := cmd{
+		Cmd: cmdCopyIn,
+		CopyInCmd: &copyInCmd{
+			Path:     p.Path,
+			Perm:     p.Perm,
+			MaxSize:  p.MaxSize,
+			Checksum: p.Checksum,
+		},
+	}
+	cl, err := c.request(&cmd, &unixsocket.Msg{Fds: []int{int(p.Src.Fd())}})
+	if err != nil {
+		return false, fmt.Errorf("copyin: %v", err)
+	}
+	defer c.endCall(cl)
+	reply, _, err := cl.recv()
+	if err != nil {
+		return false, fmt.Errorf("copyin: %v", err)
+	}
+	if reply.Error != nil {
+		return false, fmt.Errorf("copyin: %w", reply.Error)
+	}
+	return reply.CopyInReply != nil && reply.CopyInReply.Unchanged, nil
+}
+
+// CopyInFiles copies files into container concurrently with at most
+// copyInWorkers in flight, it returns the first error after all finished
+func (c *container) CopyInFiles(p []CopyInCmd) error {
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, copyInWorkers)
+	for _, cp := range p {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(cp CopyInCmd) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if _, err := c.CopyIn(cp); err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("%s: %w", cp.Path, err)
+				})
+			}
+		}(cp)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// CopyInTar extracts gzip compressed tar stream from r into directory dir
+// inside container through pipe. The total size of regular files is limited
+// by maxSize (0 uses container default)
+func (c *container) CopyInTar(dir string, r io.Reader, maxSize int64) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("copyin: %v", err)
+	}
+	cmd := cmd{
+		Cmd: cmdCopyIn,
+		CopyInCmd: &copyInCmd{
+			Path:    dir,
+			MaxSize: maxSize,
+			Tar:     true,
+		},
+	}
+	cl, err := c.request(&cmd, &unixsocket.Msg{Fds: []int{int(pr.Fd())}})
+	pr.Close()
+	if err != nil {
+		pw.Close()
+		return fmt.Errorf("copyin: %v", err)
+	}
+	defer c.endCall(cl)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(pw, r)
+		pw.Close()
+	}()
+	err = cl.recvAck("copyin")
+	// unblock the writer if container stopped reading
+	pw.Close()
+	<-done
+	return err
+}
+
+// CopyOutTar writes regular files under paths (relative to work dir) as gzip
+// compressed tar stream into w through pipe
+func (c *container) CopyOutTar(paths []string, w io.Writer) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("copyout: %v", err)
+	}
+	defer pr.Close()
+
+	cmd := cmd{
+		Cmd:        cmdCopyOut,
+		CopyOutCmd: &copyOutCmd{Paths: paths, Tar: true},
+	}
+	cl, err := c.request(&cmd, &unixsocket.Msg{Fds: []int{int(pw.Fd())}})
+	pw.Close()
+	if err != nil {
+		return fmt.Errorf("copyout: %v", err)
+	}
+	defer c.endCall(cl)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, pr)
+		// fail the container writer if w failed
+		pr.Close()
+		done <- err
+	}()
+	err = cl.recvAck("copyout")
+	// container closed its end before reply
+	copyErr := <-done
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return fmt.Errorf("copyout: %v", copyErr)
+	}
+	return nil
+}
+
+// batchMaxFds limits fds sent with single batch (kernel SCM_MAX_FD is 253)
+const batchMaxFds = 253
+
+// copyInBatch copies files in single batch command. Batch is not atomic,
+// files copied before the failed one are kept
+func (c *container) copyInBatch(p []CopyInCmd) error {
+	msg := &unixsocket.Msg{}
+	cm := newCopyInBatch(p, nil, msg)
+	cl, err := c.request(&cm, msg)
+	if err != nil {
+		return err
+	}
+	defer c.endCall(cl)
+	return recvBatch(cl)
+}
+
+// newCopyInBatch creates batch of copyin followed by the last command if not
+// nil, source fds are inserted before the fds in msg
+func newCopyInBatch(copyIn []CopyInCmd, last *cmd, msg *unixsocket.Msg) cmd {
+	batch := make([]cmd, 0, len(copyIn)+1)
+	fds := make([]int, 0, len(copyIn)+len(msg.Fds))
+	for _, p := range copyIn {
+		batch = append(batch, cmd{
+			Cmd: cmdCopyIn,
+			CopyInCmd: &copyInCmd{
+				Path:     p.Path,
+				Perm:     p.Perm,
+				MaxSize:  p.MaxSize,
+				Checksum: p.Checksum,
+			},
+		})
+		fds = append(fds, int(p.Src.Fd()))
+	}
+	if last != nil {
+		batch = append(batch, *last)
+	}
+	msg.Fds = append(fds, msg.Fds...)
+	return cmd{
+		Cmd:      cmdBatch,
+		BatchCmd: batch,
+	}
+}
+
+// recvBatch receives the combined reply of batch, fds are discarded
+func recvBatch(cl *call) error {
+	reply, msg, err := cl.recv()
+	if err != nil {
+		return err
+	}
+	if msg != nil {
+		closeFds(msg.Fds)
+	}
+	if reply.Error != nil {
+		return reply.Error
+	}
+	if reply.BatchReply == nil {
+		return fmt.Errorf("no batch reply received")
+	}
+	return nil
+}
+
 // Delete remove file from container
 func (c *container) Delete(p string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	cmd := cmd{
 		Cmd:       cmdDelete,
 		DeleteCmd: &deleteCmd{Path: p},
 	}
-	if err := c.sendCmd(&cmd, nil); err != nil {
-		return fmt.Errorf("delete: %v", err)
+	return c.requestAck(&cmd, "delete")
+}
+
+// Rename renames (moves) file inside container, the destination is replaced
+// atomically if exists
+func (c *container) Rename(oldPath, newPath string) error {
+	cmd := cmd{
+		Cmd:     cmdRename,
+		LinkCmd: &linkCmd{Old: oldPath, New: newPath},
 	}
-	return c.recvAckReply("delete")
+	return c.requestAck(&cmd, "rename")
 }
 
-// Reset remove all from /tmp and /w
-func (c *container) Reset() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// Link creates hard link newPath to oldPath inside container
+func (c *container) Link(oldPath, newPath string) error {
+	cmd := cmd{
+		Cmd:     cmdLink,
+		LinkCmd: &linkCmd{Old: oldPath, New: newPath},
+	}
+	return c.requestAck(&cmd, "link")
+}
+
+// Symlink creates symbolic link newPath pointing to target inside container
+func (c *container) Symlink(target, newPath string) error {
+	cmd := cmd{
+		Cmd:     cmdSymlink,
+		LinkCmd: &linkCmd{Old: target, New: newPath},
+	}
+	return c.requestAck(&cmd, "symlink")
+}
+
+// Stat returns metadata of file inside container (symbolic link is not followed)
+func (c *container) Stat(p string) (*FileStat, error) {
+	cmd := cmd{
+		Cmd:     cmdStat,
+		StatCmd: &statCmd{Path: p},
+	}
+	cl, err := c.request(&cmd, nil)
+	if err != nil {
+		return nil, fmt.Errorf("stat: %v", err)
+	}
+	defer c.endCall(cl)
+	reply, _, err := cl.recv()
+	if err != nil {
+		return nil, fmt.Errorf("stat: %v", err)
+	}
+	if reply.Error != nil {
+		return nil, fmt.Errorf("stat: %w", reply.Error)
+	}
+	if reply.StatReply == nil {
+		return nil, fmt.Errorf("stat: no reply received")
+	}
+	return reply.StatReply, nil
+}
+
+// CopyOut collects files or directories (recursively) from container work dir.
+// The returned files are opened for read and named by path relative to work dir
+func (c *container) CopyOut(p []string) ([]*os.File, error) {
+	cmd := cmd{
+		Cmd:        cmdCopyOut,
+		CopyOutCmd: &copyOutCmd{Paths: p},
+	}
+	cl, err := c.request(&cmd, nil)
+	if err != nil {
+		return nil, fmt.Errorf("copyout: %v", err)
+	}
+	defer c.endCall(cl)
+
+	var ret []*os.File
+	for {
+		reply, msg, err := cl.recv()
+		if err != nil {
+			closeFiles(ret)
+			return nil, fmt.Errorf("copyout: %v", err)
+		}
+		if reply.Error != nil {
+			closeFiles(ret)
+			return nil, fmt.Errorf("copyout: %w", reply.Error)
+		}
+		if reply.CopyOutReply == nil || len(msg.Fds) != len(reply.CopyOutReply.Names) {
+			closeFds(msg.Fds)
+			closeFiles(ret)
+			return nil, fmt.Errorf("copyout: unexpected number of fd %v", len(msg.Fds))
+		}
+		for i, fd := range msg.Fds {
+			ret = append(ret, os.NewFile(uintptr(fd), reply.CopyOutReply.Names[i]))
+		}
+		if !reply.CopyOutReply.More {
+			return ret, nil
+		}
+	}
+}
+
+// Mount bind mounts a file or directory (recursively) on the host into the
+// running container, the mount point is created if not exists
+func (c *container) Mount(p MountCmd) error {
+	fd, err := openTree(p.Source)
+	if err != nil {
+		return fmt.Errorf("mount: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	cmd := cmd{
+		Cmd: cmdMount,
+		MountCmd: &mountCmd{
+			Target:   p.Target,
+			Readonly: p.Readonly,
+		},
+	}
+	cl, err := c.request(&cmd, &unixsocket.Msg{Fds: []int{fd}})
+	if err != nil {
+		return fmt.Errorf("mount: %v", err)
+	}
+	defer c.endCall(cl)
+	return cl.recvAck("mount")
+}
+
+// CacheExec stores content of src as executable inside container keyed by
+// key (e.g. hash of content), which could be executed by ExecveParam.CachedExec.
+// It is noop if key already cached, the source file is not closed
+func (c *container) CacheExec(key string, src *os.File) error {
+	cmd := cmd{
+		Cmd:      cmdCache,
+		CacheCmd: &cacheCmd{Key: key},
+	}
+	cl, err := c.request(&cmd, &unixsocket.Msg{Fds: []int{int(src.Fd())}})
+	if err != nil {
+		return fmt.Errorf("cache: %v", err)
+	}
+	defer c.endCall(cl)
+	return cl.recvAck("cache")
+}
+
+// DropExec removes the cached executable inside container
+func (c *container) DropExec(key string) error {
+	cmd := cmd{
+		Cmd:      cmdCache,
+		CacheCmd: &cacheCmd{Key: key, Drop: true},
+	}
+	return c.requestAck(&cmd, "cache")
+}
 
+// MkWorkDir creates unique per-run directory under work dir owned by cred
+// (nil uses container default), and returns its path inside container
+func (c *container) MkWorkDir(cred *syscall.Credential) (string, error) {
+	wd := &workDirCmd{}
+	if cred != nil {
+		wd.Cred = &execCred{UID: cred.Uid, GID: cred.Gid}
+	}
+	cmd := cmd{
+		Cmd:        cmdMkWorkDir,
+		WorkDirCmd: wd,
+	}
+	cl, err := c.request(&cmd, nil)
+	if err != nil {
+		return "", fmt.Errorf("mkworkdir: %v", err)
+	}
+	defer c.endCall(cl)
+
+	reply, _, err := cl.recv()
+	if err != nil {
+		return "", fmt.Errorf("mkworkdir: %v", err)
+	}
+	if reply.Error != nil {
+		return "", fmt.Errorf("mkworkdir: %w", reply.Error)
+	}
+	if reply.WorkDirReply == nil {
+		return "", fmt.Errorf("mkworkdir: no reply received")
+	}
+	return reply.WorkDirReply.Path, nil
+}
+
+// RmWorkDir removes the per-run directory created by MkWorkDir recursively
+func (c *container) RmWorkDir(p string) error {
+	cmd := cmd{
+		Cmd:        cmdRmWorkDir,
+		WorkDirCmd: &workDirCmd{Path: p},
+	}
+	return c.requestAck(&cmd, "rmworkdir")
+}
+
+// Reset remove all from reset paths (default /tmp and /w)
+func (c *container) Reset() error {
 	cmd := cmd{
 		Cmd: cmdReset,
 	}
-	if err := c.sendCmd(&cmd, nil); err != nil {
-		return fmt.Errorf("reset: %v", err)
+	return c.requestAck(&cmd, "reset")
+}
+
+// Info returns runtime information of the container. Mount table and id maps
+// are read from host /proc if the container does not mount proc
+func (c *container) Info() (*Info, error) {
+	cmd := cmd{
+		Cmd: cmdInfo,
+	}
+	cl, err := c.request(&cmd, nil)
+	if err != nil {
+		return nil, fmt.Errorf("info: %v", err)
+	}
+	defer c.endCall(cl)
+
+	reply, _, err := cl.recv()
+	if err != nil {
+		return nil, fmt.Errorf("info: %v", err)
 	}
-	return c.recvAckReply("reset")
+	if reply.Error != nil {
+		return nil, fmt.Errorf("info: %w", reply.Error)
+	}
+	if reply.InfoReply == nil {
+		return nil, fmt.Errorf("info: no reply received")
+	}
+
+	info := reply.InfoReply
+	procPath := "/proc/" + strconv.Itoa(c.pid)
+	if len(info.Mounts) == 0 {
+		info.Mounts, _ = readLines(procPath + "/mountinfo")
+	}
+	if info.UIDMap == "" {
+		b, _ := ioutil.ReadFile(procPath + "/uid_map")
+		info.UIDMap = string(b)
+	}
+	if info.GIDMap == "" {
+		b, _ := ioutil.ReadFile(procPath + "/gid_map")
+		info.GIDMap = string(b)
+	}
+	return info, nil
 }
 
-func (c *container) recvAckReply(name string) error {
-	reply, _, err := c.recvReply()
+// Shutdown asks container init to kill all processes inside and exit
+// gracefully. It falls back to Destroy if context is done before the reply
+func (c *container) Shutdown(ctx context.Context) error {
+	cmd := cmd{
+		Cmd: cmdShutdown,
+	}
+	cl, err := c.request(&cmd, nil)
 	if err != nil {
-		return fmt.Errorf("%v: recvAck %v", name, err)
+		c.Destroy()
+		return fmt.Errorf("shutdown: %v", err)
+	}
+	defer c.endCall(cl)
+
+	reply, _, err := cl.recvContext(ctx)
+	if err != nil {
+		c.Destroy()
+		return fmt.Errorf("shutdown: %v", err)
 	}
 	if reply.Error != nil {
-		return fmt.Errorf("%v: container error %v", name, reply.Error)
+		c.Destroy()
+		return fmt.Errorf("shutdown: container error %w", reply.Error)
+	}
+	if err := c.exit(false); err != nil {
+		return fmt.Errorf("shutdown: %v", err)
 	}
 	return nil
 }
 
-func (c *container) recvReply() (*reply, *unixsocket.Msg, error) {
-	reply := new(reply)
-	msg, err := c.socket.RecvMsg(reply)
+// requestAck sends cmd and waits for reply without error
+func (c *container) requestAck(cmd *cmd, name string) error {
+	cl, err := c.request(cmd, nil)
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	defer c.endCall(cl)
+	return cl.recvAck(name)
+}
+
+// call is a request waiting for replies with the same id. Replies are queued
+// without bound so that a slow consumer never blocks the reader
+type call struct {
+	id    uint64
+	ready chan struct{} // signaled when a reply queued or the reader exits
+
+	mu     sync.Mutex
+	queue  []callReply
+	closed bool  // the reader exited
+	err    error // reader error, valid after closed
+}
+
+type callReply struct {
+	reply *reply
+	msg   *unixsocket.Msg
+}
+
+func newCall(id uint64) *call {
+	return &call{
+		id:    id,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push queues the reply, it never blocks
+func (cl *call) push(r callReply) {
+	cl.mu.Lock()
+	cl.queue = append(cl.queue, r)
+	cl.mu.Unlock()
+	cl.signal()
+}
+
+// abort wakes up the receiver with the reader error
+func (cl *call) abort(err error) {
+	cl.mu.Lock()
+	cl.closed, cl.err = true, err
+	cl.mu.Unlock()
+	cl.signal()
+}
+
+// discard closes fds of the replies not received
+func (cl *call) discard() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for _, r := range cl.queue {
+		closeFds(r.msg.Fds)
+	}
+	cl.queue = nil
+}
+
+func (cl *call) signal() {
+	select {
+	case cl.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (cl *call) recv() (*reply, *unixsocket.Msg, error) {
+	return cl.recvContext(context.Background())
+}
+
+func (cl *call) recvTimeout(d time.Duration) (*reply, *unixsocket.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	r, msg, err := cl.recvContext(ctx)
+	if err == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %v", d)
+	}
+	return r, msg, err
+}
+
+func (cl *call) recvContext(ctx context.Context) (*reply, *unixsocket.Msg, error) {
+	for {
+		cl.mu.Lock()
+		if len(cl.queue) > 0 {
+			r := cl.queue[0]
+			cl.queue[0] = callReply{}
+			cl.queue = cl.queue[1:]
+			cl.mu.Unlock()
+			return r.reply, r.msg, nil
+		}
+		if cl.closed {
+			cl.mu.Unlock()
+			return nil, nil, cl.err
+		}
+		cl.mu.Unlock()
+
+		select {
+		case <-cl.ready:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (cl *call) recvAck(name string) error {
+	reply, _, err := cl.recv()
 	if err != nil {
-		return nil, nil, err
+		return fmt.Errorf("%v: recvAck %v", name, err)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("%v: container error %w", name, reply.Error)
+	}
+	return nil
+}
+
+// request registers a new call and sends the cmd with its id
+func (c *container) request(cmd *cmd, msg *unixsocket.Msg) (*call, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	cl := newCall(c.nextID)
+	c.calls[cl.id] = cl
+	c.mu.Unlock()
+
+	if err := c.sendCall(cl, cmd, msg); err != nil {
+		c.endCall(cl)
+		return nil, err
 	}
-	return reply, msg, nil
+	return cl, nil
+}
+
+// endCall unregisters the call, replies received afterwards are discarded
+func (c *container) endCall(cl *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.calls, cl.id)
+	cl.discard()
 }
 
-func (c *container) sendCmd(cmd *cmd, msg *unixsocket.Msg) error {
+// sendCall sends cmd as part of the call
+func (c *container) sendCall(cl *call, cmd *cmd, msg *unixsocket.Msg) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	cmd.ID = cl.id
+	if cmd.Timeout == 0 {
+		cmd.Timeout = c.cmdTimeout
+	}
 	return c.socket.SendMsg(cmd, msg)
 }
+
+// readLoop receives replies and dispatches them to calls by id
+func (c *container) readLoop() {
+	defer close(c.readDone)
+
+	var err error
+	for {
+		reply := new(reply)
+		var msg *unixsocket.Msg
+		if msg, err = c.socket.RecvMsg(reply); err != nil {
+			break
+		}
+
+		// queued under the lock so that the call could not end in between
+		c.mu.Lock()
+		if cl, ok := c.calls[reply.ID]; ok {
+			cl.push(callReply{reply: reply, msg: msg})
+		} else {
+			closeFds(msg.Fds)
+		}
+		c.mu.Unlock()
+	}
+
+	// abort all pending calls
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	for _, cl := range c.calls {
+		cl.abort(err)
+	}
+}
@@ -3,9 +3,14 @@ package container
 import (
 	"context"
 	"fmt"
-	"time"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
 
 	"github.com/criyle/go-sandbox/pkg/rlimit"
+	"github.com/criyle/go-sandbox/pkg/seccomp"
 	"github.com/criyle/go-sandbox/pkg/unixsocket"
 	"github.com/criyle/go-sandbox/runner"
 )
@@ -21,22 +26,102 @@ type ExecveParam struct {
 	// Files specifies file descriptors for the child process
 	Files []uintptr
 
+	// CopyIn specifies files copied into container before the process runs,
+	// they are sent with the execve in single batch command (leading ones are
+	// sent in batches of their own if the fds exceed the limit of single
+	// message). The process is not started if any of the copy failed. The
+	// copy is not atomic, files copied before the failed one are kept
+	CopyIn []CopyInCmd
+
 	// ExecFile specifies file descriptor for executable file using fexecve
 	ExecFile uintptr
 
+	// CachedExec executes the executable cached by CacheExec with the key
+	// using fexecve (ignored if ExecFile is set)
+	CachedExec string
+
 	// RLimits specifies POSIX Resource limit through setrlimit
 	RLimits []rlimit.RLimit
 
+	// WorkDir specifies the working directory of the process inside container,
+	// relative path is resolved against container work dir, empty uses /w
+	WorkDir string
+
 	// SyncFunc calls with pid just before execve (for attach the process to cgroups)
 	SyncFunc func(pid int) error
+
+	// Signals receives signals to deliver to the running process (e.g. SIGTERM
+	// for graceful termination, SIGSTOP / SIGCONT for pause / resume),
+	// signals are discarded if the process is not running
+	Signals <-chan SignalCmd
+
+	// OutputFunc receives stdout (fd 1) / stderr (fd 2) of the process while
+	// it is running. If set, Files[1] and Files[2] are replaced by pipes
+	// inside container and missing stdin is replaced by an empty one
+	OutputFunc func(fd int, b []byte)
+
+	// Stdin is written to the stdin of the process while it is running, stdin
+	// is closed when it reaches EOF. If set, Files[0] is replaced by pipe
+	// inside container
+	Stdin io.Reader
+
+	// Credential specifies uid / gid / groups inside container to run the
+	// process, the ids must be mapped by Builder.UIDMappings / GIDMappings.
+	// Empty groups keeps supplementary groups unchanged
+	Credential *syscall.Credential
+
+	// AmbientCaps raises the capabilities (bit mask of 1 << CAP_*, e.g.
+	// 1 << unix.CAP_NET_BIND_SERVICE) as ambient before execve, so that
+	// a helper running with Credential could use them (e.g. bind a low port
+	// in the container network namespace) without running as root. Other
+	// capabilities are dropped from bounding set
+	AmbientCaps uint64
+
+	// Seccomp defines the seccomp filter attach to the process (should be
+	// whitelist only and allows execve), empty means no filter. It is sent
+	// with the command (8 bytes per instruction) which is limited to 16k
+	// together with Args and Env
+	Seccomp seccomp.Filter
+
+	// OOMKilled reports whether the process was killed by OOM killer (e.g.
+	// oom_kill counter of its memory cgroup increased). It is called after
+	// the process killed by SIGKILL, which is reported as memory limit
+	// exceeded instead of time limit exceeded if it returns true
+	OOMKilled func() bool
+
+	// ForkLimitHit reports whether the process failed to fork / clone by the
+	// process limit (e.g. max counter of pids.events of its pids cgroup
+	// increased). It is called after the process exited abnormally (not OOM
+	// killed), which is reported as fork limit exceeded if it returns true
+	ForkLimitHit func() bool
+
+	// OOMScoreAdj is written to oom_score_adj of the process before it runs
+	// (-1000 to 1000), so that the process rather than the container init is
+	// preferred to be killed by OOM killer. 0 keeps the inherited value
+	OOMScoreAdj int
+
+	// CoreLimit enables core dump of the process with RLIMIT_CORE in bytes,
+	// leading bytes and path of the core file in work dir are reported in
+	// Result.Crash (requires kernel.core_pattern to be "core")
+	CoreLimit int64
+
+	// DisableASLR disables address space layout randomization of the process
+	// by personality(ADDR_NO_RANDOMIZE), e.g. to reproduce crashes
+	DisableASLR bool
+
+	// TTYFunc receives the master side of the pseudo terminal attached to
+	// stdin / stdout / stderr of the process before it runs, the callee owns
+	// the file. If set, Files[0:3] are replaced, and a devpts is required to be
+	// mounted at /dev/pts (e.g. mount.Builder.WithDevpts)
+	TTYFunc func(master *os.File)
 }
 
 // Execve runs process inside container. It accepts context cancelation as time limit exceeded.
+// Multiple Execve could run concurrently inside the same container. SetUpTime
+// of the result is the wall time from fork to execve (including sync) and
+// RunningTime is from execve to exit, both measured inside the container, so
+// that the sum is the wall time from fork to exit
 func (c *container) Execve(ctx context.Context, param ExecveParam) <-chan runner.Result {
-	c.mu.Lock()
-
-	sTime := time.Now()
-
 	// make sure goroutine not leaked (blocked) even if result is not consumed
 	result := make(chan runner.Result, 1)
 
@@ -62,56 +147,118 @@ func (c *container) Execve(ctx context.Context, param ExecveParam) <-chan runner
 		Env:     param.Env,
 		RLimits: param.RLimits,
 		FdExec:  param.ExecFile > 0,
+		Cached:  param.CachedExec,
+		WorkDir: param.WorkDir,
+
+		StreamOutput: param.OutputFunc != nil,
+		StreamInput:  param.Stdin != nil,
+		TTY:          param.TTYFunc != nil,
+
+		Seccomp:   param.Seccomp,
+		CoreLimit: param.CoreLimit,
+
+		DisableASLR: param.DisableASLR,
+		AmbientCaps: param.AmbientCaps,
+	}
+	if c := param.Credential; c != nil {
+		execCmd.Cred = &execCred{
+			UID:    c.Uid,
+			GID:    c.Gid,
+			Groups: c.Groups,
+		}
 	}
 	cm := cmd{
 		Cmd:     cmdExecve,
 		ExecCmd: execCmd,
 	}
-	if err := c.sendCmd(&cm, msg); err != nil {
-		c.mu.Unlock()
+	copyIn := param.CopyIn
+	for len(copyIn) > 0 && len(copyIn)+len(msg.Fds) > batchMaxFds {
+		n := batchMaxFds
+		if n > len(copyIn) {
+			n = len(copyIn)
+		}
+		if err := c.copyInBatch(copyIn[:n]); err != nil {
+			return errResult("execve: copyin %v", err)
+		}
+		copyIn = copyIn[n:]
+	}
+	if len(msg.Fds) > batchMaxFds {
+		return errResult("execve: too many fds (%d > %d)", len(msg.Fds), batchMaxFds)
+	}
+	if len(copyIn) > 0 {
+		cm = newCopyInBatch(copyIn, &cm, msg)
+	}
+	cl, err := c.request(&cm, msg)
+	if err != nil {
 		return errResult("execve: sendCmd %v", err)
 	}
+	// combined reply of copyin
+	if len(copyIn) > 0 {
+		if err := recvBatch(cl); err != nil {
+			c.endCall(cl)
+			return errResult("execve: copyin %v", err)
+		}
+	}
 	// sync function
-	reply, msg, err := c.recvReply()
+	reply, msg, err := cl.recv()
 	if err != nil {
-		c.mu.Unlock()
+		c.endCall(cl)
 		return errResult("execve: recvReply %v", err)
 	}
 	// if sync function did not involved
 	if reply.Error != nil || msg == nil || msg.Cred == nil {
+		if msg != nil {
+			closeFds(msg.Fds)
+		}
 		// tell kill function to exit and sync
-		c.execveSyncKill()
-		c.mu.Unlock()
+		c.execveSyncKill(cl)
+		c.endCall(cl)
 		return errResult("execve: no pid received or error %v", reply.Error)
 	}
-	if param.SyncFunc != nil {
-		if err := param.SyncFunc(int(msg.Cred.Pid)); err != nil {
-			// tell sync function to exit and recv error
-			c.execveSyncKill()
-			// tell kill function to exit and sync
-			c.execveSyncKill()
-			c.mu.Unlock()
-			return errResult("execve: syncfunc failed %v", err)
+	// pseudo terminal master
+	var tty *os.File
+	if param.TTYFunc != nil && len(msg.Fds) == 1 {
+		tty = os.NewFile(uintptr(msg.Fds[0]), "ptmx")
+	} else {
+		closeFds(msg.Fds)
+	}
+	if err := execveSync(int(msg.Cred.Pid), &param); err != nil {
+		if tty != nil {
+			tty.Close()
 		}
+		// tell sync function to exit and recv error
+		c.execveSyncKill(cl)
+		// tell kill function to exit and sync
+		c.execveSyncKill(cl)
+		c.endCall(cl)
+		return errResult("execve: %v", err)
+	}
+	if tty != nil {
+		param.TTYFunc(tty)
 	}
 	// send to syncFunc ack ok
-	if err := c.sendCmd(&cmd{Cmd: cmdOk}, nil); err != nil {
-		c.mu.Unlock()
+	if err := c.sendCall(cl, &cmd{Cmd: cmdOk}, nil); err != nil {
+		c.endCall(cl)
 		return errResult("execve: ack failed %v", err)
 	}
 
-	mTime := time.Now()
-
 	waitDone := make(chan struct{})
 
 	// Wait
 	go func() {
-		reply2, _, err := c.recvReply()
+		reply2, _, err := cl.recv()
+		// streamed output before result
+		for err == nil && reply2.OutputReply != nil {
+			if param.OutputFunc != nil {
+				param.OutputFunc(reply2.OutputReply.Fd, reply2.OutputReply.Data)
+			}
+			reply2, _, err = cl.recv()
+		}
 		close(waitDone)
 		// done signal (should recv after kill)
-		c.recvReply()
-		// unlock after last read / write
-		c.mu.Unlock()
+		cl.recv()
+		// end call after last read
+		c.endCall(cl)
 
 		// handle potential error
 		if err != nil {
@@ -135,31 +282,109 @@ func (c *container) Execve(ctx context.Context, param ExecveParam) <-chan runner
 			}
 			return
 		}
+		// SIGKILL is treated as TLE inside container
+		status := reply2.ExecReply.Status
+		if status == runner.StatusTimeLimitExceeded && reply2.ExecReply.ExitStatus == int(syscall.SIGKILL) &&
+			param.OOMKilled != nil && param.OOMKilled() {
+			status = runner.StatusMemoryLimitExceeded
+		}
+		switch status {
+		case runner.StatusTimeLimitExceeded, runner.StatusSignalled, runner.StatusNonzeroExitStatus:
+			if param.ForkLimitHit != nil && param.ForkLimitHit() {
+				status = runner.StatusForkLimitExceeded
+			}
+		}
 		// emit result after all communication finish
 		result <- runner.Result{
-			Status:      reply2.ExecReply.Status,
+			Status:      status,
 			ExitStatus:  reply2.ExecReply.ExitStatus,
 			Time:        reply2.ExecReply.Time,
 			Memory:      reply2.ExecReply.Memory,
-			SetUpTime:   mTime.Sub(sTime),
-			RunningTime: time.Since(mTime),
+			Rusage:      &reply2.ExecReply.Rusage,
+			Crash:       reply2.ExecReply.Crash,
+			SetUpTime:   reply2.ExecReply.SetUpTime,
+			RunningTime: reply2.ExecReply.WallTime - reply2.ExecReply.SetUpTime,
 		}
 	}()
 
+	// Signal
+	if param.Signals != nil {
+		go func() {
+			for {
+				select {
+				case sig, ok := <-param.Signals:
+					if !ok {
+						return
+					}
+					c.sendCall(cl, &cmd{Cmd: cmdSignal, SignalCmd: &sig}, nil)
+				case <-waitDone:
+					return
+				}
+			}
+		}()
+	}
+
+	// Stdin
+	if param.Stdin != nil {
+		go c.sendStdin(cl, param.Stdin, waitDone)
+	}
+
 	// Kill (if wait is done, a kill message need to be send to collect zombies)
 	go func() {
 		select {
 		case <-ctx.Done():
 		case <-waitDone:
 		}
-		c.sendCmd(&cmd{Cmd: cmdKill}, nil)
+		c.sendCall(cl, &cmd{Cmd: cmdKill}, nil)
 	}()
 
 	return result
 }
 
+// sendStdin reads from r and sends to container until EOF or the process exits
+func (c *container) sendStdin(cl *call, r io.Reader, waitDone <-chan struct{}) {
+	buf := make([]byte, outputChunkSize)
+	for {
+		n, err := r.Read(buf)
+		select {
+		case <-waitDone:
+			return
+		default:
+		}
+		if n > 0 || err != nil {
+			stdin := &stdinCmd{
+				Data:  buf[:n],
+				Close: err != nil,
+			}
+			if c.sendCall(cl, &cmd{Cmd: cmdStdin, StdinCmd: stdin}, nil) != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 // execveSyncKill will send kill and recv reply
-func (c *container) execveSyncKill() {
-	c.sendCmd(&cmd{Cmd: cmdKill}, nil)
-	c.recvReply()
+func (c *container) execveSyncKill(cl *call) {
+	c.sendCall(cl, &cmd{Cmd: cmdKill}, nil)
+	cl.recv()
+}
+
+// execveSync sets oom_score_adj and calls SyncFunc for the process stopped
+// before execve
+func execveSync(pid int, param *ExecveParam) error {
+	if param.OOMScoreAdj != 0 {
+		p := "/proc/" + strconv.Itoa(pid) + "/oom_score_adj"
+		if err := ioutil.WriteFile(p, []byte(strconv.Itoa(param.OOMScoreAdj)), 0); err != nil {
+			return fmt.Errorf("oom_score_adj: %v", err)
+		}
+	}
+	if param.SyncFunc != nil {
+		if err := param.SyncFunc(pid); err != nil {
+			return fmt.Errorf("syncfunc failed %v", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,79 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// logFd is the fd of container init log passed by host
+const logFd = 4
+
+// logLevel defines severity of container init log
+type logLevel int
+
+const (
+	logLevelError logLevel = iota
+	logLevelInfo
+	logLevelDebug
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case logLevelError:
+		return "error"
+	case logLevelInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+// logger writes leveled log lines of container init, debug logs are written
+// only if verbose is set by host
+type logger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	verbose bool
+}
+
+// newInitLogger writes to log fd if host passed it, otherwise stderr
+func newInitLogger() *logger {
+	if _, err := unix.FcntlInt(logFd, unix.F_GETFD, 0); err == nil {
+		return &logger{w: os.NewFile(logFd, "log")}
+	}
+	return &logger{w: os.Stderr}
+}
+
+func (l *logger) setVerbose(v bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.verbose = v
+}
+
+func (l *logger) logf(level logLevel, ft string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level == logLevelDebug && !l.verbose {
+		return
+	}
+	fmt.Fprintf(l.w, "%s container_init [%v] %s\n",
+		time.Now().Format("15:04:05.000000"), level, fmt.Sprintf(ft, v...))
+}
+
+func (l *logger) errorf(ft string, v ...interface{}) {
+	l.logf(logLevelError, ft, v...)
+}
+
+func (l *logger) infof(ft string, v ...interface{}) {
+	l.logf(logLevelInfo, ft, v...)
+}
+
+func (l *logger) debugf(ft string, v ...interface{}) {
+	l.logf(logLevelDebug, ft, v...)
+}
@@ -6,17 +6,33 @@ import (
 	"time"
 
 	"github.com/criyle/go-sandbox/pkg/rlimit"
+	"github.com/criyle/go-sandbox/pkg/seccomp"
 	"github.com/criyle/go-sandbox/runner"
 )
 
 // cmd is the control message send into container
 type cmd struct {
+	ID  uint64 // request id, replies carry the same id
 	Cmd string // type of the cmd
 
-	OpenCmd   []OpenCmd  // open argument
-	DeleteCmd *deleteCmd // delete argument
-	ExecCmd   *execCmd   // execve argument
-	ConfCmd   *confCmd   // to set configuration
+	// Timeout limits the time spent on file operations inside container
+	// (open / delete / stat / rename / link / copyin / copyout / reset), 0 means no limit
+	Timeout time.Duration
+
+	OpenCmd    []OpenCmd   // open argument
+	DeleteCmd  *deleteCmd  // delete argument
+	StatCmd    *statCmd    // stat argument
+	LinkCmd    *linkCmd    // rename / link / symlink argument
+	CopyOutCmd *copyOutCmd // copyout argument
+	CopyInCmd  *copyInCmd  // copyin argument (source fd in msg)
+	MountCmd   *mountCmd   // mount argument (detached mount tree fd in msg)
+	CacheCmd   *cacheCmd   // executable cache argument (source fd in msg)
+	WorkDirCmd *workDirCmd // mkworkdir / rmworkdir argument
+	ExecCmd    *execCmd    // execve argument
+	SignalCmd  *SignalCmd  // signal argument (for execve session)
+	StdinCmd   *stdinCmd   // stdin data (for execve session)
+	ConfCmd    *confCmd    // to set configuration
+	BatchCmd   []cmd       // sub-commands of batch (fds in msg consumed in order)
 }
 
 // OpenCmd correspond to a single open syscall
@@ -31,12 +47,127 @@ type deleteCmd struct {
 	Path string
 }
 
+// statCmd stores stat parameter
+type statCmd struct {
+	Path string
+}
+
+// linkCmd stores rename / link / symlink parameter (Old is the link target
+// for symlink)
+type linkCmd struct {
+	Old string
+	New string
+}
+
+// FileStat stores metadata of a file inside container
+type FileStat struct {
+	Name    string      // base name of the file
+	Size    int64       // length in bytes for regular files
+	Mode    os.FileMode // file mode bits, including file type
+	ModTime time.Time   // modification time
+}
+
+// CopyInCmd copies content of Src into Path inside container
+type CopyInCmd struct {
+	Src     *os.File
+	Path    string
+	Perm    os.FileMode
+	MaxSize int64 // maximum size in bytes, 0 uses container default
+
+	// Checksum identifies the content of Src (e.g. sha256), copy is skipped if
+	// the file was copied in with the same checksum and not modified since.
+	// It is not verified against the content
+	Checksum []byte
+}
+
+// copyInCmd stores copyin parameter
+type copyInCmd struct {
+	Path     string
+	Perm     os.FileMode
+	MaxSize  int64
+	Checksum []byte
+	Tar      bool // source is gzip compressed tar extracted into Path
+}
+
+// copyInReply stores copyin result
+type copyInReply struct {
+	Unchanged bool // copy skipped since checksum matched
+}
+
+// MountCmd bind mounts Source on the host to Target inside container
+type MountCmd struct {
+	Source   string
+	Target   string
+	Readonly bool
+}
+
+// mountCmd stores mount parameter
+type mountCmd struct {
+	Target   string
+	Readonly bool
+}
+
+// cacheCmd stores executable cache parameter
+type cacheCmd struct {
+	Key  string
+	Drop bool // remove the cached executable instead
+}
+
+// workDirCmd stores mkworkdir (owner) / rmworkdir (path) parameter
+type workDirCmd struct {
+	Path string
+	Cred *execCred // owner of the directory (nil uses container default)
+}
+
+// workDirReply stores the directory created by mkworkdir
+type workDirReply struct {
+	Path string
+}
+
+// copyOutCmd stores copyout parameter
+type copyOutCmd struct {
+	Paths []string // files or directories (relative to work dir) to collect
+	Tar   bool     // write gzip compressed tar to the fd in msg instead
+}
+
+// SignalCmd sends signal to the running process of an execve
+type SignalCmd struct {
+	Signal syscall.Signal
+	Group  bool // send to the process group of the process
+}
+
+// stdinCmd stores data written to stdin of the running process
+type stdinCmd struct {
+	Data  []byte
+	Close bool // close stdin after data written
+}
+
 // execCmd stores execve parameter
 type execCmd struct {
 	Argv    []string        // execve argv
 	Env     []string        // execve env
 	RLimits []rlimit.RLimit // execve posix rlimit
 	FdExec  bool            // if use fexecve (fd[0] as exec)
+	Cached  string          // fexecve cached executable with the key if not empty
+	WorkDir string          // working directory (empty uses container work dir)
+
+	StreamOutput bool // stream stdout / stderr as output replies
+	StreamInput  bool // stdin is written by stdin commands
+	TTY          bool // attach pseudo terminal to stdin / stdout / stderr
+
+	Cred    *execCred      // credential of the process (nil uses container default)
+	Seccomp seccomp.Filter // seccomp filter of the process (empty means no filter)
+
+	CoreLimit   int64  // RLIMIT_CORE of the process, core file is collected if positive
+	DisableASLR bool   // personality(ADDR_NO_RANDOMIZE) for the process
+	AmbientCaps uint64 // capabilities raised as ambient (bit mask of 1 << CAP_*)
+}
+
+// execCred stores uid / gid inside container to run the process
+type execCred struct {
+	UID    uint32
+	GID    uint32
+	Groups []uint32
 }
 
 // confCmd stores conf parameter
@@ -46,19 +177,63 @@ type confCmd struct {
 
 // ContainerConfig set the container config
 type containerConfig struct {
-	Cred bool
+	Cred       bool
+	ResetPaths []string
+	Roots      []string
+	MaxSize    int64 // maximum size of copyin file, 0 means no limit
+	Verbose    bool  // write debug log
 }
 
 // reply is the reply message send back to controller
 type reply struct {
-	Error     *errorReply // nil if no error
-	ExecReply *execReply
+	ID           uint64 // request id of the cmd
+	Error        *Error // nil if no error
+	ExecReply    *execReply
+	CopyInReply  *copyInReply
+	CopyOutReply *copyOutReply
+	StatReply    *FileStat
+	OutputReply  *outputReply
+	InfoReply    *Info
+	BatchReply   *batchReply
+	WorkDirReply *workDirReply
+}
+
+// batchReply stores replies of the sub-commands of batch in order, fds of all
+// sub-replies are sent in single message
+type batchReply struct {
+	Replies []reply
+	Fds     []int // number of fds for each reply
+}
+
+// Info stores runtime information of the container for debugging and
+// deciding when to recycle the container
+type Info struct {
+	Mounts []string    // mount table (lines of mountinfo)
+	PIDs   []int       // live processes (pid inside container)
+	Disk   []DiskUsage // disk usage of reset paths
+	UIDMap string      // uid_map of the container user namespace
+	GIDMap string      // gid_map of the container user namespace
 }
 
-// errorReply stores error returned back from container
-type errorReply struct {
-	Msg   string
-	Errno *syscall.Errno
+// DiskUsage stores file system usage of a path inside container
+type DiskUsage struct {
+	Path      string
+	Size      uint64 // total size in bytes
+	Free      uint64 // free size in bytes
+	Files     uint64 // total inodes
+	FreeFiles uint64 // free inodes
+}
+
+// outputReply stores a chunk of streamed output of running execve
+type outputReply struct {
+	Fd   int // 1 for stdout, 2 for stderr
+	Data []byte
+}
+
+// copyOutReply stores names of collected files, fds are sent along with the message
+type copyOutReply struct {
+	Names []string
+	More  bool // more replies follow
 }
 
 // execReply stores execve result
@@ -67,8 +242,10 @@ type execReply struct {
 	Status     runner.Status // return status
 	Time       time.Duration // waitpid user CPU (ns)
 	Memory     runner.Size   // waitpid user memory (byte)
-}
+	Rusage     runner.Rusage // waitpid resource usage
+
+	SetUpTime time.Duration // wall time from fork to execve (including sync)
+	WallTime  time.Duration // wall time from fork to exit
 
-func (e *errorReply) Error() string {
-	return e.Msg
+	Crash *runner.CrashInfo // crash information if signalled
 }
@@ -0,0 +1,123 @@
+package container
+
+import (
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// waitid is not available in older syscall / x/sys packages
+const (
+	pAll    = 0
+	wNowait = 0x1000000
+)
+
+// waitStatus is the wait4 result of a child process
+type waitStatus struct {
+	wstatus syscall.WaitStatus
+	rusage  syscall.Rusage
+	time    time.Time // reaped time
+}
+
+// reaper is the only one calls wait4 inside container init. Since init is the
+// parent of all orphaned processes, a wait4(-1) from concurrent executions
+// could consume exit status of each other. Reaper collects all children and
+// dispatch the exit status to registered waiters, others are discarded
+type reaper struct {
+	mu      sync.Mutex
+	waiters map[int]chan waitStatus
+	started chan struct{} // signal new child possibly started
+}
+
+func newReaper() *reaper {
+	r := &reaper{
+		waiters: make(map[int]chan waitStatus),
+		started: make(chan struct{}, 1),
+	}
+	go r.loop()
+	return r
+}
+
+// start calls f to start a child, which must call register with the pid
+// before the child could exit (e.g. in SyncFunc while the child waits for the
+// sync), so that the exit status will not be discarded even if it exits
+// immediately. The lock is not held by f thus concurrent starts do not wait
+// for the sync of each other. The registration is removed if f failed
+func (r *reaper) start(f func(register func(pid int)) (int, error)) (int, <-chan waitStatus, error) {
+	var (
+		ch  = make(chan waitStatus, 1)
+		reg int
+	)
+	register := func(pid int) {
+		r.mu.Lock()
+		r.waiters[pid] = ch
+		r.mu.Unlock()
+		reg = pid
+		r.wake()
+	}
+
+	pid, err := f(register)
+	r.wake()
+	if err != nil {
+		if reg != 0 {
+			r.mu.Lock()
+			if r.waiters[reg] == ch {
+				delete(r.waiters, reg)
+			}
+			r.mu.Unlock()
+		}
+		return 0, nil, err
+	}
+	return pid, ch, nil
+}
+
+// wake wakes up the loop to wait for the new child
+func (r *reaper) wake() {
+	select {
+	case r.started <- struct{}{}:
+	default:
+	}
+}
+
+func (r *reaper) loop() {
+	for {
+		var ws waitStatus
+		pid, err := syscall.Wait4(-1, &ws.wstatus, 0, &ws.rusage)
+		if err == syscall.EINTR {
+			continue
+		}
+		// no child (ECHILD), wait until new child started
+		if err != nil {
+			<-r.started
+			continue
+		}
+		ws.time = time.Now()
+
+		r.mu.Lock()
+		if ch, ok := r.waiters[pid]; ok {
+			ch <- ws
+			delete(r.waiters, pid)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// waitAll waits at most timeout until all children are reaped. It checks by
+// waitid(P_ALL, WNOWAIT) so that exit status is still collected by the loop
+func (r *reaper) waitAll(timeout time.Duration) bool {
+	const interval = 10 * time.Millisecond
+	var info [128]byte // siginfo_t
+	deadline := time.Now().Add(timeout)
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pAll, 0, uintptr(unsafe.Pointer(&info[0])),
+			syscall.WEXITED|syscall.WNOHANG|wNowait, 0, 0)
+		if errno == syscall.ECHILD {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(interval)
+	}
+}
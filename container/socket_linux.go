@@ -1,8 +1,7 @@
 package container
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/binary"
 	"fmt"
 	"sync"
 
@@ -18,24 +17,38 @@ var bufferPool = sync.Pool{
 	},
 }
 
-type socket struct {
-	*unixsocket.Socket
+// versionMagic prefix the raw version handshake message
+const versionMagic = "go-sandbox-container"
 
-	recvBuff bytes.Buffer
-	decoder  *gob.Decoder
+// versionMsgSize is the size of version message: magic, version, codec.
+// The version message of protocol version 1 has no codec
+const (
+	versionMsgSize   = len(versionMagic) + 8
+	versionMsgSizeV1 = len(versionMagic) + 4
+)
 
-	sendBuff bytes.Buffer
-	encoder  *gob.Encoder
+type socket struct {
+	*unixsocket.Socket
+	codec codec
 }
 
+// newSocket creates socket with gob codec, which could be changed by SetCodec
+// during handshake
 func newSocket(s *unixsocket.Socket) *socket {
-	soc := socket{
+	return &socket{
 		Socket: s,
+		codec:  newGobCodec(),
 	}
-	soc.decoder = gob.NewDecoder(&soc.recvBuff)
-	soc.encoder = gob.NewEncoder(&soc.sendBuff)
+}
 
-	return &soc
+// SetCodec changes the codec used by the socket
+func (s *socket) SetCodec(c Codec) error {
+	cc, err := newCodec(c)
+	if err != nil {
+		return err
+	}
+	s.codec = cc
+	return nil
 }
 
 func (s *socket) RecvMsg(e interface{}) (*unixsocket.Msg, error) {
@@ -44,25 +57,76 @@ func (s *socket) RecvMsg(e interface{}) (*unixsocket.Msg, error) {
 
 	n, msg, err := s.Socket.RecvMsg(buff)
 	if err != nil {
-		return nil, fmt.Errorf("RecvMsg: %v", err)
+		return nil, fmt.Errorf("RecvMsg: %w", err)
 	}
-	s.recvBuff.Reset()
-	s.recvBuff.Write(buff[:n])
-
-	if err := s.decoder.Decode(e); err != nil {
+	if err := s.codec.Decode(buff[:n], e); err != nil {
 		return nil, fmt.Errorf("RecvMsg: failed to decode %v", err)
 	}
 	return msg, nil
 }
 
 func (s *socket) SendMsg(e interface{}, msg *unixsocket.Msg) error {
-	s.sendBuff.Reset()
-	if err := s.encoder.Encode(e); err != nil {
+	b, err := s.codec.Encode(e)
+	if err != nil {
 		return fmt.Errorf("SendMsg: failed to encode %v", err)
 	}
+	// larger message is truncated by the receiver. It is not sent after
+	// encoded, which is fine for gob since the type information of cmd and
+	// reply is sent with the first message (conf and its ack)
+	if len(b) > bufferSize {
+		return fmt.Errorf("SendMsg: encoded size %d exceeds %d", len(b), bufferSize)
+	}
 
-	if err := s.Socket.SendMsg(s.sendBuff.Bytes(), msg); err != nil {
+	if err := s.Socket.SendMsg(b, msg); err != nil {
 		return fmt.Errorf("SendMsg: failed to SendMsg %v", err)
 	}
 	return nil
 }
+
+// SendVersion sends raw version message with selected codec, it must be called
+// before any encoded message since the gob stream is stateful
+func (s *socket) SendVersion(v uint32, c Codec) error {
+	buff := make([]byte, versionMsgSize)
+	binary.LittleEndian.PutUint32(buff[len(versionMagic)+4:], uint32(c))
+	return s.sendVersion(buff, v)
+}
+
+// SendVersionV1 sends raw version message without codec, which is understood
+// by peers of protocol version 1
+func (s *socket) SendVersionV1(v uint32) error {
+	return s.sendVersion(make([]byte, versionMsgSizeV1), v)
+}
+
+func (s *socket) sendVersion(buff []byte, v uint32) error {
+	copy(buff, versionMagic)
+	binary.LittleEndian.PutUint32(buff[len(versionMagic):], v)
+	if err := s.Socket.SendMsg(buff, nil); err != nil {
+		return fmt.Errorf("SendVersion: %v", err)
+	}
+	return nil
+}
+
+// RecvVersion receives raw version message with selected codec. The version
+// is parsed before the size is checked, so that peers of other versions are
+// reported by version mismatch (codec is gob if absent)
+func (s *socket) RecvVersion() (uint32, Codec, error) {
+	buff := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buff)
+
+	n, _, err := s.Socket.RecvMsg(buff)
+	if err != nil {
+		return 0, 0, fmt.Errorf("RecvVersion: %v", err)
+	}
+	if n < versionMsgSizeV1 || string(buff[:len(versionMagic)]) != versionMagic {
+		return 0, 0, fmt.Errorf("RecvVersion: invalid version message")
+	}
+	v := binary.LittleEndian.Uint32(buff[len(versionMagic):])
+	if v != protocolVersion {
+		return v, CodecGob, nil
+	}
+	if n != versionMsgSize {
+		return 0, 0, fmt.Errorf("RecvVersion: invalid version message")
+	}
+	c := Codec(binary.LittleEndian.Uint32(buff[len(versionMagic)+4:]))
+	return v, c, nil
+}
@@ -0,0 +1,171 @@
+package container
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// extractTar extracts gzip compressed tar stream from src into dir. Entries
+// are created beneath the configured roots and the total size of regular
+// files is limited by maxSize (0 means no limit). Directories, regular files
+// and symbolic links are extracted, other types are skipped
+func (c *containerServer) extractTar(src io.Reader, dir string, maxSize int64) error {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return fmt.Errorf("gzip: %v", err)
+	}
+	defer zr.Close()
+
+	dir = workPath(dir)
+	if err := c.mkdirAllBeneath(dir, 0755); err != nil {
+		return err
+	}
+
+	var total int64
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar: %v", err)
+		}
+		name := path.Clean(h.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return &os.PathError{Op: "extract", Path: h.Name, Err: syscall.EPERM}
+		}
+		p := path.Join(dir, name)
+		perm := os.FileMode(h.Mode).Perm()
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = c.mkdirAllBeneath(p, perm)
+
+		case tar.TypeReg, tar.TypeRegA:
+			if err = c.mkdirAllBeneath(path.Dir(p), 0755); err == nil {
+				total, err = c.extractFile(tr, p, perm, total, maxSize)
+			}
+
+		case tar.TypeSymlink:
+			if err = c.mkdirAllBeneath(path.Dir(p), 0755); err == nil {
+				err = c.symlinkBeneath(h.Linkname, p)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractFile writes content of the current tar entry into p, and returns
+// the total size of extracted files
+func (c *containerServer) extractFile(r io.Reader, p string, perm os.FileMode, total, maxSize int64) (int64, error) {
+	dst, err := c.openBeneath(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return total, err
+	}
+	defer dst.Close()
+
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize-total+1)
+	}
+	n, err := io.Copy(dst, r)
+	total += n
+	if err == nil && maxSize > 0 && total > maxSize {
+		err = &os.PathError{Op: "extract", Path: p, Err: syscall.EFBIG}
+	}
+	return total, err
+}
+
+// mkdirAllBeneath creates directory p with its parents inside the configured
+// roots
+func (c *containerServer) mkdirAllBeneath(p string, perm os.FileMode) error {
+	root, rel, err := c.resolvePath(p)
+	if err != nil {
+		return err
+	}
+	if root == "" {
+		return os.MkdirAll(rel, perm)
+	}
+	if rel == "." {
+		return nil
+	}
+
+	cur := root
+	for _, n := range strings.Split(rel, "/") {
+		cur = path.Join(cur, n)
+		dirFd, name, close, err := c.parentBeneath(cur, "mkdir")
+		if err != nil {
+			return err
+		}
+		err = unix.Mkdirat(dirFd, name, syscallMode(perm))
+		close()
+		if err != nil && err != syscall.EEXIST {
+			return &os.PathError{Op: "mkdir", Path: cur, Err: err}
+		}
+	}
+	return nil
+}
+
+// writeTar writes regular files under paths (relative to work dir) as gzip
+// compressed tar stream into dst, entries are named as collected by copyout
+func (c *containerServer) writeTar(dst io.Writer, paths []string) error {
+	zw := gzip.NewWriter(dst)
+	tw := tar.NewWriter(zw)
+	for _, p := range paths {
+		if _, _, err := c.resolvePath(p); err != nil {
+			return err
+		}
+		names, err := collectFiles(p)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if err := c.writeTarFile(tw, n); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("tar: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("gzip: %v", err)
+	}
+	return nil
+}
+
+func (c *containerServer) writeTarFile(tw *tar.Writer, name string) error {
+	f, err := c.openBeneath(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimPrefix(name, "/"),
+		Mode:     int64(fi.Mode().Perm()),
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+	}); err != nil {
+		return fmt.Errorf("tar: %v", err)
+	}
+	if _, err := io.Copy(tw, io.LimitReader(f, fi.Size())); err != nil {
+		return fmt.Errorf("tar: %v", err)
+	}
+	return nil
+}
@@ -1,8 +1,10 @@
 package container
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 )
 
@@ -40,6 +42,12 @@ func closeFds(s []int) {
 	}
 }
 
+func closeFiles(s []*os.File) {
+	for _, f := range s {
+		f.Close()
+	}
+}
+
 // removeContents delete content of a directory
 func removeContents(dir string) error {
 	d, err := os.Open(dir)
@@ -61,3 +69,18 @@ func removeContents(dir string) error {
 	}
 	return nil
 }
+
+// readLines reads non-empty lines of a file
+func readLines(p string) ([]string, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			ret = append(ret, l)
+		}
+	}
+	return ret, nil
+}
@@ -64,3 +64,27 @@ func TestCgroup(t *testing.T) {
 	}
 	cg.Destroy()
 }
+
+func BenchmarkStatReader(b *testing.B) {
+	builder, err := NewBuilder("benchmark").WithCPUAcct().WithMemory().WithPids().WithIO().FilterByEnv()
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	cg, err := builder.Build()
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	defer cg.Destroy()
+
+	r := cg.NewStatReader()
+	var s Stat
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.Read(&s); err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
@@ -6,17 +6,62 @@ import (
 )
 
 // Builder builds cgroup directories
-// available: cpuacct, memory, pids
+// available: cpuacct, cpu, cpuset, memory, pids, freezer, io (blkio for v1),
+// hugetlb, rdma
+// for cgroup v2, cpuacct stands for cpu.stat and freezer stands for
+// cgroup.freeze (linux 5.2+), which need no controller
 type Builder struct {
-	Prefix                string
-	CPUAcct, Memory, Pids bool
+	Prefix string
+	Type   Type
+	// Root is the base directory of cgroup v2 (e.g. delegated subtree),
+	// empty for /sys/fs/cgroup
+	Root string
+
+	CPUAcct, CPU, Cpuset, Memory, Pids, Freezer, IO, HugeTLB, RDMA bool
+
+	// PidsMax is written to pids.max of the built cgroup if not 0
+	PidsMax uint64
+
+	// CPUQuota and CPUPeriod (in us) limit the cpu bandwidth of the built
+	// cgroup if CPUQuota is not 0
+	CPUQuota, CPUPeriod uint64
+
+	// CpusetCpus and CpusetMems (e.g. "2-3", "0") are written to cpuset.cpus
+	// and cpuset.mems of the built cgroup if not empty
+	CpusetCpus, CpusetMems string
+
+	// IOLimits throttle the block devices of the built cgroup
+	IOLimits []IOLimit
+
+	// HugeTLBLimits limit the huge pages usage in bytes of the built cgroup,
+	// keyed by the page size (e.g. "2MB", "1GB")
+	HugeTLBLimits map[string]uint64
+
+	// RDMALimits limit the rdma resources of the built cgroup, keyed by the
+	// device name (e.g. "mlx4_0": "hca_handle=2 hca_object=2000")
+	RDMALimits map[string]string
 }
 
-// NewBuilder return a dumb builder without any sub-cgroup
+// NewBuilder return a dumb builder without any sub-cgroup, with the type of
+// cgroup hierarchy detected
 func NewBuilder(prefix string) *Builder {
 	return &Builder{
 		Prefix: prefix,
+		Type:   DetectType(),
+	}
+}
+
+// WithRoot sets the base directory of cgroup v2
+func (b *Builder) WithRoot(root string) *Builder {
+	b.Root = root
+	return b
+}
+
+func (b *Builder) root() string {
+	if b.Root == "" {
+		return basePath
 	}
+	return b.Root
 }
 
 // WithCPUAcct includes cpuacct cgroup
@@ -25,6 +70,30 @@ func (b *Builder) WithCPUAcct() *Builder {
 	return b
 }
 
+// WithCPU includes cpu cgroup
+func (b *Builder) WithCPU() *Builder {
+	b.CPU = true
+	return b
+}
+
+// WithCPUMax includes cpu cgroup and limits the cpu bandwidth to quota us
+// for every period us (e.g. 150000 / 100000 for 1.5 cpus)
+func (b *Builder) WithCPUMax(quota, period uint64) *Builder {
+	b.CPU = true
+	b.CPUQuota = quota
+	b.CPUPeriod = period
+	return b
+}
+
+// WithCpuset includes cpuset cgroup and restricts the cpus and memory nodes
+// in it, empty ones are inherited from the parent
+func (b *Builder) WithCpuset(cpus, mems string) *Builder {
+	b.Cpuset = true
+	b.CpusetCpus = cpus
+	b.CpusetMems = mems
+	return b
+}
+
 // WithMemory includes memory cgroup
 func (b *Builder) WithMemory() *Builder {
 	b.Memory = true
@@ -37,32 +106,146 @@ func (b *Builder) WithPids() *Builder {
 	return b
 }
 
-// FilterByEnv reads /proc/cgroups and filter out non-exists ones
+// WithPidsMax includes pids cgroup and limits the number of processes and
+// threads in it
+func (b *Builder) WithPidsMax(n uint64) *Builder {
+	b.Pids = true
+	b.PidsMax = n
+	return b
+}
+
+// WithFreezer includes freezer cgroup
+func (b *Builder) WithFreezer() *Builder {
+	b.Freezer = true
+	return b
+}
+
+// WithIO includes io cgroup (blkio for v1)
+func (b *Builder) WithIO() *Builder {
+	b.IO = true
+	return b
+}
+
+// WithIOMax includes io cgroup and throttles the block devices
+func (b *Builder) WithIOMax(l ...IOLimit) *Builder {
+	b.IO = true
+	b.IOLimits = append(b.IOLimits, l...)
+	return b
+}
+
+// WithHugeTLB includes hugetlb cgroup
+func (b *Builder) WithHugeTLB() *Builder {
+	b.HugeTLB = true
+	return b
+}
+
+// WithHugeTLBMax includes hugetlb cgroup and limits the usage in bytes of the
+// huge pages in page size (e.g. "2MB")
+func (b *Builder) WithHugeTLBMax(size string, limit uint64) *Builder {
+	b.HugeTLB = true
+	if b.HugeTLBLimits == nil {
+		b.HugeTLBLimits = make(map[string]uint64)
+	}
+	b.HugeTLBLimits[size] = limit
+	return b
+}
+
+// WithRDMA includes rdma cgroup
+func (b *Builder) WithRDMA() *Builder {
+	b.RDMA = true
+	return b
+}
+
+// WithRDMAMax includes rdma cgroup and limits the resources of the device
+// (e.g. "mlx4_0", "hca_handle=2 hca_object=2000")
+func (b *Builder) WithRDMAMax(device, limit string) *Builder {
+	b.RDMA = true
+	if b.RDMALimits == nil {
+		b.RDMALimits = make(map[string]string)
+	}
+	b.RDMALimits[device] = limit
+	return b
+}
+
+// FilterByEnv reads /proc/cgroups (or cgroup.controllers for v2) and filter
+// out non-exists ones
 func (b *Builder) FilterByEnv() (*Builder, error) {
+	if b.Type == TypeV2 {
+		m, err := GetAvailableController(b.root())
+		if err != nil {
+			return b, err
+		}
+		// cpu.stat is always available without the cpu controller
+		b.CPU = b.CPU && m["cpu"]
+		b.Cpuset = b.Cpuset && m["cpuset"]
+		b.Memory = b.Memory && m["memory"]
+		b.Pids = b.Pids && m["pids"]
+		b.IO = b.IO && m["io"]
+		b.HugeTLB = b.HugeTLB && m["hugetlb"]
+		b.RDMA = b.RDMA && m["rdma"]
+		return b, nil
+	}
+
 	m, err := GetAllSubCgroup()
 	if err != nil {
 		return b, err
 	}
 	b.CPUAcct = b.CPUAcct && m["cpuacct"]
+	b.CPU = b.CPU && m["cpu"]
+	b.Cpuset = b.Cpuset && m["cpuset"]
 	b.Memory = b.Memory && m["memory"]
 	b.Pids = b.Pids && m["pids"]
+	b.Freezer = b.Freezer && m["freezer"]
+	b.IO = b.IO && m["blkio"]
+	b.HugeTLB = b.HugeTLB && m["hugetlb"]
+	b.RDMA = b.RDMA && m["rdma"]
 	return b, nil
 }
 
 // String prints the build properties
 func (b *Builder) String() string {
-	s := make([]string, 0, 3)
+	s := make([]string, 0, len(controllers))
 	for _, t := range []struct {
 		name    string
 		enabled bool
 	}{
 		{"cpuacct", b.CPUAcct},
+		{cpuString(b.CPUQuota, b.CPUPeriod), b.CPU},
+		{cpusetString(b.CpusetCpus, b.CpusetMems), b.Cpuset},
 		{"memory", b.Memory},
-		{"pids", b.Pids},
+		{pidsString(b.PidsMax), b.Pids},
+		{"freezer", b.Freezer},
+		{"io", b.IO},
+		{"hugetlb", b.HugeTLB},
+		{"rdma", b.RDMA},
 	} {
 		if t.enabled {
 			s = append(s, t.name)
 		}
 	}
-	return fmt.Sprintf("cgroup builder: [%s]", strings.Join(s, ", "))
+	if b.Root != "" {
+		return fmt.Sprintf("cgroup builder(%v, %s): [%s]", b.Type, b.Root, strings.Join(s, ", "))
+	}
+	return fmt.Sprintf("cgroup builder(%v): [%s]", b.Type, strings.Join(s, ", "))
+}
+
+func cpuString(quota, period uint64) string {
+	if quota == 0 {
+		return "cpu"
+	}
+	return fmt.Sprintf("cpu(max=%d/%d)", quota, period)
+}
+
+func cpusetString(cpus, mems string) string {
+	if cpus == "" && mems == "" {
+		return "cpuset"
+	}
+	return fmt.Sprintf("cpuset(cpus=%s,mems=%s)", cpus, mems)
+}
+
+func pidsString(max uint64) string {
+	if max == 0 {
+		return "pids"
+	}
+	return fmt.Sprintf("pids(max=%d)", max)
 }
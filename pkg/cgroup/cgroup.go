@@ -2,135 +2,426 @@ package cgroup
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"strconv"
+	"time"
 )
 
 // Cgroup is the combination of sub-cgroups
 type Cgroup struct {
 	prefix                string
+	typ                   Type
 	cpuacct, memory, pids *SubCgroup
+	// cpu is the same as cpuacct if they are co-mounted (cpu,cpuacct)
+	cpu, cpuset, freezer, io *SubCgroup
+	hugetlb, rdma            *SubCgroup
+	// cgroup v2 directory, sub-cgroups of enabled controllers share the path
+	unified *SubCgroup
+	// distinct v1 sub-cgroups created
+	subs []*SubCgroup
 }
 
+// controller describes the sub-cgroup of a controller
+type controller struct {
+	v1      string // hierarchy name of v1
+	v2      string // controller name of v2, empty if need not to be enabled
+	enabled func(*Builder) bool
+	sub     func(*Cgroup) **SubCgroup
+}
+
+var controllers = []controller{
+	{"cpuacct", "", func(b *Builder) bool { return b.CPUAcct }, func(c *Cgroup) **SubCgroup { return &c.cpuacct }},
+	{"cpu", "cpu", func(b *Builder) bool { return b.CPU }, func(c *Cgroup) **SubCgroup { return &c.cpu }},
+	{"cpuset", "cpuset", func(b *Builder) bool { return b.Cpuset }, func(c *Cgroup) **SubCgroup { return &c.cpuset }},
+	{"memory", "memory", func(b *Builder) bool { return b.Memory }, func(c *Cgroup) **SubCgroup { return &c.memory }},
+	{"pids", "pids", func(b *Builder) bool { return b.Pids }, func(c *Cgroup) **SubCgroup { return &c.pids }},
+	{"freezer", "", func(b *Builder) bool { return b.Freezer }, func(c *Cgroup) **SubCgroup { return &c.freezer }},
+	{"blkio", "io", func(b *Builder) bool { return b.IO }, func(c *Cgroup) **SubCgroup { return &c.io }},
+	{"hugetlb", "hugetlb", func(b *Builder) bool { return b.HugeTLB }, func(c *Cgroup) **SubCgroup { return &c.hugetlb }},
+	{"rdma", "rdma", func(b *Builder) bool { return b.RDMA }, func(c *Cgroup) **SubCgroup { return &c.rdma }},
+}
+
+// ErrNotSupported returned when the operation is not supported by the type of
+// cgroup hierarchy
+var ErrNotSupported = errors.New("cgroup operation not supported")
+
+// ErrKillTimeout returned when processes are still alive after killed
+var ErrKillTimeout = errors.New("cgroup kill timeout")
+
+const (
+	killRetry    = 100
+	killInterval = time.Millisecond
+)
+
 // Build creates new cgrouup directories
-func (b *Builder) Build() (cg *Cgroup, err error) {
-	var (
-		cpuacctPath, memoryPath, pidsPath string
-	)
+func (b *Builder) Build() (*Cgroup, error) {
+	build := b.buildV1
+	if b.Type == TypeV2 {
+		build = b.buildV2
+	}
+	cg, err := build()
+	if err != nil {
+		return nil, err
+	}
+	if err := cg.setLimits(b); err != nil {
+		cg.Destroy()
+		return nil, err
+	}
+	return cg, nil
+}
+
+// setLimits writes the limits of the builder
+func (c *Cgroup) setLimits(b *Builder) error {
+	if b.PidsMax > 0 {
+		if err := c.SetPidsMax(b.PidsMax); err != nil {
+			return err
+		}
+	}
+	if b.CPUQuota > 0 {
+		if err := c.SetCPUMax(b.CPUQuota, b.CPUPeriod); err != nil {
+			return err
+		}
+	}
+	if err := c.SetCpuset(b.CpusetCpus, b.CpusetMems); err != nil {
+		return err
+	}
+	for _, l := range b.IOLimits {
+		if err := c.SetIOMax(l); err != nil {
+			return err
+		}
+	}
+	for size, l := range b.HugeTLBLimits {
+		if err := c.SetHugeTLBLimit(size, l); err != nil {
+			return err
+		}
+	}
+	for dev, l := range b.RDMALimits {
+		if err := c.SetRDMAMax(dev, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newCgroup creates Cgroup with all sub-cgroups not initialized
+func newCgroup(prefix string, typ Type) *Cgroup {
+	c := &Cgroup{prefix: prefix, typ: typ, unified: NewSubCgroup("")}
+	for _, ctl := range controllers {
+		*ctl.sub(c) = NewSubCgroup("")
+	}
+	return c
+}
+
+func (b *Builder) buildV1() (cg *Cgroup, err error) {
+	cg = newCgroup(b.Prefix, TypeV1)
 	// if failed, remove potential created directory
 	defer func() {
 		if err != nil {
-			remove(cpuacctPath)
-			remove(memoryPath)
-			remove(pidsPath)
+			cg.Destroy()
 		}
 	}()
-	if b.CPUAcct {
-		if cpuacctPath, err = CreateSubCgroupPath("cpuacct", b.Prefix); err != nil {
+	for _, ctl := range controllers {
+		if !ctl.enabled(b) {
+			continue
+		}
+		if ctl.v1 == "cpu" && b.CPUAcct && sameHierarchy("cpu", "cpuacct") {
+			cg.cpu = cg.cpuacct
+			continue
+		}
+		var p string
+		if p, err = CreateSubCgroupPath(ctl.v1, b.Prefix); err != nil {
 			return
 		}
+		s := NewSubCgroup(p)
+		*ctl.sub(cg) = s
+		cg.subs = append(cg.subs, s)
+
+		if ctl.v1 == "cpuset" {
+			// v1 cpuset is empty after created, which can not have any process
+			if err = initCpuset(path.Dir(p)); err != nil {
+				return
+			}
+			if err = initCpuset(p); err != nil {
+				return
+			}
+		}
 	}
-	if b.Memory {
-		if memoryPath, err = CreateSubCgroupPath("memory", b.Prefix); err != nil {
-			return
+	return cg, nil
+}
+
+func (b *Builder) buildV2() (*Cgroup, error) {
+	var ctl []string
+	for _, c := range controllers {
+		if c.v2 != "" && c.enabled(b) {
+			ctl = append(ctl, c.v2)
 		}
 	}
-	if b.Pids {
-		if pidsPath, err = CreateSubCgroupPath("pids", b.Prefix); err != nil {
-			return
+	p, err := CreateV2Path(b.root(), b.Prefix, ctl)
+	if err != nil {
+		return nil, err
+	}
+
+	cg := newCgroup(b.Prefix, TypeV2)
+	cg.unified = NewSubCgroup(p)
+	for _, c := range controllers {
+		if c.enabled(b) {
+			*c.sub(cg) = cg.unified
 		}
 	}
+	return cg, nil
+}
 
-	return &Cgroup{
-		prefix:  b.Prefix,
-		cpuacct: NewSubCgroup(cpuacctPath),
-		memory:  NewSubCgroup(memoryPath),
-		pids:    NewSubCgroup(pidsPath),
-	}, nil
+// Type returns the type of cgroup hierarchy
+func (c *Cgroup) Type() Type {
+	return c.typ
 }
 
 // AddProc writes cgroup.procs to all sub-cgroup
 func (c *Cgroup) AddProc(pid int) error {
-	if err := c.cpuacct.WriteUint(cgroupProcs, uint64(pid)); err != nil {
-		return err
+	if c.typ == TypeV2 {
+		return c.unified.WriteUint(cgroupProcs, uint64(pid))
 	}
-	if err := c.memory.WriteUint(cgroupProcs, uint64(pid)); err != nil {
-		return err
-	}
-	if err := c.pids.WriteUint(cgroupProcs, uint64(pid)); err != nil {
-		return err
+	for _, s := range c.subs {
+		if err := s.WriteUint(cgroupProcs, uint64(pid)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // Destroy removes dir for sub-cgroup, errors are ignored if remove one failed
 func (c *Cgroup) Destroy() error {
+	if c.typ == TypeV2 {
+		return remove(c.unified.path)
+	}
 	var err1 error
-	if err := remove(c.cpuacct.path); err != nil {
-		err1 = err
+	for _, s := range c.subs {
+		if err := remove(s.path); err != nil {
+			err1 = err
+		}
 	}
-	if err := remove(c.memory.path); err != nil {
-		err1 = err
+	return err1
+}
+
+// Kill kills all processes in the cgroup by cgroup.kill (v2, linux 5.14+).
+// Otherwise SIGKILL is sent to the processes in cgroup.procs until it is empty,
+// while the cgroup is frozen if the freezer is available to stop forks
+func (c *Cgroup) Kill() error {
+	if c.typ == TypeV2 {
+		if c.unified.exists("cgroup.kill") {
+			return c.unified.WriteFile("cgroup.kill", []byte("1"))
+		}
 	}
-	if err := remove(c.pids.path); err != nil {
-		err1 = err
+	s := c.procsCgroup()
+	if s == nil {
+		return ErrNotInitialized
 	}
-	return err1
+	if c.freezer.path != "" && c.Freeze() == nil {
+		// no new process while frozen, and the killed die after thawed (v1)
+		// or while frozen (v2)
+		defer c.Thaw()
+		_, err := s.killProcs()
+		return err
+	}
+	for i := 0; i < killRetry; i++ {
+		if i > 0 {
+			time.Sleep(killInterval)
+		}
+		n, err := s.killProcs()
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+	return ErrKillTimeout
 }
 
-// CpuacctUsage read cpuacct.usage in ns
+// procsCgroup returns the sub-cgroup that contains all processes, any of
+// the v1 sub-cgroups since processes are attached to all of them
+func (c *Cgroup) procsCgroup() *SubCgroup {
+	if c.typ == TypeV2 {
+		return c.unified
+	}
+	if len(c.subs) == 0 {
+		return nil
+	}
+	return c.subs[0]
+}
+
+// CpuacctUsage read cpuacct.usage in ns (usage_usec of cpu.stat for v2)
 func (c *Cgroup) CpuacctUsage() (uint64, error) {
+	if c.typ == TypeV2 {
+		us, err := c.cpuacct.readProperty("cpu.stat", "usage_usec")
+		return us * 1000, err
+	}
 	return c.cpuacct.ReadUint("cpuacct.usage")
 }
 
-// MemoryMaxUsageInBytes read memory.max_usage_in_bytes
+// MemoryMaxUsageInBytes read memory.max_usage_in_bytes (memory.peak for v2,
+// linux 5.19+)
 func (c *Cgroup) MemoryMaxUsageInBytes() (uint64, error) {
+	if c.typ == TypeV2 {
+		return c.memory.ReadUint("memory.peak")
+	}
 	return c.memory.ReadUint("memory.max_usage_in_bytes")
 }
 
-// SetMemoryLimitInBytes write memory.limit_in_bytes
+// SetMemoryLimitInBytes write memory.limit_in_bytes (memory.max for v2)
 func (c *Cgroup) SetMemoryLimitInBytes(i uint64) error {
+	if c.typ == TypeV2 {
+		return c.memory.WriteUint("memory.max", i)
+	}
 	return c.memory.WriteUint("memory.limit_in_bytes", i)
 }
 
+// SetMemorySwapMax write memory.swap.max for v2, or memory.memsw.limit_in_bytes
+// as memory.limit_in_bytes + i for v1, so that 0 disables swap. For v1, it
+// should be called after memory limit is set, and ErrNotSupported is returned
+// if swap accounting is not enabled (swapaccount=1)
+func (c *Cgroup) SetMemorySwapMax(i uint64) error {
+	if c.memory.path == "" {
+		return nil
+	}
+	if c.typ == TypeV2 {
+		return c.memory.WriteUint("memory.swap.max", i)
+	}
+	if !c.memory.exists("memory.memsw.limit_in_bytes") {
+		return ErrNotSupported
+	}
+	l, err := c.memory.ReadUint("memory.limit_in_bytes")
+	if err != nil {
+		return err
+	}
+	return c.memory.WriteUint("memory.memsw.limit_in_bytes", l+i)
+}
+
+// MemorySwapMaxUsageInBytes read memory.swap.peak for v2 (linux 6.5+), or
+// approximated by memory.memsw.max_usage_in_bytes - memory.max_usage_in_bytes
+// for v1
+func (c *Cgroup) MemorySwapMaxUsageInBytes() (uint64, error) {
+	if c.typ == TypeV2 {
+		return c.memory.ReadUint("memory.swap.peak")
+	}
+	memsw, err := c.memory.ReadUint("memory.memsw.max_usage_in_bytes")
+	if err != nil {
+		return 0, err
+	}
+	mem, err := c.memory.ReadUint("memory.max_usage_in_bytes")
+	if err != nil || memsw < mem {
+		return 0, err
+	}
+	return memsw - mem, nil
+}
+
 // SetPidsMax write pids.max
 func (c *Cgroup) SetPidsMax(i uint64) error {
 	return c.pids.WriteUint("pids.max", i)
 }
 
-// SetCpuacctUsage write cpuacct.usage in ns
+// PidsEventsMax read max counter from pids.events (linux 4.6+), which is the
+// number of fork / clone failed by pids.max in the cgroup
+func (c *Cgroup) PidsEventsMax() (uint64, error) {
+	return c.pids.readProperty("pids.events", "max")
+}
+
+// SetCPUMax write cpu.max (cpu.cfs_period_us and cpu.cfs_quota_us for v1) to
+// limit the cpu bandwidth to quota us for every period us, 0 quota removes
+// the limit
+func (c *Cgroup) SetCPUMax(quota, period uint64) error {
+	if c.cpu.path == "" {
+		return nil
+	}
+	if c.typ == TypeV2 {
+		q := "max"
+		if quota > 0 {
+			q = strconv.FormatUint(quota, 10)
+		}
+		return c.cpu.WriteFile("cpu.max", []byte(q+" "+strconv.FormatUint(period, 10)))
+	}
+	if err := c.cpu.WriteUint("cpu.cfs_period_us", period); err != nil {
+		return err
+	}
+	if quota == 0 {
+		return c.cpu.WriteFile("cpu.cfs_quota_us", []byte("-1"))
+	}
+	return c.cpu.WriteUint("cpu.cfs_quota_us", quota)
+}
+
+// SetCpuset write cpuset.cpus and cpuset.mems if not empty, which restricts
+// the cpus and memory nodes even if the process resets its affinity
+func (c *Cgroup) SetCpuset(cpus, mems string) error {
+	if c.cpuset.path == "" {
+		return nil
+	}
+	if cpus != "" {
+		if err := c.cpuset.WriteFile("cpuset.cpus", []byte(cpus)); err != nil {
+			return err
+		}
+	}
+	if mems != "" {
+		if err := c.cpuset.WriteFile("cpuset.mems", []byte(mems)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCpuacctUsage write cpuacct.usage in ns (not supported by v2)
 func (c *Cgroup) SetCpuacctUsage(i uint64) error {
+	if c.typ == TypeV2 {
+		return ErrNotSupported
+	}
 	return c.cpuacct.WriteUint("cpuacct.usage", i)
 }
 
-// SetMemoryMaxUsageInBytes write cpuacct.usage in ns
+// SetMemoryMaxUsageInBytes write memory.max_usage_in_bytes (not supported by
+// v2)
 func (c *Cgroup) SetMemoryMaxUsageInBytes(i uint64) error {
+	if c.typ == TypeV2 {
+		return ErrNotSupported
+	}
 	return c.memory.WriteUint("memory.max_usage_in_bytes", i)
 }
 
 // FindMemoryStatProperty find certain property from memory.stat
+// (e.g. page cache is "cache" for v1 and "file" for v2)
 func (c *Cgroup) FindMemoryStatProperty(prop string) (uint64, error) {
-	content, err := c.memory.ReadFile("memory.stat")
-	if err != nil {
-		return 0, err
+	return c.memory.readProperty("memory.stat", prop)
+}
+
+// MemoryOOMKill read oom_kill counter from memory.oom_control (linux 4.13+,
+// memory.events for v2), which is the number of processes killed by OOM
+// killer in the cgroup
+func (c *Cgroup) MemoryOOMKill() (uint64, error) {
+	if c.typ == TypeV2 {
+		return c.memory.readProperty("memory.events", "oom_kill")
 	}
-	r := bytes.NewReader(content)
-	for {
-		var p string
-		var i uint64
-		_, err = fmt.Fscanln(r, &p, &i)
-		if err != nil {
-			return 0, err
+	return c.memory.readProperty("memory.oom_control", "oom_kill")
+}
+
+// findProperty finds value of the property from lines of "name value"
+func findProperty(content []byte, prop string) (uint64, error) {
+	for len(content) > 0 {
+		l := content
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			l, content = content[:i], content[i+1:]
+		} else {
+			content = nil
 		}
-		if p == prop {
-			return i, nil
+		if len(l) > len(prop) && l[len(prop)] == ' ' && string(l[:len(prop)]) == prop {
+			return strconv.ParseUint(string(l[len(prop)+1:]), 10, 64)
 		}
 	}
+	return 0, fmt.Errorf("cgroup: property %q not found", prop)
 }
 
 func remove(name string) error {
 	if name != "" {
-		return os.Remove(name)
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	return nil
 }
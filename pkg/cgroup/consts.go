@@ -5,4 +5,26 @@ const (
 	basePath        = "/sys/fs/cgroup"
 	cgroupProcs     = "cgroup.procs"
 	procCgroupsPath = "/proc/cgroups"
+
+	// cgroup v2
+	cgroupControllers    = "cgroup.controllers"
+	cgroupSubtreeControl = "cgroup.subtree_control"
+	cgroup2SuperMagic    = 0x63677270 // CGROUP2_SUPER_MAGIC
+)
+
+// Type is the type of the cgroup hierarchy mounted at /sys/fs/cgroup
+type Type int
+
+// Types of the cgroup hierarchy. TypeV1 also covers the hybrid hierarchy,
+// which mounts v1 controllers with an empty unified hierarchy
+const (
+	TypeV1 Type = iota
+	TypeV2
 )
+
+func (t Type) String() string {
+	if t == TypeV2 {
+		return "v2"
+	}
+	return "v1"
+}
@@ -0,0 +1,148 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	procSelfCgroupPath = "/proc/self/cgroup"
+	delegatedInit      = "init"
+)
+
+// Features is the availability of cgroup in the current environment, which
+// downgrades gracefully when running without root
+type Features struct {
+	Type Type
+
+	// Root is the base directory to create cgroup v2, which is /sys/fs/cgroup
+	// for root, or the delegated subtree for unprivileged user. Empty if
+	// cgroup is not usable
+	Root      string
+	Delegated bool
+
+	// Controllers available to use, nil if cgroup is not usable
+	Controllers map[string]bool
+}
+
+func (f Features) String() string {
+	c := make([]string, 0, len(f.Controllers))
+	for k := range f.Controllers {
+		c = append(c, k)
+	}
+	sort.Strings(c)
+	return fmt.Sprintf("cgroup features(%v, root=%q, delegated=%v): %v", f.Type, f.Root, f.Delegated, c)
+}
+
+// DetectFeatures detects the type of cgroup, and the delegated subtree with
+// its available controllers if not running as root. It does not modify the
+// cgroup of the current process
+func DetectFeatures() Features {
+	f := Features{Type: DetectType()}
+	if f.Type == TypeV1 {
+		// v1 hierarchies could not be delegated safely
+		if os.Geteuid() != 0 {
+			return f
+		}
+		f.Controllers, _ = GetAllSubCgroup()
+		return f
+	}
+
+	f.Root = basePath
+	if os.Geteuid() != 0 {
+		p, err := FindDelegatedRoot()
+		if err != nil {
+			f.Root = ""
+			return f
+		}
+		f.Root, f.Delegated = p, true
+	}
+	f.Controllers, _ = GetAvailableController(f.Root)
+	return f
+}
+
+// FindDelegatedRoot finds the cgroup v2 subtree delegated to the current user
+// (e.g. created by systemd-run --user --scope -p Delegate=yes), which is the
+// current cgroup of the process if it is writable
+func FindDelegatedRoot() (string, error) {
+	delegated.Lock()
+	defer delegated.Unlock()
+	// the process was moved to init by EnableDelegation
+	if delegated.root != "" {
+		return delegated.root, nil
+	}
+	return findDelegatedRoot()
+}
+
+func findDelegatedRoot() (string, error) {
+	p, err := currentCgroupPath()
+	if err != nil {
+		return "", err
+	}
+	for _, f := range []string{p, path.Join(p, cgroupProcs), path.Join(p, cgroupSubtreeControl)} {
+		if err := unix.Access(f, unix.W_OK); err != nil {
+			return "", fmt.Errorf("cgroup: %s is not delegated: %v", p, err)
+		}
+	}
+	return p, nil
+}
+
+// delegated is the delegated root enabled for the process
+var delegated struct {
+	sync.Mutex
+	root string
+}
+
+// EnableDelegation moves the current process into the leaf cgroup "init" of
+// the delegated subtree, so that the controllers could be enabled in it
+// (no internal process constraint). The returned root is used by
+// Builder.WithRoot
+func EnableDelegation() (string, error) {
+	delegated.Lock()
+	defer delegated.Unlock()
+	if delegated.root != "" {
+		return delegated.root, nil
+	}
+
+	root, err := findDelegatedRoot()
+	if err != nil {
+		return "", err
+	}
+	leaf := path.Join(root, delegatedInit)
+	if err := EnsureDirExists(leaf); err != nil {
+		return "", err
+	}
+	// moves all threads of the process
+	if err := NewSubCgroup(leaf).WriteUint(cgroupProcs, uint64(os.Getpid())); err != nil {
+		return "", err
+	}
+	delegated.root = root
+	return root, nil
+}
+
+// currentCgroupPath reads the cgroup v2 path of the current process
+func currentCgroupPath() (string, error) {
+	f, err := os.Open(procSelfCgroupPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if p := strings.TrimPrefix(s.Text(), "0::"); p != s.Text() {
+			return path.Join(basePath, p), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("cgroup: cgroup v2 path not found in %s", procSelfCgroupPath)
+}
@@ -1,17 +1,31 @@
 // Package cgroup provices builder to create multiple different cgroup-v1 sub groups
-// under systemd defined mount path (i.e.,sys/fs/cgroup).
+// under systemd defined mount path (i.e.,sys/fs/cgroup), or a single directory
+// in the cgroup-v2 unified hierarchy if it is mounted there.
 //
 // Current avaliable:
-//  cpuacct
+//  cpuacct (cpu.stat for v2)
+//  cpu
+//  cpuset
 //  memory
 //  pids
+//  freezer (cgroup.freeze for v2)
+//  blkio (io for v2)
+//  hugetlb
+//  rdma
 //
-// Current not available: cpu, cpuset, devices, freezer, net_cls, blkio, perf_event, net_prio, huge_tlb, rdma
+// Current not available: devices, net_cls, perf_event, net_prio
+//
+// For cgroup-v2, the controllers are enabled in cgroup.subtree_control from
+// the root to the prefix directory, so that the prefix directory must not
+// contain any process (no internal process constraint).
+//
+// Without root, the cgroup-v2 subtree delegated to the user (e.g. by systemd)
+// could be used by EnableDelegation and Builder.WithRoot, DetectFeatures
+// reports what is available.
 //
 // Additional ideas:
 //
 //   cpu share(not used): cpu.share
 //   reclaim pages from old process: memory.force_empty
 //   (tasks kill are managed out of cgroup as freeze takes some time)
-//   freeze: freezer.state
 package cgroup
@@ -0,0 +1,64 @@
+package cgroup
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// ErrFreezeTimeout returned when the cgroup did not become frozen in time
+// (e.g. the processes are in uninterruptible sleep)
+var ErrFreezeTimeout = errors.New("cgroup freeze timeout")
+
+const (
+	freezeRetry    = 1000
+	freezeInterval = time.Millisecond
+)
+
+// Freeze stops all processes in the cgroup and waits until they are frozen,
+// by freezer.state for v1 or cgroup.freeze for v2. Frozen processes do not
+// handle signals before thawed, except that fatal signals (e.g. SIGKILL)
+// still kill them on v2 while they are pending until thawed on v1
+func (c *Cgroup) Freeze() error {
+	if c.freezer.path == "" {
+		return ErrNotInitialized
+	}
+	for i := 0; i < freezeRetry; i++ {
+		if i > 0 {
+			time.Sleep(freezeInterval)
+		}
+		frozen, err := c.freeze()
+		if err != nil || frozen {
+			return err
+		}
+	}
+	return ErrFreezeTimeout
+}
+
+// freeze requests freezing and reports whether the cgroup is frozen
+func (c *Cgroup) freeze() (bool, error) {
+	if c.typ == TypeV2 {
+		if err := c.freezer.WriteFile("cgroup.freeze", []byte("1")); err != nil {
+			return false, err
+		}
+		frozen, err := c.freezer.readProperty("cgroup.events", "frozen")
+		return frozen == 1, err
+	}
+	// writes FROZEN again for processes forked in FREEZING state
+	if err := c.freezer.WriteFile("freezer.state", []byte("FROZEN")); err != nil {
+		return false, err
+	}
+	s, err := c.freezer.ReadFile("freezer.state")
+	return string(bytes.TrimSpace(s)) == "FROZEN", err
+}
+
+// Thaw resumes all processes in the cgroup
+func (c *Cgroup) Thaw() error {
+	if c.freezer.path == "" {
+		return ErrNotInitialized
+	}
+	if c.typ == TypeV2 {
+		return c.freezer.WriteFile("cgroup.freeze", []byte("0"))
+	}
+	return c.freezer.WriteFile("freezer.state", []byte("THAWED"))
+}
@@ -0,0 +1,47 @@
+package cgroup
+
+import "fmt"
+
+// SetHugeTLBLimit write hugetlb.<size>.max (hugetlb.<size>.limit_in_bytes for
+// v1) to limit the usage in bytes of the huge pages in page size (e.g. "2MB")
+func (c *Cgroup) SetHugeTLBLimit(size string, i uint64) error {
+	if c.hugetlb.path == "" {
+		return nil
+	}
+	if c.typ == TypeV2 {
+		return c.hugetlb.WriteUint(hugetlbFile(size, "max"), i)
+	}
+	return c.hugetlb.WriteUint(hugetlbFile(size, "limit_in_bytes"), i)
+}
+
+// HugeTLBUsage read hugetlb.<size>.current (hugetlb.<size>.usage_in_bytes for
+// v1), which is the usage in bytes of the huge pages in page size
+func (c *Cgroup) HugeTLBUsage(size string) (uint64, error) {
+	if c.typ == TypeV2 {
+		return c.hugetlb.ReadUint(hugetlbFile(size, "current"))
+	}
+	return c.hugetlb.ReadUint(hugetlbFile(size, "usage_in_bytes"))
+}
+
+// HugeTLBEventsMax read max counter from hugetlb.<size>.events
+// (hugetlb.<size>.failcnt for v1), which is the number of allocations failed
+// by the limit
+func (c *Cgroup) HugeTLBEventsMax(size string) (uint64, error) {
+	if c.typ == TypeV2 {
+		return c.hugetlb.readProperty(hugetlbFile(size, "events"), "max")
+	}
+	return c.hugetlb.ReadUint(hugetlbFile(size, "failcnt"))
+}
+
+// SetRDMAMax write rdma.max to limit the resources of the device, e.g.
+// "mlx4_0", "hca_handle=2 hca_object=2000", "max" removes the limit
+func (c *Cgroup) SetRDMAMax(device, limit string) error {
+	if c.rdma.path == "" {
+		return nil
+	}
+	return c.rdma.WriteFile("rdma.max", []byte(device+" "+limit))
+}
+
+func hugetlbFile(size, name string) string {
+	return fmt.Sprintf("hugetlb.%s.%s", size, name)
+}
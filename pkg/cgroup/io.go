@@ -0,0 +1,179 @@
+package cgroup
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IOLimit is the throttling of the block device (MAJ:MIN), 0 for unlimited
+type IOLimit struct {
+	Major, Minor                           uint32
+	ReadBps, WriteBps, ReadIOPS, WriteIOPS uint64
+}
+
+// IOStat is the io accounting summed over all block devices
+type IOStat struct {
+	ReadBytes, WriteBytes uint64
+	ReadIOs, WriteIOs     uint64
+}
+
+// ParseIOLimit parses the io.max format of cgroup v2, e.g.
+// "8:0 rbps=1048576 wiops=120", missing keys or "max" means unlimited
+func ParseIOLimit(s string) (IOLimit, error) {
+	var l IOLimit
+	f := strings.Fields(s)
+	if len(f) == 0 {
+		return l, fmt.Errorf("cgroup: empty io limit")
+	}
+	if _, err := fmt.Sscanf(f[0], "%d:%d", &l.Major, &l.Minor); err != nil {
+		return l, fmt.Errorf("cgroup: invalid device %q", f[0])
+	}
+	for _, kv := range f[1:] {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			return l, fmt.Errorf("cgroup: invalid io limit %q", kv)
+		}
+		var v uint64
+		if p[1] != "max" {
+			var err error
+			if v, err = strconv.ParseUint(p[1], 10, 64); err != nil {
+				return l, fmt.Errorf("cgroup: invalid io limit %q", kv)
+			}
+		}
+		switch p[0] {
+		case "rbps":
+			l.ReadBps = v
+		case "wbps":
+			l.WriteBps = v
+		case "riops":
+			l.ReadIOPS = v
+		case "wiops":
+			l.WriteIOPS = v
+		default:
+			return l, fmt.Errorf("cgroup: invalid io limit %q", kv)
+		}
+	}
+	return l, nil
+}
+
+func (l IOLimit) String() string {
+	v := func(i uint64) string {
+		if i == 0 {
+			return "max"
+		}
+		return strconv.FormatUint(i, 10)
+	}
+	return fmt.Sprintf("%d:%d rbps=%s wbps=%s riops=%s wiops=%s", l.Major, l.Minor,
+		v(l.ReadBps), v(l.WriteBps), v(l.ReadIOPS), v(l.WriteIOPS))
+}
+
+// SetIOMax write io.max for v2, or blkio.throttle.*_device for v1
+func (c *Cgroup) SetIOMax(l IOLimit) error {
+	if c.io.path == "" {
+		return nil
+	}
+	if c.typ == TypeV2 {
+		return c.io.WriteFile("io.max", []byte(l.String()))
+	}
+	for _, t := range []struct {
+		name string
+		v    uint64
+	}{
+		{"blkio.throttle.read_bps_device", l.ReadBps},
+		{"blkio.throttle.write_bps_device", l.WriteBps},
+		{"blkio.throttle.read_iops_device", l.ReadIOPS},
+		{"blkio.throttle.write_iops_device", l.WriteIOPS},
+	} {
+		// 0 removes the rule
+		s := fmt.Sprintf("%d:%d %d", l.Major, l.Minor, t.v)
+		if err := c.io.WriteFile(t.name, []byte(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IOStat read io.stat for v2, or blkio.throttle.io_service_bytes and
+// blkio.throttle.io_serviced for v1. Buffered writes are only accounted by v2
+// when written back
+func (c *Cgroup) IOStat() (IOStat, error) {
+	var s IOStat
+	if c.io.path == "" {
+		return s, ErrNotInitialized
+	}
+	if c.typ == TypeV2 {
+		b, err := c.io.ReadFile("io.stat")
+		if err != nil {
+			return s, err
+		}
+		return parseIOStat(b), nil
+	}
+
+	var err error
+	if s.ReadBytes, s.WriteBytes, err = c.io.readBlkioStat("blkio.throttle.io_service_bytes"); err != nil {
+		return s, err
+	}
+	if s.ReadIOs, s.WriteIOs, err = c.io.readBlkioStat("blkio.throttle.io_serviced"); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// readBlkioStat sums Read and Write of the blkio stat file
+func (c *SubCgroup) readBlkioStat(filename string) (r, w uint64, err error) {
+	b, err := c.ReadFile(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, w = parseBlkioStat(b)
+	return r, w, nil
+}
+
+// parseIOStat sums lines of "MAJ:MIN rbytes=.. wbytes=.. rios=.. wios=.. .."
+func parseIOStat(b []byte) IOStat {
+	var s IOStat
+	for _, l := range bytes.Split(b, []byte{'\n'}) {
+		f := strings.Fields(string(l))
+		if len(f) == 0 {
+			continue
+		}
+		for _, kv := range f[1:] {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) != 2 {
+				continue
+			}
+			v, _ := strconv.ParseUint(p[1], 10, 64)
+			switch p[0] {
+			case "rbytes":
+				s.ReadBytes += v
+			case "wbytes":
+				s.WriteBytes += v
+			case "rios":
+				s.ReadIOs += v
+			case "wios":
+				s.WriteIOs += v
+			}
+		}
+	}
+	return s
+}
+
+// parseBlkioStat sums Read and Write from the lines of "MAJ:MIN Op value"
+func parseBlkioStat(b []byte) (r, w uint64) {
+	for _, l := range bytes.Split(b, []byte{'\n'}) {
+		f := strings.Fields(string(l))
+		if len(f) != 3 {
+			continue
+		}
+		v, _ := strconv.ParseUint(f[2], 10, 64)
+		switch f[1] {
+		case "Read":
+			r += v
+		case "Write":
+			w += v
+		}
+	}
+	return r, w
+}
@@ -0,0 +1,80 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// OOMNotifier learns whether processes in the memory cgroup are killed by OOM
+// killer, by eventfd registered on memory.oom_control for v1, or oom_kill
+// counter of memory.events for v2. Both are signaled before the killed
+// process exits, so that it is definitive after the process is reaped
+type OOMNotifier struct {
+	efd    int // v1
+	events *SubCgroup
+	base   uint64 // v2 oom_kill counter when created
+	killed bool
+}
+
+// NotifyOOM creates OOMNotifier for the memory cgroup, which need to be
+// created before the process runs
+func (c *Cgroup) NotifyOOM() (*OOMNotifier, error) {
+	if c.memory.path == "" {
+		return nil, ErrNotInitialized
+	}
+	if c.typ == TypeV2 {
+		base, err := c.memory.readProperty("memory.events", "oom_kill")
+		if err != nil {
+			return nil, err
+		}
+		return &OOMNotifier{efd: -1, events: c.memory, base: base}, nil
+	}
+
+	ctl, err := os.Open(path.Join(c.memory.path, "memory.oom_control"))
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close()
+
+	fd, _, errno := syscall.Syscall(unix.SYS_EVENTFD2, 0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("cgroup: eventfd: %v", errno)
+	}
+	reg := fmt.Sprintf("%d %d", fd, ctl.Fd())
+	if err := c.memory.WriteFile("cgroup.event_control", []byte(reg)); err != nil {
+		syscall.Close(int(fd))
+		return nil, err
+	}
+	return &OOMNotifier{efd: int(fd)}, nil
+}
+
+// OOMKilled reports whether any OOM event happened since the notifier created
+func (n *OOMNotifier) OOMKilled() bool {
+	if n.killed {
+		return true
+	}
+	if n.efd >= 0 {
+		// read fails with EAGAIN if the counter is 0
+		var b [8]byte
+		_, err := syscall.Read(n.efd, b[:])
+		n.killed = err == nil
+	} else {
+		cnt, err := n.events.readProperty("memory.events", "oom_kill")
+		n.killed = err == nil && cnt > n.base
+	}
+	return n.killed
+}
+
+// Close releases the eventfd (v1), the registration is removed with it
+func (n *OOMNotifier) Close() error {
+	if n.efd < 0 {
+		return nil
+	}
+	err := syscall.Close(n.efd)
+	n.efd = -1
+	return err
+}
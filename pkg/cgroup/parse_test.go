@@ -0,0 +1,137 @@
+package cgroup
+
+import "testing"
+
+func TestFindProperty(t *testing.T) {
+	content := []byte("usage_usec 1500\nuser_usec 1000\nsystem_usec 500\nnr 7")
+	tests := []struct {
+		prop string
+		want uint64
+		err  bool
+	}{
+		{"usage_usec", 1500, false},
+		{"system_usec", 500, false},
+		{"nr", 7, false},
+		{"user", 0, true},
+		{"usec", 0, true},
+		{"missing", 0, true},
+	}
+	for _, tc := range tests {
+		v, err := findProperty(content, tc.prop)
+		if (err != nil) != tc.err || v != tc.want {
+			t.Errorf("findProperty(%q) = %d, %v, want %d", tc.prop, v, err, tc.want)
+		}
+	}
+	if _, err := findProperty([]byte("file abc\n"), "file"); err == nil {
+		t.Error("findProperty: expected error for invalid value")
+	}
+}
+
+func TestParseUint(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		err  bool
+	}{
+		{"4096\n", 4096, false},
+		{"0 \n", 0, false},
+		{"18446744073709551615", 1<<64 - 1, false},
+		{"max\n", 0, true},
+		{"", 0, true},
+	}
+	for _, tc := range tests {
+		v, err := parseUint([]byte(tc.in))
+		if (err != nil) != tc.err || v != tc.want {
+			t.Errorf("parseUint(%q) = %d, %v, want %d", tc.in, v, err, tc.want)
+		}
+	}
+}
+
+func TestParsePressure(t *testing.T) {
+	p, err := parsePressure([]byte("some avg10=0.00 avg60=0.00 avg300=0.00 total=1234\n" +
+		"full avg10=0.00 avg60=0.00 avg300=0.00 total=56\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != (Pressure{Some: 1234, Full: 56}) {
+		t.Errorf("parsePressure = %+v", p)
+	}
+	// cpu.pressure has no full line before linux 5.13
+	if p, err = parsePressure([]byte("some avg10=0.00 avg60=0.00 avg300=0.00 total=7\n")); err != nil || p != (Pressure{Some: 7}) {
+		t.Errorf("parsePressure = %+v, %v", p, err)
+	}
+	if _, err = parsePressure([]byte("some total=x\n")); err == nil {
+		t.Error("parsePressure: expected error for invalid total")
+	}
+}
+
+func TestParseIOStat(t *testing.T) {
+	s := parseIOStat([]byte("8:0 rbytes=100 wbytes=200 rios=1 wios=2 dbytes=0 dios=0\n" +
+		"8:16 rbytes=10 wbytes=20 rios=3 wios=4 dbytes=0 dios=0\n"))
+	want := IOStat{ReadBytes: 110, WriteBytes: 220, ReadIOs: 4, WriteIOs: 6}
+	if s != want {
+		t.Errorf("parseIOStat = %+v, want %+v", s, want)
+	}
+}
+
+func TestParseBlkioStat(t *testing.T) {
+	r, w := parseBlkioStat([]byte("8:0 Read 100\n8:0 Write 200\n8:0 Sync 300\n8:0 Total 300\n" +
+		"8:16 Read 10\n8:16 Write 20\nTotal 330\n"))
+	if r != 110 || w != 220 {
+		t.Errorf("parseBlkioStat = %d, %d, want 110, 220", r, w)
+	}
+}
+
+func TestParseIOLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want IOLimit
+		str  string
+	}{
+		{"8:0 rbps=1048576 wiops=120", IOLimit{Major: 8, Minor: 0, ReadBps: 1048576, WriteIOPS: 120},
+			"8:0 rbps=1048576 wbps=max riops=max wiops=120"},
+		{"259:1 rbps=max wbps=2 riops=3 wiops=max", IOLimit{Major: 259, Minor: 1, WriteBps: 2, ReadIOPS: 3},
+			"259:1 rbps=max wbps=2 riops=3 wiops=max"},
+		{"8:16", IOLimit{Major: 8, Minor: 16}, "8:16 rbps=max wbps=max riops=max wiops=max"},
+	}
+	for _, tc := range tests {
+		l, err := ParseIOLimit(tc.in)
+		if err != nil {
+			t.Errorf("ParseIOLimit(%q): %v", tc.in, err)
+			continue
+		}
+		if l != tc.want {
+			t.Errorf("ParseIOLimit(%q) = %+v, want %+v", tc.in, l, tc.want)
+		}
+		if s := l.String(); s != tc.str {
+			t.Errorf("String() = %q, want %q", s, tc.str)
+		}
+		if l2, err := ParseIOLimit(l.String()); err != nil || l2 != l {
+			t.Errorf("ParseIOLimit(String()) = %+v, %v, want %+v", l2, err, l)
+		}
+	}
+	for _, s := range []string{"", "8", "a:b", "8:0 rbps", "8:0 rbps=x", "8:0 foo=1"} {
+		if _, err := ParseIOLimit(s); err == nil {
+			t.Errorf("ParseIOLimit(%q): expected error", s)
+		}
+	}
+}
+
+func TestControllerString(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{cpuString(0, 100000), "cpu"},
+		{cpuString(50000, 100000), "cpu(max=50000/100000)"},
+		{cpusetString("", ""), "cpuset"},
+		{cpusetString("0-1", "0"), "cpuset(cpus=0-1,mems=0)"},
+		{pidsString(0), "pids"},
+		{pidsString(10), "pids(max=10)"},
+		{hugetlbFile("2MB", "max"), "hugetlb.2MB.max"},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("got %q, want %q", tc.got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cgroup
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Pressure is the total stall time (in us) of the resource by PSI (pressure
+// stall information), Some is the time at least one task stalled and Full is
+// the time all tasks stalled
+type Pressure struct {
+	Some, Full uint64
+}
+
+// PressureStat is the PSI of cpu, memory and io
+type PressureStat struct {
+	CPU, Memory, IO Pressure
+}
+
+// Pressure read cpu.pressure, memory.pressure and io.pressure (cgroup v2 only,
+// linux 4.20+ with PSI enabled)
+func (c *Cgroup) Pressure() (PressureStat, error) {
+	var (
+		s   PressureStat
+		err error
+	)
+	if c.typ != TypeV2 {
+		return s, ErrNotSupported
+	}
+	if s.CPU, err = c.unified.readPressure("cpu.pressure"); err != nil {
+		return s, err
+	}
+	if s.Memory, err = c.unified.readPressure("memory.pressure"); err != nil {
+		return s, err
+	}
+	if s.IO, err = c.unified.readPressure("io.pressure"); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// readPressure reads the pressure file
+func (c *SubCgroup) readPressure(filename string) (Pressure, error) {
+	b, err := c.ReadFile(filename)
+	if err != nil {
+		return Pressure{}, err
+	}
+	return parsePressure(b)
+}
+
+// parsePressure parses total of lines of "some|full avg10=.. avg60=.. avg300=.. total=.."
+func parsePressure(b []byte) (Pressure, error) {
+	var p Pressure
+	for _, l := range bytes.Split(b, []byte{'\n'}) {
+		f := strings.Fields(string(l))
+		if len(f) == 0 {
+			continue
+		}
+		for _, kv := range f[1:] {
+			if !strings.HasPrefix(kv, "total=") {
+				continue
+			}
+			v, err := strconv.ParseUint(kv[len("total="):], 10, 64)
+			if err != nil {
+				return p, err
+			}
+			switch f[0] {
+			case "some":
+				p.Some = v
+			case "full":
+				p.Full = v
+			}
+		}
+	}
+	return p, nil
+}
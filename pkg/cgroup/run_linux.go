@@ -0,0 +1,95 @@
+package cgroup
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// Run manages the lifecycle of the cgroup created for a single run. The
+// process is attached by Attach (e.g. as SyncFunc of the runner), the final
+// usage is collected by Stat, and Close kills the remaining processes and
+// removes the cgroup. Close should be deferred right after Start so that the
+// cgroup is cleaned up even on panic
+type Run struct {
+	*Cgroup
+	oom    *OOMNotifier
+	stat   *StatReader
+	closed bool
+}
+
+const (
+	destroyRetry    = 100
+	destroyInterval = time.Millisecond
+)
+
+// Start builds the cgroup for a single run with the limits of the builder
+func (b *Builder) Start() (*Run, error) {
+	cg, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	r := &Run{Cgroup: cg, stat: cg.NewStatReader()}
+	if cg.memory.path != "" {
+		// eventfd is best effort, oom_kill counter is used if failed
+		r.oom, _ = cg.NotifyOOM()
+	}
+	return r, nil
+}
+
+// Attach adds the process into the cgroup
+func (r *Run) Attach(pid int) error {
+	return r.AddProc(pid)
+}
+
+// OOMKilled reports whether any process in the run was killed by OOM killer
+func (r *Run) OOMKilled() bool {
+	if r.oom != nil {
+		return r.oom.OOMKilled()
+	}
+	n, err := r.MemoryOOMKill()
+	return err == nil && n > 0
+}
+
+// ForkLimitHit reports whether any fork / clone in the run failed by pids.max
+func (r *Run) ForkLimitHit() bool {
+	n, err := r.PidsEventsMax()
+	return err == nil && n > 0
+}
+
+// Stat collects the final resource usage of the run, error is returned only
+// if cpu or memory usage of the enabled controller could not be read
+func (r *Run) Stat() (Stat, error) {
+	var s Stat
+	if err := r.stat.Read(&s); err != nil {
+		return s, err
+	}
+	if r.memory.path != "" {
+		s.OOMKilled = r.OOMKilled()
+	}
+	return s, nil
+}
+
+// Close kills the remaining processes and removes the cgroup, it is safe to be
+// called more than once
+func (r *Run) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.oom != nil {
+		r.oom.Close()
+	}
+	r.Kill()
+	// the killed processes leave the cgroup asynchronously
+	var err error
+	for i := 0; i < destroyRetry; i++ {
+		if i > 0 {
+			time.Sleep(destroyInterval)
+		}
+		if err = r.Destroy(); !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package cgroup
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// startRun starts a run with cpuacct, memory and pids, skipped if not root or
+// cgroup not available
+func startRun(t *testing.T) *Run {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	b, err := NewBuilder("test").WithCPUAcct().WithMemory().WithPids().FilterByEnv()
+	if err != nil {
+		t.Skip("cgroup not available: ", err)
+	}
+	r, err := b.Start()
+	if err != nil {
+		t.Skip("cgroup not available: ", err)
+	}
+	return r
+}
+
+// startProc starts the command stopped by SIGSTOP so that it is attached
+// before running
+func startProc(t *testing.T, r *Run, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command("/bin/sh", "-c", "kill -STOP $$; exec \"$0\" \"$@\"", name)
+	cmd.Args = append(cmd.Args, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(cmd.Process.Pid, &ws, syscall.WUNTRACED, nil); err != nil || !ws.Stopped() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal("failed to stop the process: ", err)
+	}
+	if err := r.Attach(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal(err)
+	}
+	cmd.Process.Signal(syscall.SIGCONT)
+	return cmd
+}
+
+func TestRunAttach(t *testing.T) {
+	r := startRun(t)
+	defer r.Close()
+
+	cmd := startProc(t, r, "/bin/sh", "-c", "i=0; while [ $i -lt 10000 ]; do i=$((i+1)); done")
+	b, err := r.procsCgroup().ReadFile(cgroupProcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, f := range strings.Fields(string(b)) {
+		found = found || f == strconv.Itoa(cmd.Process.Pid)
+	}
+	if !found {
+		t.Errorf("cgroup.procs = %q, missing %d", b, cmd.Process.Pid)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := r.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CPUUsage == 0 {
+		t.Error("CPUUsage is 0")
+	}
+	if r.memory.path != "" && s.MemoryPeak == 0 {
+		t.Error("MemoryPeak is 0")
+	}
+	if s.OOMKilled {
+		t.Error("unexpected OOMKilled")
+	}
+}
+
+func TestRunClose(t *testing.T) {
+	r := startRun(t)
+	p := r.procsCgroup().path
+
+	cmd := startProc(t, r, "/bin/sleep", "100")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err := cmd.Wait()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || !ws.Signaled() || ws.Signal() != syscall.SIGKILL {
+		t.Errorf("process not killed: %v", err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("cgroup %s not removed: %v", p, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
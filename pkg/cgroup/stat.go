@@ -0,0 +1,184 @@
+package cgroup
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Stat is the final resource usage of the run, fields are zero if the
+// controller is not enabled or the file is not available
+type Stat struct {
+	CPUUsage    time.Duration
+	MemoryPeak  uint64
+	MemoryCache uint64 // page cache, included in MemoryPeak
+	SwapPeak    uint64
+	PidsPeak    uint64 // linux 6.1+
+	IO          IOStat
+	Pressure    *PressureStat // cgroup v2 only
+
+	OOMKilled    bool
+	ForkLimitHit bool
+}
+
+// StatReader collects Stat of the cgroup by a single read of each file. The
+// file paths are resolved when created and the read buffer is reused, so that
+// it is cheap to be called for every run
+type StatReader struct {
+	files []statFile
+	buf   []byte
+}
+
+type statFile struct {
+	path     string
+	required bool // error is returned if failed to read
+	parse    func(s *Stat, b []byte) error
+}
+
+const statBufSize = 4 << 10
+
+// NewStatReader creates StatReader for the enabled controllers of the cgroup
+func (c *Cgroup) NewStatReader() *StatReader {
+	r := &StatReader{buf: make([]byte, statBufSize)}
+	add := func(s *SubCgroup, name string, required bool, parse func(*Stat, []byte) error) {
+		if s.path != "" {
+			r.files = append(r.files, statFile{path.Join(s.path, name), required, parse})
+		}
+	}
+	if c.typ == TypeV2 {
+		add(c.cpuacct, "cpu.stat", true, func(s *Stat, b []byte) error {
+			us, err := findProperty(b, "usage_usec")
+			s.CPUUsage = time.Duration(us) * time.Microsecond
+			return err
+		})
+		add(c.memory, "memory.peak", true, func(s *Stat, b []byte) (err error) {
+			s.MemoryPeak, err = parseUint(b)
+			return
+		})
+		add(c.memory, "memory.stat", false, func(s *Stat, b []byte) (err error) {
+			s.MemoryCache, err = findProperty(b, "file")
+			return
+		})
+		add(c.memory, "memory.swap.peak", false, func(s *Stat, b []byte) (err error) {
+			s.SwapPeak, err = parseUint(b)
+			return
+		})
+		add(c.io, "io.stat", false, func(s *Stat, b []byte) error {
+			s.IO = parseIOStat(b)
+			return nil
+		})
+		for _, p := range []struct {
+			name string
+			f    func(*PressureStat) *Pressure
+		}{
+			{"cpu.pressure", func(p *PressureStat) *Pressure { return &p.CPU }},
+			{"memory.pressure", func(p *PressureStat) *Pressure { return &p.Memory }},
+			{"io.pressure", func(p *PressureStat) *Pressure { return &p.IO }},
+		} {
+			f := p.f
+			add(c.unified, p.name, false, func(s *Stat, b []byte) (err error) {
+				if s.Pressure == nil {
+					s.Pressure = new(PressureStat)
+				}
+				*f(s.Pressure), err = parsePressure(b)
+				return
+			})
+		}
+	} else {
+		add(c.cpuacct, "cpuacct.usage", true, func(s *Stat, b []byte) error {
+			ns, err := parseUint(b)
+			s.CPUUsage = time.Duration(ns)
+			return err
+		})
+		add(c.memory, "memory.max_usage_in_bytes", true, func(s *Stat, b []byte) (err error) {
+			s.MemoryPeak, err = parseUint(b)
+			return
+		})
+		add(c.memory, "memory.stat", false, func(s *Stat, b []byte) (err error) {
+			s.MemoryCache, err = findProperty(b, "cache")
+			return
+		})
+		// after memory.max_usage_in_bytes as memsw includes memory
+		add(c.memory, "memory.memsw.max_usage_in_bytes", false, func(s *Stat, b []byte) error {
+			memsw, err := parseUint(b)
+			if err == nil && memsw > s.MemoryPeak {
+				s.SwapPeak = memsw - s.MemoryPeak
+			}
+			return err
+		})
+		add(c.io, "blkio.throttle.io_service_bytes", false, func(s *Stat, b []byte) error {
+			s.IO.ReadBytes, s.IO.WriteBytes = parseBlkioStat(b)
+			return nil
+		})
+		add(c.io, "blkio.throttle.io_serviced", false, func(s *Stat, b []byte) error {
+			s.IO.ReadIOs, s.IO.WriteIOs = parseBlkioStat(b)
+			return nil
+		})
+	}
+	add(c.pids, "pids.peak", false, func(s *Stat, b []byte) (err error) {
+		s.PidsPeak, err = parseUint(b)
+		return
+	})
+	add(c.pids, "pids.events", false, func(s *Stat, b []byte) error {
+		n, err := findProperty(b, "max")
+		s.ForkLimitHit = n > 0
+		return err
+	})
+	return r
+}
+
+// Read collects the stat into s, error is returned only if cpu or memory usage
+// of the enabled controller could not be read. OOMKilled is not collected
+func (r *StatReader) Read(s *Stat) error {
+	*s = Stat{}
+	for _, f := range r.files {
+		b, err := r.readFile(f.path)
+		if err == nil {
+			err = f.parse(s, b)
+		}
+		if err != nil && f.required {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile reads the whole file into the reused buffer, which is valid until
+// the next read
+func (r *StatReader) readFile(p string) ([]byte, error) {
+	fd, err := syscall.Open(p, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	for err == syscall.EINTR {
+		fd, err = syscall.Open(p, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	n := 0
+	for {
+		if n == len(r.buf) {
+			r.buf = append(r.buf, make([]byte, len(r.buf))...)
+		}
+		m, err := syscall.Read(fd, r.buf[n:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "read", Path: p, Err: err}
+		}
+		if m == 0 {
+			return r.buf[:n], nil
+		}
+		n += m
+	}
+}
+
+func parseUint(b []byte) (uint64, error) {
+	for len(b) > 0 && (b[len(b)-1] == '\n' || b[len(b)-1] == ' ') {
+		b = b[:len(b)-1]
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
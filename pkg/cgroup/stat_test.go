@@ -0,0 +1,146 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCgroup creates a cgroup with all controllers at a temp dir filled with
+// the files
+func fakeCgroup(t *testing.T, typ Type, files map[string]string) *Cgroup {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for n, c := range files {
+		if err := ioutil.WriteFile(path.Join(dir, n), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newCgroup("", typ)
+	for _, ctl := range controllers {
+		*ctl.sub(c) = NewSubCgroup(dir)
+	}
+	if typ == TypeV2 {
+		c.unified = NewSubCgroup(dir)
+	}
+	return c
+}
+
+func TestStatReaderV2(t *testing.T) {
+	c := fakeCgroup(t, TypeV2, map[string]string{
+		"cpu.stat":         "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\n",
+		"memory.peak":      "8192\n",
+		"memory.stat":      "anon 4096\nfile 2048\n",
+		"memory.swap.peak": "1024\n",
+		"io.stat":          "8:0 rbytes=100 wbytes=200 rios=1 wios=2\n",
+		"cpu.pressure":     "some avg10=0.00 avg60=0.00 avg300=0.00 total=10\n",
+		"memory.pressure":  "some avg10=0.00 avg60=0.00 avg300=0.00 total=20\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=5\n",
+		"pids.peak":        "3\n",
+		"pids.events":      "max 1\n",
+	})
+	var s Stat
+	if err := c.NewStatReader().Read(&s); err != nil {
+		t.Fatal(err)
+	}
+	want := Stat{
+		CPUUsage:     1500 * time.Microsecond,
+		MemoryPeak:   8192,
+		MemoryCache:  2048,
+		SwapPeak:     1024,
+		PidsPeak:     3,
+		IO:           IOStat{ReadBytes: 100, WriteBytes: 200, ReadIOs: 1, WriteIOs: 2},
+		ForkLimitHit: true,
+	}
+	if s.Pressure == nil || *s.Pressure != (PressureStat{CPU: Pressure{Some: 10}, Memory: Pressure{Some: 20, Full: 5}}) {
+		t.Errorf("Pressure = %+v", s.Pressure)
+	}
+	s.Pressure = nil
+	if s != want {
+		t.Errorf("Read = %+v, want %+v", s, want)
+	}
+}
+
+func TestStatReaderV1(t *testing.T) {
+	c := fakeCgroup(t, TypeV1, map[string]string{
+		"cpuacct.usage":                   "2000000\n",
+		"memory.max_usage_in_bytes":       "8192\n",
+		"memory.stat":                     "cache 2048\nrss 4096\n",
+		"memory.memsw.max_usage_in_bytes": "9216\n",
+		"blkio.throttle.io_service_bytes": "8:0 Read 100\n8:0 Write 200\nTotal 300\n",
+		"blkio.throttle.io_serviced":      "8:0 Read 1\n8:0 Write 2\nTotal 3\n",
+		"pids.events":                     "max 0\n",
+	})
+	var s Stat
+	if err := c.NewStatReader().Read(&s); err != nil {
+		t.Fatal(err)
+	}
+	want := Stat{
+		CPUUsage:    2 * time.Millisecond,
+		MemoryPeak:  8192,
+		MemoryCache: 2048,
+		SwapPeak:    1024,
+		IO:          IOStat{ReadBytes: 100, WriteBytes: 200, ReadIOs: 1, WriteIOs: 2},
+	}
+	if s != want {
+		t.Errorf("Read = %+v, want %+v", s, want)
+	}
+}
+
+func TestStatReaderRequired(t *testing.T) {
+	// optional files missing are ignored
+	c := fakeCgroup(t, TypeV2, map[string]string{
+		"cpu.stat":    "usage_usec 1\n",
+		"memory.peak": "2\n",
+	})
+	var s Stat
+	if err := c.NewStatReader().Read(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.CPUUsage != time.Microsecond || s.MemoryPeak != 2 || s.Pressure != nil {
+		t.Errorf("Read = %+v", s)
+	}
+
+	// required file missing
+	c = fakeCgroup(t, TypeV2, map[string]string{"cpu.stat": "usage_usec 1\n"})
+	if err := c.NewStatReader().Read(&s); !os.IsNotExist(err) {
+		t.Errorf("Read: got %v, want not exist", err)
+	}
+	// required file invalid
+	c = fakeCgroup(t, TypeV2, map[string]string{"cpu.stat": "usage_usec 1\n", "memory.peak": "max\n"})
+	if err := c.NewStatReader().Read(&s); err == nil {
+		t.Error("Read: expected error for invalid memory.peak")
+	}
+}
+
+func TestStatReaderLargeFile(t *testing.T) {
+	// the property is beyond the initial buffer
+	c := fakeCgroup(t, TypeV2, map[string]string{
+		"cpu.stat":    "usage_usec 1\n",
+		"memory.peak": "2\n",
+		"memory.stat": strings.Repeat("anon 0\n", statBufSize/7+10) + "file 42\n",
+	})
+	r := c.NewStatReader()
+	var s Stat
+	if err := r.Read(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.MemoryCache != 42 {
+		t.Errorf("MemoryCache = %d, want 42", s.MemoryCache)
+	}
+	if len(r.buf) <= statBufSize {
+		t.Errorf("buffer not grown: %d", len(r.buf))
+	}
+}
+
+func TestStatReaderDisabled(t *testing.T) {
+	// no files for controllers not enabled
+	if r := newCgroup("", TypeV2).NewStatReader(); len(r.files) != 0 {
+		t.Errorf("files = %v, want none", r.files)
+	}
+}
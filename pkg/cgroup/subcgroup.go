@@ -3,6 +3,7 @@ package cgroup
 import (
 	"errors"
 	"io/ioutil"
+	"os"
 	"path"
 	"strconv"
 	"strings"
@@ -46,6 +47,42 @@ func (c *SubCgroup) ReadUint(filename string) (uint64, error) {
 	return s, nil
 }
 
+// exists checks whether the file exists in the cgroup, since cgroup files
+// could not be created
+func (c *SubCgroup) exists(filename string) bool {
+	_, err := os.Stat(path.Join(c.path, filename))
+	return err == nil
+}
+
+// killProcs sends SIGKILL to processes in cgroup.procs and returns the count
+func (c *SubCgroup) killProcs() (int, error) {
+	b, err := c.ReadFile(cgroupProcs)
+	if err != nil {
+		return 0, err
+	}
+	pids := strings.Fields(string(b))
+	for _, s := range pids {
+		p, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, err
+		}
+		syscall.Kill(p, syscall.SIGKILL)
+	}
+	return len(pids), nil
+}
+
+// readProperty reads the property from the file of lines of "name value"
+func (c *SubCgroup) readProperty(filename, prop string) (uint64, error) {
+	if c.path == "" {
+		return 0, ErrNotInitialized
+	}
+	b, err := c.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return findProperty(b, prop)
+}
+
 // WriteFile writes cgroup file and handles potential EINTR error while writes to
 // the slow device (cgroup)
 func (c *SubCgroup) WriteFile(name string, content []byte) error {
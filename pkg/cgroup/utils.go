@@ -2,10 +2,12 @@ package cgroup
 
 import (
 	"bufio"
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"syscall"
 )
 
 // EnsureDirExists creates directories if the path not exists
@@ -37,7 +39,8 @@ func GetAllSubCgroup() (map[string]bool, error) {
 		text := s.Text()
 		if text[0] != '#' {
 			parts := strings.Fields(text)
-			if len(parts) >= 4 && parts[3] != "0" {
+			// hierarchy 0 is not mounted as v1 (e.g. bound to v2 in hybrid mode)
+			if len(parts) >= 4 && parts[1] != "0" && parts[3] != "0" {
 				rt[parts[0]] = true
 			}
 		}
@@ -47,3 +50,81 @@ func GetAllSubCgroup() (map[string]bool, error) {
 	}
 	return rt, nil
 }
+
+// DetectType detects whether /sys/fs/cgroup is the cgroup v2 unified hierarchy
+func DetectType() Type {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(basePath, &st); err != nil {
+		return TypeV1
+	}
+	if int64(st.Type) == cgroup2SuperMagic {
+		return TypeV2
+	}
+	return TypeV1
+}
+
+// GetAvailableController reads cgroup.controllers of the cgroup v2 root (e.g.
+// /sys/fs/cgroup or the delegated subtree) and get all available controllers
+// as set
+func GetAvailableController(root string) (map[string]bool, error) {
+	c, err := NewSubCgroup(root).ReadFile(cgroupControllers)
+	if err != nil {
+		return nil, err
+	}
+	rt := make(map[string]bool)
+	for _, s := range strings.Fields(string(c)) {
+		rt[s] = true
+	}
+	return rt, nil
+}
+
+// CreateV2Path creates path for cgroup v2 with given root and prefix, and
+// enables the controllers for the created path on the way from the root
+func CreateV2Path(root, prefix string, controllers []string) (string, error) {
+	base := path.Join(root, prefix)
+	EnsureDirExists(base)
+	if len(controllers) > 0 {
+		ctl := []byte("+" + strings.Join(controllers, " +"))
+		for _, p := range []string{root, base} {
+			if err := NewSubCgroup(p).WriteFile(cgroupSubtreeControl, ctl); err != nil {
+				return "", err
+			}
+		}
+	}
+	return ioutil.TempDir(base, "")
+}
+
+// sameHierarchy checks whether two cgroup v1 controllers are co-mounted in
+// the same hierarchy (e.g. cpu and cpuacct are links to cpu,cpuacct)
+func sameHierarchy(a, b string) bool {
+	sa, err := os.Stat(path.Join(basePath, a))
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(path.Join(basePath, b))
+	if err != nil {
+		return false
+	}
+	return os.SameFile(sa, sb)
+}
+
+// initCpuset copies cpuset.cpus and cpuset.mems from the parent if empty
+func initCpuset(p string) error {
+	c, parent := NewSubCgroup(p), NewSubCgroup(path.Dir(p))
+	for _, f := range []string{"cpuset.cpus", "cpuset.mems"} {
+		b, err := c.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			continue
+		}
+		if b, err = parent.ReadFile(f); err != nil {
+			return err
+		}
+		if err := c.WriteFile(f, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
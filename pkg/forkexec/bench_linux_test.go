@@ -27,6 +27,33 @@ func BenchmarkSimpleFork(b *testing.B) {
 	benchmarkRun(r, b)
 }
 
+// BenchmarkSimpleVfork is about 0.65ms/op
+func BenchmarkSimpleVfork(b *testing.B) {
+	r, f := getRunner(b)
+	defer f.Close()
+	r.Vfork = true
+	benchmarkRun(r, b)
+}
+
+// BenchmarkSimpleForkLargeHeap is about 6.2ms/op
+func BenchmarkSimpleForkLargeHeap(b *testing.B) {
+	heap := largeHeap()
+	r, f := getRunner(b)
+	defer f.Close()
+	benchmarkRun(r, b)
+	heap[0]++
+}
+
+// BenchmarkSimpleVforkLargeHeap is about 0.70ms/op
+func BenchmarkSimpleVforkLargeHeap(b *testing.B) {
+	heap := largeHeap()
+	r, f := getRunner(b)
+	defer f.Close()
+	r.Vfork = true
+	benchmarkRun(r, b)
+	heap[0]++
+}
+
 // BenchmarkUnsharePid is about 0.79ms/op
 func BenchmarkUnsharePid(b *testing.B) {
 	r, f := getRunner(b)
@@ -148,6 +175,15 @@ func benchmarkRun(r *Runner, b *testing.B) {
 	}
 }
 
+// largeHeap allocates and touches 256MiB so that fork copies its page tables
+func largeHeap() []byte {
+	heap := make([]byte, 256<<20)
+	for i := 0; i < len(heap); i += 4096 {
+		heap[i] = 1
+	}
+	return heap
+}
+
 func getMounts(dirs []string) []mount.SyscallParams {
 	builder := mount.NewBuilder()
 	for _, d := range dirs {
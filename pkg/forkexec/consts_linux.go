@@ -10,12 +10,31 @@ const (
 	SECCOMP_SET_MODE_FILTER   = 1
 	SECCOMP_FILTER_FLAG_TSYNC = 1
 
+	// Scheduling policies for SchedPolicy (sched.h)
+	SCHED_OTHER = 0
+	SCHED_BATCH = 3
+	SCHED_IDLE  = 5
+
 	// Unshare flags
 	UnshareFlags = unix.CLONE_NEWIPC | unix.CLONE_NEWNET | unix.CLONE_NEWNS |
 		unix.CLONE_NEWPID | unix.CLONE_NEWUSER | unix.CLONE_NEWUTS | unix.CLONE_NEWCGROUP
 
-	// Read-only bind mount need to be remounted
-	bindRo = unix.MS_BIND | unix.MS_RDONLY
+	// Bind mount with these flags need to be remounted
+	bindRemount = unix.MS_RDONLY | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME
+
+	// clone3 is not available in older syscall / x/sys packages
+	_SYS_CLONE3        = 435 // same on all architectures
+	_CLONE_INTO_CGROUP = 0x200000000
+
+	// time namespace (linux 5.6), only available by unshare
+	_CLONE_NEWTIME = 0x80
+
+	// close_range (linux 5.9, CLOSE_RANGE_CLOEXEC since 5.11)
+	_SYS_CLOSE_RANGE     = 436 // same on all architectures
+	_CLOSE_RANGE_CLOEXEC = 1 << 2
+
+	// personality flag to disable ASLR (sys/personality.h)
+	_ADDR_NO_RANDOMIZE = 0x0040000
 )
 
 // used by unshare remount / to private
@@ -25,6 +44,24 @@ var (
 	empty = []byte("\000")
 	tmpfs = []byte("tmpfs\000")
 
+	// overlay root
+	overlayFs = []byte("overlay\000")
+
+	// bring up loopback by ioctl(SIOCSIFFLAGS)
+	loopbackUp = ifreqFlags{
+		name:  [unix.IFNAMSIZ]byte{'l', 'o'},
+		flags: unix.IFF_UP | unix.IFF_RUNNING,
+	}
+
+	// SIGCHLD blocked and waited by the Hold child (sigset_t of the kernel)
+	sigchldMask uint64 = 1 << (unix.SIGCHLD - 1)
+
+	// time namespace clock offsets
+	timensOffsets = []byte("/proc/self/timens_offsets\000")
+
+	// fallback of close_range
+	procSelfFd = []byte("/proc/self/fd\000")
+
 	// tmp dir made by pivot_root
 	oldRoot = []byte("old_root\000")
 
@@ -35,17 +72,15 @@ var (
 	// go does not allow constant uintptr to be negative...
 	_AT_FDCWD = unix.AT_FDCWD
 
-	// Drop all capabilities
+	// sched_param for sched_setscheduler, priority must be 0 for
+	// SCHED_OTHER / SCHED_BATCH / SCHED_IDLE
+	schedParam int32
+
+	// capset header (Drop all capabilities / Caps)
 	dropCapHeader = unix.CapUserHeader{
 		Version: unix.LINUX_CAPABILITY_VERSION_3,
 		Pid:     0,
 	}
-
-	dropCapData = unix.CapUserData{
-		Effective:   0,
-		Permitted:   0,
-		Inheritable: 0,
-	}
 )
 
 const (
@@ -61,3 +96,25 @@ const (
 	_SECURE_NO_CAP_AMBIENT_RAISE
 	_SECURE_NO_CAP_AMBIENT_RAISE_LOCKED
 )
+
+// cloneArgs is struct clone_args for clone3 (linux/sched.h, CLONE_ARGS_SIZE_VER2)
+type cloneArgs struct {
+	flags      uint64
+	pidFD      uint64
+	childTID   uint64
+	parentTID  uint64
+	exitSignal uint64
+	stack      uint64
+	stackSize  uint64
+	tls        uint64
+	setTID     uint64
+	setTIDSize uint64
+	cgroup     uint64
+}
+
+// ifreqFlags is struct ifreq with ifr_flags (padded to the size of the union)
+type ifreqFlags struct {
+	name  [unix.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
@@ -0,0 +1,15 @@
+//go:build !arm && !386
+// +build !arm,!386
+
+package forkexec
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// set*id syscalls with 32-bit ids
+const (
+	sysSetgroups = unix.SYS_SETGROUPS
+	sysSetresgid = unix.SYS_SETRESGID
+	sysSetresuid = unix.SYS_SETRESUID
+)
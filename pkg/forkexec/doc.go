@@ -1,6 +1,7 @@
 // Package forkexec provides interface to run a subprocess with seccomp filter, rlimit and
 // containerized or ptraced.
 //
+// clone3 into cgroup (CgroupFd) requires kernel >= 5.7
 // unshare cgroup namespace requires kernel >= 4.6
 // seccomp, unshare pid / user namespaces requires kernel >= 3.8
 // pipe2, dup3 requires kernel >= 2.6.27
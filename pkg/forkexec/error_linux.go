@@ -0,0 +1,91 @@
+package forkexec
+
+import (
+	"syscall"
+)
+
+// Stage indicates where the child failed between fork and execve
+type Stage int
+
+// Stages of the child in order
+const (
+	StageUnknown     Stage = iota
+	StageSetns             // setns, fork into the joined pid namespace
+	StageUserNS            // wait for uid / gid mappings
+	StageTimeNS            // unshare time namespace, set clock offsets
+	StageFds               // securebits, fd assignment and close extra fds
+	StageSession           // setsid and controlling terminal
+	StageMount             // mount, pivot_root
+	StageHostname          // sethostname, setdomainname
+	StageNetwork           // bring up loopback
+	StageCredential        // setgroups, setresgid, setresuid
+	StagePdeathsig         // prctl(PR_SET_PDEATHSIG)
+	StageChdir             // chdir(WorkDir)
+	StageRLimit            // prlimit
+	StageSched             // sched_setaffinity, setpriority, sched_setscheduler
+	StagePersonality       // personality(ADDR_NO_RANDOMIZE)
+	StageNoNewPrivs        // prctl(PR_SET_NO_NEW_PRIVS)
+	StageCaps              // drop bounding set, capset, raise ambient
+	StageSync              // sync with parent
+	StageCgroupNS          // unshare(CLONE_NEWCGROUP) after sync
+	StagePtrace            // ptrace(PTRACE_TRACEME), stop before seccomp
+	StageSeccomp           // seccomp load filter
+	StageExecve            // execve / execveat
+)
+
+var stageNames = []string{
+	StageUnknown:     "unknown",
+	StageSetns:       "setns",
+	StageUserNS:      "user namespace",
+	StageTimeNS:      "time namespace",
+	StageFds:         "fds",
+	StageSession:     "session",
+	StageMount:       "mount",
+	StageHostname:    "hostname",
+	StageNetwork:     "network",
+	StageCredential:  "credential",
+	StagePdeathsig:   "pdeathsig",
+	StageChdir:       "chdir",
+	StageRLimit:      "rlimit",
+	StageSched:       "sched",
+	StagePersonality: "personality",
+	StageNoNewPrivs:  "no_new_privs",
+	StageCaps:        "capabilities",
+	StageSync:        "sync",
+	StageCgroupNS:    "cgroup namespace",
+	StagePtrace:      "ptrace",
+	StageSeccomp:     "seccomp",
+	StageExecve:      "execve",
+}
+
+func (s Stage) String() string {
+	if s < 0 || int(s) >= len(stageNames) {
+		return stageNames[StageUnknown]
+	}
+	return stageNames[s]
+}
+
+// ChildError is returned by Start if the child failed before execve,
+// it unwraps to the errno
+type ChildError struct {
+	Stage Stage
+	Err   syscall.Errno
+}
+
+func (e *ChildError) Error() string {
+	return "child " + e.Stage.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the errno
+func (e *ChildError) Unwrap() error {
+	return e.Err
+}
+
+// childStatus is written by the child through socket pair, Errno is 0 when
+// the child is ready to sync. Pid is the grandchild forked into the joined pid
+// namespace, reported by the child before it exits
+type childStatus struct {
+	Errno syscall.Errno
+	Stage Stage
+	Pid   uintptr
+}
@@ -0,0 +1,129 @@
+package forkexec
+
+import (
+	"debug/elf"
+	"errors"
+	"io"
+	"path"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Errors of the executable pre-check by CheckExec
+var (
+	ErrNotExecutable = errors.New("not executable")
+	ErrNotELF        = errors.New("not an ELF executable")
+	ErrWrongArch     = errors.New("wrong architecture")
+)
+
+// ExecError is returned by Start if the executable failed the pre-check
+type ExecError struct {
+	Path string
+	Err  error
+}
+
+func (e *ExecError) Error() string {
+	return "exec " + e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// supportedMachines are the ELF machines could be executed on the current
+// architecture (including 32-bit compat)
+var supportedMachines = map[string][]elf.Machine{
+	"amd64":   {elf.EM_X86_64, elf.EM_386},
+	"386":     {elf.EM_386},
+	"arm64":   {elf.EM_AARCH64, elf.EM_ARM},
+	"arm":     {elf.EM_ARM},
+	"riscv64": {elf.EM_RISCV},
+	"ppc64le": {elf.EM_PPC64},
+	"s390x":   {elf.EM_S390},
+	"mips64":  {elf.EM_MIPS},
+}
+
+// checkExec validates the executable (ExecFile or Args[0] resolved in the
+// current mount namespace) is a regular file with exec bit and is either a
+// script or an ELF for the current architecture
+func (r *Runner) checkExec() error {
+	fd, name := int(r.ExecFile), "fd"
+	if r.ExecFile == 0 {
+		// path inside the new root is not visible before fork
+		if r.PivotRoot != "" || len(r.Args) == 0 {
+			return nil
+		}
+		name = r.Args[0]
+		p := name
+		if !path.IsAbs(p) && r.WorkDir != "" {
+			p = path.Join(r.WorkDir, p)
+		}
+		var err error
+		if fd, err = unix.Open(p, unix.O_RDONLY|unix.O_CLOEXEC, 0); err != nil {
+			return &ExecError{Path: name, Err: err}
+		}
+		defer unix.Close(fd)
+	}
+	if err := checkExecFd(fd); err != nil {
+		return &ExecError{Path: name, Err: err}
+	}
+	return nil
+}
+
+func checkExecFd(fd int) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG || st.Mode&0111 == 0 {
+		return ErrNotExecutable
+	}
+
+	// interpreter script is checked by execve
+	var magic [4]byte
+	n, err := unix.Pread(fd, magic[:], 0)
+	if err != nil {
+		return err
+	}
+	if n >= 2 && string(magic[:2]) == "#!" {
+		return nil
+	}
+
+	f, err := elf.NewFile(fdReaderAt(fd))
+	if err != nil {
+		return ErrNotELF
+	}
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return ErrNotExecutable
+	}
+	machines, ok := supportedMachines[runtime.GOARCH]
+	if !ok {
+		return nil
+	}
+	for _, m := range machines {
+		if f.Machine == m {
+			return nil
+		}
+	}
+	return ErrWrongArch
+}
+
+// fdReaderAt reads the fd by pread without changing its offset
+type fdReaderAt int
+
+func (f fdReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := unix.Pread(int(f), p, off)
+	if err == syscall.EINTR {
+		return f.ReadAt(p, off)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
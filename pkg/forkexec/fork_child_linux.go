@@ -9,17 +9,67 @@ import (
 
 // Reference to src/syscall/exec_linux.go
 //go:norace
-func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, hostname, domainname, pivotRoot *byte, p [2]int) (r1 uintptr, err1 syscall.Errno) {
+func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, hostname, domainname, pivotRoot *byte, overlay *overlayParams, timeOffsets []byte, filters []*syscall.SockFprog, p [2]int) (r1 uintptr, err1 syscall.Errno) {
 	var (
 		pid         uintptr
 		err2        syscall.Errno
-		unshareUser = r.CloneFlags&unix.CLONE_NEWUSER == unix.CLONE_NEWUSER
+		stage       Stage       // current stage reported on error
+		status      childStatus // status written to parent
+		unshareUser = r.CloneFlags&unix.CLONE_NEWUSER == unix.CLONE_NEWUSER && len(r.Setns) == 0
+		cloneFlags  = r.CloneFlags & UnshareFlags
+		joinPid     bool
 	)
 
+	// namespaces are joined instead of created at clone
+	if len(r.Setns) > 0 {
+		cloneFlags = 0
+		for _, ns := range r.Setns {
+			joinPid = joinPid || ns.Type == unix.CLONE_NEWPID
+		}
+	}
+
 	// similar to exec_linux, avoid side effect by shuffling around
 	fd, nextfd := prepareFds(r.Files)
 	pipe := p[1]
 
+	// record parent pid so that child could test whether it has died
+	ppid, _, _ := syscall.RawSyscall(syscall.SYS_GETPID, 0, 0, 0)
+
+	// capabilities retained (cap_user_data_t for _LINUX_CAPABILITY_VERSION_3
+	// is 2 structs for 64 bits), all dropped if Caps is nil
+	var (
+		capData    [2]unix.CapUserData
+		capAmbient uint64
+	)
+	if c := r.Caps; c != nil {
+		capAmbient = c.Ambient & c.Permitted
+		capData[0].Permitted = uint32(c.Permitted)
+		capData[1].Permitted = uint32(c.Permitted >> 32)
+		capData[0].Effective = capData[0].Permitted
+		capData[1].Effective = capData[1].Permitted
+		capData[0].Inheritable = uint32(capAmbient)
+		capData[1].Inheritable = uint32(capAmbient >> 32)
+	}
+
+	// buffer for getdents64 of /proc/self/fd if close_range is not available
+	var dirBuf [512]byte
+
+	// fds closed by the Hold child if close_range is not available
+	var nofile syscall.Rlimit
+	if r.Hold {
+		syscall.Getrlimit(syscall.RLIMIT_NOFILE, &nofile)
+	}
+
+	// clone3 arguments should be prepared before fork
+	var clone3 *cloneArgs
+	if r.CgroupFd > 0 {
+		clone3 = &cloneArgs{
+			flags:      uint64(cloneFlags) | _CLONE_INTO_CGROUP,
+			exitSignal: uint64(syscall.SIGCHLD),
+			cgroup:     uint64(r.CgroupFd),
+		}
+	}
+
 	// Acquire the fork lock so that no other threads
 	// create new fds that are not yet close-on-exec
 	// before we fork.
@@ -30,7 +80,11 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 	beforeFork()
 
 	// UnshareFlags (new namespaces) is activated by clone syscall
-	r1, _, err1 = syscall.RawSyscall6(syscall.SYS_CLONE, uintptr(syscall.SIGCHLD)|(r.CloneFlags&UnshareFlags), 0, 0, 0, 0, 0)
+	if clone3 != nil {
+		r1, _, err1 = syscall.RawSyscall(_SYS_CLONE3, uintptr(unsafe.Pointer(clone3)), unsafe.Sizeof(*clone3), 0)
+	} else {
+		r1, _, err1 = syscall.RawSyscall6(syscall.SYS_CLONE, uintptr(syscall.SIGCHLD)|cloneFlags, 0, 0, 0, 0, 0)
+	}
 	if err1 != 0 || r1 != 0 {
 		// in parent process, immediate return
 		return
@@ -45,12 +99,53 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 		goto childerror
 	}
 
+	stage = StageSetns
+	// join the namespaces in order (user namespace first)
+	for _, ns := range r.Setns {
+		_, _, err1 = syscall.RawSyscall(unix.SYS_SETNS, ns.Fd, ns.Type, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	// setns of pid namespace only applies to children, fork again to enter it
+	// as a child of the parent (CLONE_PARENT) and report its pid
+	if joinPid {
+		r1, _, err1 = syscall.RawSyscall6(syscall.SYS_CLONE, uintptr(syscall.SIGCHLD)|syscall.CLONE_PARENT, 0, 0, 0, 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+		if r1 != 0 {
+			status.Pid = r1
+			syscall.RawSyscall(unix.SYS_WRITE, uintptr(pipe), uintptr(unsafe.Pointer(&status)), unsafe.Sizeof(status))
+			for {
+				syscall.RawSyscall(syscall.SYS_EXIT, 0, 0, 0)
+			}
+		}
+
+		// kill the remaining processes (e.g. of the previous run) except the init
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_KILL, ^uintptr(0), uintptr(syscall.SIGKILL), 0)
+		if err1 != 0 && err1 != syscall.ESRCH {
+			goto childerror
+		}
+	}
+
+	// unshare the rest in the joined user namespace
+	if len(r.Setns) > 0 && r.CloneFlags&^(unix.CLONE_NEWUSER|unix.CLONE_NEWPID) != 0 {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_UNSHARE, r.CloneFlags&^(unix.CLONE_NEWUSER|unix.CLONE_NEWPID), 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageUserNS
 	// If usernamespace is unshared, uid map and gid map is required to create folders
 	// and files
 	// We need parent to setup uid_map / gid_map for us since we do not have capabilities
 	// in the original namespace
 	// At the same time, socket pair / pipe synchronization is required as well
-	if unshareUser {
+	// the grandchild in the joined pid namespace waits for the parent as well
+	if unshareUser || joinPid {
 		r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(pipe), uintptr(unsafe.Pointer(&err2)), unsafe.Sizeof(err2))
 		if err1 != 0 {
 			goto childerror
@@ -65,6 +160,27 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 		}
 	}
 
+	stage = StageTimeNS
+	// unshare time namespace and set clock offsets before any process enters
+	// it (the child enters it on execve), /proc of the host is still visible
+	if r.TimeNamespace {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_UNSHARE, _CLONE_NEWTIME, 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+		r1, _, err1 = syscall.RawSyscall6(syscall.SYS_OPENAT, uintptr(_AT_FDCWD), uintptr(unsafe.Pointer(&timensOffsets[0])),
+			uintptr(syscall.O_WRONLY|syscall.O_CLOEXEC), 0, 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_WRITE, r1, uintptr(unsafe.Pointer(&timeOffsets[0])), uintptr(len(timeOffsets)))
+		syscall.RawSyscall(syscall.SYS_CLOSE, r1, 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageFds
 	// Get pid of child
 	pid, _, err1 = syscall.RawSyscall(syscall.SYS_GETPID, 0, 0, 0)
 	if err1 != 0 {
@@ -78,29 +194,6 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 		goto childerror
 	}
 
-	// set the credential for the child process(exec_linux.go)
-	if cred := r.Credential; cred != nil {
-		ngroups := uintptr(len(cred.Groups))
-		groups := uintptr(0)
-		if ngroups > 0 {
-			groups = uintptr(unsafe.Pointer(&cred.Groups[0]))
-		}
-		if !(r.GIDMappings != nil && !r.GIDMappingsEnableSetgroups && ngroups == 0) && !cred.NoSetGroups {
-			_, _, err1 = syscall.RawSyscall(unix.SYS_SETGROUPS, ngroups, groups, 0)
-			if err1 != 0 {
-				goto childerror
-			}
-		}
-		_, _, err1 = syscall.RawSyscall(unix.SYS_SETGID, uintptr(cred.Gid), 0, 0)
-		if err1 != 0 {
-			goto childerror
-		}
-		_, _, err1 = syscall.RawSyscall(unix.SYS_SETUID, uintptr(cred.Uid), 0, 0)
-		if err1 != 0 {
-			goto childerror
-		}
-	}
-
 	// Pass 1 & pass 2 assigns fds for child process
 	// Pass 1: fd[i] < i => nextfd
 	if pipe < nextfd {
@@ -154,12 +247,58 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 		}
 	}
 
+	// Mark fds beyond Files close on exec (fds used before execve are kept)
+	if r.CloseExtraFds {
+		_, _, err1 = syscall.RawSyscall(_SYS_CLOSE_RANGE, uintptr(len(fd)), ^uintptr(0), _CLOSE_RANGE_CLOEXEC)
+		if err1 == syscall.ENOSYS || err1 == syscall.EINVAL {
+			// linux < 5.11, iterate /proc/self/fd
+			r1, _, err1 = syscall.RawSyscall6(syscall.SYS_OPENAT, uintptr(_AT_FDCWD), uintptr(unsafe.Pointer(&procSelfFd[0])),
+				uintptr(syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC), 0, 0, 0)
+			if err1 != 0 {
+				goto childerror
+			}
+			dirFd := r1
+			for {
+				r1, _, err1 = syscall.RawSyscall(syscall.SYS_GETDENTS64, dirFd, uintptr(unsafe.Pointer(&dirBuf[0])), uintptr(len(dirBuf)))
+				if err1 != 0 {
+					goto childerror
+				}
+				if r1 == 0 {
+					break
+				}
+				// struct linux_dirent64 { ino u64; off s64; reclen u16; type u8; name [] }
+				for off := uintptr(0); off < r1; off += uintptr(*(*uint16)(unsafe.Pointer(&dirBuf[off+16]))) {
+					n, i := 0, off+19
+					for ; dirBuf[i] >= '0' && dirBuf[i] <= '9'; i++ {
+						n = n*10 + int(dirBuf[i]-'0')
+					}
+					if i == off+19 || dirBuf[i] != 0 || n < len(fd) || uintptr(n) == dirFd {
+						continue
+					}
+					syscall.RawSyscall(syscall.SYS_FCNTL, uintptr(n), syscall.F_SETFD, syscall.FD_CLOEXEC)
+				}
+			}
+			syscall.RawSyscall(syscall.SYS_CLOSE, dirFd, 0, 0)
+		} else if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageSession
 	// Set the session ID
 	_, _, err1 = syscall.RawSyscall(syscall.SYS_SETSID, 0, 0, 0)
 	if err1 != 0 {
 		goto childerror
 	}
 
+	// Set the controlling TTY (fd already moved to its place)
+	if r.Setctty {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_IOCTL, uintptr(r.Ctty), uintptr(syscall.TIOCSCTTY), 1)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
 	// Set the pgid, so that the wait operation can apply to only certain
 	// subgroup of processes
 	// _, _, err1 = syscall.RawSyscall(syscall.SYS_SETPGID, 0, 0, 0)
@@ -167,9 +306,7 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 	// 	goto childerror
 	// }
 
-	// Set the controlling TTY..
-	_, _, _ = syscall.RawSyscall(syscall.SYS_IOCTL, uintptr(0), uintptr(syscall.TIOCSCTTY), 1)
-
+	stage = StageMount
 	// If mount point is unshared, mark root as private to avoid propagate
 	// outside to the original mount namespace
 	if r.CloneFlags&syscall.CLONE_NEWNS == syscall.CLONE_NEWNS {
@@ -194,6 +331,28 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 		if err1 != 0 {
 			goto childerror
 		}
+
+		// mount overlay on root/merged & chdir to it as the new root
+		if overlay != nil {
+			for _, d := range overlay.dirs {
+				_, _, err1 = syscall.RawSyscall(syscall.SYS_MKDIRAT, uintptr(_AT_FDCWD), uintptr(unsafe.Pointer(d)), 0755)
+				if err1 != 0 {
+					goto childerror
+				}
+			}
+			// mount("overlay", merged, "overlay", 0, "lowerdir=..,upperdir=..,workdir=..")
+			_, _, err1 = syscall.RawSyscall6(syscall.SYS_MOUNT, uintptr(unsafe.Pointer(&overlayFs[0])),
+				uintptr(unsafe.Pointer(overlay.merged)), uintptr(unsafe.Pointer(&overlayFs[0])), 0,
+				uintptr(unsafe.Pointer(overlay.data)), 0)
+			if err1 != 0 {
+				goto childerror
+			}
+			_, _, err1 = syscall.RawSyscall(syscall.SYS_CHDIR, uintptr(unsafe.Pointer(overlay.merged)), 0, 0)
+			if err1 != 0 {
+				goto childerror
+			}
+			pivotRoot = overlay.merged
+		}
 	}
 
 	// performing mounts
@@ -220,8 +379,8 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 		if err1 != 0 {
 			goto childerror
 		}
-		// bind mount is not respect ro flag so that read-only bind mount needs remount
-		if m.Flags&bindRo == bindRo {
+		// bind mount is not respect ro (and other) flags so that it needs remount
+		if m.Flags&syscall.MS_BIND == syscall.MS_BIND && m.Flags&bindRemount != 0 {
 			_, _, err1 = syscall.RawSyscall6(syscall.SYS_MOUNT, uintptr(unsafe.Pointer(&empty[0])),
 				uintptr(unsafe.Pointer(m.Target)), uintptr(unsafe.Pointer(m.FsType)),
 				uintptr(m.Flags|syscall.MS_REMOUNT), uintptr(unsafe.Pointer(m.Data)), 0)
@@ -258,179 +417,286 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 		}
 
 		// mount("tmpfs", "/", "tmpfs", MS_BIND | MS_REMOUNT | MS_RDONLY | MS_NOATIME | MS_NOSUID, nil)
-		_, _, err1 = syscall.RawSyscall6(syscall.SYS_MOUNT, uintptr(unsafe.Pointer(&tmpfs[0])),
-			uintptr(unsafe.Pointer(&slash[0])), uintptr(unsafe.Pointer(&tmpfs[0])),
-			uintptr(syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOATIME|syscall.MS_NOSUID),
-			uintptr(unsafe.Pointer(&empty[0])), 0)
-		if err1 != 0 {
-			goto childerror
+		// overlay root is kept writable
+		if overlay == nil {
+			_, _, err1 = syscall.RawSyscall6(syscall.SYS_MOUNT, uintptr(unsafe.Pointer(&tmpfs[0])),
+				uintptr(unsafe.Pointer(&slash[0])), uintptr(unsafe.Pointer(&tmpfs[0])),
+				uintptr(syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOATIME|syscall.MS_NOSUID),
+				uintptr(unsafe.Pointer(&empty[0])), 0)
+			if err1 != 0 {
+				goto childerror
+			}
 		}
 	}
 
+	stage = StageHostname
 	// SetHostName
 	if hostname != nil {
 		_, _, err1 = syscall.RawSyscall(syscall.SYS_SETHOSTNAME,
 			uintptr(unsafe.Pointer(hostname)), uintptr(len(r.HostName)), 0)
+		if err1 != 0 {
+			goto childerror
+		}
 	}
 
 	// SetDomainName
 	if domainname != nil {
 		_, _, err1 = syscall.RawSyscall(syscall.SYS_SETDOMAINNAME,
 			uintptr(unsafe.Pointer(domainname)), uintptr(len(r.DomainName)), 0)
-	}
-
-	// chdir for child
-	if workdir != nil {
-		_, _, err1 = syscall.RawSyscall(syscall.SYS_CHDIR, uintptr(unsafe.Pointer(workdir)), 0, 0)
 		if err1 != 0 {
 			goto childerror
 		}
 	}
 
-	// Set limit
-	for _, rlim := range r.RLimits {
-		// prlimit instead of setrlimit to avoid 32-bit limitation (linux > 3.2)
-		_, _, err1 = syscall.RawSyscall6(syscall.SYS_PRLIMIT64, 0, uintptr(rlim.Res), uintptr(unsafe.Pointer(&rlim.Rlim)), 0, 0, 0)
+	stage = StageNetwork
+	// socket(AF_INET, SOCK_DGRAM, 0), ioctl(fd, SIOCSIFFLAGS, {"lo", IFF_UP | IFF_RUNNING})
+	if r.Loopback && r.CloneFlags&syscall.CLONE_NEWNET == syscall.CLONE_NEWNET {
+		var sock uintptr
+		sock, _, err1 = syscall.RawSyscall(syscall.SYS_SOCKET, syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
 		if err1 != 0 {
 			goto childerror
 		}
-	}
-
-	// No new privs
-	if r.NoNewPrivs || r.Seccomp != nil {
-		_, _, err1 = syscall.RawSyscall6(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0)
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_IOCTL, sock, syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&loopbackUp)))
+		syscall.RawSyscall(syscall.SYS_CLOSE, sock, 0, 0)
 		if err1 != 0 {
 			goto childerror
 		}
 	}
 
-	// Drop all capabilities
-	if (r.Credential != nil || r.DropCaps) && !r.UnshareCgroupAfterSync {
-		// make sure the children have no privilege at all
-		_, _, err1 = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECUREBITS,
-			_SECURE_KEEP_CAPS_LOCKED|_SECURE_NO_SETUID_FIXUP|_SECURE_NO_SETUID_FIXUP_LOCKED|_SECURE_NOROOT|_SECURE_NOROOT_LOCKED, 0)
+	stage = StageCredential
+	// set the credential for the child process(exec_linux.go) after namespace
+	// setup, so that the program never runs as (namespace) root. setres*id sets
+	// real, effective and saved ids thus it could not switch back
+	if cred := r.Credential; cred != nil {
+		ngroups := uintptr(len(cred.Groups))
+		groups := uintptr(0)
+		if ngroups > 0 {
+			groups = uintptr(unsafe.Pointer(&cred.Groups[0]))
+		}
+		if !(r.GIDMappings != nil && !r.GIDMappingsEnableSetgroups && ngroups == 0) && !cred.NoSetGroups {
+			_, _, err1 = syscall.RawSyscall(sysSetgroups, ngroups, groups, 0)
+			if err1 != 0 {
+				goto childerror
+			}
+		}
+		_, _, err1 = syscall.RawSyscall(sysSetresgid, uintptr(cred.Gid), uintptr(cred.Gid), uintptr(cred.Gid))
 		if err1 != 0 {
 			goto childerror
 		}
-		_, _, err1 = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&dropCapHeader)), uintptr(unsafe.Pointer(&dropCapData)), 0)
+		_, _, err1 = syscall.RawSyscall(sysSetresuid, uintptr(cred.Uid), uintptr(cred.Uid), uintptr(cred.Uid))
 		if err1 != 0 {
 			goto childerror
 		}
 	}
 
-	// Enable Ptrace & sync with parent (since ptrace_me is a blocking operation)
-	if r.Ptrace && r.Seccomp != nil {
-		err2 = 0
-		r1, _, err1 = syscall.RawSyscall(syscall.SYS_WRITE, uintptr(pipe), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
-		if r1 == 0 || err1 != 0 {
+	stage = StagePdeathsig
+	// Set parent death signal after credential is set (which clears it)
+	if r.Pdeathsig != 0 {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(r.Pdeathsig), 0)
+		if err1 != 0 {
 			goto childerror
 		}
+		// signal self if parent already died (getppid is 0 in new pid namespace)
+		r1, _, _ = syscall.RawSyscall(syscall.SYS_GETPPID, 0, 0, 0)
+		if r1 != 0 && r1 != ppid {
+			_, _, err1 = syscall.RawSyscall(syscall.SYS_KILL, pid, uintptr(r.Pdeathsig), 0)
+			if err1 != 0 {
+				goto childerror
+			}
+		}
+	}
 
-		r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(pipe), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
+	stage = StageSync
+	// hold the namespaces as the init: report ready, close all fds and reap
+	// the children (orphans reparented to the init) until killed
+	if r.Hold {
+		r1, _, err1 = syscall.RawSyscall(syscall.SYS_WRITE, uintptr(pipe), uintptr(unsafe.Pointer(&status)), uintptr(unsafe.Sizeof(status)))
 		if r1 == 0 || err1 != 0 {
 			goto childerror
 		}
-
-		// unshare cgroup namespace
-		if r.UnshareCgroupAfterSync {
-			r1, _, err1 = syscall.RawSyscall(syscall.SYS_UNSHARE, uintptr(unix.CLONE_NEWCGROUP), 0, 0)
-			if err1 != 0 {
-				goto childerror
+		_, _, err1 = syscall.RawSyscall(_SYS_CLOSE_RANGE, 0, ^uintptr(0), 0)
+		if err1 != 0 {
+			for i := uintptr(0); i < uintptr(nofile.Cur); i++ {
+				syscall.RawSyscall(syscall.SYS_CLOSE, i, 0, 0)
 			}
-			if r.DropCaps || r.Credential != nil {
-				// make sure the children have no privilege at all
-				_, _, err1 = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECUREBITS,
-					_SECURE_KEEP_CAPS_LOCKED|_SECURE_NO_SETUID_FIXUP|_SECURE_NO_SETUID_FIXUP_LOCKED|_SECURE_NOROOT|_SECURE_NOROOT_LOCKED, 0)
-				if err1 != 0 {
-					goto childerror
-				}
-				_, _, err1 = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&dropCapHeader)), uintptr(unsafe.Pointer(&dropCapData)), 0)
-				if err1 != 0 {
-					goto childerror
+		}
+		// SIGCHLD is blocked so that it is pending for sigtimedwait
+		syscall.RawSyscall6(syscall.SYS_RT_SIGPROCMASK, 0 /* SIG_BLOCK */, uintptr(unsafe.Pointer(&sigchldMask)), 0, unsafe.Sizeof(sigchldMask), 0, 0)
+		for {
+			for {
+				r1, _, err1 = syscall.RawSyscall6(syscall.SYS_WAIT4, ^uintptr(0), 0, syscall.WNOHANG|unix.WALL, 0, 0, 0)
+				if r1 == 0 || (err1 != 0 && err1 != syscall.EINTR) {
+					break
 				}
 			}
+			syscall.RawSyscall6(syscall.SYS_RT_SIGTIMEDWAIT, uintptr(unsafe.Pointer(&sigchldMask)), 0, 0, unsafe.Sizeof(sigchldMask), 0, 0)
 		}
+	}
 
-		_, _, err1 = syscall.RawSyscall(syscall.SYS_PTRACE, uintptr(syscall.PTRACE_TRACEME), 0, 0)
+	// Set umask (always succeed)
+	if r.Umask != nil {
+		syscall.RawSyscall(syscall.SYS_UMASK, uintptr(*r.Umask&0777), 0, 0)
+	}
+
+	stage = StageChdir
+	// chdir for child
+	if workdir != nil {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_CHDIR, uintptr(unsafe.Pointer(workdir)), 0, 0)
 		if err1 != 0 {
 			goto childerror
 		}
 	}
 
-	// if both seccomp and ptrace is defined, then seccomp filter should have
-	// traced execve, thus child need parent attached to it first
-	// actually, this is not effective if pid namespace is unshared
-	if r.StopBeforeSeccomp || (r.Seccomp != nil && r.Ptrace) {
-		// Stop to wait for ptrace tracer
-		_, _, err1 = syscall.RawSyscall(syscall.SYS_KILL, pid, uintptr(syscall.SIGSTOP), 0)
+	stage = StageRLimit
+	// Set limit
+	for _, rlim := range r.RLimits {
+		// prlimit instead of setrlimit to avoid 32-bit limitation (linux > 3.2)
+		_, _, err1 = syscall.RawSyscall6(syscall.SYS_PRLIMIT64, 0, uintptr(rlim.Res), uintptr(unsafe.Pointer(&rlim.Rlim)), 0, 0, 0)
 		if err1 != 0 {
 			goto childerror
 		}
 	}
 
-	// Load seccomp, stop and wait for tracer
-	if r.Seccomp != nil && (!r.UnshareCgroupAfterSync || r.Ptrace) {
-		// If execve is seccomp trapped, then tracee stop is necessary
-		// otherwise execve will fail due to ENOSYS
-		// Do getpid and kill to send SYS_KILL to self
-		// need to do before seccomp as these might be traced
+	stage = StageSched
+	// Set CPU affinity
+	if r.CPUSet != nil {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(*r.CPUSet), uintptr(unsafe.Pointer(r.CPUSet)))
+		if err1 != 0 {
+			goto childerror
+		}
+	}
 
-		// Load seccomp filter
-		_, _, err1 = syscall.RawSyscall(unix.SYS_SECCOMP, SECCOMP_SET_MODE_FILTER, SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(r.Seccomp)))
+	// Set niceness & scheduling policy
+	if r.Nice != 0 {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_SETPRIORITY, syscall.PRIO_PROCESS, 0, uintptr(r.Nice))
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+	if r.SchedPolicy != SCHED_OTHER {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, 0, uintptr(r.SchedPolicy), uintptr(unsafe.Pointer(&schedParam)))
 		if err1 != 0 {
 			goto childerror
 		}
 	}
 
-	// Before exec, sync with parent through pipe (configured as close_on_exec)
-	if !r.Ptrace || r.Seccomp == nil {
-		err2 = 0
-		r1, _, err1 = syscall.RawSyscall(syscall.SYS_WRITE, uintptr(pipe), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
-		if r1 == 0 || err1 != 0 {
+	stage = StagePersonality
+	// Disable ASLR (personality(0xffffffff) queries current persona)
+	if r.DisableASLR {
+		r1, _, err1 = syscall.RawSyscall(syscall.SYS_PERSONALITY, 0xffffffff, 0, 0)
+		if err1 != 0 {
 			goto childerror
 		}
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_PERSONALITY, r1|_ADDR_NO_RANDOMIZE, 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
 
-		r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(pipe), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
-		if r1 == 0 || err1 != 0 {
+	stage = StageNoNewPrivs
+	// No new privs
+	if r.NoNewPrivs || len(filters) > 0 {
+		_, _, err1 = syscall.RawSyscall6(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0)
+		if err1 != 0 {
 			goto childerror
 		}
+	}
 
-		// unshare cgroup namespace
-		if r.UnshareCgroupAfterSync {
-			r1, _, err1 = syscall.RawSyscall(syscall.SYS_UNSHARE, uintptr(unix.CLONE_NEWCGROUP), 0, 0)
+	stage = StageCaps
+	// Drop capabilities not in the bounding set
+	if r.Caps != nil {
+		for c := uintptr(0); c < 64; c++ {
+			if r.Caps.Bounding&(1<<c) != 0 {
+				continue
+			}
+			_, _, err1 = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, c, 0)
+			if err1 == syscall.EINVAL {
+				// beyond CAP_LAST_CAP of the kernel
+				break
+			}
 			if err1 != 0 {
 				goto childerror
 			}
-			if r.DropCaps || r.Credential != nil {
-				// make sure the children have no privilege at all
-				_, _, err1 = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECUREBITS,
-					_SECURE_KEEP_CAPS_LOCKED|_SECURE_NO_SETUID_FIXUP|_SECURE_NO_SETUID_FIXUP_LOCKED|_SECURE_NOROOT|_SECURE_NOROOT_LOCKED, 0)
-				if err1 != 0 {
-					goto childerror
-				}
-				_, _, err1 = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&dropCapHeader)), uintptr(unsafe.Pointer(&dropCapData)), 0)
-				if err1 != 0 {
-					goto childerror
-				}
+		}
+	}
+
+	stage = StageSync
+	// Sync with parent through pipe (configured as close_on_exec) before
+	// ptrace_me (blocking) and seccomp (the filter may not allow the sync)
+	r1, _, err1 = syscall.RawSyscall(syscall.SYS_WRITE, uintptr(pipe), uintptr(unsafe.Pointer(&status)), uintptr(unsafe.Sizeof(status)))
+	if r1 == 0 || err1 != 0 {
+		goto childerror
+	}
+
+	r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(pipe), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
+	if r1 == 0 || err1 != 0 {
+		goto childerror
+	}
+
+	stage = StageCgroupNS
+	// unshare cgroup namespace after the parent moved the child into cgroup
+	if r.UnshareCgroupAfterSync {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_UNSHARE, uintptr(unix.CLONE_NEWCGROUP), 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageCaps
+	// Drop all capabilities (except for Caps), after unshare which needs them
+	if r.Credential != nil || r.DropCaps || r.Caps != nil {
+		// make sure the children have no privilege at all
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECUREBITS,
+			_SECURE_KEEP_CAPS_LOCKED|_SECURE_NO_SETUID_FIXUP|_SECURE_NO_SETUID_FIXUP_LOCKED|_SECURE_NOROOT|_SECURE_NOROOT_LOCKED, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&dropCapHeader)), uintptr(unsafe.Pointer(&capData[0])), 0)
+		if err1 != 0 {
+			goto childerror
+		}
+		// raise ambient capabilities (kept through execve)
+		for c := uintptr(0); capAmbient != 0 && c < 64; c++ {
+			if capAmbient&(1<<c) == 0 {
+				continue
 			}
-			if r.Seccomp != nil {
-				// Load seccomp filter
-				_, _, err1 = syscall.RawSyscall(unix.SYS_SECCOMP, SECCOMP_SET_MODE_FILTER, SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(r.Seccomp)))
-				if err1 != 0 {
-					goto childerror
-				}
+			_, _, err1 = syscall.RawSyscall6(syscall.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c, 0, 0, 0)
+			if err1 != 0 {
+				goto childerror
 			}
 		}
 	}
 
-	// Enable ptrace if no seccomp is needed
-	if r.Ptrace && r.Seccomp == nil {
+	stage = StagePtrace
+	// Enable ptrace
+	if r.Ptrace {
 		_, _, err1 = syscall.RawSyscall(syscall.SYS_PTRACE, uintptr(syscall.PTRACE_TRACEME), 0, 0)
 		if err1 != 0 {
 			goto childerror
 		}
 	}
 
+	// if both seccomp and ptrace is defined, then seccomp filter should have
+	// traced execve, thus child need parent attached to it first
+	// actually, this is not effective if pid namespace is unshared
+	if r.StopBeforeSeccomp || (len(filters) > 0 && r.Ptrace) {
+		// Stop to wait for ptrace tracer
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_KILL, pid, uintptr(syscall.SIGSTOP), 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageSeccomp
+	// Load seccomp filters in order (TSYNC for each)
+	for i := 0; i < len(filters); i++ {
+		_, _, err1 = syscall.RawSyscall(unix.SYS_SECCOMP, SECCOMP_SET_MODE_FILTER, SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(filters[i])))
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageExecve
 	// at this point, runner is successfully attached for seccomp trap filter
 	// or execve trapped without seccomp filter
 	// time to exec
@@ -463,8 +729,9 @@ func forkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir, host
 	}
 
 childerror:
-	// send error code on pipe
-	syscall.RawSyscall(unix.SYS_WRITE, uintptr(pipe), uintptr(unsafe.Pointer(&err1)), unsafe.Sizeof(err1))
+	// send error code and stage on pipe
+	status = childStatus{Errno: err1, Stage: stage}
+	syscall.RawSyscall(unix.SYS_WRITE, uintptr(pipe), uintptr(unsafe.Pointer(&status)), unsafe.Sizeof(status))
 	for {
 		syscall.RawSyscall(syscall.SYS_EXIT, uintptr(err1+err2), 0, 0)
 	}
@@ -1,7 +1,13 @@
 package forkexec
 
 import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe" // required for go:linkname.
 
 	"golang.org/x/sys/unix"
@@ -12,9 +18,22 @@ import (
 // The runtime OS thread must be locked before calling this function
 // if ptrace is set to true
 func (r *Runner) Start() (int, error) {
-	argv0, argv, env, err := prepareExec(r.Args, r.Env)
-	if err != nil {
-		return 0, err
+	if r.CheckExec {
+		if err := r.checkExec(); err != nil {
+			return 0, err
+		}
+	}
+
+	// the Hold child does not execve
+	var (
+		argv0     *byte
+		argv, env []*byte
+		err       error
+	)
+	if !r.Hold {
+		if argv0, argv, env, err = prepareExec(r.Args, r.Env); err != nil {
+			return 0, err
+		}
 	}
 
 	// prepare work dir
@@ -23,16 +42,21 @@ func (r *Runner) Start() (int, error) {
 		return 0, err
 	}
 
-	// prepare hostname
-	hostname, err := syscallStringFromString(r.HostName)
-	if err != nil {
-		return 0, err
+	// fast path for the simple runner
+	if r.Vfork && r.vforkable() {
+		return r.startVfork(argv0, argv, env, workdir)
 	}
 
-	// prepare domainname
-	domainname, err := syscallStringFromString(r.DomainName)
-	if err != nil {
-		return 0, err
+	// prepare hostname & domainname, only set in unshared UTS namespace
+	// otherwise it would change the name of the host
+	var hostname, domainname *byte
+	if r.CloneFlags&unix.CLONE_NEWUTS == unix.CLONE_NEWUTS {
+		if hostname, err = syscallStringFromString(r.HostName); err != nil {
+			return 0, err
+		}
+		if domainname, err = syscallStringFromString(r.DomainName); err != nil {
+			return 0, err
+		}
 	}
 
 	// prepare pivot_root param
@@ -41,6 +65,23 @@ func (r *Runner) Start() (int, error) {
 		return 0, err
 	}
 
+	// prepare overlay root params
+	var overlay *overlayParams
+	if r.OverlayLower != "" && r.PivotRoot != "" {
+		if overlay, err = prepareOverlay(r.PivotRoot, r.OverlayLower); err != nil {
+			return 0, err
+		}
+	}
+
+	// prepare time namespace offsets
+	var timeOffsets []byte
+	if r.TimeNamespace {
+		timeOffsets = formatTimeOffsets(r.MonotonicOffset, r.BoottimeOffset)
+	}
+
+	// seccomp filters in load order
+	filters := r.seccompFilters()
+
 	// socketpair p used to notify child the uid / gid mapping have been setup
 	// socketpair p is also used to sync with parent before final execve
 	// p[0] is used by parent and p[1] is used by child
@@ -50,7 +91,7 @@ func (r *Runner) Start() (int, error) {
 	}
 
 	// fork in child
-	pid, err1 := forkAndExecInChild(r, argv0, argv, env, workdir, hostname, domainname, pivotRoot, p)
+	pid, err1 := forkAndExecInChild(r, argv0, argv, env, workdir, hostname, domainname, pivotRoot, overlay, timeOffsets, filters, p)
 
 	// restore all signals
 	afterFork()
@@ -63,9 +104,14 @@ func syncWithChild(r *Runner, p [2]int, pid int, err1 syscall.Errno) (int, error
 	var (
 		r1          uintptr
 		err2        syscall.Errno
+		status      childStatus
 		err         error
-		unshareUser = r.CloneFlags&unix.CLONE_NEWUSER == unix.CLONE_NEWUSER
+		unshareUser = r.CloneFlags&unix.CLONE_NEWUSER == unix.CLONE_NEWUSER && len(r.Setns) == 0
+		joinPid     bool
 	)
+	for _, ns := range r.Setns {
+		joinPid = joinPid || ns.Type == unix.CLONE_NEWPID
+	}
 
 	// sync with child
 	unix.Close(p[1])
@@ -76,21 +122,45 @@ func syncWithChild(r *Runner, p [2]int, pid int, err1 syscall.Errno) (int, error
 		return 0, syscall.Errno(err1)
 	}
 
+	// the child exits after forking into the joined pid namespace, reap it
+	// and continue with the grandchild
+	if joinPid {
+		r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(p[0]), uintptr(unsafe.Pointer(&status)), uintptr(unsafe.Sizeof(status)))
+		if r1 != unsafe.Sizeof(status) || status.Errno != 0 || err1 != 0 {
+			err = handlePipeError(r1, status)
+			goto fail
+		}
+		handleChildFailed(pid)
+		pid = int(status.Pid)
+		syscall.RawSyscall(syscall.SYS_WRITE, uintptr(p[0]), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
+	}
+
 	// synchronize with child for uid / gid map
 	if unshareUser {
 		if err = writeIDMaps(r, int(pid)); err != nil {
-			err2 = err.(syscall.Errno)
+			// helper errors are not errno, report the original error
+			err2 = syscall.EPERM
+			errors.As(err, &err2)
 		}
 		syscall.RawSyscall(syscall.SYS_WRITE, uintptr(p[0]), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
+		if err != nil {
+			goto fail
+		}
 	}
 
-	r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(p[0]), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
+	r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(p[0]), uintptr(unsafe.Pointer(&status)), uintptr(unsafe.Sizeof(status)))
 	// child returned error code
-	if r1 != unsafe.Sizeof(err2) || err2 != 0 || err1 != 0 {
-		err = handlePipeError(r1, err2)
+	if r1 != unsafe.Sizeof(status) || status.Errno != 0 || err1 != 0 {
+		err = handlePipeError(r1, status)
 		goto fail
 	}
 
+	// the child holds the namespaces without execve
+	if r.Hold {
+		unix.Close(p[0])
+		return int(pid), nil
+	}
+
 	// if syncfunc return error, then fail child immediately
 	if r.SyncFunc != nil {
 		if err = r.SyncFunc(int(pid)); err != nil {
@@ -107,10 +177,10 @@ func syncWithChild(r *Runner, p [2]int, pid int, err1 syscall.Errno) (int, error
 	}
 
 	// if read anything mean child failed after sync (close_on_exec so it should not block)
-	r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(p[0]), uintptr(unsafe.Pointer(&err2)), uintptr(unsafe.Sizeof(err2)))
+	r1, _, err1 = syscall.RawSyscall(syscall.SYS_READ, uintptr(p[0]), uintptr(unsafe.Pointer(&status)), uintptr(unsafe.Sizeof(status)))
 	unix.Close(p[0])
 	if r1 != 0 || err1 != 0 {
-		err = handlePipeError(r1, err2)
+		err = handlePipeError(r1, status)
 		goto failAfterClose
 	}
 	return int(pid), nil
@@ -123,10 +193,10 @@ failAfterClose:
 	return 0, err
 }
 
-// check pipe error
-func handlePipeError(r1 uintptr, errno syscall.Errno) error {
-	if r1 == unsafe.Sizeof(errno) {
-		return syscall.Errno(errno)
+// check pipe error, report the stage where child failed
+func handlePipeError(r1 uintptr, status childStatus) error {
+	if r1 == unsafe.Sizeof(status) {
+		return &ChildError{Stage: status.Stage, Err: status.Errno}
 	}
 	return syscall.EPIPE
 }
@@ -141,3 +211,70 @@ func handleChildFailed(pid int) {
 		_, err = syscall.Wait4(pid, &wstatus, 0, nil)
 	}
 }
+
+// seccompFilters returns Seccomp followed by SeccompFilters in load order
+func (r *Runner) seccompFilters() []*syscall.SockFprog {
+	var filters []*syscall.SockFprog
+	if r.Seccomp != nil {
+		filters = append(filters, r.Seccomp)
+	}
+	for _, f := range r.SeccompFilters {
+		if f != nil {
+			filters = append(filters, f)
+		}
+	}
+	return filters
+}
+
+// formatTimeOffsets formats timens_offsets as "<clock> <secs> <nanosecs>" per
+// line, nanosecs is within [0, 1e9) even if offset is negative
+func formatTimeOffsets(monotonic, boottime time.Duration) []byte {
+	var b []byte
+	for _, o := range []struct {
+		name   string
+		offset time.Duration
+	}{{"monotonic", monotonic}, {"boottime", boottime}} {
+		sec, nsec := int64(o.offset/time.Second), int64(o.offset%time.Second)
+		if nsec < 0 {
+			sec, nsec = sec-1, nsec+int64(time.Second)
+		}
+		b = append(b, o.name+" "+strconv.FormatInt(sec, 10)+" "+strconv.FormatInt(nsec, 10)+"\n"...)
+	}
+	return b
+}
+
+// overlayParams are the paths in the tmpfs of pivot root to mount the overlay
+// root, upper and work dir are on the tmpfs
+type overlayParams struct {
+	dirs   [3]*byte // upper, work, merged
+	merged *byte
+	data   *byte
+}
+
+// prepareOverlay prepares the overlay root of lower dir in pivot root
+func prepareOverlay(root, lower string) (*overlayParams, error) {
+	// , and : are separators of the overlay options
+	if strings.ContainsAny(lower, ",:") || !path.IsAbs(lower) {
+		return nil, fmt.Errorf("forkexec: invalid overlay lower dir %q", lower)
+	}
+	// the upper layer could not be inside of the lower one
+	if lower = path.Clean(lower); strings.HasPrefix(path.Clean(root)+"/", strings.TrimSuffix(lower, "/")+"/") {
+		return nil, fmt.Errorf("forkexec: overlay lower dir %q contains the root %q", lower, root)
+	}
+	var (
+		o   overlayParams
+		err error
+	)
+	upper, work, merged := path.Join(root, "upper"), path.Join(root, "work"), path.Join(root, "merged")
+	for i, d := range []string{upper, work, merged} {
+		if o.dirs[i], err = syscall.BytePtrFromString(d); err != nil {
+			return nil, err
+		}
+	}
+	o.merged = o.dirs[2]
+	data := "lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work
+	if o.data, err = syscall.BytePtrFromString(data); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
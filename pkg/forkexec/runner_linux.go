@@ -1,10 +1,13 @@
 package forkexec
 
 import (
+	"io"
 	"syscall"
+	"time"
 
 	"github.com/criyle/go-sandbox/pkg/mount"
 	"github.com/criyle/go-sandbox/pkg/rlimit"
+	"golang.org/x/sys/unix"
 )
 
 // Runner is the configuration including the exec path, argv
@@ -18,23 +21,92 @@ type Runner struct {
 	// if exec_fd is defined, then at the end, fd_execve is called
 	ExecFile uintptr
 
+	// check_exec validates the executable (ExecFile or Args[0] relative to
+	// WorkDir, skipped if PivotRoot is set) before fork: it should be a
+	// regular file with the exec bit, and a script or an ELF for the current
+	// architecture. Start returns *ExecError wrapping ErrNotExecutable,
+	// ErrNotELF or ErrWrongArch instead of ENOEXEC / EACCES from the child
+	CheckExec bool
+
 	// POSIX Resource limit set by set rlimit
 	RLimits []rlimit.RLimit
 
 	// file disriptors map for new process, from 0 to len - 1
 	Files []uintptr
 
+	// Stdin / Stdout / Stderr are used by StartStdio as fd 0, 1, 2 instead of
+	// Files[0:3]. *os.File is passed to the child as is, other reader / writer
+	// is connected by pipe copied in the parent. If nil, the path is opened
+	// (created / truncated for stdout / stderr), empty path is /dev/null
+	Stdin                             io.Reader
+	Stdout, Stderr                    io.Writer
+	StdinPath, StdoutPath, StderrPath string
+
+	// umask sets the file mode creation mask of the child (e.g. 022), so that
+	// files created by the program have predictable permissions regardless of
+	// the inherited one, nil inherits
+	Umask *int
+
+	// close_extra_fds marks all fds other than Files close-on-exec by
+	// close_range(CLOSE_RANGE_CLOEXEC) (or /proc/self/fd for older kernel), so
+	// that inherited fds without O_CLOEXEC never leak into the child
+	CloseExtraFds bool
+
 	// work path set by chdir(dir) (current working directory for child)
 	// if pivot_root is defined, this will execute after changed to new root
 	WorkDir string
 
+	// the child always starts in a new session (setsid), setctty acquires the
+	// terminal at fd Ctty (index of Files, e.g. pty slave) as its controlling
+	// terminal by ioctl(TIOCSCTTY), so that job control and SIGINT from the
+	// terminal work for interactive programs
+	Setctty bool
+	Ctty    int
+
+	// pdeathsig calls prctl(PR_SET_PDEATHSIG) so that the child receives the
+	// signal (e.g. SIGKILL) if the parent dies, even outside pid namespace.
+	// The signal is sent when the creating thread exits, thus it should be
+	// used from a goroutine not exiting with runtime.LockOSThread held
+	Pdeathsig syscall.Signal
+
 	// seccomp syscall filter applied to child
 	Seccomp *syscall.SockFprog
 
+	// seccomp_filters are loaded in order after Seccomp (e.g. a base deny list
+	// then a per-language refinement). All filters run on each syscall and the
+	// action of highest precedence wins, thus later ones could only restrict
+	// further. Earlier filters need to allow seccomp for later ones to load
+	SeccompFilters []*syscall.SockFprog
+
+	// vfork spawns the child by clone(CLONE_VM | CLONE_VFORK) without copying
+	// page tables of the parent, which reduces spawn latency for tiny programs
+	// especially when the parent has large heap. The calling thread is
+	// suspended until execve, thus it only applies to the simple runner using
+	// Args, Env, ExecFile, Files, WorkDir, RLimits, NoNewPrivs and seccomp
+	// filters on amd64 / arm64. fork is used if any other option is set
+	Vfork bool
+
 	// ptrace controls child process to call ptrace(PTRACE_TRACEME)
 	// runtime.LockOSThread is required for tracer to call ptrace syscalls
 	Ptrace bool
 
+	// sched_setaffinity pins the child (and its children) to the CPU set, so
+	// that runs on dedicated cores have reproducible timing. nil inherits
+	CPUSet *unix.CPUSet
+
+	// setpriority(PRIO_PROCESS, 0, nice) sets niceness of the child (-20 to 19,
+	// larger is lower priority, negative requires CAP_SYS_NICE), 0 inherits
+	Nice int
+
+	// sched_setscheduler sets scheduling policy of the child, SCHED_BATCH /
+	// SCHED_IDLE let background runs (e.g. re-judge) not starve interactive
+	// ones on the same host. 0 (SCHED_OTHER) inherits
+	SchedPolicy int
+
+	// disable_aslr calls personality(ADDR_NO_RANDOMIZE) to disable address
+	// space layout randomization for the child (kept through execve)
+	DisableASLR bool
+
 	// no_new_privs calls prctl(PR_SET_NO_NEW_PRIVS) to 0 to disable calls to
 	// setuid processes. It is automatically enabled when seccomp filter is provided
 	NoNewPrivs bool
@@ -48,8 +120,41 @@ type Runner struct {
 
 	// clone unshare flag to create linux namespace, effective when clone child
 	// since unshare syscall does not join the new pid group
+	// CLONE_NEWCGROUP makes the child see its cgroup as root in
+	// /proc/self/cgroup, so that host cgroup topology is not exposed. The root
+	// is the cgroup at clone (CgroupFd if defined), use UnshareCgroupAfterSync
+	// if the child is added to cgroup by SyncFunc
 	CloneFlags uintptr
 
+	// setns joins the namespaces of the fds (/proc/[pid]/ns/*, e.g. of a Hold
+	// child) in order instead of creating them at clone. The user namespace
+	// should be the first so that the child gains capabilities to join the
+	// others. CloneFlags except CLONE_NEWUSER / CLONE_NEWPID are unshared after
+	// joining (e.g. CLONE_NEWNS for a private copy of the joined mounts).
+	// If a pid namespace is joined, the child forks again (CLONE_PARENT) to
+	// enter it, kills the other processes in it except the init, and the pid
+	// of the grandchild is returned
+	Setns []Namespace
+
+	// hold keeps the child as the init of its namespaces instead of execve:
+	// after the namespace setup (mounts, pivot_root, hostname, loopback) it
+	// closes all fds and reaps the orphans until killed, so that the
+	// namespaces could be joined by Setns. Start returns when it is ready.
+	// The child is a forked copy of the parent thus memory is shared until
+	// written by the parent (copy on write)
+	Hold bool
+
+	// time_namespace unshares time namespace (linux 5.6, CAP_SYS_TIME) with the
+	// clock offsets of CLOCK_MONOTONIC / CLOCK_BOOTTIME, so that the host uptime
+	// is hidden (e.g. negative of the current uptime to start from 0)
+	TimeNamespace                   bool
+	MonotonicOffset, BoottimeOffset time.Duration
+
+	// if cgroup_fd is defined, clone3 with CLONE_INTO_CGROUP is used to place
+	// the child into the cgroup (v2 directory fd) at creation, so that no
+	// allocation of the child escapes accounting (kernel >= 5.7)
+	CgroupFd uintptr
+
 	// mounts defines the mount syscalls after unshare mount namespace
 	// need CAP_SYS_ADMIN inside the namespace (e.g. unshare user namespace)
 	// if pivot root is provided, relative target is better for chdir-mount meta
@@ -69,24 +174,53 @@ type Runner struct {
 	// mount("tmpfs", "/", "tmpfs", MS_BIND | MS_REMOUNT | MS_RDONLY | MS_NOATIME | MS_NOSUID, nil)
 	PivotRoot string
 
+	// OverlayLower, if set with PivotRoot, makes the new root an overlayfs of
+	// the lower directory (e.g. a rootfs image, kept pristine) and an upper
+	// layer in the tmpfs, so that the program could write anywhere. The upper
+	// layer is discarded with the mount namespace. Mounts are performed on top
+	// of the overlay and the new root is not remounted read-only.
+	// Unprivileged overlayfs in user namespace requires linux 5.11
+	OverlayLower string
+
 	// HostName and DomainName to be set after unshare UTS & user (CAP_SYS_ADMIN)
+	// so that programs calling gethostname / uname do not see the host name
+	// ignored if CLONE_NEWUTS is not in CloneFlags, at most 64 bytes
 	HostName, DomainName string
 
+	// Loopback brings up the lo interface in the unshared network namespace
+	// (CLONE_NEWNET, CAP_NET_ADMIN), so that programs could bind / connect
+	// 127.0.0.1 while having no external connectivity
+	Loopback bool
+
 	// drop_caps calls cap_set(self, 0) to drop all capabilities
 	// from effective, permitted, inheritable capability sets before execve
 	// it should avoid calls to set ambient capabilities
 	DropCaps bool
 
+	// caps retains the specified capabilities instead of dropping all (e.g.
+	// CAP_SYS_PTRACE for debugger based checker), implies DropCaps
+	Caps *CapSet
+
 	// UidMappings / GidMappings for unshared user namespaces, no-op if mapping is null
+	// multiple ranges could be mapped (e.g. 65536 ids for rootless container),
+	// which requires CAP_SETUID / CAP_SETGID in parent or the newuidmap helpers
 	UIDMappings []syscall.SysProcIDMap
 	GIDMappings []syscall.SysProcIDMap
 
+	// NewUIDMap / NewGIDMap are paths of the setuid helpers (newuidmap /
+	// newgidmap from shadow-utils) to write the mappings on behalf of the
+	// unprivileged parent, ranges need to be granted by /etc/subuid / subgid
+	// mappings are written to /proc/[pid]/uid_map / gid_map directly if empty
+	NewUIDMap, NewGIDMap string
+
 	// GidMappingsEnableSetgroups allows / disallows setgroups syscall.
 	// deny if GIDMappings is nil
 	GIDMappingsEnableSetgroups bool
 
 	// Credential holds user and group identities to be assumed
 	// by a child process started by StartProcess.
+	// setgroups / setresgid / setresuid are called after namespace setup
+	// (mounts / pivot_root / hostname), before chdir and execve
 	Credential *syscall.Credential
 
 	// Parent and child process with sync sataus through a socket pair.
@@ -97,5 +231,28 @@ type Runner struct {
 
 	// UnshareCgroupAfterSync specifies whether to unshare cgroup namespace after
 	// sync (the syncFunc might be add the child to the cgroup)
+	// not necessary if the child is cloned into cgroup by CgroupFd
 	UnshareCgroupAfterSync bool
 }
+
+// Namespace is a namespace fd (e.g. /proc/[pid]/ns/mnt) with its type
+// (CLONE_NEW*) to join by setns
+type Namespace struct {
+	Fd   uintptr
+	Type uintptr
+}
+
+// CapSet defines capabilities retained by the child, as bit masks of
+// 1 << CAP_* (e.g. 1 << unix.CAP_SYS_PTRACE)
+type CapSet struct {
+	// Bounding limits capabilities could ever be gained (e.g. by execve of
+	// program with file capabilities), others are dropped by PR_CAPBSET_DROP
+	Bounding uint64
+
+	// Permitted (and effective) capabilities kept until execve
+	Permitted uint64
+
+	// Ambient capabilities kept through execve of non-privileged programs
+	// (e.g. with Credential), effective if also in Permitted
+	Ambient uint64
+}
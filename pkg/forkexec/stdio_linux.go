@@ -0,0 +1,157 @@
+package forkexec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Stdio holds the parent side of stdin / stdout / stderr created by
+// StartStdio, i.e. the pipe ends copied from Stdin / to Stdout and Stderr
+type Stdio struct {
+	child  []*os.File     // opened for the child, closed after start
+	parent []*os.File     // pipe ends in the parent, closed after copy
+	copies []func() error // copy between the pipe ends and reader / writer
+	errCh  chan error     // results of copies
+}
+
+// StartStdio is Start with Stdin / Stdout / Stderr (or the paths) as fd 0, 1,
+// 2 of the child instead of Files[0:3], Files[3:] are passed as fd 3 onwards.
+// Wait of the returned Stdio should be called after the child exited
+func (r *Runner) StartStdio() (int, *Stdio, error) {
+	s := &Stdio{}
+	files := make([]uintptr, 3, 3+len(r.Files))
+	if len(r.Files) > 3 {
+		files = append(files, r.Files[3:]...)
+	}
+
+	stdin, err := s.reader(r.Stdin, r.StdinPath)
+	var stdout, stderr *os.File
+	if err == nil {
+		stdout, err = s.writer(r.Stdout, r.StdoutPath)
+	}
+	if err == nil {
+		// share the pipe if stdout and stderr are the same writer
+		stderr = stdout
+		if r.Stderr == nil || !sameWriter(r.Stdout, r.Stderr) {
+			stderr, err = s.writer(r.Stderr, r.StderrPath)
+		}
+	}
+	if err != nil {
+		s.closeFiles(s.child)
+		s.closeFiles(s.parent)
+		return 0, nil, fmt.Errorf("stdio: %v", err)
+	}
+	files[0], files[1], files[2] = stdin.Fd(), stdout.Fd(), stderr.Fd()
+
+	c := *r
+	c.Files = files
+	pid, err := c.Start()
+	s.closeFiles(s.child)
+	if err != nil {
+		s.closeFiles(s.parent)
+		return 0, nil, err
+	}
+
+	s.errCh = make(chan error, len(s.copies))
+	for _, fn := range s.copies {
+		go func(fn func() error) {
+			s.errCh <- fn()
+		}(fn)
+	}
+	return pid, s, nil
+}
+
+// Wait waits for the copies of Stdin / Stdout / Stderr to finish, i.e. the
+// child (and its children) exited or closed them. It returns the first error
+func (s *Stdio) Wait() error {
+	var err error
+	for range s.copies {
+		if e := <-s.errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// reader returns the child side of stdin, *os.File is passed as is
+func (s *Stdio) reader(r io.Reader, path string) (*os.File, error) {
+	if f, ok := r.(*os.File); ok {
+		return f, nil
+	}
+	if r == nil {
+		return s.open(path, os.O_RDONLY)
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	s.child = append(s.child, pr)
+	s.parent = append(s.parent, pw)
+	s.copies = append(s.copies, func() error {
+		defer pw.Close()
+		_, err := io.Copy(pw, r)
+		// the child is not required to read all of its input
+		if errors.Is(err, syscall.EPIPE) {
+			err = nil
+		}
+		return err
+	})
+	return pr, nil
+}
+
+// writer returns the child side of stdout / stderr, *os.File is passed as is
+func (s *Stdio) writer(w io.Writer, path string) (*os.File, error) {
+	if f, ok := w.(*os.File); ok {
+		return f, nil
+	}
+	if w == nil {
+		return s.open(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	s.child = append(s.child, pw)
+	s.parent = append(s.parent, pr)
+	s.copies = append(s.copies, func() error {
+		defer pr.Close()
+		_, err := io.Copy(w, pr)
+		return err
+	})
+	return pw, nil
+}
+
+// open opens path for the child, /dev/null if path is empty
+func (s *Stdio) open(path string, flag int) (*os.File, error) {
+	if path == "" {
+		path = os.DevNull
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.child = append(s.child, f)
+	return f, nil
+}
+
+func (s *Stdio) closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// sameWriter reports whether a and b are the same writer (uncomparable
+// writers are different)
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
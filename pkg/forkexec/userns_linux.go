@@ -1,6 +1,8 @@
 package forkexec
 
 import (
+	"fmt"
+	"os/exec"
 	"strconv"
 	"syscall"
 
@@ -13,13 +15,19 @@ func writeIDMaps(r *Runner, pid int) error {
 	var uidMappings, gidMappings, setGroups []byte
 	pidStr := strconv.Itoa(pid)
 
-	if r.UIDMappings == nil {
-		uidMappings = []byte("0 " + strconv.Itoa(unix.Geteuid()) + " 1")
+	if r.UIDMappings != nil && r.NewUIDMap != "" {
+		if err := runIDMapHelper(r.NewUIDMap, pidStr, r.UIDMappings); err != nil {
+			return err
+		}
 	} else {
-		uidMappings = formatIDMappings(r.UIDMappings)
-	}
-	if err := writeFile("/proc/"+pidStr+"/uid_map", uidMappings); err != nil {
-		return err
+		if r.UIDMappings == nil {
+			uidMappings = []byte("0 " + strconv.Itoa(unix.Geteuid()) + " 1")
+		} else {
+			uidMappings = formatIDMappings(r.UIDMappings)
+		}
+		if err := writeFile("/proc/"+pidStr+"/uid_map", uidMappings); err != nil {
+			return err
+		}
 	}
 
 	if r.GIDMappings == nil || !r.GIDMappingsEnableSetgroups {
@@ -31,6 +39,9 @@ func writeIDMaps(r *Runner, pid int) error {
 		return err
 	}
 
+	if r.GIDMappings != nil && r.NewGIDMap != "" {
+		return runIDMapHelper(r.NewGIDMap, pidStr, r.GIDMappings)
+	}
 	if r.GIDMappings == nil {
 		gidMappings = []byte("0 " + strconv.Itoa(unix.Getegid()) + " 1")
 	} else {
@@ -42,6 +53,19 @@ func writeIDMaps(r *Runner, pid int) error {
 	return nil
 }
 
+// runIDMapHelper calls newuidmap / newgidmap helper as
+// helper <pid> <container id> <host id> <size> ...
+func runIDMapHelper(helper, pidStr string, idMap []syscall.SysProcIDMap) error {
+	args := []string{pidStr}
+	for _, im := range idMap {
+		args = append(args, strconv.Itoa(im.ContainerID), strconv.Itoa(im.HostID), strconv.Itoa(im.Size))
+	}
+	if out, err := exec.Command(helper, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", helper, err, out)
+	}
+	return nil
+}
+
 func formatIDMappings(idMap []syscall.SysProcIDMap) []byte {
 	var data []byte
 	for _, im := range idMap {
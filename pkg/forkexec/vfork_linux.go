@@ -0,0 +1,216 @@
+package forkexec
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// vforkable returns whether the runner only uses options supported by the
+// vfork path, i.e. no namespace, no sync with the parent and no credential
+func (r *Runner) vforkable() bool {
+	return vforkSupported && r.CloneFlags == 0 && !r.TimeNamespace && r.CgroupFd == 0 &&
+		!r.Ptrace && !r.StopBeforeSeccomp && r.SyncFunc == nil &&
+		!r.UnshareCgroupAfterSync && len(r.Mounts) == 0 && r.PivotRoot == "" &&
+		r.Credential == nil && !r.DropCaps && r.Caps == nil && r.Umask == nil &&
+		!r.CloseExtraFds && !r.Setctty && r.Pdeathsig == 0 && r.CPUSet == nil &&
+		r.Nice == 0 && r.SchedPolicy == SCHED_OTHER && !r.DisableASLR &&
+		len(r.Setns) == 0 && !r.Hold
+}
+
+// startVfork spawns the child by vfork. The calling thread is suspended until
+// the child calls execve or exits, thus no sync is needed: anything read from
+// the socket pair is the error reported by the child
+func (r *Runner) startVfork(argv0 *byte, argv, env []*byte, workdir *byte) (int, error) {
+	p, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	fd, nextfd := prepareFds(r.Files)
+	filters := r.seccompFilters()
+
+	// Acquire the fork lock so that no other threads
+	// create new fds that are not yet close-on-exec
+	// before we fork.
+	syscall.ForkLock.Lock()
+	pid, err1 := vforkAndExecInChild(r, argv0, argv, env, workdir, filters, fd, nextfd, p)
+
+	// restore all signals
+	afterFork()
+	syscall.ForkLock.Unlock()
+
+	unix.Close(p[1])
+	if err1 != 0 {
+		unix.Close(p[0])
+		return 0, syscall.Errno(err1)
+	}
+
+	// child has called execve (pipe closed on exec) or exited with error
+	var status childStatus
+	r1, _, err1 := syscall.RawSyscall(syscall.SYS_READ, uintptr(p[0]), uintptr(unsafe.Pointer(&status)), uintptr(unsafe.Sizeof(status)))
+	unix.Close(p[0])
+	if r1 != 0 || err1 != 0 {
+		handleChildFailed(int(pid))
+		return 0, handlePipeError(r1, status)
+	}
+	return int(pid), nil
+}
+
+// vforkAndExecInChild is the minimal child setup of the vfork path.
+// The child shares memory and stack with the parent, so the child does all
+// post-fork processing in this stack frame and never returns, while the
+// parent returns immediately. All variables are declared before fork and
+// the child must not write to memory used by the parent afterwards (e.g. r)
+//
+//go:noinline
+//go:norace
+func vforkAndExecInChild(r *Runner, argv0 *byte, argv, env []*byte, workdir *byte, filters []*syscall.SockFprog, fd []int, nextfd int, p [2]int) (pid uintptr, err1 syscall.Errno) {
+	var (
+		i        int
+		stage    Stage       // current stage reported on error
+		status   childStatus // status written to parent
+		pipe     = p[1]
+		execFile = r.ExecFile
+	)
+
+	// About to call fork.
+	// No more allocation or calls of non-assembly functions.
+	beforeFork()
+
+	pid, err1 = rawVforkSyscall(syscall.SYS_CLONE, uintptr(syscall.SIGCHLD)|syscall.CLONE_VM|syscall.CLONE_VFORK, 0, 0)
+	if err1 != 0 || pid != 0 {
+		// in parent process, immediate return, the results are written by
+		// rawVforkSyscall after the child replaced
+		return
+	}
+
+	// In child process
+	afterForkInChild()
+	// Notice: cannot call any GO functions beyond this point
+
+	stage = StageFds
+	// Pass 1 & pass 2 assigns fds for child process
+	// Pass 1: fd[i] < i => nextfd
+	if pipe < nextfd {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_DUP3, uintptr(pipe), uintptr(nextfd), syscall.O_CLOEXEC)
+		if err1 != 0 {
+			goto childerror
+		}
+		pipe = nextfd
+		nextfd++
+	}
+	if execFile > 0 && int(execFile) < nextfd {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_DUP3, execFile, uintptr(nextfd), syscall.O_CLOEXEC)
+		if err1 != 0 {
+			goto childerror
+		}
+		execFile = uintptr(nextfd)
+		nextfd++
+	}
+	for i = 0; i < len(fd); i++ {
+		if fd[i] >= 0 && fd[i] < i {
+			// Avoid fd rewrite
+			for nextfd == pipe || (execFile > 0 && nextfd == int(execFile)) {
+				nextfd++
+			}
+			_, _, err1 = syscall.RawSyscall(syscall.SYS_DUP3, uintptr(fd[i]), uintptr(nextfd), syscall.O_CLOEXEC)
+			if err1 != 0 {
+				goto childerror
+			}
+			// Set up close on exec
+			fd[i] = nextfd
+			nextfd++
+		}
+	}
+	// Pass 2: fd[i] => i
+	for i = 0; i < len(fd); i++ {
+		if fd[i] == -1 {
+			syscall.RawSyscall(syscall.SYS_CLOSE, uintptr(i), 0, 0)
+			continue
+		}
+		if fd[i] == i {
+			// dup2(i, i) will not clear close on exec flag, need to reset the flag
+			_, _, err1 = syscall.RawSyscall(syscall.SYS_FCNTL, uintptr(fd[i]), syscall.F_SETFD, 0)
+			if err1 != 0 {
+				goto childerror
+			}
+			continue
+		}
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_DUP3, uintptr(fd[i]), uintptr(i), 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageSession
+	// Set the session ID
+	_, _, err1 = syscall.RawSyscall(syscall.SYS_SETSID, 0, 0, 0)
+	if err1 != 0 {
+		goto childerror
+	}
+
+	stage = StageChdir
+	// chdir for child
+	if workdir != nil {
+		_, _, err1 = syscall.RawSyscall(syscall.SYS_CHDIR, uintptr(unsafe.Pointer(workdir)), 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageRLimit
+	// Set limit
+	for i = 0; i < len(r.RLimits); i++ {
+		_, _, err1 = syscall.RawSyscall6(syscall.SYS_PRLIMIT64, 0, uintptr(r.RLimits[i].Res), uintptr(unsafe.Pointer(&r.RLimits[i].Rlim)), 0, 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageNoNewPrivs
+	// No new privs
+	if r.NoNewPrivs || len(filters) > 0 {
+		_, _, err1 = syscall.RawSyscall6(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0)
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageSeccomp
+	// Load seccomp filters in order
+	for i = 0; i < len(filters); i++ {
+		_, _, err1 = syscall.RawSyscall(unix.SYS_SECCOMP, SECCOMP_SET_MODE_FILTER, SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(filters[i])))
+		if err1 != 0 {
+			goto childerror
+		}
+	}
+
+	stage = StageExecve
+	// retrying on ETXTBSY same as the fork path
+	for {
+		if execFile > 0 {
+			_, _, err1 = syscall.RawSyscall6(unix.SYS_EXECVEAT, execFile,
+				uintptr(unsafe.Pointer(&empty[0])),
+				uintptr(unsafe.Pointer(&argv[0])),
+				uintptr(unsafe.Pointer(&env[0])), unix.AT_EMPTY_PATH, 0)
+		} else {
+			_, _, err1 = syscall.RawSyscall6(unix.SYS_EXECVEAT, uintptr(_AT_FDCWD),
+				uintptr(unsafe.Pointer(argv0)),
+				uintptr(unsafe.Pointer(&argv[0])),
+				uintptr(unsafe.Pointer(&env[0])), 0, 0)
+		}
+		if err1 != syscall.ETXTBSY {
+			break
+		}
+	}
+
+childerror:
+	// send error code and stage on pipe
+	status = childStatus{Errno: err1, Stage: stage}
+	syscall.RawSyscall(unix.SYS_WRITE, uintptr(pipe), uintptr(unsafe.Pointer(&status)), unsafe.Sizeof(status))
+	for {
+		syscall.RawSyscall(syscall.SYS_EXIT, uintptr(err1), 0, 0)
+	}
+	// cannot reach this point
+}
@@ -0,0 +1,183 @@
+package forkexec
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/criyle/go-sandbox/pkg/mount"
+	"github.com/criyle/go-sandbox/pkg/rlimit"
+	"golang.org/x/sys/unix"
+)
+
+// vforkRun starts r by the vfork path and waits for it
+func vforkRun(t *testing.T, r *Runner) (syscall.WaitStatus, error) {
+	if !vforkSupported {
+		t.Skip("vfork not supported")
+	}
+	r.Vfork = true
+	if !r.vforkable() {
+		t.Fatal("runner is not vforkable")
+	}
+	pid, err := r.Start()
+	if err != nil {
+		return 0, err
+	}
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &ws, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	return ws, nil
+}
+
+// tempFile creates a temp file removed after the test
+func tempFile(t *testing.T) *os.File {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	return f
+}
+
+func readFile(t *testing.T, f *os.File) string {
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestVforkNotExists(t *testing.T) {
+	_, err := vforkRun(t, &Runner{
+		Args: []string{"/not_exists"},
+	})
+	var ce *ChildError
+	if !errors.As(err, &ce) || ce.Stage != StageExecve || ce.Err != syscall.ENOENT {
+		t.Errorf("got %v, want child execve error", err)
+	}
+}
+
+func TestVforkFds(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	a, b := tempFile(t), tempFile(t)
+
+	// swap a and b at fd 100 and 101, fd[101] = 100 is below nextfd
+	const fdA, fdB = 100, 101
+	for fd, f := range map[int]*os.File{fdA: a, fdB: b} {
+		if err := syscall.Dup3(int(f.Fd()), fd, syscall.O_CLOEXEC); err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(fd)
+	}
+	files := make([]uintptr, fdB+1)
+	for i := range files {
+		files[i] = null.Fd()
+	}
+	files[fdA], files[fdB] = fdB, fdA
+
+	ws, err := vforkRun(t, &Runner{
+		Args:  []string{"/bin/sh", "-c", "echo b >/proc/self/fd/100; echo a >/proc/self/fd/101"},
+		Env:   []string{"PATH=/bin"},
+		Files: files,
+	})
+	if err != nil || ws.ExitStatus() != 0 {
+		t.Fatal(ws, err)
+	}
+	if got := readFile(t, a); got != "a\n" {
+		t.Errorf("a: got %q", got)
+	}
+	if got := readFile(t, b); got != "b\n" {
+		t.Errorf("b: got %q", got)
+	}
+}
+
+func TestVforkRLimitSeccomp(t *testing.T) {
+	out := tempFile(t)
+	// uname returns EPERM
+	filter := []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 0},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 0, Jf: 1, K: unix.SYS_UNAME},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(syscall.EPERM)},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+	}
+	ws, err := vforkRun(t, &Runner{
+		Args:  []string{"/bin/sh", "-c", "ulimit -n; uname"},
+		Env:   []string{"PATH=/usr/bin:/bin"},
+		Files: []uintptr{out.Fd(), out.Fd(), out.Fd()},
+		RLimits: []rlimit.RLimit{
+			{Res: unix.RLIMIT_NOFILE, Rlim: syscall.Rlimit{Cur: 64, Max: 64}},
+		},
+		Seccomp: &syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.ExitStatus() == 0 {
+		t.Errorf("uname succeeded: %q", readFile(t, out))
+	}
+	if got := readFile(t, out); len(got) < 3 || got[:3] != "64\n" {
+		t.Errorf("got %q, want nofile 64", got)
+	}
+}
+
+func TestVforkable(t *testing.T) {
+	if !vforkSupported {
+		t.Skip("vfork not supported")
+	}
+	if !(&Runner{Args: []string{"/bin/true"}}).vforkable() {
+		t.Fatal("simple runner is not vforkable")
+	}
+	umask := 022
+	tests := map[string]func(r *Runner){
+		"CloneFlags":             func(r *Runner) { r.CloneFlags = unix.CLONE_NEWNS },
+		"TimeNamespace":          func(r *Runner) { r.TimeNamespace = true },
+		"CgroupFd":               func(r *Runner) { r.CgroupFd = 3 },
+		"Ptrace":                 func(r *Runner) { r.Ptrace = true },
+		"StopBeforeSeccomp":      func(r *Runner) { r.StopBeforeSeccomp = true },
+		"SyncFunc":               func(r *Runner) { r.SyncFunc = func(int) error { return nil } },
+		"UnshareCgroupAfterSync": func(r *Runner) { r.UnshareCgroupAfterSync = true },
+		"Mounts":                 func(r *Runner) { r.Mounts = []mount.SyscallParams{{}} },
+		"PivotRoot":              func(r *Runner) { r.PivotRoot = "/tmp" },
+		"Credential":             func(r *Runner) { r.Credential = &syscall.Credential{} },
+		"DropCaps":               func(r *Runner) { r.DropCaps = true },
+		"Caps":                   func(r *Runner) { r.Caps = &CapSet{} },
+		"Umask":                  func(r *Runner) { r.Umask = &umask },
+		"CloseExtraFds":          func(r *Runner) { r.CloseExtraFds = true },
+		"Setctty":                func(r *Runner) { r.Setctty = true },
+		"Pdeathsig":              func(r *Runner) { r.Pdeathsig = syscall.SIGKILL },
+		"CPUSet":                 func(r *Runner) { r.CPUSet = &unix.CPUSet{} },
+		"Nice":                   func(r *Runner) { r.Nice = 1 },
+		"SchedPolicy":            func(r *Runner) { r.SchedPolicy = SCHED_BATCH },
+		"DisableASLR":            func(r *Runner) { r.DisableASLR = true },
+		"Setns":                  func(r *Runner) { r.Setns = []Namespace{{}} },
+		"Hold":                   func(r *Runner) { r.Hold = true },
+	}
+	for name, set := range tests {
+		r := &Runner{Args: []string{"/bin/true"}}
+		set(r)
+		if r.vforkable() {
+			t.Errorf("%s: vforkable", name)
+		}
+	}
+
+	// falls back to fork
+	r := &Runner{Args: []string{"/bin/true"}, Vfork: true, Pdeathsig: syscall.SIGKILL}
+	pid, err := r.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &ws, 0, nil); err != nil || ws.ExitStatus() != 0 {
+		t.Error(ws, err)
+	}
+}
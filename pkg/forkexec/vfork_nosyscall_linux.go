@@ -0,0 +1,14 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package forkexec
+
+import "syscall"
+
+// vforkSupported indicates rawVforkSyscall is implemented for the architecture
+const vforkSupported = false
+
+// rawVforkSyscall is not implemented, Vfork falls back to fork
+func rawVforkSyscall(trap, a1, a2, a3 uintptr) (r1 uintptr, err syscall.Errno) {
+	return 0, syscall.ENOSYS
+}
@@ -0,0 +1,13 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package forkexec
+
+import "syscall"
+
+// vforkSupported indicates rawVforkSyscall is implemented for the architecture
+const vforkSupported = true
+
+// rawVforkSyscall calls clone with CLONE_VM | CLONE_VFORK, it is safe to
+// return in both the parent and the child which share the stack
+func rawVforkSyscall(trap, a1, a2, a3 uintptr) (r1 uintptr, err syscall.Errno)
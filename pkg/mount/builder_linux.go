@@ -2,6 +2,7 @@ package mount
 
 import (
 	"os"
+	"path"
 	"strings"
 
 	"golang.org/x/sys/unix"
@@ -104,6 +105,66 @@ func (b *Builder) WithProc() *Builder {
 	return b
 }
 
+// maskedProcPaths expose host information, masked by WithProcMask (same as
+// Docker)
+var maskedProcPaths = []string{
+	"acpi", "kcore", "keys", "latency_stats", "timer_list", "timer_stats",
+	"sched_debug", "scsi",
+}
+
+// WithProcMask masks the paths of proc file system (mounted by WithProc) which
+// expose host information (e.g. kcore, keys, timer_list), by bind mounting
+// /dev/null over files and read-only tmpfs over directories. Paths not exist
+// in the host proc are skipped. The proc (including sys) is read-only already
+func (b *Builder) WithProcMask() *Builder {
+	for _, p := range maskedProcPaths {
+		fi, err := os.Stat(path.Join("/proc", p))
+		if err != nil {
+			continue
+		}
+		target := path.Join("proc", p)
+		if !fi.IsDir() {
+			b.WithBind("/dev/null", target, false)
+			continue
+		}
+		b.Mounts = append(b.Mounts, Mount{
+			Source: "tmpfs",
+			Target: target,
+			FsType: "tmpfs",
+			Flags:  mFlag | unix.MS_RDONLY,
+		})
+	}
+	return b
+}
+
+// WithDevpts add a new instance of devpts file system at dev/pts, which is
+// required to allocate pseudo terminal by dev/pts/ptmx
+func (b *Builder) WithDevpts() *Builder {
+	b.Mounts = append(b.Mounts, Mount{
+		Source: "devpts",
+		Target: "dev/pts",
+		FsType: "devpts",
+		Flags:  unix.MS_NOSUID | unix.MS_NOEXEC,
+		Data:   "newinstance,ptmxmode=0666,mode=0620",
+	})
+	return b
+}
+
+// devices bind mounted from the host by WithDev, device nodes could not be
+// created in user namespace
+var devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// WithDev adds a private tmpfs at dev populated with the common devices
+// (null, zero, full, random, urandom, tty) bind mounted from the host, and a
+// new instance of devpts at dev/pts
+func (b *Builder) WithDev() *Builder {
+	b.WithTmpfs("dev", "size=64k,nr_inodes=64,mode=755")
+	for _, d := range devices {
+		b.WithBind("/dev/"+d, "dev/"+d, false)
+	}
+	return b.WithDevpts()
+}
+
 func (b Builder) String() string {
 	var sb strings.Builder
 	sb.WriteString("Mounts: ")
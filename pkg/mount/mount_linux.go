@@ -14,9 +14,9 @@ func (m *Mount) Mount() error {
 	if err := syscall.Mount(m.Source, m.Target, m.FsType, m.Flags, m.Data); err != nil {
 		return err
 	}
-	// Read-only bind mount need to be remounted
-	const bindRo = syscall.MS_BIND | syscall.MS_RDONLY
-	if m.Flags&bindRo == bindRo {
+	// Read-only (and other flags) bind mount need to be remounted
+	const bindRemount = syscall.MS_RDONLY | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME
+	if m.Flags&syscall.MS_BIND == syscall.MS_BIND && m.Flags&bindRemount != 0 {
 		if err := syscall.Mount("", m.Target, m.FsType, m.Flags|syscall.MS_REMOUNT, m.Data); err != nil {
 			return err
 		}
@@ -0,0 +1,99 @@
+package mount
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Spec types
+const (
+	TypeBind   = "bind"
+	TypeTmpfs  = "tmpfs"
+	TypeProc   = "proc"
+	TypeDevpts = "devpts"
+	TypeDev    = "dev" // tmpfs with common devices and devpts, see WithDev
+)
+
+// Spec declares a mount point of the new root, so that the rootfs layout
+// could be loaded from configuration instead of hardcoded builder calls.
+// Target is relative to the new root (pivot_root)
+type Spec struct {
+	Type     string `json:"type"`
+	Source   string `json:"source,omitempty"` // bind source on the host
+	Target   string `json:"target,omitempty"` // default to dev/pts for devpts and proc for proc
+	Readonly bool   `json:"readonly,omitempty"`
+	Data     string `json:"data,omitempty"` // e.g. size=8m,mode=755 for tmpfs
+
+	// Flags are the additional mount flags, e.g. noexec, nodev
+	Flags []string `json:"flags,omitempty"`
+}
+
+// specFlags are the mount flags could be added by Spec
+var specFlags = map[string]uintptr{
+	"ro":      unix.MS_RDONLY,
+	"nosuid":  unix.MS_NOSUID,
+	"nodev":   unix.MS_NODEV,
+	"noexec":  unix.MS_NOEXEC,
+	"noatime": unix.MS_NOATIME,
+}
+
+// WithSpecs adds the declared mount points to builder in order
+func (b *Builder) WithSpecs(specs []Spec) (*Builder, error) {
+	for _, s := range specs {
+		if s.Type == TypeDev {
+			b.WithDev()
+			continue
+		}
+		m, err := s.ToMount()
+		if err != nil {
+			return nil, err
+		}
+		b.Mounts = append(b.Mounts, m)
+	}
+	return b, nil
+}
+
+// ToMount converts spec to mount with the same flags used by builder
+func (s *Spec) ToMount() (Mount, error) {
+	var m Mount
+	switch s.Type {
+	case TypeBind:
+		if s.Source == "" || s.Target == "" {
+			return m, fmt.Errorf("mount: bind requires source and target")
+		}
+		m = Mount{Source: s.Source, Target: s.Target, Flags: bind}
+
+	case TypeTmpfs:
+		if s.Target == "" {
+			return m, fmt.Errorf("mount: tmpfs requires target")
+		}
+		m = Mount{Source: "tmpfs", Target: s.Target, FsType: "tmpfs", Flags: mFlag, Data: s.Data}
+
+	case TypeProc:
+		m = NewBuilder().WithProc().Mounts[0]
+
+	case TypeDevpts:
+		m = NewBuilder().WithDevpts().Mounts[0]
+
+	default:
+		return m, fmt.Errorf("mount: unknown type %q", s.Type)
+	}
+	if s.Target != "" {
+		m.Target = s.Target
+	}
+	if s.Data != "" {
+		m.Data = s.Data
+	}
+	if s.Readonly {
+		m.Flags |= unix.MS_RDONLY
+	}
+	for _, f := range s.Flags {
+		v, ok := specFlags[f]
+		if !ok {
+			return m, fmt.Errorf("mount: unknown flag %q", f)
+		}
+		m.Flags |= v
+	}
+	return m, nil
+}
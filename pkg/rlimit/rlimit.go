@@ -7,16 +7,25 @@ import (
 	"syscall"
 
 	"github.com/criyle/go-sandbox/runner"
+	"golang.org/x/sys/unix"
 )
 
-// RLimits defines the rlimit applied by setrlimit syscall to traced process
+// RLimits defines the rlimit applied by setrlimit syscall to traced process.
+// Hard limits less than soft limits are raised to the soft limits
 type RLimits struct {
 	CPU          uint64 // in s
 	CPUHard      uint64 // in s
 	Data         uint64 // in bytes
+	DataHard     uint64 // in bytes
 	FileSize     uint64 // in bytes
+	FileSizeHard uint64 // in bytes
 	Stack        uint64 // in bytes
+	StackHard    uint64 // in bytes
 	AddressSpace uint64 // in bytes
+	OpenFile     uint64 // number of file descriptors
+	OpenFileHard uint64 // number of file descriptors
+	NProc        uint64 // number of processes of the real user id
+	NProcHard    uint64 // number of processes of the real user id
 }
 
 // RLimit is the resource limits defined by Linux setrlimit
@@ -28,6 +37,9 @@ type RLimit struct {
 }
 
 func getRlimit(cur, max uint64) syscall.Rlimit {
+	if max < cur {
+		max = cur
+	}
 	return syscall.Rlimit{Cur: cur, Max: max}
 }
 
@@ -35,40 +47,24 @@ func getRlimit(cur, max uint64) syscall.Rlimit {
 // TimeLimit in s, SizeLimit in byte
 func (r *RLimits) PrepareRLimit() []RLimit {
 	var ret []RLimit
-	if r.CPU > 0 {
-		cpuHard := r.CPUHard
-		if cpuHard < r.CPU {
-			cpuHard = r.CPU
+	for _, l := range []struct {
+		res      int
+		cur, max uint64
+	}{
+		{syscall.RLIMIT_CPU, r.CPU, r.CPUHard},
+		{syscall.RLIMIT_DATA, r.Data, r.DataHard},
+		{syscall.RLIMIT_FSIZE, r.FileSize, r.FileSizeHard},
+		{syscall.RLIMIT_STACK, r.Stack, r.StackHard},
+		{syscall.RLIMIT_AS, r.AddressSpace, r.AddressSpace},
+		{syscall.RLIMIT_NOFILE, r.OpenFile, r.OpenFileHard},
+		{unix.RLIMIT_NPROC, r.NProc, r.NProcHard},
+	} {
+		if l.cur > 0 {
+			ret = append(ret, RLimit{
+				Res:  l.res,
+				Rlim: getRlimit(l.cur, l.max),
+			})
 		}
-
-		ret = append(ret, RLimit{
-			Res:  syscall.RLIMIT_CPU,
-			Rlim: getRlimit(r.CPU, cpuHard),
-		})
-	}
-	if r.Data > 0 {
-		ret = append(ret, RLimit{
-			Res:  syscall.RLIMIT_DATA,
-			Rlim: getRlimit(r.Data, r.Data),
-		})
-	}
-	if r.FileSize > 0 {
-		ret = append(ret, RLimit{
-			Res:  syscall.RLIMIT_FSIZE,
-			Rlim: getRlimit(r.FileSize, r.FileSize),
-		})
-	}
-	if r.Stack > 0 {
-		ret = append(ret, RLimit{
-			Res:  syscall.RLIMIT_STACK,
-			Rlim: getRlimit(r.Stack, r.Stack),
-		})
-	}
-	if r.AddressSpace > 0 {
-		ret = append(ret, RLimit{
-			Res:  syscall.RLIMIT_AS,
-			Rlim: getRlimit(r.AddressSpace, r.AddressSpace),
-		})
 	}
 	return ret
 }
@@ -87,6 +83,10 @@ func (r RLimit) String() string {
 		t = "Stack"
 	case syscall.RLIMIT_AS:
 		t = "AddressSpace"
+	case syscall.RLIMIT_NOFILE:
+		return fmt.Sprintf("OpenFile[%d:%d]", r.Rlim.Cur, r.Rlim.Max)
+	case unix.RLIMIT_NPROC:
+		return fmt.Sprintf("NProc[%d:%d]", r.Rlim.Cur, r.Rlim.Max)
 	}
 	return fmt.Sprintf("%s[%v:%v]", t, runner.Size(r.Rlim.Cur), runner.Size(r.Rlim.Max))
 }
@@ -10,6 +10,7 @@ const (
 	ActionErrno
 	ActionTrace
 	ActionKill
+	ActionLog // allowed after logged by the kernel (audit mode)
 )
 
 // MsgDisallow, Msghandle defines the action needed when trapped by
@@ -0,0 +1,241 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Ret is the return value of the filter, with the action in the high 16 bits
+// and the data (e.g. errno) in the low 16 bits
+type Ret uint32
+
+// seccomp return actions (linux/seccomp.h)
+const (
+	RetKillProcess Ret = 0x80000000
+	RetKillThread  Ret = 0x00000000
+	RetTrap        Ret = 0x00030000
+	RetErrno       Ret = 0x00050000
+	RetUserNotif   Ret = 0x7fc00000
+	RetTrace       Ret = 0x7ff00000
+	RetLog         Ret = 0x7ffc0000
+	RetAllow       Ret = 0x7fff0000
+
+	retActionMask = 0xffff0000
+	retDataMask   = 0x0000ffff
+)
+
+var retNames = map[Ret]string{
+	RetKillProcess: "KILL_PROCESS",
+	RetKillThread:  "KILL_THREAD",
+	RetTrap:        "TRAP",
+	RetErrno:       "ERRNO",
+	RetUserNotif:   "USER_NOTIF",
+	RetTrace:       "TRACE",
+	RetLog:         "LOG",
+	RetAllow:       "ALLOW",
+}
+
+// Action returns the action of the return value
+func (r Ret) Action() Ret {
+	return r & retActionMask
+}
+
+// Data returns the data of the return value
+func (r Ret) Data() uint16 {
+	return uint16(r & retDataMask)
+}
+
+func (r Ret) String() string {
+	n, ok := retNames[r.Action()]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN(%#x)", uint32(r))
+	}
+	switch r.Action() {
+	case RetErrno:
+		return fmt.Sprintf("%s(%d: %v)", n, r.Data(), syscall.Errno(r.Data()))
+	case RetTrap, RetTrace:
+		return fmt.Sprintf("%s(%d)", n, r.Data())
+	}
+	return n
+}
+
+// Data is the input of the filter (struct seccomp_data)
+type Data struct {
+	Nr                 int32
+	Arch               uint32 // AUDIT_ARCH_*
+	InstructionPointer uint64
+	Args               [6]uint64
+}
+
+// bytes encodes the data in native (little endian) layout
+func (d *Data) bytes() []byte {
+	b := make([]byte, 64)
+	binary.LittleEndian.PutUint32(b[0:], uint32(d.Nr))
+	binary.LittleEndian.PutUint32(b[4:], d.Arch)
+	binary.LittleEndian.PutUint64(b[8:], d.InstructionPointer)
+	for i, a := range d.Args {
+		binary.LittleEndian.PutUint64(b[16+8*i:], a)
+	}
+	return b
+}
+
+// Disassemble returns the filter in readable cBPF, one instruction per line.
+// Jumps are shown with absolute targets and returns with the action
+func (f Filter) Disassemble() string {
+	var sb strings.Builder
+	for i, s := range f {
+		fmt.Fprintf(&sb, "%4d: ", i)
+		switch {
+		case s.Code == syscall.BPF_JMP|syscall.BPF_JA:
+			fmt.Fprintf(&sb, "ja %d", i+1+int(s.K))
+		case s.Code&0x07 == syscall.BPF_JMP:
+			src := fmt.Sprintf("#%#x", s.K)
+			if s.Code&0x08 == syscall.BPF_X {
+				src = "x"
+			}
+			fmt.Fprintf(&sb, "%s %s, %d, %d", jumpNames[s.Code&0xf0], src, i+1+int(s.Jt), i+1+int(s.Jf))
+		case s.Code == syscall.BPF_RET|syscall.BPF_K:
+			fmt.Fprintf(&sb, "ret %v", Ret(s.K))
+		default:
+			raw := bpf.RawInstruction{Op: s.Code, Jt: s.Jt, Jf: s.Jf, K: s.K}
+			fmt.Fprint(&sb, raw.Disassemble())
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+var jumpNames = map[uint16]string{
+	syscall.BPF_JEQ:  "jeq",
+	syscall.BPF_JGT:  "jgt",
+	syscall.BPF_JGE:  "jge",
+	syscall.BPF_JSET: "jset",
+}
+
+// Evaluate runs the filter as the kernel on the syscall and returns the
+// result, to find out what the filter does for the syscall
+func (f Filter) Evaluate(d Data) (Ret, error) {
+	var (
+		in     = d.bytes()
+		a, x   uint32
+		mem    [16]uint32
+		loadAt = func(k uint32) (uint32, error) {
+			if k%4 != 0 || k+4 > uint32(len(in)) {
+				return 0, fmt.Errorf("seccomp: invalid load offset %d", k)
+			}
+			return binary.LittleEndian.Uint32(in[k:]), nil
+		}
+		err error
+	)
+	for pc := 0; pc < len(f); pc++ {
+		s := f[pc]
+		k := s.K
+		switch s.Code & 0x07 {
+		case syscall.BPF_LD, syscall.BPF_LDX:
+			var v uint32
+			switch s.Code & 0xe0 {
+			case syscall.BPF_ABS:
+				v, err = loadAt(k)
+			case syscall.BPF_IMM:
+				v = k
+			case syscall.BPF_MEM:
+				v = mem[k%16]
+			case syscall.BPF_LEN:
+				v = uint32(len(in))
+			default:
+				err = fmt.Errorf("seccomp: unsupported load %#x at %d", s.Code, pc)
+			}
+			if err != nil {
+				return 0, err
+			}
+			if s.Code&0x07 == syscall.BPF_LD {
+				a = v
+			} else {
+				x = v
+			}
+
+		case syscall.BPF_ST:
+			mem[k%16] = a
+		case syscall.BPF_STX:
+			mem[k%16] = x
+
+		case syscall.BPF_ALU:
+			if s.Code&0x08 == syscall.BPF_X {
+				k = x
+			}
+			switch s.Code & 0xf0 {
+			case syscall.BPF_ADD:
+				a += k
+			case syscall.BPF_SUB:
+				a -= k
+			case syscall.BPF_MUL:
+				a *= k
+			case syscall.BPF_DIV, unix.BPF_MOD:
+				if k == 0 {
+					return 0, fmt.Errorf("seccomp: division by zero at %d", pc)
+				}
+				if s.Code&0xf0 == syscall.BPF_DIV {
+					a /= k
+				} else {
+					a %= k
+				}
+			case syscall.BPF_AND:
+				a &= k
+			case syscall.BPF_OR:
+				a |= k
+			case unix.BPF_XOR:
+				a ^= k
+			case syscall.BPF_LSH:
+				a <<= k
+			case syscall.BPF_RSH:
+				a >>= k
+			case syscall.BPF_NEG:
+				a = -a
+			}
+
+		case syscall.BPF_JMP:
+			if s.Code&0xf0 == syscall.BPF_JA {
+				pc += int(k)
+				continue
+			}
+			if s.Code&0x08 == syscall.BPF_X {
+				k = x
+			}
+			var cond bool
+			switch s.Code & 0xf0 {
+			case syscall.BPF_JEQ:
+				cond = a == k
+			case syscall.BPF_JGT:
+				cond = a > k
+			case syscall.BPF_JGE:
+				cond = a >= k
+			case syscall.BPF_JSET:
+				cond = a&k != 0
+			}
+			if cond {
+				pc += int(s.Jt)
+			} else {
+				pc += int(s.Jf)
+			}
+
+		case syscall.BPF_RET:
+			if s.Code&0x18 == syscall.BPF_A {
+				return Ret(a), nil
+			}
+			return Ret(k), nil
+
+		case syscall.BPF_MISC:
+			if s.Code&0xf8 == syscall.BPF_TAX {
+				x = a
+			} else {
+				a = x
+			}
+		}
+	}
+	return 0, fmt.Errorf("seccomp: filter ends without return")
+}
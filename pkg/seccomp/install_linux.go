@@ -0,0 +1,65 @@
+package seccomp
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Flags of filter installation (SECCOMP_FILTER_FLAG_*)
+const (
+	FlagTSync      = 1 << 0 // synchronize the filter to all threads
+	FlagLog        = 1 << 1 // log all actions except allow
+	FlagSpecAllow  = 1 << 2 // disable speculative store bypass mitigation
+	FlagTSyncESRCH = 1 << 4 // report TSYNC failure as ESRCH (since 5.7)
+)
+
+// SECCOMP_SET_MODE_FILTER
+const setModeFilter = 1
+
+// TSyncError is returned by Install if the filter could not be synchronized
+// to a thread, e.g. the thread has already loaded a diverged filter
+type TSyncError struct {
+	Tid int // 0 if reported by ESRCH
+}
+
+func (e *TSyncError) Error() string {
+	if e.Tid == 0 {
+		return "seccomp: failed to synchronize filter to all threads"
+	}
+	return fmt.Sprintf("seccomp: failed to synchronize filter to thread %d", e.Tid)
+}
+
+// Install loads the filter into the calling process with no_new_privs set.
+// Without FlagTSync, the filter only applies to the calling thread, so that
+// FlagTSync is needed for multithreaded runtimes (e.g. Go) which have
+// started threads before the filter lands. The OS thread is locked during
+// the installation, callers relying on the thread-local filter should have
+// locked the thread (runtime.LockOSThread) before calling and keep it locked.
+// The filter could not be removed once installed
+func (f Filter) Install(flags uint) error {
+	if len(f) == 0 {
+		return fmt.Errorf("seccomp: empty filter")
+	}
+	// no_new_privs and the filter must land on the same thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("seccomp: no_new_privs: %v", err)
+	}
+	r1, _, errno := syscall.Syscall(unix.SYS_SECCOMP, setModeFilter, uintptr(flags), uintptr(unsafe.Pointer(f.SockFprog())))
+	switch {
+	case errno == syscall.ESRCH && flags&FlagTSyncESRCH != 0:
+		return &TSyncError{}
+	case errno != 0:
+		return fmt.Errorf("seccomp: %v", errno)
+	case r1 != 0 && flags&FlagTSync != 0:
+		// the id of the thread failed to synchronize
+		return &TSyncError{Tid: int(r1)}
+	}
+	return nil
+}
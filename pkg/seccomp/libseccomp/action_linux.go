@@ -15,6 +15,8 @@ func ToSeccompAction(a seccomp.Action) libseccomp.Action {
 		action = libseccomp.ActionErrno
 	case seccomp.ActionTrace:
 		action = libseccomp.ActionTrace
+	case seccomp.ActionLog:
+		action = libseccomp.ActionLog
 	default:
 		action = libseccomp.ActionKillProcess
 	}
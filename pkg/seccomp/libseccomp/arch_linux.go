@@ -0,0 +1,94 @@
+package libseccomp
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/criyle/go-sandbox/pkg/seccomp"
+	"github.com/elastic/go-seccomp-bpf/arch"
+)
+
+// Arch is a syscall ABI the filter could be compiled for. Syscalls are
+// identified by the audit architecture in seccomp_data, while x32 shares
+// the audit architecture of x86_64 with X32_SYSCALL_BIT set in the number
+type Arch struct {
+	Name      string
+	AuditArch uint32
+	Syscalls  map[string]int
+	Mask      uint32 // ORed into syscall numbers (x32)
+}
+
+// Supported architectures
+var (
+	ArchX86_64  = fromInfo(arch.X86_64, 0)
+	ArchX32     = fromInfo(arch.X32, x32SyscallBit)
+	ArchI386    = fromInfo(arch.I386, 0)
+	ArchARM     = fromInfo(arch.ARM, 0)
+	ArchAARCH64 = &Arch{Name: "aarch64", AuditArch: auditArchAARCH64, Syscalls: syscallsAARCH64}
+	ArchRISCV64 = &Arch{Name: "riscv64", AuditArch: auditArchRISCV64, Syscalls: syscallsRISCV64}
+)
+
+// allArches are the supported architectures
+var allArches = []*Arch{ArchX86_64, ArchX32, ArchI386, ArchARM, ArchAARCH64, ArchRISCV64}
+
+// nativeArches maps GOARCH to the architecture
+var nativeArches = map[string]*Arch{
+	"amd64":   ArchX86_64,
+	"386":     ArchI386,
+	"arm":     ArchARM,
+	"arm64":   ArchAARCH64,
+	"riscv64": ArchRISCV64,
+}
+
+// compatArches are the ABIs could be called by processes of the native
+// architecture, i.e. 32-bit syscalls on 64-bit kernels
+var compatArches = map[*Arch][]*Arch{
+	ArchX86_64:  {ArchI386, ArchX32},
+	ArchAARCH64: {ArchARM},
+}
+
+// NativeArch returns the architecture of the current process, nil if the
+// syscall table is not available
+func NativeArch() *Arch {
+	return nativeArches[runtime.GOARCH]
+}
+
+// CompatArches returns the compat ABIs of the architecture (e.g. i386 and
+// x32 for x86_64)
+func (a *Arch) CompatArches() []*Arch {
+	return compatArches[a]
+}
+
+func (a *Arch) String() string {
+	return a.Name
+}
+
+// syscall returns the syscall number used in the filter
+func (a *Arch) syscall(name string) (uint32, bool) {
+	nr, ok := a.Syscalls[name]
+	return uint32(nr) | a.Mask, ok
+}
+
+func fromInfo(i *arch.Info, mask uint32) *Arch {
+	return &Arch{
+		Name:      i.Name,
+		AuditArch: uint32(i.ID),
+		Syscalls:  i.SyscallNames,
+		Mask:      mask,
+	}
+}
+
+// Data returns the filter input of the syscall on the architecture, to
+// evaluate the filter by seccomp.Filter.Evaluate
+func (a *Arch) Data(name string, args ...uint64) (seccomp.Data, error) {
+	nr, ok := a.syscall(name)
+	if !ok {
+		return seccomp.Data{}, fmt.Errorf("seccomp: unknown syscall %q on %s", name, a.Name)
+	}
+	if len(args) > 6 {
+		return seccomp.Data{}, fmt.Errorf("seccomp: too many arguments for %q", name)
+	}
+	d := seccomp.Data{Nr: int32(nr), Arch: a.AuditArch}
+	copy(d.Args[:], args)
+	return d, nil
+}
@@ -16,8 +16,18 @@ type Builder struct {
 
 var actTrace = libseccomp.ActionTrace | libseccomp.Action(seccomp.MsgHandle)
 
-// Build builds the filter
+// Build builds the filter, filters of the same builder are compiled once
+// and shared (must not be modified)
 func (b *Builder) Build() (seccomp.Filter, error) {
+	return cachedFilter(b.key(), b.build)
+}
+
+func (b *Builder) build() (seccomp.Filter, error) {
+	// go-seccomp-bpf does not have the syscall table of some architectures
+	// (e.g. aarch64)
+	if errInfo != nil {
+		return b.buildPolicy()
+	}
 	policy := libseccomp.Policy{
 		DefaultAction: ToSeccompAction(b.Default),
 		Syscalls: []libseccomp.SyscallGroup{
@@ -38,6 +48,29 @@ func (b *Builder) Build() (seccomp.Filter, error) {
 	return ExportBPF(program)
 }
 
+// buildPolicy compiles the builder by Policy for the native architecture,
+// syscalls not exist on it (e.g. open on aarch64) are ignored
+func (b *Builder) buildPolicy() (seccomp.Filter, error) {
+	native := NativeArch()
+	if native == nil {
+		return nil, errInfo
+	}
+	known := func(names []string) []string {
+		r := make([]string, 0, len(names))
+		for _, n := range names {
+			if _, ok := native.Syscalls[n]; ok {
+				r = append(r, n)
+			}
+		}
+		return r
+	}
+	p := NewPolicy().Allow(known(b.Allow)...).Trace(known(b.Trace)...).Default(b.Default)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.build()
+}
+
 // ExportBPF convert libseccomp filter to kernel readable BPF content
 func ExportBPF(filter []bpf.Instruction) (seccomp.Filter, error) {
 	raw, err := bpf.Assemble(filter)
@@ -0,0 +1,87 @@
+package libseccomp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/criyle/go-sandbox/pkg/seccomp"
+)
+
+// filterCache caches the compiled filters of the process by the hash of the
+// canonical policy. Cached filters are shared by the callers of Build and
+// must not be modified
+var filterCache sync.Map // [sha256.Size]byte -> seccomp.Filter
+
+// cachedFilter returns the cached filter of the key, or builds and caches it
+func cachedFilter(key []byte, build func() (seccomp.Filter, error)) (seccomp.Filter, error) {
+	h := sha256.Sum256(key)
+	if f, ok := filterCache.Load(h); ok {
+		return f.(seccomp.Filter), nil
+	}
+	f, err := build()
+	if err != nil {
+		return nil, err
+	}
+	cf, _ := filterCache.LoadOrStore(h, f)
+	return cf.(seccomp.Filter), nil
+}
+
+// policyKey writes the canonical form of the policy: the order of different
+// syscalls does not change the filter
+type policyKey struct {
+	bytes.Buffer
+}
+
+func (k *policyKey) field(name string, v ...interface{}) {
+	fmt.Fprintf(&k.Buffer, "%s%#v\n", name, v)
+}
+
+func (k *policyKey) names(name string, n []string) {
+	n = append([]string(nil), n...)
+	sort.Strings(n)
+	k.field(name, n)
+}
+
+func (b *Builder) key() []byte {
+	var k policyKey
+	k.field("builder")
+	k.names("allow", b.Allow)
+	k.names("trace", b.Trace)
+	k.field("default", uint32(b.Default))
+	return k.Bytes()
+}
+
+func (p *Policy) key() []byte {
+	var k policyKey
+	k.field("policy")
+	for _, a := range p.arches {
+		k.field("arch", a.Name, a.AuditArch, a.Mask)
+	}
+	k.field("default", uint32(p.def), uint32(p.compat), uint32(p.audit), p.last)
+
+	// rules of the same syscall keep their order
+	rules := append([]policyRule(nil), p.rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].name < rules[j].name
+	})
+	for _, r := range rules {
+		k.field("rule", r.name, uint32(r.action), r.conds)
+	}
+	return k.Bytes()
+}
+
+func (p *OCIProfile) key(caps []string) ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("seccomp: %v", err)
+	}
+	var k policyKey
+	k.field("oci")
+	k.Write(b)
+	k.names("caps", caps)
+	return k.Bytes(), nil
+}
@@ -0,0 +1,199 @@
+package libseccomp
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/criyle/go-sandbox/pkg/seccomp"
+	"golang.org/x/net/bpf"
+)
+
+// rule is the action of the syscall if all of args matched
+type rule struct {
+	name string
+	ret  uint32
+	args []Cond
+}
+
+// program is the BPF program being compiled, jumps to labels are resolved
+// when assembled
+type program struct {
+	insts  []bpf.Instruction
+	labels map[string]int
+	jumps  map[int]string
+}
+
+// compile compiles the rules in order for the architectures. Syscalls
+// without rule return def, syscalls of other architectures (including x32
+// if not in arches) return other. Syscalls not exist on an architecture are
+// ignored for it. If last is not empty, syscalls without rule numbered above
+// it fail with ENOSYS
+func compile(arches []*Arch, rules []rule, def, other uint32, last string) (seccomp.Filter, error) {
+	p := &program{
+		labels: make(map[string]int),
+		jumps:  make(map[int]string),
+	}
+
+	// x86_64 and x32 share the audit arch
+	var (
+		audits  []uint32
+		byAudit = make(map[uint32][]*Arch)
+	)
+	for _, a := range arches {
+		as, ok := byAudit[a.AuditArch]
+		if !ok {
+			audits = append(audits, a.AuditArch)
+		}
+		if !containsArch(as, a) {
+			byAudit[a.AuditArch] = append(as, a)
+		}
+	}
+
+	// dispatch by audit arch
+	p.emit(bpf.LoadAbsolute{Off: offsetArch, Size: 4})
+	for _, id := range audits {
+		p.emit(bpf.JumpIf{Cond: bpf.JumpEqual, Val: id, SkipFalse: 1})
+		p.jump(fmt.Sprintf("audit %x", id))
+	}
+	p.emit(bpf.RetConstant{Val: other})
+
+	for _, id := range audits {
+		p.label(fmt.Sprintf("audit %x", id))
+		p.emit(bpf.LoadAbsolute{Off: offsetNr, Size: 4})
+		if id != auditArchX86_64 {
+			for _, a := range byAudit[id] {
+				if err := p.compileArch(a, rules, def, last); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		// x32 syscalls have X32_SYSCALL_BIT set
+		var native, x32 *Arch
+		for _, a := range byAudit[id] {
+			if a.Mask != 0 {
+				x32 = a
+			} else {
+				native = a
+			}
+		}
+		p.emit(bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: x32SyscallBit, SkipFalse: 1})
+		if x32 != nil {
+			p.jump(x32.Name)
+		} else {
+			p.emit(bpf.RetConstant{Val: other})
+		}
+		if native == nil {
+			p.emit(bpf.RetConstant{Val: other})
+		} else if err := p.compileArch(native, rules, def, last); err != nil {
+			return nil, err
+		}
+		if x32 != nil {
+			p.label(x32.Name)
+			if err := p.compileArch(x32, rules, def, last); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	insts, err := p.assemble()
+	if err != nil {
+		return nil, err
+	}
+	return ExportBPF(insts)
+}
+
+// compileArch compiles the dispatch by syscall number with the syscall
+// number loaded, rules with args are jumped into blocks after the dispatch
+// table
+func (p *program) compileArch(a *Arch, rules []rule, def uint32, last string) error {
+	// rules of each syscall in order, until unconditional one
+	var (
+		order []uint32
+		byNr  = make(map[uint32][]rule)
+		final = make(map[uint32]bool)
+	)
+	for _, r := range rules {
+		nr, ok := a.syscall(r.name)
+		if !ok || final[nr] {
+			continue
+		}
+		if _, ok := byNr[nr]; !ok {
+			order = append(order, nr)
+		}
+		byNr[nr] = append(byNr[nr], r)
+		final[nr] = len(r.args) == 0
+	}
+
+	for _, nr := range order {
+		p.emit(bpf.JumpIf{Cond: bpf.JumpEqual, Val: nr, SkipFalse: 1})
+		if rs := byNr[nr]; len(rs[0].args) == 0 {
+			p.emit(bpf.RetConstant{Val: rs[0].ret})
+			continue
+		}
+		p.jump(fmt.Sprintf("%s %d", a.Name, nr))
+	}
+	if nr, ok := a.syscall(last); ok {
+		p.emit(
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: nr, SkipFalse: 1},
+			bpf.RetConstant{Val: retErrno | uint32(syscall.ENOSYS)},
+		)
+	}
+	p.emit(bpf.RetConstant{Val: def})
+
+	for _, nr := range order {
+		rs := byNr[nr]
+		if len(rs[0].args) == 0 {
+			continue
+		}
+		p.label(fmt.Sprintf("%s %d", a.Name, nr))
+		for _, r := range rs {
+			if len(r.args) == 0 {
+				p.emit(bpf.RetConstant{Val: r.ret})
+				break
+			}
+			insts, err := argRule(r.args, r.ret)
+			if err != nil {
+				return err
+			}
+			p.emit(insts...)
+		}
+		if !final[nr] {
+			p.emit(bpf.RetConstant{Val: def})
+		}
+	}
+	return nil
+}
+
+func (p *program) emit(insts ...bpf.Instruction) {
+	p.insts = append(p.insts, insts...)
+}
+
+func (p *program) label(l string) {
+	p.labels[l] = len(p.insts)
+}
+
+func (p *program) jump(l string) {
+	p.jumps[len(p.insts)] = l
+	p.emit(bpf.Jump{})
+}
+
+func (p *program) assemble() ([]bpf.Instruction, error) {
+	if len(p.insts) > maxInsns {
+		return nil, fmt.Errorf("seccomp: program too long (%d instructions)", len(p.insts))
+	}
+	for i, l := range p.jumps {
+		p.insts[i] = bpf.Jump{Skip: uint32(p.labels[l] - i - 1)}
+	}
+	return p.insts, nil
+}
+
+func containsArch(s []*Arch, a *Arch) bool {
+	for _, e := range s {
+		if e == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package libseccomp
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+)
+
+// Op is the comparison of the syscall argument
+type Op int
+
+// Comparisons of the syscall argument as unsigned 64-bit value
+const (
+	OpEqual Op = iota + 1
+	OpNotEqual
+	OpGreater
+	OpGreaterEqual
+	OpLess
+	OpLessEqual
+	OpMaskedEqual    // argument & Mask == Value
+	OpMaskedNotEqual // argument & Mask != Value
+)
+
+// Cond is the condition on the syscall argument at Index (0 - 5)
+type Cond struct {
+	Index uint
+	Op    Op
+	Value uint64
+	Mask  uint64 // OpMaskedEqual / OpMaskedNotEqual only
+}
+
+// ArgEq matches argument == v
+func ArgEq(index uint, v uint64) Cond {
+	return Cond{Index: index, Op: OpEqual, Value: v}
+}
+
+// ArgNe matches argument != v
+func ArgNe(index uint, v uint64) Cond {
+	return Cond{Index: index, Op: OpNotEqual, Value: v}
+}
+
+// ArgGt matches argument > v
+func ArgGt(index uint, v uint64) Cond {
+	return Cond{Index: index, Op: OpGreater, Value: v}
+}
+
+// ArgGe matches argument >= v
+func ArgGe(index uint, v uint64) Cond {
+	return Cond{Index: index, Op: OpGreaterEqual, Value: v}
+}
+
+// ArgLt matches argument < v
+func ArgLt(index uint, v uint64) Cond {
+	return Cond{Index: index, Op: OpLess, Value: v}
+}
+
+// ArgLe matches argument <= v
+func ArgLe(index uint, v uint64) Cond {
+	return Cond{Index: index, Op: OpLessEqual, Value: v}
+}
+
+// ArgMaskedEq matches argument & mask == v, e.g. ArgMaskedEq(0,
+// CLONE_NEWUSER, 0) for clone flags without CLONE_NEWUSER
+func ArgMaskedEq(index uint, mask, v uint64) Cond {
+	return Cond{Index: index, Op: OpMaskedEqual, Mask: mask, Value: v}
+}
+
+// ArgMaskedNe matches argument & mask != v
+func ArgMaskedNe(index uint, mask, v uint64) Cond {
+	return Cond{Index: index, Op: OpMaskedNotEqual, Mask: mask, Value: v}
+}
+
+func (c Cond) validate() error {
+	if _, ok := condInsnLen[c.Op]; !ok {
+		return fmt.Errorf("seccomp: unknown op %d", c.Op)
+	}
+	if c.Index > 5 {
+		return fmt.Errorf("seccomp: invalid arg index %d", c.Index)
+	}
+	return nil
+}
+
+// argRule compiles the conditions (all need to match) with ret after them,
+// it falls through to next instruction after the rule if any condition
+// failed
+func argRule(conds []Cond, ret uint32) ([]bpf.Instruction, error) {
+	length := 1
+	for _, c := range conds {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		length += condInsnLen[c.Op]
+	}
+
+	var insts []bpf.Instruction
+	for _, c := range conds {
+		insts = append(insts, c.compare(len(insts), length)...)
+	}
+	return append(insts, bpf.RetConstant{Val: ret}), nil
+}
+
+var condInsnLen = map[Op]int{
+	OpEqual:          4,
+	OpNotEqual:       4,
+	OpGreater:        5,
+	OpGreaterEqual:   5,
+	OpLess:           5,
+	OpLessEqual:      5,
+	OpMaskedEqual:    6,
+	OpMaskedNotEqual: 6,
+}
+
+// compare compares 64-bit argument by high and low 32-bit (little endian)
+// starting at pos of the rule, jumps to fail if not matched
+func (c Cond) compare(pos, fail int) []bpf.Instruction {
+	lo := uint32(offsetArgs + 8*c.Index)
+	hi := lo + 4
+	vhi, vlo := uint32(c.Value>>32), uint32(c.Value)
+	f := func(i int) uint8 {
+		return uint8(fail - pos - i - 1)
+	}
+	ldHi := bpf.LoadAbsolute{Off: hi, Size: 4}
+	ldLo := bpf.LoadAbsolute{Off: lo, Size: 4}
+
+	switch c.Op {
+	case OpEqual:
+		return []bpf.Instruction{
+			ldHi, bpf.JumpIf{Cond: bpf.JumpEqual, Val: vhi, SkipFalse: f(1)},
+			ldLo, bpf.JumpIf{Cond: bpf.JumpEqual, Val: vlo, SkipFalse: f(3)},
+		}
+	case OpNotEqual:
+		return []bpf.Instruction{
+			ldHi, bpf.JumpIf{Cond: bpf.JumpEqual, Val: vhi, SkipFalse: 2},
+			ldLo, bpf.JumpIf{Cond: bpf.JumpEqual, Val: vlo, SkipTrue: f(3)},
+		}
+	case OpGreater, OpGreaterEqual:
+		cond := bpf.JumpGreaterThan
+		if c.Op == OpGreaterEqual {
+			cond = bpf.JumpGreaterOrEqual
+		}
+		return []bpf.Instruction{
+			ldHi, bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: vhi, SkipTrue: 3},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: vhi, SkipFalse: f(2)},
+			ldLo, bpf.JumpIf{Cond: cond, Val: vlo, SkipFalse: f(4)},
+		}
+	case OpLess, OpLessEqual:
+		cond := bpf.JumpGreaterOrEqual
+		if c.Op == OpLessEqual {
+			cond = bpf.JumpGreaterThan
+		}
+		return []bpf.Instruction{
+			ldHi, bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: vhi, SkipTrue: f(1)},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: vhi, SkipFalse: 2},
+			ldLo, bpf.JumpIf{Cond: cond, Val: vlo, SkipTrue: f(4)},
+		}
+	case OpMaskedNotEqual:
+		return []bpf.Instruction{
+			ldHi, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: uint32(c.Mask >> 32)},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: vhi, SkipFalse: 3},
+			ldLo, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: uint32(c.Mask)},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: vlo, SkipTrue: f(5)},
+		}
+	default: // OpMaskedEqual
+		return []bpf.Instruction{
+			ldHi, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: uint32(c.Mask >> 32)},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: vhi, SkipFalse: f(2)},
+			ldLo, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: uint32(c.Mask)},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: vlo, SkipFalse: f(5)},
+		}
+	}
+}
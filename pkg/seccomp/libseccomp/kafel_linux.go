@@ -0,0 +1,642 @@
+package libseccomp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/criyle/go-sandbox/pkg/seccomp"
+)
+
+// maxKafelTerms limits the rules generated from the condition of a syscall
+const maxKafelTerms = 64
+
+// LoadKafel reads and parses the policy file in Kafel language
+func LoadKafel(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("seccomp: %v", err)
+	}
+	return ParseKafel(string(b))
+}
+
+// ParseKafel parses the policy in the subset of Kafel language, e.g.
+//
+//	#define AF_UNIX 1
+//	POLICY base {
+//		ALLOW { read, write, close, socket(domain) { domain == AF_UNIX } },
+//		ERRNO(1) { socket }
+//	}
+//	POLICY sample {
+//		USE base,
+//		KILL { clone(flags) { (flags & 0x10000000) != 0 } },
+//		ALLOW { clone }
+//	}
+//	USE sample DEFAULT KILL
+//
+// Actions are ALLOW, KILL, LOG, ERRNO(n) and TRACE(n). Conditions compare
+// the named arguments (or arg & mask) with constants, combined by &&, || and
+// !. Rules of a syscall are matched in order as Policy, and errors are
+// reported with line and column
+func ParseKafel(src string) (*Policy, error) {
+	toks, err := lexKafel(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &kafelParser{
+		toks:     toks,
+		defines:  make(map[string]uint64),
+		policies: make(map[string][]kafelRule),
+	}
+	return p.parse()
+}
+
+type kafelToken struct {
+	text      string
+	line, col int
+	number    bool
+}
+
+// kafelRule is the parsed rule, conds are in disjunctive normal form (nil
+// for unconditional)
+type kafelRule struct {
+	tok    kafelToken
+	action seccomp.Action
+	conds  [][]Cond
+}
+
+type kafelParser struct {
+	toks     []kafelToken
+	pos      int
+	defines  map[string]uint64
+	policies map[string][]kafelRule
+}
+
+// kafelExpr is the boolean expression of syscall arguments
+type kafelExpr interface{}
+
+type (
+	kafelCmp struct {
+		tok  kafelToken
+		cond Cond
+	}
+	kafelNot struct {
+		e kafelExpr
+	}
+	kafelBinary struct {
+		and  bool
+		l, r kafelExpr
+	}
+)
+
+func lexKafel(src string) ([]kafelToken, error) {
+	var (
+		toks      []kafelToken
+		line, col = 1, 1
+	)
+	advance := func(n int) {
+		for _, c := range src[:n] {
+			if c == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		src = src[n:]
+	}
+	for len(src) > 0 {
+		c := src[0]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			advance(1)
+		case strings.HasPrefix(src, "//"):
+			n := strings.IndexByte(src, '\n')
+			if n < 0 {
+				n = len(src)
+			}
+			advance(n)
+		case strings.HasPrefix(src, "/*"):
+			n := strings.Index(src, "*/")
+			if n < 0 {
+				return nil, kafelErrorf(kafelToken{line: line, col: col}, "unterminated comment")
+			}
+			advance(n + 2)
+		case isKafelIdent(c) || c == '#':
+			n := 1
+			for n < len(src) && (isKafelIdent(src[n]) || isKafelDigit(src[n])) {
+				n++
+			}
+			toks = append(toks, kafelToken{text: src[:n], line: line, col: col})
+			advance(n)
+		case isKafelDigit(c):
+			n := 1
+			for n < len(src) && (isKafelIdent(src[n]) || isKafelDigit(src[n])) {
+				n++
+			}
+			toks = append(toks, kafelToken{text: src[:n], line: line, col: col, number: true})
+			advance(n)
+		default:
+			n := 1
+			for _, op := range []string{"&&", "||", "==", "!=", "<=", ">="} {
+				if strings.HasPrefix(src, op) {
+					n = 2
+					break
+				}
+			}
+			if n == 1 && !strings.ContainsRune("{}(),!<>&|", rune(c)) {
+				return nil, kafelErrorf(kafelToken{line: line, col: col}, "unexpected character %q", c)
+			}
+			toks = append(toks, kafelToken{text: src[:n], line: line, col: col})
+			advance(n)
+		}
+	}
+	return append(toks, kafelToken{line: line, col: col}), nil
+}
+
+func isKafelIdent(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isKafelDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func kafelErrorf(t kafelToken, format string, v ...interface{}) error {
+	return fmt.Errorf("seccomp: kafel %d:%d: %s", t.line, t.col, fmt.Sprintf(format, v...))
+}
+
+func (p *kafelParser) peek() kafelToken {
+	return p.toks[p.pos]
+}
+
+func (p *kafelParser) next() kafelToken {
+	t := p.toks[p.pos]
+	if p.pos < len(p.toks)-1 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *kafelParser) accept(text string) bool {
+	if t := p.peek(); !t.number && t.text == text {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *kafelParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected(text)
+	}
+	return nil
+}
+
+func (p *kafelParser) unexpected(want string) error {
+	t := p.peek()
+	if t.text == "" {
+		return kafelErrorf(t, "unexpected end of policy, expecting %s", want)
+	}
+	return kafelErrorf(t, "unexpected %q, expecting %s", t.text, want)
+}
+
+func (p *kafelParser) ident() (kafelToken, error) {
+	t := p.peek()
+	if t.number || t.text == "" || !isKafelIdent(t.text[0]) {
+		return t, p.unexpected("identifier")
+	}
+	return p.next(), nil
+}
+
+// parse parses: { #define | POLICY } USE name DEFAULT action
+func (p *kafelParser) parse() (*Policy, error) {
+	for {
+		switch {
+		case p.accept("#define"):
+			if err := p.define(); err != nil {
+				return nil, err
+			}
+		case p.accept("POLICY"):
+			if err := p.policy(); err != nil {
+				return nil, err
+			}
+		case p.accept("USE"):
+			return p.use()
+		default:
+			return nil, p.unexpected("#define, POLICY or USE")
+		}
+	}
+}
+
+func (p *kafelParser) define() error {
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	if _, ok := p.defines[name.text]; ok {
+		return kafelErrorf(name, "redefined %q", name.text)
+	}
+	v, err := p.constant()
+	if err != nil {
+		return err
+	}
+	p.defines[name.text] = v
+	return nil
+}
+
+// policy parses: name { [ item { , item } ] }
+func (p *kafelParser) policy() error {
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	if _, ok := p.policies[name.text]; ok {
+		return kafelErrorf(name, "redefined policy %q", name.text)
+	}
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	var rules []kafelRule
+	for first := true; !p.accept("}"); first = false {
+		if !first {
+			if err := p.expect(","); err != nil {
+				return err
+			}
+		}
+		r, err := p.item()
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r...)
+	}
+	p.policies[name.text] = rules
+	return nil
+}
+
+// item parses: USE name | action { [ syscall { , syscall } ] }
+func (p *kafelParser) item() ([]kafelRule, error) {
+	if p.accept("USE") {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		r, ok := p.policies[name.text]
+		if !ok {
+			return nil, kafelErrorf(name, "undefined policy %q", name.text)
+		}
+		return r, nil
+	}
+	a, err := p.action()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var rules []kafelRule
+	for first := true; !p.accept("}"); first = false {
+		if !first {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		r, err := p.syscall(a)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// action parses: ALLOW | KILL | LOG | ERRNO(n) | TRACE(n)
+func (p *kafelParser) action() (seccomp.Action, error) {
+	t, err := p.ident()
+	if err != nil {
+		return 0, err
+	}
+	switch t.text {
+	case "ALLOW":
+		return seccomp.ActionAllow, nil
+	case "KILL", "KILL_PROCESS":
+		return seccomp.ActionKill, nil
+	case "LOG":
+		return seccomp.ActionLog, nil
+	case "ERRNO", "TRACE":
+		if err := p.expect("("); err != nil {
+			return 0, err
+		}
+		v, err := p.constant()
+		if err != nil {
+			return 0, err
+		}
+		if v > 0xffff {
+			return 0, kafelErrorf(t, "%s value %d out of range", t.text, v)
+		}
+		if err := p.expect(")"); err != nil {
+			return 0, err
+		}
+		if t.text == "ERRNO" {
+			return seccomp.ActionErrno.WithReturnCode(int16(v)), nil
+		}
+		return seccomp.ActionTrace.WithReturnCode(int16(v)), nil
+	}
+	return 0, kafelErrorf(t, "unknown action %q", t.text)
+}
+
+// syscall parses: name [ ( arg { , arg } ) ] [ { expr } ]
+func (p *kafelParser) syscall(a seccomp.Action) (kafelRule, error) {
+	name, err := p.ident()
+	if err != nil {
+		return kafelRule{}, err
+	}
+	if !hasSyscall(allArches, name.text) {
+		return kafelRule{}, kafelErrorf(name, "unknown syscall %q", name.text)
+	}
+	args := make(map[string]uint)
+	if p.accept("(") {
+		for i := uint(0); i == 0 || p.accept(","); i++ {
+			arg, err := p.ident()
+			if err != nil {
+				return kafelRule{}, err
+			}
+			if i > 5 {
+				return kafelRule{}, kafelErrorf(arg, "too many arguments")
+			}
+			if _, ok := args[arg.text]; ok {
+				return kafelRule{}, kafelErrorf(arg, "duplicate argument %q", arg.text)
+			}
+			args[arg.text] = i
+		}
+		if err := p.expect(")"); err != nil {
+			return kafelRule{}, err
+		}
+	}
+	r := kafelRule{tok: name, action: a}
+	if !p.accept("{") {
+		return r, nil
+	}
+	e, err := p.or(args)
+	if err != nil {
+		return kafelRule{}, err
+	}
+	if err := p.expect("}"); err != nil {
+		return kafelRule{}, err
+	}
+	if r.conds, err = kafelDNF(e, false); err != nil {
+		return kafelRule{}, err
+	}
+	if len(r.conds) > maxKafelTerms {
+		return kafelRule{}, kafelErrorf(name, "condition too complex")
+	}
+	return r, nil
+}
+
+// or parses: and { || and }
+func (p *kafelParser) or(args map[string]uint) (kafelExpr, error) {
+	e, err := p.and(args)
+	for err == nil && p.accept("||") {
+		var r kafelExpr
+		if r, err = p.and(args); err == nil {
+			e = &kafelBinary{l: e, r: r}
+		}
+	}
+	return e, err
+}
+
+// and parses: unary { && unary }
+func (p *kafelParser) and(args map[string]uint) (kafelExpr, error) {
+	e, err := p.unary(args)
+	for err == nil && p.accept("&&") {
+		var r kafelExpr
+		if r, err = p.unary(args); err == nil {
+			e = &kafelBinary{and: true, l: e, r: r}
+		}
+	}
+	return e, err
+}
+
+// unary parses: ! unary | ( or ) | comparison
+func (p *kafelParser) unary(args map[string]uint) (kafelExpr, error) {
+	if p.accept("!") {
+		e, err := p.unary(args)
+		return &kafelNot{e: e}, err
+	}
+	if pos := p.pos; p.accept("(") {
+		// (arg & mask) == v is a comparison
+		if e, err := p.or(args); err == nil && p.accept(")") {
+			return e, nil
+		}
+		p.pos = pos
+	}
+	return p.compare(args)
+}
+
+var kafelOps = map[string]Op{
+	"==": OpEqual,
+	"!=": OpNotEqual,
+	">":  OpGreater,
+	">=": OpGreaterEqual,
+	"<":  OpLess,
+	"<=": OpLessEqual,
+}
+
+// kafelSwapped is the operator with the operands swapped
+var kafelSwapped = map[Op]Op{
+	OpEqual:        OpEqual,
+	OpNotEqual:     OpNotEqual,
+	OpGreater:      OpLess,
+	OpGreaterEqual: OpLessEqual,
+	OpLess:         OpGreater,
+	OpLessEqual:    OpGreaterEqual,
+}
+
+// compare parses: operand op operand, one of the operands is argument
+func (p *kafelParser) compare(args map[string]uint) (kafelExpr, error) {
+	t := p.peek()
+	l, err := p.operand(args)
+	if err != nil {
+		return nil, err
+	}
+	opTok := p.peek()
+	op, ok := kafelOps[opTok.text]
+	if !ok || opTok.number {
+		return nil, p.unexpected("comparison")
+	}
+	p.next()
+	r, err := p.operand(args)
+	if err != nil {
+		return nil, err
+	}
+	if l.arg == r.arg {
+		return nil, kafelErrorf(t, "comparison needs exactly one argument")
+	}
+	if r.arg {
+		l, r = r, l
+		op = kafelSwapped[op]
+	}
+	c := Cond{Index: l.index, Op: op, Value: r.value}
+	if l.masked {
+		switch op {
+		case OpEqual:
+			c.Op = OpMaskedEqual
+		case OpNotEqual:
+			c.Op = OpMaskedNotEqual
+		default:
+			return nil, kafelErrorf(opTok, "masked argument only supports == and !=")
+		}
+		c.Mask = l.mask
+	}
+	return &kafelCmp{tok: t, cond: c}, nil
+}
+
+type kafelOperand struct {
+	arg    bool
+	index  uint
+	masked bool
+	mask   uint64
+	value  uint64
+}
+
+// operand parses: arg [ & constant ] | ( arg & constant ) | constant
+func (p *kafelParser) operand(args map[string]uint) (kafelOperand, error) {
+	if p.accept("(") {
+		o, err := p.operand(args)
+		if err != nil {
+			return o, err
+		}
+		return o, p.expect(")")
+	}
+	t := p.peek()
+	if i, ok := args[t.text]; ok && !t.number {
+		p.next()
+		o := kafelOperand{arg: true, index: i}
+		if p.accept("&") {
+			v, err := p.constant()
+			if err != nil {
+				return o, err
+			}
+			o.masked, o.mask = true, v
+		}
+		return o, nil
+	}
+	v, err := p.constant()
+	return kafelOperand{value: v}, err
+}
+
+// constant parses: value { | value }, value is number or defined name
+func (p *kafelParser) constant() (uint64, error) {
+	var v uint64
+	for {
+		t := p.peek()
+		switch {
+		case t.number:
+			n, err := strconv.ParseUint(t.text, 0, 64)
+			if err != nil {
+				return 0, kafelErrorf(t, "invalid number %q", t.text)
+			}
+			v |= n
+		case t.text != "" && isKafelIdent(t.text[0]):
+			n, ok := p.defines[t.text]
+			if !ok {
+				return 0, kafelErrorf(t, "undefined %q", t.text)
+			}
+			v |= n
+		default:
+			return 0, p.unexpected("constant")
+		}
+		p.next()
+		if !p.accept("|") {
+			return v, nil
+		}
+	}
+}
+
+// use parses: name DEFAULT action
+func (p *kafelParser) use() (*Policy, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	rules, ok := p.policies[name.text]
+	if !ok {
+		return nil, kafelErrorf(name, "undefined policy %q", name.text)
+	}
+	if err := p.expect("DEFAULT"); err != nil {
+		return nil, err
+	}
+	def, err := p.action()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.text != "" {
+		return nil, kafelErrorf(t, "unexpected %q after USE", t.text)
+	}
+
+	policy := NewPolicy().Default(def)
+	for _, r := range rules {
+		if r.conds == nil {
+			policy.add(r.action, []string{r.tok.text})
+		}
+		for _, c := range r.conds {
+			policy.addIf(r.action, r.tok.text, c)
+		}
+		if policy.err != nil {
+			return nil, kafelErrorf(r.tok, "%v", strings.TrimPrefix(policy.err.Error(), "seccomp: "))
+		}
+	}
+	return policy, nil
+}
+
+// kafelDNF converts the expression (negated if neg) to disjunction of
+// conjunctions
+func kafelDNF(e kafelExpr, neg bool) ([][]Cond, error) {
+	switch e := e.(type) {
+	case *kafelNot:
+		return kafelDNF(e.e, !neg)
+
+	case *kafelBinary:
+		l, err := kafelDNF(e.l, neg)
+		if err != nil {
+			return nil, err
+		}
+		r, err := kafelDNF(e.r, neg)
+		if err != nil {
+			return nil, err
+		}
+		// !(a && b) == !a || !b
+		if e.and == neg {
+			return append(l, r...), nil
+		}
+		var terms [][]Cond
+		for _, a := range l {
+			for _, b := range r {
+				if len(terms) > maxKafelTerms {
+					return terms, nil
+				}
+				terms = append(terms, append(a[:len(a):len(a)], b...))
+			}
+		}
+		return terms, nil
+
+	default:
+		c := e.(*kafelCmp).cond
+		if neg {
+			c.Op = kafelNegated[c.Op]
+		}
+		return [][]Cond{{c}}, nil
+	}
+}
+
+var kafelNegated = map[Op]Op{
+	OpEqual:          OpNotEqual,
+	OpNotEqual:       OpEqual,
+	OpGreater:        OpLessEqual,
+	OpGreaterEqual:   OpLess,
+	OpLess:           OpGreaterEqual,
+	OpLessEqual:      OpGreater,
+	OpMaskedEqual:    OpMaskedNotEqual,
+	OpMaskedNotEqual: OpMaskedEqual,
+}
@@ -0,0 +1,295 @@
+package libseccomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/criyle/go-sandbox/pkg/seccomp"
+)
+
+// OCIProfile is the seccomp profile in OCI runtime spec / Docker format
+type OCIProfile struct {
+	DefaultAction   string       `json:"defaultAction"`
+	DefaultErrnoRet *uint        `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string     `json:"architectures,omitempty"`
+	ArchMap         []OCIArchMap `json:"archMap,omitempty"`
+	Syscalls        []OCISyscall `json:"syscalls,omitempty"`
+}
+
+// OCIArchMap is the architecture with its sub-architectures (Docker)
+type OCIArchMap struct {
+	Architecture     string   `json:"architecture"`
+	SubArchitectures []string `json:"subArchitectures,omitempty"`
+}
+
+// OCISyscall is the action for the syscalls if the args matched
+type OCISyscall struct {
+	Names    []string   `json:"names,omitempty"`
+	Name     string     `json:"name,omitempty"` // legacy Docker format
+	Action   string     `json:"action"`
+	ErrnoRet *uint      `json:"errnoRet,omitempty"`
+	Args     []OCIArg   `json:"args,omitempty"`
+	Includes *OCIFilter `json:"includes,omitempty"` // Docker only
+	Excludes *OCIFilter `json:"excludes,omitempty"` // Docker only
+}
+
+// OCIArg compares the syscall argument at index (ValueTwo is the expected
+// value of SCMP_CMP_MASKED_EQ with Value as mask)
+type OCIArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// OCIFilter selects rules by architecture, capabilities and kernel version
+type OCIFilter struct {
+	Arches    []string `json:"arches,omitempty"`
+	Caps      []string `json:"caps,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// seccomp return values (linux/seccomp.h)
+const (
+	retKillProcess = 0x80000000
+	retKillThread  = 0x00000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+
+	// offsets of seccomp_data
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+
+	auditArchX86_64  = 0xc000003e
+	auditArchAARCH64 = 0xc00000b7
+	auditArchRISCV64 = 0xc00000f3
+	x32SyscallBit    = 0x40000000
+
+	// BPF_MAXINSNS
+	maxInsns = 4096
+)
+
+// ociArches maps the architecture to the OCI architecture
+var ociArches = map[*Arch]string{
+	ArchX86_64:  "SCMP_ARCH_X86_64",
+	ArchX32:     "SCMP_ARCH_X32",
+	ArchI386:    "SCMP_ARCH_X86",
+	ArchAARCH64: "SCMP_ARCH_AARCH64",
+	ArchARM:     "SCMP_ARCH_ARM",
+	ArchRISCV64: "SCMP_ARCH_RISCV64",
+}
+
+// ParseOCIProfile parses OCI / Docker seccomp profile in JSON
+func ParseOCIProfile(b []byte) (*OCIProfile, error) {
+	p := new(OCIProfile)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("seccomp: %v", err)
+	}
+	return p, nil
+}
+
+// Build compiles the profile into filter for the current architecture and
+// its compat ABIs listed in the profile (e.g. SCMP_ARCH_X86 on x86_64).
+// caps (e.g. CAP_SYS_ADMIN) are the capabilities of the process to select
+// the rules by includes / excludes. Syscalls not exist on an architecture
+// are ignored, and syscalls of other architectures fail with ENOSYS. Filters
+// of the same profile and caps are compiled once and shared (must not be
+// modified)
+func (p *OCIProfile) Build(caps []string) (seccomp.Filter, error) {
+	key, err := p.key(caps)
+	if err != nil {
+		return nil, err
+	}
+	return cachedFilter(key, func() (seccomp.Filter, error) {
+		return p.build(caps)
+	})
+}
+
+func (p *OCIProfile) build(caps []string) (seccomp.Filter, error) {
+	native := NativeArch()
+	if native == nil {
+		return nil, fmt.Errorf("seccomp: architecture %s not supported", runtime.GOARCH)
+	}
+	if !p.hasArch(native) {
+		return nil, fmt.Errorf("seccomp: architecture %s not in profile", runtime.GOARCH)
+	}
+	arches := []*Arch{native}
+	for _, a := range native.CompatArches() {
+		if p.hasArch(a) {
+			arches = append(arches, a)
+		}
+	}
+	defRet, err := ociAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	kernel := kernelVersion()
+
+	var rules []rule
+	for _, s := range p.Syscalls {
+		if !s.Includes.match(caps, kernel, true) || !s.Excludes.match(caps, kernel, false) {
+			continue
+		}
+		ret, err := ociAction(s.Action, s.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		conds := make([]Cond, 0, len(s.Args))
+		for _, a := range s.Args {
+			c, err := a.cond()
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, c)
+		}
+		names := s.Names
+		if s.Name != "" {
+			names = append(names[:len(names):len(names)], s.Name)
+		}
+		for _, n := range names {
+			rules = append(rules, rule{name: n, ret: ret, args: conds})
+		}
+	}
+	return compile(arches, rules, defRet, retErrno|uint32(syscall.ENOSYS), "")
+}
+
+// hasArch reports whether the architecture is in the profile, the native
+// architecture is assumed if the profile has no architecture
+func (p *OCIProfile) hasArch(a *Arch) bool {
+	if len(p.Architectures) == 0 && len(p.ArchMap) == 0 {
+		return a == NativeArch()
+	}
+	name := ociArches[a]
+	if contains(p.Architectures, name) {
+		return true
+	}
+	for _, m := range p.ArchMap {
+		if m.Architecture == name || contains(m.SubArchitectures, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the rule is selected, all of includes need to be
+// satisfied while none of excludes
+func (f *OCIFilter) match(caps []string, kernel [2]int, include bool) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Arches) > 0 && contains(f.Arches, runtime.GOARCH) != include {
+		return false
+	}
+	for _, c := range f.Caps {
+		if contains(caps, c) != include {
+			return false
+		}
+	}
+	if f.MinKernel != "" && !versionLess(kernel, parseVersion(f.MinKernel)) != include {
+		return false
+	}
+	return true
+}
+
+// cond converts the arg to the condition
+func (a OCIArg) cond() (Cond, error) {
+	op, ok := ociOps[a.Op]
+	if !ok {
+		return Cond{}, fmt.Errorf("seccomp: unknown op %q", a.Op)
+	}
+	if op == OpMaskedEqual {
+		return Cond{Index: a.Index, Op: op, Mask: a.Value, Value: a.ValueTwo}, nil
+	}
+	return Cond{Index: a.Index, Op: op, Value: a.Value}, nil
+}
+
+var ociOps = map[string]Op{
+	"SCMP_CMP_EQ":        OpEqual,
+	"SCMP_CMP_NE":        OpNotEqual,
+	"SCMP_CMP_GT":        OpGreater,
+	"SCMP_CMP_GE":        OpGreaterEqual,
+	"SCMP_CMP_LT":        OpLess,
+	"SCMP_CMP_LE":        OpLessEqual,
+	"SCMP_CMP_MASKED_EQ": OpMaskedEqual,
+}
+
+// ociAction converts the action to seccomp return value, errnoRet defaults
+// to EPERM for SCMP_ACT_ERRNO
+func ociAction(action string, errnoRet *uint) (uint32, error) {
+	var data uint32
+	if errnoRet != nil {
+		data = uint32(*errnoRet) & 0xffff
+	}
+	switch action {
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return retKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return retKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return retTrap, nil
+	case "SCMP_ACT_ERRNO":
+		if errnoRet == nil {
+			data = uint32(syscall.EPERM)
+		}
+		return retErrno | data, nil
+	case "SCMP_ACT_TRACE":
+		return retTrace | data, nil
+	case "SCMP_ACT_LOG":
+		return retLog, nil
+	case "SCMP_ACT_ALLOW":
+		return retAllow, nil
+	}
+	return 0, fmt.Errorf("seccomp: unsupported action %q", action)
+}
+
+// kernelVersion returns major and minor version of the running kernel
+func kernelVersion() [2]int {
+	var u syscall.Utsname
+	if err := syscall.Uname(&u); err != nil {
+		return [2]int{}
+	}
+	var b []byte
+	for _, c := range u.Release {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return parseVersion(string(b))
+}
+
+// parseVersion parses "major.minor[.patch][-extra]"
+func parseVersion(s string) [2]int {
+	var v [2]int
+	for i, p := range strings.SplitN(s, ".", 3) {
+		if i > 1 {
+			break
+		}
+		if j := strings.IndexFunc(p, func(r rune) bool { return r < '0' || r > '9' }); j >= 0 {
+			p = p[:j]
+		}
+		v[i], _ = strconv.Atoi(p)
+	}
+	return v
+}
+
+func versionLess(a, b [2]int) bool {
+	return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package libseccomp
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"github.com/criyle/go-sandbox/pkg/seccomp"
+)
+
+// Policy builds the filter from per-syscall rules, e.g.
+//
+//	NewPolicy().Allow("read", "write").Errno(syscall.EPERM, "socket").KillDefault().Build()
+//
+// Rules could have conditions on the syscall arguments, e.g.
+//
+//	AllowIf("socket", ArgEq(0, syscall.AF_UNIX))
+//
+// rules of a syscall are matched in order they added, until the one without
+// condition. The policy is compiled for the current architecture by default,
+// the same policy could be compiled for other architectures by Arch. Syscall
+// names are validated against the architectures, and a syscall could only
+// have one action without condition
+type Policy struct {
+	actions map[string]seccomp.Action // actions without condition
+	rules   []policyRule
+	arches  []*Arch
+	def     seccomp.Action
+	compat  seccomp.Action
+	audit   seccomp.Action
+	last    string // syscalls above fail with ENOSYS
+	err     error
+}
+
+type policyRule struct {
+	name   string
+	action seccomp.Action
+	conds  []Cond
+}
+
+// NewPolicy creates a policy which kills the process on syscalls not allowed
+// and on syscalls of other architectures (e.g. i386 / x32 on x86_64)
+func NewPolicy() *Policy {
+	return &Policy{
+		actions: make(map[string]seccomp.Action),
+		def:     seccomp.ActionKill,
+		compat:  seccomp.ActionKill,
+	}
+}
+
+// Allow allows the syscalls
+func (p *Policy) Allow(names ...string) *Policy {
+	return p.add(seccomp.ActionAllow, names)
+}
+
+// Errno fails the syscalls with errno (e.g. EPERM)
+func (p *Policy) Errno(errno syscall.Errno, names ...string) *Policy {
+	return p.add(seccomp.ActionErrno.WithReturnCode(int16(errno)), names)
+}
+
+// Trace traps the syscalls to the ptrace tracer (MsgHandle as the Builder)
+func (p *Policy) Trace(names ...string) *Policy {
+	return p.add(seccomp.ActionTrace.WithReturnCode(seccomp.MsgHandle), names)
+}
+
+// AllowIf allows the syscall if all of the conditions matched
+func (p *Policy) AllowIf(name string, conds ...Cond) *Policy {
+	return p.addIf(seccomp.ActionAllow, name, conds)
+}
+
+// ErrnoIf fails the syscall with errno if all of the conditions matched
+func (p *Policy) ErrnoIf(errno syscall.Errno, name string, conds ...Cond) *Policy {
+	return p.addIf(seccomp.ActionErrno.WithReturnCode(int16(errno)), name, conds)
+}
+
+// TraceIf traps the syscall to the ptrace tracer if all of the conditions
+// matched
+func (p *Policy) TraceIf(name string, conds ...Cond) *Policy {
+	return p.addIf(seccomp.ActionTrace.WithReturnCode(seccomp.MsgHandle), name, conds)
+}
+
+// Default sets the action of the syscalls without rule
+func (p *Policy) Default(a seccomp.Action) *Policy {
+	p.def = a
+	return p
+}
+
+// KillDefault kills the process on syscalls without rule
+func (p *Policy) KillDefault() *Policy {
+	return p.Default(seccomp.ActionKill)
+}
+
+// Arch compiles the policy for the architectures instead of the current one,
+// e.g. Arch(ArchX86_64, ArchI386) handles 32-bit syscalls on x86_64 by the
+// same rules. Syscalls not exist on an architecture are ignored for it
+func (p *Policy) Arch(arches ...*Arch) *Policy {
+	p.arches = arches
+	return p
+}
+
+// HandleCompat compiles the policy for the current architecture and its
+// compat ABIs (i386 and x32 on x86_64, arm on aarch64)
+func (p *Policy) HandleCompat() *Policy {
+	if native := NativeArch(); native != nil {
+		return p.Arch(append([]*Arch{native}, native.CompatArches()...)...)
+	}
+	return p
+}
+
+// Compat sets the action of syscalls from architectures not compiled for
+func (p *Policy) Compat(a seccomp.Action) *Policy {
+	p.compat = a
+	return p
+}
+
+// ENOSYSAfter fails syscalls numbered above the syscall (e.g. "rseq") with
+// ENOSYS instead of the default action if they have no rule, so that
+// runtimes probing newer syscalls (e.g. clone3, faccessat2) fall back to the
+// older ones rather than killed
+func (p *Policy) ENOSYSAfter(name string) *Policy {
+	p.last = name
+	return p
+}
+
+// Audit replaces the denying actions (kill and errno, including the default
+// and compat) by a, so that the program runs as if allowed while the denied
+// syscalls are reported. ActionLog logs them by the kernel (audit log or
+// dmesg), ActionTrace with MsgDisallow reports them to the ptrace runner
+// (Audit of the ptrace Runner)
+func (p *Policy) Audit(a seccomp.Action) *Policy {
+	p.audit = a
+	return p
+}
+
+// ret returns the seccomp return value of the action
+func (p *Policy) ret(a seccomp.Action) uint32 {
+	if p.audit != 0 && (a.Action() == seccomp.ActionKill || a.Action() == seccomp.ActionErrno) {
+		a = p.audit
+	}
+	return uint32(ToSeccompAction(a))
+}
+
+func (p *Policy) add(a seccomp.Action, names []string) *Policy {
+	for _, n := range names {
+		if p.err != nil {
+			return p
+		}
+		if prev, ok := p.actions[n]; ok {
+			if prev != a {
+				p.err = fmt.Errorf("seccomp: conflicting actions for syscall %q", n)
+			}
+			continue
+		}
+		p.actions[n] = a
+		p.rules = append(p.rules, policyRule{name: n, action: a})
+	}
+	return p
+}
+
+func (p *Policy) addIf(a seccomp.Action, name string, conds []Cond) *Policy {
+	if len(conds) == 0 {
+		return p.add(a, []string{name})
+	}
+	if p.err != nil {
+		return p
+	}
+	for _, c := range conds {
+		if err := c.validate(); err != nil {
+			p.err = err
+			return p
+		}
+	}
+	p.rules = append(p.rules, policyRule{name: name, action: a, conds: conds})
+	return p
+}
+
+// Build compiles the policy to BPF, it returns the first error of the rules.
+// Filters of the same policy are compiled once and shared (must not be
+// modified)
+func (p *Policy) Build() (seccomp.Filter, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return cachedFilter(p.key(), p.build)
+}
+
+func (p *Policy) build() (seccomp.Filter, error) {
+	arches := p.arches
+	if len(arches) == 0 {
+		native := NativeArch()
+		if native == nil {
+			return nil, fmt.Errorf("seccomp: architecture %s not supported", runtime.GOARCH)
+		}
+		arches = []*Arch{native}
+	}
+
+	rules := make([]rule, 0, len(p.rules))
+	for _, r := range p.rules {
+		if !hasSyscall(arches, r.name) {
+			return nil, fmt.Errorf("seccomp: unknown syscall %q", r.name)
+		}
+		rules = append(rules, rule{name: r.name, ret: p.ret(r.action), args: r.conds})
+	}
+	if p.last != "" && !hasSyscall(arches, p.last) {
+		return nil, fmt.Errorf("seccomp: unknown syscall %q", p.last)
+	}
+	return compile(arches, rules, p.ret(p.def), p.ret(p.compat), p.last)
+}
+
+// hasSyscall reports whether the syscall exists on any of the architectures
+func hasSyscall(arches []*Arch, name string) bool {
+	for _, a := range arches {
+		if _, ok := a.Syscalls[name]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package libseccomp
 
 import (
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/criyle/go-sandbox/pkg/seccomp"
@@ -27,7 +29,7 @@ func TestBuildFilter(t *testing.T) {
 	}
 }
 
-// BenchmarkBuildDefaultFilter is about 0.2ms/op
+// BenchmarkBuildDefaultFilter is about 0.02ms/op from cache (0.2ms/op to compile)
 func BenchmarkBuildDefaultFilter(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		builder := Builder{
@@ -47,3 +49,172 @@ func buildFilterMock() (seccomp.Filter, error) {
 	}
 	return b.Build()
 }
+
+func TestPolicy(t *testing.T) {
+	if _, err := NewPolicy().Allow(defaultSyscallAllows...).Trace("execve").
+		Errno(syscall.EPERM, "socket").KillDefault().Build(); err != nil {
+		t.Errorf("Policy build failed: %v", err)
+	}
+	if _, err := NewPolicy().Allow("read", "not_a_syscall").Build(); err == nil {
+		t.Error("Policy should reject unknown syscall")
+	}
+	if _, err := NewPolicy().Allow("read").Errno(syscall.EPERM, "read").Build(); err == nil {
+		t.Error("Policy should reject conflicting actions")
+	}
+	if _, err := NewPolicy().Allow("read", "renameat", "riscv_hwprobe").Arch(ArchAARCH64, ArchRISCV64, ArchX86_64, ArchI386, ArchX32).Build(); err != nil {
+		t.Errorf("Policy build for multiple architectures failed: %v", err)
+	}
+	if _, err := NewPolicy().Allow("arch_prctl").Arch(ArchAARCH64, ArchRISCV64).Build(); err == nil {
+		t.Error("Policy should reject syscall not exist on the architectures")
+	}
+	if _, err := NewPolicy().Allow("read").Errno(syscall.EPERM, "socket").Audit(seccomp.ActionLog).Build(); err != nil {
+		t.Errorf("Policy build in audit mode failed: %v", err)
+	}
+	if _, err := NewPolicy().AllowIf("socket", ArgEq(0, syscall.AF_UNIX)).Errno(syscall.EPERM, "socket").
+		AllowIf("clone", ArgMaskedEq(0, syscall.CLONE_NEWUSER, 0)).Build(); err != nil {
+		t.Errorf("Policy build with conditions failed: %v", err)
+	}
+	if _, err := NewPolicy().AllowIf("read", ArgEq(6, 0)).Build(); err == nil {
+		t.Error("Policy should reject invalid arg index")
+	}
+	if _, err := NewPolicy().Allow(defaultSyscallAllows...).ENOSYSAfter("rseq").Build(); err != nil {
+		t.Errorf("Policy build with ENOSYSAfter failed: %v", err)
+	}
+}
+
+func TestFilterCache(t *testing.T) {
+	f1, err := NewPolicy().Allow("read", "write").AllowIf("socket", ArgEq(0, syscall.AF_UNIX)).Build()
+	if err != nil {
+		t.Fatalf("Policy build failed: %v", err)
+	}
+	f2, _ := NewPolicy().AllowIf("socket", ArgEq(0, syscall.AF_UNIX)).Allow("write", "read").Build()
+	f3, _ := NewPolicy().Allow("read", "write").AllowIf("socket", ArgEq(0, syscall.AF_INET)).Build()
+	if &f1[0] != &f2[0] {
+		t.Error("Same policy should share the cached filter")
+	}
+	if &f1[0] == &f3[0] {
+		t.Error("Different policy should not share the cached filter")
+	}
+}
+
+func TestKafel(t *testing.T) {
+	p, err := ParseKafel(`
+#define AF_UNIX 1
+POLICY base {
+	ALLOW { read, write, socket(domain) { domain == AF_UNIX } },
+	ERRNO(1) { socket }
+}
+POLICY sample {
+	USE base,
+	KILL { clone(flags) { (flags & 0x10000000) != 0 } },
+	ALLOW { clone }
+}
+USE sample DEFAULT KILL`)
+	if err != nil {
+		t.Fatalf("Parse kafel failed: %v", err)
+	}
+	if _, err := p.Build(); err != nil {
+		t.Errorf("Build kafel policy failed: %v", err)
+	}
+	if _, err := ParseKafel("POLICY a {\n\tALLOW { not_a_syscall }\n}\nUSE a DEFAULT KILL"); err == nil || !strings.Contains(err.Error(), "2:10") {
+		t.Errorf("Kafel should reject unknown syscall with position: %v", err)
+	}
+	if _, err := ParseKafel("POLICY a {\n\tALLOW { mmap(addr, len, addr) }\n}\nUSE a DEFAULT KILL"); err == nil || !strings.Contains(err.Error(), "2:26") || !strings.Contains(err.Error(), "duplicate argument") {
+		t.Errorf("Kafel should reject duplicate argument with position: %v", err)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	f, err := NewPolicy().Allow("read").AllowIf("socket", ArgEq(0, syscall.AF_UNIX)).
+		Errno(syscall.EPERM, "socket").Arch(ArchX86_64, ArchI386).Build()
+	if err != nil {
+		t.Fatalf("Policy build failed: %v", err)
+	}
+	if f.Disassemble() == "" {
+		t.Error("Disassemble returned empty")
+	}
+	for _, c := range []struct {
+		arch *Arch
+		name string
+		args []uint64
+		ret  seccomp.Ret
+	}{
+		{ArchX86_64, "read", nil, seccomp.RetAllow},
+		{ArchI386, "read", nil, seccomp.RetAllow},
+		{ArchX86_64, "socket", []uint64{syscall.AF_UNIX}, seccomp.RetAllow},
+		{ArchX86_64, "socket", []uint64{syscall.AF_INET}, seccomp.RetErrno | seccomp.Ret(syscall.EPERM)},
+		{ArchX86_64, "write", nil, seccomp.RetKillProcess},
+		{ArchX32, "read", nil, seccomp.RetKillProcess},
+	} {
+		d, err := c.arch.Data(c.name, c.args...)
+		if err != nil {
+			t.Fatalf("Data failed: %v", err)
+		}
+		if r, err := f.Evaluate(d); err != nil || r != c.ret {
+			t.Errorf("Evaluate %v %s%v = %v, %v; want %v", c.arch, c.name, c.args, r, err, c.ret)
+		}
+	}
+}
+
+func TestEvaluateCond(t *testing.T) {
+	const v = 0x00000002_00000005
+	// values around v with the high word lower / equal / higher
+	args := []uint64{
+		0, 5, 0x00000001_ffffffff,
+		v - 1, v, v + 1, 0x00000002_ffffffff,
+		0x00000003_00000000, 0x00000003_00000005, ^uint64(0),
+	}
+	const mask = 0x0000000f_0000000f
+	for _, c := range []struct {
+		cond  Cond
+		match func(a uint64) bool
+	}{
+		{ArgEq(1, v), func(a uint64) bool { return a == v }},
+		{ArgNe(1, v), func(a uint64) bool { return a != v }},
+		{ArgGt(1, v), func(a uint64) bool { return a > v }},
+		{ArgGe(1, v), func(a uint64) bool { return a >= v }},
+		{ArgLt(1, v), func(a uint64) bool { return a < v }},
+		{ArgLe(1, v), func(a uint64) bool { return a <= v }},
+		{ArgMaskedEq(1, mask, v), func(a uint64) bool { return a&mask == v }},
+		{ArgMaskedNe(1, mask, v), func(a uint64) bool { return a&mask != v }},
+	} {
+		f, err := NewPolicy().AllowIf("read", c.cond).Arch(ArchX86_64).Build()
+		if err != nil {
+			t.Fatalf("Policy build failed: %v", err)
+		}
+		for _, a := range args {
+			d, err := ArchX86_64.Data("read", 0, a)
+			if err != nil {
+				t.Fatalf("Data failed: %v", err)
+			}
+			want := seccomp.RetKillProcess
+			if c.match(a) {
+				want = seccomp.RetAllow
+			}
+			if r, err := f.Evaluate(d); err != nil || r != want {
+				t.Errorf("Evaluate %+v arg %#x = %v, %v; want %v", c.cond, a, r, err, want)
+			}
+		}
+	}
+}
+
+func TestOCIProfile(t *testing.T) {
+	p, err := ParseOCIProfile([]byte(`{
+		"defaultAction": "SCMP_ACT_ERRNO",
+		"syscalls": [
+			{"names": ["read", "write", "_llseek"], "action": "SCMP_ACT_ALLOW"},
+			{"names": ["personality"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 8, "op": "SCMP_CMP_EQ"}]},
+			{"names": ["clone"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 2114060288, "valueTwo": 0, "op": "SCMP_CMP_MASKED_EQ"}], "excludes": {"caps": ["CAP_SYS_ADMIN"]}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Parse OCI profile failed: %v", err)
+	}
+	if _, err := p.Build(nil); err != nil {
+		t.Errorf("Build OCI profile failed: %v", err)
+	}
+	p.DefaultAction = "SCMP_ACT_NOTIFY"
+	if _, err := p.Build(nil); err == nil {
+		t.Error("Build OCI profile should reject unsupported action")
+	}
+}
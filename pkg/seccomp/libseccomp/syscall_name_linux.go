@@ -8,12 +8,32 @@ import (
 
 var info, errInfo = arch.GetInfo("")
 
+// nativeNames is the syscall names of the native architecture, used when
+// go-seccomp-bpf does not support it (e.g. aarch64)
+var nativeNames = func() map[int]string {
+	a := NativeArch()
+	if errInfo == nil || a == nil {
+		return nil
+	}
+	m := make(map[int]string, len(a.Syscalls))
+	for n, nr := range a.Syscalls {
+		m[nr] = n
+	}
+	return m
+}()
+
 // ToSyscallName convert syscallno to syscall name
 func ToSyscallName(sysno uint) (string, error) {
-	if errInfo != nil {
+	var n string
+	var ok bool
+	switch {
+	case errInfo == nil:
+		n, ok = info.SyscallNumbers[int(sysno)]
+	case nativeNames != nil:
+		n, ok = nativeNames[int(sysno)]
+	default:
 		return "", errInfo
 	}
-	n, ok := info.SyscallNumbers[int(sysno)]
 	if !ok {
 		return "", fmt.Errorf("syscall no %d does not exits", sysno)
 	}
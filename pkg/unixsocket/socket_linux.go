@@ -4,6 +4,7 @@ package unixsocket
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -21,6 +22,10 @@ var oobPool = sync.Pool{
 	},
 }
 
+// ErrTruncated is returned by RecvMsg if the message or its oob message is
+// larger than the buffer, the rest of which is discarded
+var ErrTruncated = errors.New("unixsocket: message truncated")
+
 // Socket wrappers a unix socket connection
 type Socket net.UnixConn
 
@@ -118,7 +123,7 @@ func (s *Socket) RecvMsg(b []byte) (int, *Msg, error) {
 	oob := oobPool.Get().([]byte)
 	defer oobPool.Put(oob)
 
-	n, oobn, _, _, err := (*net.UnixConn)(s).ReadMsgUnix(b, oob)
+	n, oobn, flags, _, err := (*net.UnixConn)(s).ReadMsgUnix(b, oob)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -131,6 +136,12 @@ func (s *Socket) RecvMsg(b []byte) (int, *Msg, error) {
 	if err != nil {
 		return 0, nil, err
 	}
+	if flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+		for _, fd := range msg.Fds {
+			syscall.Close(fd)
+		}
+		return 0, nil, ErrTruncated
+	}
 	return n, msg, nil
 }
 
@@ -7,11 +7,6 @@ import (
 	unix "golang.org/x/sys/unix"
 )
 
-// TODO: make this method not to call ptrace too much
-func ptraceReadStr(pid int, addr uintptr, buff []byte) {
-	syscall.PtracePeekData(pid, addr, buff)
-}
-
 func processVMReadv(pid int, localIov, remoteIov []unix.Iovec,
 	flags uintptr) (r1, r2 uintptr, err syscall.Errno) {
 	return syscall.Syscall6(unix.SYS_PROCESS_VM_READV, uintptr(pid),
@@ -23,7 +18,7 @@ func processVMReadv(pid int, localIov, remoteIov []unix.Iovec,
 func vmRead(pid int, addr uintptr, buff []byte) (int, error) {
 	l := len(buff)
 	localIov := getIovecs(&buff[0], l)
-	remoteIov := getIovecs((*byte)(unsafe.Pointer(addr)), l)
+	remoteIov := getRemoteIovecs(addr, l)
 	n, _, err := processVMReadv(pid, localIov, remoteIov, uintptr(0))
 	if err == 0 {
 		return int(n), nil
@@ -31,10 +26,40 @@ func vmRead(pid int, addr uintptr, buff []byte) (int, error) {
 	return int(n), err
 }
 
+func processVMWritev(pid int, localIov, remoteIov []unix.Iovec,
+	flags uintptr) (r1, r2 uintptr, err syscall.Errno) {
+	return syscall.Syscall6(unix.SYS_PROCESS_VM_WRITEV, uintptr(pid),
+		uintptr(unsafe.Pointer(&localIov[0])), uintptr(len(localIov)),
+		uintptr(unsafe.Pointer(&remoteIov[0])), uintptr(len(remoteIov)),
+		flags)
+}
+
+// vmWriteOrPoke writes buff into process memory by process_vm_writev, or by
+// PTRACE_POKEDATA if failed (e.g. not available)
+func vmWriteOrPoke(pid int, addr uintptr, buff []byte) error {
+	if UseVMReadv {
+		localIov := getIovecs(&buff[0], len(buff))
+		remoteIov := getRemoteIovecs(addr, len(buff))
+		n, _, err := processVMWritev(pid, localIov, remoteIov, uintptr(0))
+		if err == 0 && int(n) == len(buff) {
+			return nil
+		}
+	}
+	_, err := syscall.PtracePokeData(pid, addr, buff)
+	return err
+}
+
 func getIovecs(base *byte, l int) []unix.Iovec {
 	return []unix.Iovec{getIovec(base, l)}
 }
 
+// getRemoteIovecs creates iovec of the address in the other process
+func getRemoteIovecs(addr uintptr, l int) []unix.Iovec {
+	iov := getIovec(nil, l)
+	*(*uintptr)(unsafe.Pointer(&iov.Base)) = addr
+	return []unix.Iovec{iov}
+}
+
 func vmReadStr(pid int, addr uintptr, buff []byte) error {
 	// Deal with unaligned addr
 	n := 0
@@ -44,7 +69,7 @@ func vmReadStr(pid int, addr uintptr, buff []byte) error {
 	}
 
 	for len(buff) > 0 {
-		if l := len(buff); r < l {
+		if l := len(buff); r > l {
 			r = l
 		}
 
@@ -79,5 +104,5 @@ func clen(b []byte) int {
 			return i
 		}
 	}
-	return len(b) + 1
+	return len(b)
 }
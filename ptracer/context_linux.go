@@ -12,6 +12,10 @@ type Context struct {
 	Pid int
 	// current reg context (platform dependent)
 	regs syscall.PtraceRegs
+	// regs modified by SetArg
+	modified bool
+	// scratch memory used by SetStringArg below the stack pointer
+	scratch uintptr
 }
 
 var (
@@ -38,20 +42,75 @@ func getTrapContext(pid int) (*Context, error) {
 	}, nil
 }
 
+// Arg gets the i-th argument for the current syscall
+func (c *Context) Arg(i int) uint {
+	switch i {
+	case 0:
+		return c.Arg0()
+	case 1:
+		return c.Arg1()
+	case 2:
+		return c.Arg2()
+	case 3:
+		return c.Arg3()
+	case 4:
+		return c.Arg4()
+	case 5:
+		return c.Arg5()
+	}
+	return 0
+}
+
+// GetData reads len(buff) bytes from process memory at addr
+func (c *Context) GetData(addr uintptr, buff []byte) error {
+	if UseVMReadv {
+		if n, err := vmRead(c.Pid, addr, buff); err == nil && n == len(buff) {
+			return nil
+		}
+	}
+	_, err := syscall.PtracePeekData(c.Pid, addr, buff)
+	return err
+}
+
+// SetStringArg writes the string into the scratch memory below the stack
+// pointer (not used before the syscall returns) of the process and sets the
+// i-th argument of the current syscall to it (e.g. rewrites the path)
+func (c *Context) SetStringArg(i int, s string) error {
+	if c.scratch == 0 {
+		c.scratch = c.stackPointer() - redZone
+	}
+	b := append([]byte(s), 0)
+	addr := (c.scratch - uintptr(len(b))) &^ 15
+	if err := vmWriteOrPoke(c.Pid, addr, b); err != nil {
+		return err
+	}
+	c.scratch = addr
+	c.SetArg(i, uint(addr))
+	return nil
+}
+
+// commit writes the regs modified by SetArg
+func (c *Context) commit() error {
+	if !c.modified {
+		return nil
+	}
+	return ptraceSetRegSet(c.Pid, &c.regs)
+}
+
 // GetString get the string from process data segment
 func (c *Context) GetString(addr uintptr) string {
 	buff := make([]byte, syscall.PathMax)
 	if UseVMReadv {
-		if err := vmReadStr(c.Pid, addr, buff); err != nil {
-			// if ENOSYS, then disable this function
-			if no, ok := err.(syscall.Errno); ok {
-				if no == syscall.ENOSYS {
-					UseVMReadv = false
-				}
-			}
-		} else {
+		// EFAULT if the string is not terminated before unmapped memory, the
+		// bytes before it are read already
+		err := vmReadStr(c.Pid, addr, buff)
+		if err == nil || err == syscall.EFAULT {
 			return string(buff[:clen(buff)])
 		}
+		// if ENOSYS, then disable this function
+		if err == syscall.ENOSYS {
+			UseVMReadv = false
+		}
 	}
 	syscall.PtracePeekData(c.Pid, addr, buff)
 	return string(buff[:clen(buff)])
@@ -41,14 +41,42 @@ func (c *Context) Arg5() uint {
 	return uint(c.regs.R9)
 }
 
+// SetArg sets the i-th argument for the current syscall
+func (c *Context) SetArg(i int, v uint) {
+	switch i {
+	case 0:
+		c.regs.Rdi = uint64(v)
+	case 1:
+		c.regs.Rsi = uint64(v)
+	case 2:
+		c.regs.Rdx = uint64(v)
+	case 3:
+		c.regs.R10 = uint64(v)
+	case 4:
+		c.regs.R8 = uint64(v)
+	case 5:
+		c.regs.R9 = uint64(v)
+	}
+	c.modified = true
+}
+
 // SetReturnValue set the return value if skip the syscall
 func (c *Context) SetReturnValue(retval int) {
 	c.regs.Rax = uint64(retval)
 }
 
+// red zone (128 bytes below rsp) could be used by leaf functions
+const redZone = 128
+
+func (c *Context) stackPointer() uintptr {
+	return uintptr(c.regs.Rsp)
+}
+
 func (c *Context) skipSyscall() error {
-	c.regs.Orig_rax = ^uint64(0) //-1
-	return syscall.PtraceSetRegs(c.Pid, &c.regs)
+	// copied so that SyscallNo still reports the skipped syscall
+	regs := c.regs
+	regs.Orig_rax = ^uint64(0) //-1
+	return syscall.PtraceSetRegs(c.Pid, &regs)
 }
 
 func getIovec(base *byte, l int) unix.Iovec {
@@ -41,11 +41,28 @@ func (c *Context) Arg5() uint {
 	return uint(c.regs.Uregs[5]) //R5
 }
 
+// SetArg sets the i-th argument for the current syscall
+func (c *Context) SetArg(i int, v uint) {
+	if i >= 0 && i < 6 {
+		c.regs.Uregs[i] = uint32(v) // R0 - R5
+		if i == 0 {
+			c.regs.Uregs[17] = uint32(v) // Orig_R0
+		}
+		c.modified = true
+	}
+}
+
 // SetReturnValue set the return value if skip the syscall
 func (c *Context) SetReturnValue(retval int) {
 	c.regs.Uregs[0] = uint32(retval) // R0
 }
 
+const redZone = 0
+
+func (c *Context) stackPointer() uintptr {
+	return uintptr(c.regs.Uregs[13]) // SP
+}
+
 func (c *Context) skipSyscall() error {
 	err := syscall.PtraceSetRegs(c.Pid, &c.regs)
 	if err != nil {
@@ -39,11 +39,25 @@ func (c *Context) Arg5() uint {
 	return uint(c.regs.Regs[5]) //R5
 }
 
+// SetArg sets the i-th argument for the current syscall
+func (c *Context) SetArg(i int, v uint) {
+	if i >= 0 && i < 6 {
+		c.regs.Regs[i] = uint64(v) // R0 - R5
+		c.modified = true
+	}
+}
+
 // SetReturnValue set the return value if skip the syscall
 func (c *Context) SetReturnValue(retval int) {
 	c.regs.Regs[0] = uint64(retval) // R0
 }
 
+const redZone = 0
+
+func (c *Context) stackPointer() uintptr {
+	return uintptr(c.regs.Sp)
+}
+
 func (c *Context) skipSyscall() error {
 	err := ptraceSetRegSet(c.Pid, &c.regs)
 	if err != nil {
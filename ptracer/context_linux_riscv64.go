@@ -0,0 +1,86 @@
+package ptracer
+
+import (
+	unix "golang.org/x/sys/unix"
+)
+
+// SyscallNo get current syscall no
+func (c *Context) SyscallNo() uint {
+	return uint(c.regs.A7)
+}
+
+// Arg0 gets the arg0 for the current syscall
+func (c *Context) Arg0() uint {
+	return uint(c.regs.A0)
+}
+
+// Arg1 gets the arg1 for the current syscall
+func (c *Context) Arg1() uint {
+	return uint(c.regs.A1)
+}
+
+// Arg2 gets the arg2 for the current syscall
+func (c *Context) Arg2() uint {
+	return uint(c.regs.A2)
+}
+
+// Arg3 gets the arg3 for the current syscall
+func (c *Context) Arg3() uint {
+	return uint(c.regs.A3)
+}
+
+// Arg4 gets the arg4 for the current syscall
+func (c *Context) Arg4() uint {
+	return uint(c.regs.A4)
+}
+
+// Arg5 gets the arg5 for the current syscall
+func (c *Context) Arg5() uint {
+	return uint(c.regs.A5)
+}
+
+// SetArg sets the i-th argument for the current syscall
+func (c *Context) SetArg(i int, v uint) {
+	switch i {
+	case 0:
+		c.regs.A0 = uint64(v)
+	case 1:
+		c.regs.A1 = uint64(v)
+	case 2:
+		c.regs.A2 = uint64(v)
+	case 3:
+		c.regs.A3 = uint64(v)
+	case 4:
+		c.regs.A4 = uint64(v)
+	case 5:
+		c.regs.A5 = uint64(v)
+	}
+	c.modified = true
+}
+
+// SetReturnValue set the return value if skip the syscall
+func (c *Context) SetReturnValue(retval int) {
+	c.regs.A0 = uint64(retval)
+}
+
+const redZone = 0
+
+func (c *Context) stackPointer() uintptr {
+	return uintptr(c.regs.Sp)
+}
+
+// the syscall no is re-read from a7 after the tracer stop, and a0 is kept as
+// the return value for -1
+func (c *Context) skipSyscall() error {
+	// copied so that SyscallNo still reports the skipped syscall
+	regs := c.regs
+	regs.A7 = ^uint64(0) // -1
+	return ptraceSetRegSet(c.Pid, &regs)
+}
+
+func getIovec(base *byte, l int) unix.Iovec {
+	return unix.Iovec{
+		Base: base,
+		Len:  uint64(l),
+	}
+}
@@ -0,0 +1,47 @@
+package ptracer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/criyle/go-sandbox/runner"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetStringArg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	from, to, dst := filepath.Join(dir, "from"), filepath.Join(dir, "to"), filepath.Join(dir, "dst")
+	for p, s := range map[string]string{from: "original", to: "rewritten"} {
+		if err := ioutil.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cat outputs the content of to if open of from is rewritten
+	h := &testHandler{handle: func(ctx *Context) TraceAction {
+		if ctx.SyscallNo() == unix.SYS_OPENAT && ctx.GetString(uintptr(ctx.Arg1())) == from {
+			if err := ctx.SetStringArg(1, to); err != nil {
+				t.Error(err)
+				return TraceKill
+			}
+		}
+		return TraceAllow
+	}}
+	r := traceRun(t, h, "/bin/sh", "-c", "cat "+from+" >"+dst)
+	if r.Status != runner.StatusNormal || r.ExitStatus != 0 {
+		t.Fatal(r.Status, r.ExitStatus, r.Error)
+	}
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "rewritten" {
+		t.Errorf("got %q, want rewritten", b)
+	}
+}
@@ -35,6 +35,18 @@ func (c *Context) Arg5() uint {
 	return 0
 }
 
+func (c *Context) Arg(i int) uint {
+	return 0
+}
+
+func (c *Context) SetArg(i int, v uint) {
+
+}
+
+func (c *Context) SetStringArg(i int, s string) error {
+	return nil
+}
+
 func (c *Context) SetReturnValue(retval int) {
 
 }
@@ -42,3 +54,7 @@ func (c *Context) SetReturnValue(retval int) {
 func (c *Context) GetString(addr uintptr) string {
 	return ""
 }
+
+func (c *Context) GetData(addr uintptr, buff []byte) error {
+	return nil
+}
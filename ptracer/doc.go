@@ -1,3 +1,8 @@
 // Package ptracer provides platfirm independent ptrace pooling loop
 // interface to trace program syscalls on Linux.
+//
+// The tracee only stops on syscalls trapped by its seccomp filter
+// (SECCOMP_RET_TRACE with PTRACE_O_TRACESECCOMP), rather than on every
+// syscall entry and exit by PTRACE_SYSCALL. Syscalls allowed by the filter
+// run without tracer involved.
 package ptracer
@@ -0,0 +1,39 @@
+package ptracer
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/criyle/go-sandbox/runner"
+)
+
+// syscallProfile records the traced syscalls by syscall no
+type syscallProfile struct {
+	index map[uint]int
+	list  []runner.SyscallStat
+}
+
+func newSyscallProfile() *syscallProfile {
+	return &syscallProfile{index: make(map[uint]int)}
+}
+
+// add records a call of the trapped syscall which stopped the tracee for d
+func (p *syscallProfile) add(h Handler, ctx *Context, d time.Duration) {
+	no := ctx.SyscallNo()
+	i, ok := p.index[no]
+	if !ok {
+		name, err := h.GetSyscallName(ctx)
+		if err != nil {
+			name = strconv.FormatUint(uint64(no), 10)
+		}
+		i = len(p.list)
+		p.index[no] = i
+		p.list = append(p.list, runner.SyscallStat{Name: name})
+	}
+	p.list[i].Count++
+	p.list[i].Time += d
+}
+
+func (p *syscallProfile) stats() []runner.SyscallStat {
+	return p.list
+}
@@ -19,6 +19,10 @@ type Tracer struct {
 	Handler
 	Runner
 	runner.Limit
+
+	// Profile collects the count and the time stopped of the traced syscalls
+	// into Result.SyscallProfile
+	Profile bool
 }
 
 // Runner represents the process runner
@@ -35,3 +39,10 @@ type Handler interface {
 	Debug(v ...interface{})
 	HandlerDisallow(string) error
 }
+
+// SoftBanHandler is optionally implemented by Handler to soft ban the
+// disallowed syscall (as TraceBan) with the return value set, instead of
+// calling HandlerDisallow if it returns true
+type SoftBanHandler interface {
+	SoftBanDisallow(*Context) bool
+}
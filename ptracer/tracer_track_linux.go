@@ -3,8 +3,12 @@ package ptracer
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
+	"unsafe"
 
 	unix "golang.org/x/sys/unix"
 
@@ -21,19 +25,25 @@ func (t *Tracer) Trace(c context.Context) <-chan runner.Result {
 	return result
 }
 
-// TraceRun start and traces all child process by runner in the calling goroutine
-// parameter done used to cancel work, start is used notify child starts
+// TraceRun start and traces all child process by runner in the calling goroutine.
+// All tracees are killed once c is done, the result is StatusCanceled if c is
+// canceled, or StatusTimeLimitExceeded if its deadline exceeded
 func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 	var (
 		status  = runner.StatusNormal
-		wstatus unix.WaitStatus      // wait4 wait status
-		rusage  unix.Rusage          // wait4 rusage
-		traced  = make(map[int]bool) // store all process that have set ptrace options
-		execved = false              // store whether the runner process have successfully execvd
-		pid     int                  // store pid of wait4 result
-		sTime   = time.Now()         // records start time for trace process
-		fTime   time.Time            // records finish time for execve
+		wstatus unix.WaitStatus     // wait4 wait status
+		rusage  unix.Rusage         // wait4 rusage
+		traced  = make(map[int]int) // store tgid of all process that have set ptrace options
+		usage   = newUsageTracker() // store resource usage of all thread groups
+		execved = false             // store whether the runner process have successfully execvd
+		pid     int                 // store pid of wait4 result
+		sTime   = time.Now()        // records start time for trace process
+		fTime   time.Time           // records finish time for execve
+		profile *syscallProfile     // store traced syscalls if profiling
 	)
+	if t.Profile {
+		profile = newSyscallProfile()
+	}
 
 	// ptrace is thread based (kernel proc)
 	runtime.LockOSThread()
@@ -66,18 +76,25 @@ func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 			result.Status = runner.StatusRunnerError
 			result.Error = fmt.Sprintf("%v", err)
 		}
-		// kill all tracee upon return
+		// kill all tracee upon return, including the ones left the process
+		// group (e.g. by setsid)
 		killAll(pgid)
+		for p := range traced {
+			unix.Kill(p, unix.SIGKILL)
+		}
 		collectZombie(pgid)
 		result.SetUpTime = fTime.Sub(sTime)
 		result.RunningTime = time.Since(fTime)
+		if profile != nil {
+			result.SyscallProfile = profile.stats()
+		}
 	}()
 
 	// ptrace pool loop
 	for {
 		if execved {
-			// Wait for all child in the process group
-			pid, err = unix.Wait4(-pgid, &wstatus, unix.WALL, &rusage)
+			// Wait for all child in the process group and the ones left it
+			pid, err = waitTracee(pgid, traced, &wstatus, &rusage)
 		} else {
 			// Ensure the process have called setpgid
 			pid, err = unix.Wait4(pgid, &wstatus, unix.WALL, &rusage)
@@ -94,32 +111,42 @@ func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 		}
 		t.Handler.Debug("------ ", pid, " ------")
 
-		if pid == pgid {
-			// update resource usage and check against limits
-			userTime := time.Duration(rusage.Utime.Nano()) // ns
-			userMem := runner.Size(rusage.Maxrss << 10)    // bytes
+		tgid, ok := traced[pid]
+		if !ok {
+			tgid = getTgid(pid)
+		}
 
-			// check tle / mle
-			if userTime > t.Limit.TimeLimit {
-				status = runner.StatusTimeLimitExceeded
-			}
-			if userMem > t.Limit.MemoryLimit {
-				status = runner.StatusMemoryLimitExceeded
-			}
-			result = runner.Result{
-				Status: status,
-				Time:   userTime,
-				Memory: userMem,
-			}
-			if status != runner.StatusNormal {
-				return
-			}
+		// update resource usage of the thread group and check against limits
+		usage.update(tgid, procUsage{
+			time:   time.Duration(rusage.Utime.Nano()), // ns
+			memory: runner.Size(rusage.Maxrss << 10),   // bytes
+		})
+		userTime, userMem := usage.total()
+
+		// check tle / mle
+		if userTime > t.Limit.TimeLimit {
+			status = runner.StatusTimeLimitExceeded
+		}
+		if userMem > t.Limit.MemoryLimit {
+			status = runner.StatusMemoryLimitExceeded
+		}
+		result = runner.Result{
+			Status: status,
+			Time:   userTime,
+			Memory: userMem,
+		}
+		if status != runner.StatusNormal {
+			return
 		}
 
 		// check process status
 		switch {
 		case wstatus.Exited():
 			delete(traced, pid)
+			if pid == tgid && pid != pgid {
+				// kept until accounted by its parent
+				usage.exit(tgid)
+			}
 			t.Handler.Debug("process exited: ", pid, wstatus.ExitStatus())
 			if pid == pgid {
 				if execved {
@@ -144,6 +171,10 @@ func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 				switch sig {
 				case unix.SIGXCPU, unix.SIGKILL:
 					status = runner.StatusTimeLimitExceeded
+					// the deadline of the context is the real time limit
+					if sig == unix.SIGKILL && c.Err() == context.Canceled {
+						status = runner.StatusCanceled
+					}
 				case unix.SIGXFSZ:
 					status = runner.StatusOutputLimitExceeded
 				case unix.SIGSYS:
@@ -155,13 +186,16 @@ func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 				result.ExitStatus = int(sig)
 				return
 			}
-			unix.PtraceCont(pid, int(sig))
+			delete(traced, pid)
+			if pid == tgid {
+				usage.exit(tgid)
+			}
 
 		case wstatus.Stopped():
 			// Set option if the process is newly forked
-			if !traced[pid] {
-				t.Handler.Debug("set ptrace option for", pid)
-				traced[pid] = true
+			if !ok {
+				t.Handler.Debug("set ptrace option for", pid, "tgid", tgid)
+				traced[pid] = tgid
 				// Ptrace set option valid if the tracee is stopped
 				err = setPtraceOption(pid)
 				if err != nil {
@@ -169,6 +203,13 @@ func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 					result.Error = err.Error()
 					return
 				}
+				// auto-attached children start with SIGSTOP, which should not
+				// be delivered
+				if pid != pgid && wstatus.StopSignal() == unix.SIGSTOP {
+					t.Handler.Debug("new child started: ", pid)
+					unix.PtraceCont(pid, 0)
+					continue
+				}
 			}
 
 			// Check stop signal, if trap then check seccomp
@@ -177,7 +218,11 @@ func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 				case unix.PTRACE_EVENT_SECCOMP:
 					if execved {
 						// give the customized handle for syscall
-						err := t.handleTrap(pid)
+						start := time.Now()
+						ctx, err := t.handleTrap(pid)
+						if profile != nil && ctx != nil {
+							profile.add(t.Handler, ctx, time.Since(start))
+						}
 						if err != nil {
 							result.Status = runner.StatusDisallowedSyscall
 							result.Error = err.Error()
@@ -187,12 +232,12 @@ func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 						t.Handler.Debug("ptrace seccomp before execve (should be the execve syscall)")
 					}
 
-				case unix.PTRACE_EVENT_CLONE:
-					t.Handler.Debug("ptrace stop clone")
-				case unix.PTRACE_EVENT_VFORK:
-					t.Handler.Debug("ptrace stop vfork")
-				case unix.PTRACE_EVENT_FORK:
-					t.Handler.Debug("ptrace stop fork")
+				case unix.PTRACE_EVENT_CLONE, unix.PTRACE_EVENT_VFORK, unix.PTRACE_EVENT_FORK:
+					// the new child is traced with the same options and seccomp
+					// filter, and accounted when it stops
+					child, _ := unix.PtraceGetEventMsg(pid)
+					usage.fork(int(child), tgid)
+					t.Handler.Debug("ptrace stop fork / clone: ", child)
 				case unix.PTRACE_EVENT_EXEC:
 					// forked tracee have successfully called execve
 					if !execved {
@@ -229,30 +274,72 @@ func (t *Tracer) TraceRun(c context.Context) (result runner.Result) {
 	}
 }
 
-// handleTrap handles the seccomp trap including the custom handle
-func (t *Tracer) handleTrap(pid int) error {
+// foreignChildInterval is the interval to wait for the child not traced to
+// be reaped by its owner
+const foreignChildInterval = time.Millisecond
+
+// siPidOffset is the offset of si_pid in siginfo, the union follows signo,
+// errno and code aligned to the pointer size
+const siPidOffset = 4*3 + unsafe.Sizeof(uintptr(0)) - 4
+
+// waitTracee waits for the next stop or exit of the tracees, including the
+// ones left the process group (e.g. by setsid) which wait4(-pgid) does not
+// report. The children of the tracer thread (__WNOTHREAD) are peeked by
+// waitid(WNOWAIT) first, since the thread could have forked children for
+// other goroutines before locked, which are left to their owners
+func waitTracee(pgid int, traced map[int]int, wstatus *unix.WaitStatus, rusage *unix.Rusage) (int, error) {
+	for {
+		var info unix.Siginfo
+		err := unix.Waitid(unix.P_ALL, 0, &info, unix.WEXITED|unix.WNOWAIT|unix.WALL|unix.WNOTHREAD, nil)
+		if err != nil {
+			return 0, err
+		}
+		pid := int(*(*int32)(unsafe.Pointer(uintptr(unsafe.Pointer(&info)) + siPidOffset)))
+		if _, ok := traced[pid]; ok || isTracee(pid, pgid) {
+			return unix.Wait4(pid, wstatus, unix.WALL, rusage)
+		}
+		time.Sleep(foreignChildInterval)
+	}
+}
+
+// isTracee reports whether the child not seen before is traced, i.e. it is in
+// the process group or traced by the calling thread
+func isTracee(pid, pgid int) bool {
+	if pg, err := unix.Getpgid(pid); err == nil && pg == pgid {
+		return true
+	}
+	tracer, ok := readStatus(pid, "TracerPid:")
+	return ok && tracer == unix.Gettid()
+}
+
+// handleTrap handles the seccomp trap including the custom handle, the
+// context of the trapped syscall is returned if it was read
+func (t *Tracer) handleTrap(pid int) (*Context, error) {
 	t.Handler.Debug("seccomp traced")
 	msg, err := unix.PtraceGetEventMsg(pid)
 	if err != nil {
 		t.Handler.Debug("PtraceGetEventMsg failed:", err)
-		return err
+		return nil, err
 	}
 	switch int16(msg) {
 	case seccomp.MsgDisallow:
 		ctx, err := getTrapContext(pid)
 		if err != nil {
 			t.Handler.Debug("getTrapContext failed:", err)
-			return err
+			return nil, err
 		}
 		syscallName, err := t.Handler.GetSyscallName(ctx)
 		t.Handler.Debug("disallowed syscall: ", ctx.SyscallNo(), syscallName, err)
-		return t.Handler.HandlerDisallow(syscallName)
+		if h, ok := t.Handler.(SoftBanHandler); ok && h.SoftBanDisallow(ctx) {
+			return ctx, ctx.skipSyscall()
+		}
+		return ctx, t.Handler.HandlerDisallow(syscallName)
 
 	case seccomp.MsgHandle:
 		if t.Handler != nil {
 			ctx, err := getTrapContext(pid)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			act := t.Handler.Handle(ctx)
 
@@ -260,11 +347,13 @@ func (t *Tracer) handleTrap(pid int) error {
 			case TraceBan:
 				// Set the syscallno to -1 and return value into register to skip syscall.
 				// https://www.kernel.org/doc/Documentation/prctl/pkg/seccomp_filter.txt
-				return ctx.skipSyscall()
+				return ctx, ctx.skipSyscall()
 
 			case TraceKill:
-				return runner.StatusDisallowedSyscall
+				return ctx, runner.StatusDisallowedSyscall
 			}
+			// arguments may be rewritten by handler
+			return ctx, ctx.commit()
 		}
 
 	default:
@@ -272,7 +361,31 @@ func (t *Tracer) handleTrap(pid int) error {
 		t.Handler.Debug("unknown seccomp trap message: ", msg)
 	}
 
-	return nil
+	return nil, nil
+}
+
+// getTgid reads the thread group id of the thread from /proc/<pid>/status
+// since rusage reported by wait4 covers the whole thread group
+func getTgid(pid int) int {
+	if tgid, ok := readStatus(pid, "Tgid:"); ok {
+		return tgid
+	}
+	return pid
+}
+
+// readStatus reads the integer field of /proc/<pid>/status
+func readStatus(pid int, field string) (int, bool) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if v := strings.TrimPrefix(l, field); v != l {
+			i, err := strconv.Atoi(strings.TrimSpace(v))
+			return i, err == nil
+		}
+	}
+	return 0, false
 }
 
 // set Ptrace option that set up seccomp, exit kill and all mult-process actions
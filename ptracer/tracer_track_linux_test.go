@@ -0,0 +1,81 @@
+package ptracer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/criyle/go-sandbox/pkg/forkexec"
+	"github.com/criyle/go-sandbox/pkg/seccomp"
+	"github.com/criyle/go-sandbox/pkg/seccomp/libseccomp"
+	"github.com/criyle/go-sandbox/runner"
+)
+
+type testHandler struct {
+	handle func(*Context) TraceAction
+}
+
+func (h *testHandler) Handle(ctx *Context) TraceAction {
+	if h.handle == nil {
+		return TraceAllow
+	}
+	return h.handle(ctx)
+}
+
+func (h *testHandler) GetSyscallName(ctx *Context) (string, error) {
+	return "", nil
+}
+
+func (h *testHandler) Debug(v ...interface{}) {}
+
+func (h *testHandler) HandlerDisallow(name string) error {
+	return errors.New("disallowed syscall")
+}
+
+// traceRun runs the args with open / openat traced by the handler
+func traceRun(t *testing.T, h *testHandler, args ...string) runner.Result {
+	filter, err := (&libseccomp.Builder{
+		Trace:   []string{"open", "openat"},
+		Default: seccomp.ActionAllow,
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	tracer := &Tracer{
+		Handler: h,
+		Runner: &forkexec.Runner{
+			Args:      args,
+			Env:       []string{"PATH=/usr/bin:/bin"},
+			Files:     []uintptr{null.Fd(), null.Fd(), null.Fd()},
+			Seccomp:   filter.SockFprog(),
+			Ptrace:    true,
+			Pdeathsig: syscall.SIGKILL,
+		},
+		Limit: runner.Limit{TimeLimit: 5 * time.Second, MemoryLimit: 1 << 30},
+	}
+	return tracer.TraceRun(ctx)
+}
+
+func TestTraceLeftGroup(t *testing.T) {
+	// the child left the process group by setsid stops on the traced open
+	// while the parent waits for it
+	start := time.Now()
+	r := traceRun(t, &testHandler{}, "/bin/sh", "-c", "setsid cat /dev/null")
+	if r.Status != runner.StatusNormal {
+		t.Error(r.Status, r.Error)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("finished after %v", d)
+	}
+}
@@ -0,0 +1,116 @@
+package ptracer
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/criyle/go-sandbox/runner"
+)
+
+// procUsage is the resource usage of a thread group reported by wait4, which
+// includes its reaped children
+type procUsage struct {
+	time   time.Duration
+	memory runner.Size
+}
+
+// exitedUsage is the final usage of an exited thread group not yet accounted
+// by its parent
+type exitedUsage struct {
+	procUsage
+	parent int           // tgid of the parent, 0 if the parent exited
+	base   time.Duration // time of the parent when exited
+}
+
+// usageTracker accounts the resource usage of all traced thread groups.
+// Since the usage reported for a thread group includes its reaped children,
+// an exited group is kept until its parent reaped it and reported the time
+// grown by it, so that children never reaped (or orphaned) are accounted
+type usageTracker struct {
+	alive   map[int]procUsage   // by tgid
+	exited  map[int]exitedUsage // by tgid
+	parents map[int]int         // tgid of the parent by pid of the child
+
+	// exists reports whether the process is not reaped yet
+	exists func(pid int) bool
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		alive:   make(map[int]procUsage),
+		exited:  make(map[int]exitedUsage),
+		parents: make(map[int]int),
+		exists:  processExists,
+	}
+}
+
+// fork records the parent of the new child
+func (u *usageTracker) fork(child, parent int) {
+	u.parents[child] = parent
+}
+
+// update records the usage reported for the thread group
+func (u *usageTracker) update(tgid int, p procUsage) {
+	u.alive[tgid] = p
+	// exited children reaped by the thread group are included
+	for c, e := range u.exited {
+		if e.parent == tgid && p.time-e.base >= e.time && !u.exists(c) {
+			delete(u.exited, c)
+		}
+	}
+}
+
+// exit keeps the last reported usage of the thread group until accounted by
+// its parent
+func (u *usageTracker) exit(tgid int) {
+	p, ok := u.alive[tgid]
+	if !ok {
+		return
+	}
+	delete(u.alive, tgid)
+
+	e := exitedUsage{procUsage: p, parent: u.parents[tgid]}
+	delete(u.parents, tgid)
+	if pu, ok := u.alive[e.parent]; ok {
+		e.base = pu.time
+	} else {
+		e.parent = 0
+	}
+	u.exited[tgid] = e
+
+	// children not reaped are never accounted by the exited group
+	for c, ce := range u.exited {
+		if ce.parent == tgid {
+			ce.parent = 0
+			u.exited[c] = ce
+		}
+	}
+}
+
+// total sums the time and takes the max memory of all thread groups
+func (u *usageTracker) total() (time.Duration, runner.Size) {
+	var (
+		t time.Duration
+		m runner.Size
+	)
+	add := func(p procUsage) {
+		t += p.time
+		if p.memory > m {
+			m = p.memory
+		}
+	}
+	for _, p := range u.alive {
+		add(p)
+	}
+	for _, e := range u.exited {
+		add(e.procUsage)
+	}
+	return t, m
+}
+
+// processExists reports whether /proc/<pid> exists (zombies included)
+func processExists(pid int) bool {
+	_, err := os.Stat("/proc/" + strconv.Itoa(pid))
+	return err == nil
+}
@@ -0,0 +1,96 @@
+package ptracer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageTracker(t *testing.T) {
+	const (
+		leader = 100
+		parent = 101
+		child  = 102
+	)
+	u := func(ms int) procUsage {
+		return procUsage{time: time.Duration(ms) * time.Millisecond, memory: 1}
+	}
+	tests := []struct {
+		name string
+		run  func(tr *usageTracker, reaped map[int]bool)
+		want time.Duration
+	}{
+		{
+			name: "child never reaped",
+			run: func(tr *usageTracker, reaped map[int]bool) {
+				tr.update(parent, u(100))
+				tr.fork(child, parent)
+				tr.update(child, u(300))
+				tr.exit(child)
+				tr.update(parent, u(600))
+			},
+			want: 900 * time.Millisecond,
+		},
+		{
+			name: "child reaped by parent",
+			run: func(tr *usageTracker, reaped map[int]bool) {
+				tr.update(parent, u(100))
+				tr.fork(child, parent)
+				tr.update(child, u(300))
+				tr.exit(child)
+				reaped[child] = true
+				tr.update(parent, u(450))
+			},
+			want: 450 * time.Millisecond,
+		},
+		{
+			name: "child reaped but parent not reported",
+			run: func(tr *usageTracker, reaped map[int]bool) {
+				tr.update(parent, u(100))
+				tr.fork(child, parent)
+				tr.update(child, u(300))
+				tr.exit(child)
+				reaped[child] = true
+				tr.update(parent, u(150))
+			},
+			want: 450 * time.Millisecond,
+		},
+		{
+			name: "parent exited first",
+			run: func(tr *usageTracker, reaped map[int]bool) {
+				tr.update(parent, u(100))
+				tr.fork(child, parent)
+				tr.update(parent, u(200))
+				tr.exit(parent)
+				tr.update(child, u(300))
+				tr.exit(child)
+				reaped[child] = true
+			},
+			want: 500 * time.Millisecond,
+		},
+		{
+			name: "child orphaned after exit",
+			run: func(tr *usageTracker, reaped map[int]bool) {
+				tr.update(parent, u(100))
+				tr.fork(child, parent)
+				tr.update(child, u(300))
+				tr.exit(child)
+				tr.update(parent, u(200))
+				tr.exit(parent)
+				reaped[child] = true
+			},
+			want: 500 * time.Millisecond,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reaped := make(map[int]bool)
+			tr := newUsageTracker()
+			tr.exists = func(pid int) bool { return !reaped[pid] }
+			tr.update(leader, u(0))
+			tc.run(tr, reaped)
+			if got, _ := tr.total(); got != tc.want {
+				t.Errorf("total time = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -23,7 +23,7 @@
 // Result
 //
 // Result defines program running result including
-// Status, ExitStatus, Detailed Error, Time, Memory,
+// Status, ExitStatus, Detailed Error, Time, Memory, Rusage,
 // SetupTime and RunningTime (in real clock)
 //
 // Runner
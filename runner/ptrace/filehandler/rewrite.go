@@ -0,0 +1,39 @@
+package filehandler
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// PathRemap rewrites the file paths accessed by the traced program, used as
+// Rewrite of the ptrace runner
+type PathRemap struct {
+	// Files maps the absolute file paths to others (e.g. /etc/passwd to a
+	// sanitized copy)
+	Files map[string]string
+
+	// Root, if not empty, is prefixed to the other absolute paths not inside
+	// it (e.g. /usr/lib to <Root>/usr/lib)
+	Root string
+}
+
+// NewPathRemap creates the new path remap under root
+func NewPathRemap(root string) *PathRemap {
+	return &PathRemap{Files: make(map[string]string), Root: root}
+}
+
+// Add maps the file to another one
+func (r *PathRemap) Add(from, to string) {
+	r.Files[filepath.Clean(from)] = filepath.Clean(to)
+}
+
+// Rewrite returns the path to be accessed instead
+func (r *PathRemap) Rewrite(p string) string {
+	if n, ok := r.Files[p]; ok {
+		return n
+	}
+	if r.Root == "" || p == r.Root || strings.HasPrefix(p, r.Root+"/") {
+		return p
+	}
+	return filepath.Join(r.Root, p)
+}
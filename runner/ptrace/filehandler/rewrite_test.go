@@ -0,0 +1,38 @@
+package filehandler
+
+import "testing"
+
+func TestPathRemapRewrite(t *testing.T) {
+	r := NewPathRemap("/sandbox")
+	r.Add("/etc/passwd", "/sandbox/etc/passwd.safe")
+	r.Add("/proc/self/../cpuinfo", "/sandbox/cpuinfo")
+
+	tests := []struct {
+		path, want string
+	}{
+		// exact match
+		{"/etc/passwd", "/sandbox/etc/passwd.safe"},
+		{"/proc/cpuinfo", "/sandbox/cpuinfo"},
+		// prefixed under root
+		{"/etc/hosts", "/sandbox/etc/hosts"},
+		{"/usr/lib/libc.so.6", "/sandbox/usr/lib/libc.so.6"},
+		{"/sandboxed", "/sandbox/sandboxed"},
+		// inside or equal to root
+		{"/sandbox", "/sandbox"},
+		{"/sandbox/a", "/sandbox/a"},
+	}
+	for _, tc := range tests {
+		if got := r.Rewrite(tc.path); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.path, got, tc.want)
+		}
+	}
+
+	// no root, only exact match
+	r = NewPathRemap("")
+	r.Add("/etc/passwd", "/tmp/passwd")
+	for p, want := range map[string]string{"/etc/passwd": "/tmp/passwd", "/etc/hosts": "/etc/hosts"} {
+		if got := r.Rewrite(p); got != want {
+			t.Errorf("no root %s: got %s, want %s", p, got, want)
+		}
+	}
+}
@@ -1,19 +1,28 @@
 package ptrace
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/criyle/go-sandbox/pkg/seccomp/libseccomp"
 	"github.com/criyle/go-sandbox/ptracer"
 	"github.com/criyle/go-sandbox/runner"
 )
 
 type tracerHandler struct {
-	ShowDetails, Unsafe bool
-	Handler             Handler
+	ShowDetails, Unsafe, Audit bool
+	SoftBan                    syscall.Errno
+	Rewrite                    func(string) string
+	Handler                    Handler
+
+	denied []string // denied syscalls in audit mode
 }
 
 func (h *tracerHandler) Debug(v ...interface{}) {
@@ -22,40 +31,165 @@ func (h *tracerHandler) Debug(v ...interface{}) {
 	}
 }
 
-func (h *tracerHandler) getString(ctx *ptracer.Context, addr uint) string {
-	return absPath(ctx.Pid, ctx.GetString(uintptr(addr)))
+// noDirfd is the dirfd index for syscalls resolve relative path against cwd
+const noDirfd = -1
+
+// getPath reads the path of the i-th argument relative to the dirfd argument,
+// and rewrites the argument if the path is mapped to another one by Rewrite
+func (h *tracerHandler) getPath(ctx *ptracer.Context, dirfd, i int) string {
+	fd := unix.AT_FDCWD
+	if dirfd != noDirfd {
+		fd = int(int32(ctx.Arg(dirfd)))
+	}
+	fn := resolvePath(ctx.Pid, fd, ctx.GetString(uintptr(ctx.Arg(i))))
+	if h.Rewrite == nil {
+		return fn
+	}
+	to := h.Rewrite(fn)
+	if to == fn {
+		return fn
+	}
+	// the original path is checked if failed to rewrite
+	if err := ctx.SetStringArg(i, to); err != nil {
+		h.Debug("rewrite failed: ", fn, to, err)
+		return fn
+	}
+	h.Debug("rewrite: ", fn, " -> ", to)
+	return to
+}
+
+// fileArg is the path argument i relative to the dirfd argument
+type fileArg struct {
+	dirfd, i int
 }
 
-func (h *tracerHandler) checkOpen(ctx *ptracer.Context, addr uint, flags uint) ptracer.TraceAction {
-	fn := h.getString(ctx, addr)
-	isReadOnly := (flags&syscall.O_ACCMODE == syscall.O_RDONLY) &&
-		(flags&syscall.O_CREAT == 0) &&
-		(flags&syscall.O_EXCL == 0) &&
-		(flags&syscall.O_TRUNC == 0)
+// file access checks of the traced syscalls
+const (
+	checkOpen = iota // read or write by the open flags
+	checkRead
+	checkWrite
+	checkStat
+	checkExec // read, and the file must not be anonymous (e.g. memfd)
+)
+
+// fileSyscall is the check and the path arguments of a file access syscall,
+// all paths are checked (e.g. rename / link could be used to write the
+// original file)
+type fileSyscall struct {
+	check int
+	args  []fileArg
+}
+
+var fileSyscalls = map[string]fileSyscall{
+	"open":    {checkOpen, []fileArg{{noDirfd, 0}}},
+	"openat":  {checkOpen, []fileArg{{0, 1}}},
+	"openat2": {checkOpen, []fileArg{{0, 1}}},
+	"creat":   {checkOpen, []fileArg{{noDirfd, 0}}},
+
+	"readlink":   {checkRead, []fileArg{{noDirfd, 0}}},
+	"readlinkat": {checkRead, []fileArg{{0, 1}}},
+
+	"unlink":   {checkWrite, []fileArg{{noDirfd, 0}}},
+	"rmdir":    {checkWrite, []fileArg{{noDirfd, 0}}},
+	"mkdir":    {checkWrite, []fileArg{{noDirfd, 0}}},
+	"unlinkat": {checkWrite, []fileArg{{0, 1}}},
+	"mkdirat":  {checkWrite, []fileArg{{0, 1}}},
+
+	"access":     {checkStat, []fileArg{{noDirfd, 0}}},
+	"faccessat":  {checkStat, []fileArg{{0, 1}}},
+	"faccessat2": {checkStat, []fileArg{{0, 1}}},
+	"newfstatat": {checkStat, []fileArg{{0, 1}}},
+	"fstatat64":  {checkStat, []fileArg{{0, 1}}},
+	"statx":      {checkStat, []fileArg{{0, 1}}},
+	"stat":       {checkStat, []fileArg{{noDirfd, 0}}},
+	"stat64":     {checkStat, []fileArg{{noDirfd, 0}}},
+	"lstat":      {checkStat, []fileArg{{noDirfd, 0}}},
+	"lstat64":    {checkStat, []fileArg{{noDirfd, 0}}},
+
+	"execve":   {checkExec, []fileArg{{noDirfd, 0}}},
+	"execveat": {checkExec, []fileArg{{0, 1}}},
+
+	"chmod":     {checkWrite, []fileArg{{noDirfd, 0}}},
+	"fchmodat":  {checkWrite, []fileArg{{0, 1}}},
+	"fchmodat2": {checkWrite, []fileArg{{0, 1}}},
 
-	h.Debug("open: ", fn, getFileMode(flags))
-	if isReadOnly {
-		return h.Handler.CheckRead(fn)
+	"rename":    {checkWrite, []fileArg{{noDirfd, 0}, {noDirfd, 1}}},
+	"link":      {checkWrite, []fileArg{{noDirfd, 0}, {noDirfd, 1}}},
+	"renameat":  {checkWrite, []fileArg{{0, 1}, {2, 3}}},
+	"renameat2": {checkWrite, []fileArg{{0, 1}, {2, 3}}},
+	"linkat":    {checkWrite, []fileArg{{0, 1}, {2, 3}}},
+	"symlink":   {checkWrite, []fileArg{{noDirfd, 1}}},
+	"symlinkat": {checkWrite, []fileArg{{1, 2}}},
+}
+
+// checkFile checks all paths of the file access syscall by Handler, the most
+// severe action is returned
+func (h *tracerHandler) checkFile(check int, tc *TraceContext) ptracer.TraceAction {
+	var action ptracer.TraceAction
+	for _, fn := range tc.Paths {
+		var a ptracer.TraceAction
+		switch check {
+		case checkOpen:
+			h.Debug("open: ", fn, getFileMode(tc.Flags))
+			if isReadOnly(tc.Flags) {
+				a = h.Handler.CheckRead(fn)
+			} else {
+				a = h.Handler.CheckWrite(fn)
+			}
+		case checkRead:
+			h.Debug("check read: ", fn)
+			a = h.Handler.CheckRead(fn)
+		case checkWrite:
+			h.Debug("check write: ", fn)
+			a = h.Handler.CheckWrite(fn)
+		case checkStat:
+			h.Debug("check stat: ", fn)
+			a = h.Handler.CheckStat(fn)
+		case checkExec:
+			h.Debug("check exec: ", fn)
+			if isAnonymousFile(fn) {
+				a = ptracer.TraceKill
+			} else {
+				a = h.Handler.CheckRead(fn)
+			}
+		}
+		if a > action {
+			action = a
+		}
 	}
-	return h.Handler.CheckWrite(fn)
+	return action
 }
 
-func (h *tracerHandler) checkRead(ctx *ptracer.Context, addr uint) ptracer.TraceAction {
-	fn := h.getString(ctx, addr)
-	h.Debug("check read: ", fn)
-	return h.Handler.CheckRead(fn)
+func isReadOnly(flags uint) bool {
+	return (flags&syscall.O_ACCMODE == syscall.O_RDONLY) &&
+		(flags&syscall.O_CREAT == 0) &&
+		(flags&syscall.O_EXCL == 0) &&
+		(flags&syscall.O_TRUNC == 0)
 }
 
-func (h *tracerHandler) checkWrite(ctx *ptracer.Context, addr uint) ptracer.TraceAction {
-	fn := h.getString(ctx, addr)
-	h.Debug("check write: ", fn)
-	return h.Handler.CheckWrite(fn)
+// openFlags gets the flags of the open syscalls
+func (h *tracerHandler) openFlags(ctx *ptracer.Context, name string) uint {
+	switch name {
+	case "open":
+		return ctx.Arg1()
+	case "openat":
+		return ctx.Arg2()
+	case "openat2":
+		return h.openHowFlags(ctx)
+	}
+	// creat
+	return syscall.O_CREAT | syscall.O_WRONLY | syscall.O_TRUNC
 }
 
-func (h *tracerHandler) checkStat(ctx *ptracer.Context, addr uint) ptracer.TraceAction {
-	fn := h.getString(ctx, addr)
-	h.Debug("check stat: ", fn)
-	return h.Handler.CheckStat(fn)
+// openHowFlags reads flags of struct open_how (the 2nd argument of openat2)
+func (h *tracerHandler) openHowFlags(ctx *ptracer.Context) uint {
+	var b [8]byte
+	if err := ctx.GetData(uintptr(ctx.Arg2()), b[:]); err != nil {
+		h.Debug("openat2: failed to read open_how: ", err)
+		// checked as write
+		return syscall.O_RDWR
+	}
+	return uint(binary.LittleEndian.Uint64(b[:]))
 }
 
 func (h *tracerHandler) Handle(ctx *ptracer.Context) ptracer.TraceAction {
@@ -70,43 +204,33 @@ func (h *tracerHandler) Handle(ctx *ptracer.Context) ptracer.TraceAction {
 		return ptracer.TraceKill
 	}
 
-	switch syscallName {
-	case "open":
-		action = h.checkOpen(ctx, ctx.Arg0(), ctx.Arg1())
-	case "openat":
-		action = h.checkOpen(ctx, ctx.Arg1(), ctx.Arg2())
-
-	case "readlink":
-		action = h.checkRead(ctx, ctx.Arg0())
-	case "readlinkat":
-		action = h.checkRead(ctx, ctx.Arg1())
-
-	case "unlink":
-		action = h.checkWrite(ctx, ctx.Arg0())
-	case "unlinkat":
-		action = h.checkWrite(ctx, ctx.Arg1())
-
-	case "access":
-		action = h.checkStat(ctx, ctx.Arg0())
-	case "faccessat", "newfstatat":
-		action = h.checkStat(ctx, ctx.Arg1())
-
-	case "stat", "stat64":
-		action = h.checkStat(ctx, ctx.Arg0())
-	case "lstat", "lstat64":
-		action = h.checkStat(ctx, ctx.Arg0())
-
-	case "execve":
-		action = h.checkRead(ctx, ctx.Arg0())
-	case "execveat":
-		action = h.checkRead(ctx, ctx.Arg1())
-
-	case "chmod":
-		action = h.checkWrite(ctx, ctx.Arg0())
-	case "rename":
-		action = h.checkWrite(ctx, ctx.Arg0())
-	default:
-		action = h.Handler.CheckSyscall(syscallName)
+	tc := &TraceContext{Context: ctx, Name: syscallName}
+	fs, isFile := fileSyscalls[syscallName]
+	if isFile {
+		for _, a := range fs.args {
+			fn := h.getPath(ctx, a.dirfd, a.i)
+			if fs.check == checkExec {
+				fn = fdTarget(ctx.Pid, fn)
+			}
+			tc.Paths = append(tc.Paths, fn)
+		}
+		if fs.check == checkOpen {
+			tc.Flags = h.openFlags(ctx, syscallName)
+		}
+	}
+
+	decided := false
+	if sh, ok := h.Handler.(SyscallHandler); ok {
+		act := sh.OnSyscall(tc)
+		h.Debug("on syscall: ", act)
+		action, decided = act.traceAction()
+	}
+	if !decided {
+		if isFile {
+			action = h.checkFile(fs.check, tc)
+		} else {
+			action = h.Handler.CheckSyscall(syscallName)
+		}
 	}
 
 	switch action {
@@ -116,6 +240,13 @@ func (h *tracerHandler) Handle(ctx *ptracer.Context) ptracer.TraceAction {
 		h.Debug("<soft ban syscall>")
 		return softBanSyscall(ctx)
 	default:
+		if h.Audit {
+			h.deny(syscallName)
+			return ptracer.TraceAllow
+		}
+		if h.SoftBanDisallow(ctx) {
+			return ptracer.TraceBan
+		}
 		return ptracer.TraceKill
 	}
 }
@@ -126,12 +257,37 @@ func (h *tracerHandler) GetSyscallName(ctx *ptracer.Context) (string, error) {
 }
 
 func (h *tracerHandler) HandlerDisallow(name string) error {
+	if h.Audit {
+		h.deny(name)
+		return nil
+	}
 	if !h.Unsafe {
 		return runner.StatusDisallowedSyscall
 	}
 	return nil
 }
 
+// SoftBanDisallow sets the return value to the soft ban errno if enabled
+func (h *tracerHandler) SoftBanDisallow(ctx *ptracer.Context) bool {
+	if h.Audit || h.SoftBan == 0 {
+		return false
+	}
+	h.Debug("<soft ban disallowed syscall>", h.SoftBan)
+	ctx.SetReturnValue(-int(h.SoftBan))
+	return true
+}
+
+// deny records the syscall would have been denied
+func (h *tracerHandler) deny(name string) {
+	h.Debug("<audit denied syscall>", name)
+	for _, n := range h.denied {
+		if n == name {
+			return
+		}
+	}
+	h.denied = append(h.denied, name)
+}
+
 func softBanSyscall(ctx *ptracer.Context) ptracer.TraceAction {
 	ctx.SetReturnValue(-int(BanRet))
 	return ptracer.TraceBan
@@ -163,12 +319,55 @@ func getProcCwd(pid int) string {
 	return s
 }
 
-// absPath calculates the absolute path for a process
+// getProcFd gets the path of the file descriptor of the process
+func getProcFd(pid, fd int) string {
+	s, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// fdTarget resolves the path of file descriptor (e.g. /proc/self/fd/3 or
+// /dev/fd/3 used by fexecve) of the process to the file it refers to
+func fdTarget(pid int, p string) string {
+	self := "/proc/" + strconv.Itoa(pid)
+	switch {
+	case strings.HasPrefix(p, "/dev/fd/"):
+		p = self + "/fd/" + strings.TrimPrefix(p, "/dev/fd/")
+	case strings.HasPrefix(p, "/proc/self/"):
+		p = self + strings.TrimPrefix(p, "/proc/self")
+	case strings.HasPrefix(p, "/proc/thread-self/"):
+		p = self + strings.TrimPrefix(p, "/proc/thread-self")
+	}
+	// /proc/<pid>/fd/<fd> or /proc/<pid>/task/<tid>/fd/<fd>
+	f := strings.Split(p, "/")
+	if len(f) < 5 || f[1] != "proc" || f[len(f)-2] != "fd" {
+		return p
+	}
+	if s, err := os.Readlink(p); err == nil {
+		return s
+	}
+	return p
+}
+
+// isAnonymousFile reports whether the file could not be checked by its path,
+// e.g. memfd, unlinked file or anon_inode
+func isAnonymousFile(p string) bool {
+	return !path.IsAbs(p) || strings.HasPrefix(p, "/memfd:") || strings.HasSuffix(p, " (deleted)")
+}
+
+// resolvePath calculates the absolute path for a process relative to dirfd
+// (cwd for AT_FDCWD), empty path (AT_EMPTY_PATH) refers to dirfd itself
 // built-in function did the dirty works to resolve relative paths
-func absPath(pid int, p string) string {
+func resolvePath(pid, dirfd int, p string) string {
 	// if relative path
 	if !path.IsAbs(p) {
-		return path.Join(getProcCwd(pid), p)
+		dir := getProcCwd(pid)
+		if dirfd != unix.AT_FDCWD {
+			dir = getProcFd(pid, dirfd)
+		}
+		return path.Join(dir, p)
 	}
 	return path.Clean(p)
 }
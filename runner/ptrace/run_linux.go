@@ -2,6 +2,7 @@ package ptrace
 
 import (
 	"context"
+	"syscall"
 
 	"github.com/criyle/go-sandbox/pkg/forkexec"
 	"github.com/criyle/go-sandbox/ptracer"
@@ -21,12 +22,18 @@ func (r *Runner) Run(c context.Context) <-chan runner.Result {
 		Ptrace:   true,
 		SyncFunc: r.SyncFunc,
 
+		// tracer thread is locked, child is killed if tracer dies
+		Pdeathsig: syscall.SIGKILL,
+
 		UnshareCgroupAfterSync: true,
 	}
 
 	th := &tracerHandler{
 		ShowDetails: r.ShowDetails,
 		Unsafe:      r.Unsafe,
+		Audit:       r.Audit,
+		SoftBan:     r.SoftBan,
+		Rewrite:     r.Rewrite,
 		Handler:     r.Handler,
 	}
 
@@ -34,6 +41,17 @@ func (r *Runner) Run(c context.Context) <-chan runner.Result {
 		Handler: th,
 		Runner:  ch,
 		Limit:   r.Limit,
+		Profile: r.Profile,
+	}
+	if !r.Audit {
+		return tracer.Trace(c)
 	}
-	return tracer.Trace(c)
+
+	result := make(chan runner.Result, 1)
+	go func() {
+		rt := tracer.TraceRun(c)
+		rt.DeniedSyscalls = th.denied
+		result <- rt
+	}()
+	return result
 }
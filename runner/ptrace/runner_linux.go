@@ -41,6 +41,26 @@ type Runner struct {
 	// ShowDetails / Unsafe debug flag
 	ShowDetails, Unsafe bool
 
+	// Audit allows the disallowed syscalls (MsgDisallow trap or TraceKill
+	// by Handler) and reports them in Result.DeniedSyscalls
+	Audit bool
+
+	// SoftBan, if not 0, makes the disallowed syscalls (MsgDisallow trap or
+	// TraceKill by Handler) skipped and fail with the errno (e.g. EPERM,
+	// ENOSYS) instead of killing, so that programs probing forbidden features
+	// could continue. Audit takes precedence
+	SoftBan syscall.Errno
+
+	// Rewrite, if not nil, maps the absolute path of the traced file access
+	// syscalls to the path actually accessed (e.g. a sanitized copy, or inside
+	// the sandbox root, see filehandler.PathRemap), which is checked by
+	// Handler instead of the original one
+	Rewrite func(string) string
+
+	// Profile reports the count and the time stopped of the traced syscalls
+	// in Result.SyscallProfile
+	Profile bool
+
 	// Use by cgroup to add proc
 	SyncFunc func(pid int) error
 }
@@ -55,3 +75,68 @@ type Handler interface {
 	CheckStat(string) ptracer.TraceAction
 	CheckSyscall(string) ptracer.TraceAction
 }
+
+// SyscallHandler is optionally implemented by Handler to decide the traced
+// syscalls with the decoded arguments before the checks of Handler, e.g.
+// allow writing only the files matching output_*.txt
+type SyscallHandler interface {
+	OnSyscall(*TraceContext) Action
+}
+
+// TraceContext is the traced syscall with its decoded arguments
+type TraceContext struct {
+	*ptracer.Context
+
+	// Name is the syscall name
+	Name string
+
+	// Paths are the absolute paths of the file access syscall (after
+	// Rewrite), 2 for rename / link, nil for other syscalls. Paths of file
+	// descriptor executed by execve / execveat are resolved to the file
+	Paths []string
+
+	// Flags is the open flags of open / openat / openat2 / creat
+	Flags uint
+}
+
+// Action is the decision of SyscallHandler
+type Action int
+
+const (
+	// ActionIgnore leaves the syscall to the checks of Handler
+	ActionIgnore Action = iota
+	// ActionAllow allows the syscall
+	ActionAllow
+	// ActionBan skips the syscall which fails with BanRet
+	ActionBan
+	// ActionKill denies the syscall as disallowed
+	ActionKill
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionIgnore:
+		return "ignore"
+	case ActionAllow:
+		return "allow"
+	case ActionBan:
+		return "ban"
+	case ActionKill:
+		return "kill"
+	default:
+		return "unknown"
+	}
+}
+
+// traceAction converts the decision, false for ActionIgnore
+func (a Action) traceAction() (ptracer.TraceAction, bool) {
+	switch a {
+	case ActionAllow:
+		return ptracer.TraceAllow, true
+	case ActionBan:
+		return ptracer.TraceBan, true
+	case ActionKill:
+		return ptracer.TraceKill, true
+	}
+	return ptracer.TraceAllow, false
+}
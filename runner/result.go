@@ -13,12 +13,71 @@ type Result struct {
 
 	Time   time.Duration // used user CPU time  (underlying type int64 in ns)
 	Memory Size          // used user memory    (underlying type uint64 in bytes)
+	Swap   Size          // used swap (0 if not collected by memory cgroup)
+
+	// block device io in bytes (0 if not collected by io cgroup)
+	IORead, IOWrite Size
+
+	// detailed resource usage collected by wait4 (nil if not collected by the runner)
+	Rusage *Rusage
+
+	// crash information if signalled (nil if not collected by the runner)
+	Crash *CrashInfo
+
+	// stall time by resource contention (nil if not collected by cgroup v2)
+	Pressure *Pressure
+
+	// syscalls would have been denied, in order of first call (audit mode)
+	DeniedSyscalls []string
+
+	// traced syscalls in order of first call (nil if not profiled)
+	SyscallProfile []SyscallStat
 
 	// metrics for the program runner
 	SetUpTime   time.Duration
 	RunningTime time.Duration
 }
 
+// Rusage is the resource usage of the program reported by wait4
+type Rusage struct {
+	UserTime   time.Duration // user CPU time
+	SystemTime time.Duration // system CPU time
+	MaxRss     Size          // maximum resident set size
+
+	MinorFault uint64 // page reclaims (soft page faults)
+	MajorFault uint64 // page faults (hard page faults)
+
+	VoluntaryCtxSwitch   uint64 // voluntary context switches
+	InvoluntaryCtxSwitch uint64 // involuntary context switches
+}
+
+// Pressure is the time the program stalled on the resource by PSI
+type Pressure struct {
+	CPU, Memory, IO Stall
+}
+
+// Stall is the time some (at least one) / full (all) of the tasks stalled
+type Stall struct {
+	Some, Full time.Duration
+}
+
+// SyscallStat is the number of calls of the traced syscall, and the time the
+// tracee stopped by them (from the stop reported to the tracer to resumed)
+type SyscallStat struct {
+	Name  string
+	Count uint64
+	Time  time.Duration
+}
+
+// CrashInfo is the information of the program terminated by signal
+type CrashInfo struct {
+	Signal     int    // signal terminated the program
+	CoreDumped bool   // core dump is produced
+	CorePath   string // path of the core file (empty if not collected)
+	CoreSize   int64  // size of the core file
+	Core       []byte // leading bytes of the core file (truncated)
+}
+
 func (r Result) String() string {
 	switch r.Status {
 	case StatusNormal:
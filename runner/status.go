@@ -23,6 +23,12 @@ const (
 
 	// Programmer Runner Error
 	StatusRunnerError // 8 runner error
+
+	// Resource Limit Exceeded (cont.)
+	StatusForkLimitExceeded // 9 fork failed by process / thread limit
+
+	// Canceled
+	StatusCanceled // 10 killed as the context canceled
 )
 
 var (
@@ -36,6 +42,8 @@ var (
 		"Signalled",
 		"Nonzero Exit Status",
 		"Runner Error",
+		"Fork Limit Exceeded",
+		"Canceled",
 	}
 )
 
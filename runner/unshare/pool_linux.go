@@ -0,0 +1,242 @@
+package unshare
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/criyle/go-sandbox/pkg/forkexec"
+	"github.com/criyle/go-sandbox/pkg/mount"
+	"golang.org/x/sys/unix"
+)
+
+// ErrPoolClosed is returned by Get if the pool is closed
+var ErrPoolClosed = errors.New("unshare: pool closed")
+
+// shellNamespaces are joined in order, user namespace first to gain
+// capabilities in it
+var shellNamespaces = []struct {
+	name string
+	typ  uintptr
+}{
+	{"user", unix.CLONE_NEWUSER},
+	{"mnt", unix.CLONE_NEWNS},
+	{"uts", unix.CLONE_NEWUTS},
+	{"net", unix.CLONE_NEWNET},
+	{"pid", unix.CLONE_NEWPID},
+}
+
+// Pool keeps pre-created namespaces (shells) of user, mount, pid, uts and
+// network (if Loopback) with the root, mounts and host name set up, so that
+// runs joining them by setns skip the namespace creation and mount setup
+// (Runner.Shell). The processes remaining in the shell are killed after each
+// run (and before each run if missed) and the run gets a private copy of the
+// shell mount namespace, thus mounts of the run are discarded after it.
+//
+// Files written to the shell would be visible to the next run, so that the
+// shell is read-only: the root is not an overlay and the mounts must be
+// read-only (except device binds and devpts). Writable tmpfs should be
+// mounted by Runner.Mounts for each run instead, on the mount point created
+// in the shell (e.g. a read-only tmpfs)
+type Pool struct {
+	// Root, Mounts, HostName, DomainName and Loopback are the setup of the
+	// shells, same as the Runner
+	Root                 string
+	Mounts               []mount.SyscallParams
+	HostName, DomainName string
+	Loopback             bool
+
+	mu     sync.Mutex
+	idle   []*Shell
+	closed bool
+}
+
+// Shell is the namespaces held by an init process (which reaps the orphans)
+// and pinned by the fds of /proc/[pid]/ns. It should be used by one run at
+// a time
+type Shell struct {
+	pid int
+	ns  []forkexec.Namespace
+}
+
+// Fill creates shells until n of them are idle
+func (p *Pool) Fill(n int) error {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return ErrPoolClosed
+		}
+		if len(p.idle) >= n {
+			p.mu.Unlock()
+			return nil
+		}
+		p.mu.Unlock()
+
+		s, err := p.NewShell()
+		if err != nil {
+			return err
+		}
+		p.Put(s)
+	}
+}
+
+// Get returns an idle shell, or creates a new one if none
+func (p *Pool) Get() (*Shell, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		s := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return s, nil
+	}
+	p.mu.Unlock()
+	return p.NewShell()
+}
+
+// Put returns the shell to the pool after the run, it is closed if the pool
+// is closed or its init exited (e.g. killed)
+func (p *Pool) Put(s *Shell) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || !s.alive() {
+		s.Close()
+		return
+	}
+	p.idle = append(p.idle, s)
+}
+
+// Close closes the idle shells, shells in use are closed when put back
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, s := range p.idle {
+		s.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+// NewShell creates the namespaces with the setup of the pool
+func (p *Pool) NewShell() (*Shell, error) {
+	for i := range p.Mounts {
+		if err := checkShellMount(&p.Mounts[i]); err != nil {
+			return nil, err
+		}
+	}
+	flags := uintptr(UnshareFlags &^ unix.CLONE_NEWCGROUP)
+	if p.Loopback {
+		flags |= unix.CLONE_NEWNET
+	}
+	ch := &forkexec.Runner{
+		CloneFlags: flags,
+		Mounts:     p.Mounts,
+		PivotRoot:  p.Root,
+		HostName:   p.HostName,
+		DomainName: p.DomainName,
+		Loopback:   p.Loopback,
+		Pdeathsig:  unix.SIGKILL,
+		Hold:       true,
+	}
+	pid, err := ch.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Shell{pid: pid}
+	for _, n := range shellNamespaces {
+		if flags&n.typ == 0 {
+			continue
+		}
+		fd, err := unix.Open("/proc/"+strconv.Itoa(pid)+"/ns/"+n.name, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.ns = append(s.ns, forkexec.Namespace{Fd: uintptr(fd), Type: n.typ})
+	}
+	return s, nil
+}
+
+// checkShellMount rejects the mount writable across runs
+func checkShellMount(m *mount.SyscallParams) error {
+	if m.Flags&unix.MS_RDONLY != 0 {
+		return nil
+	}
+	fsType := unix.BytePtrToString(m.FsType)
+	// ptys of a new devpts instance are freed with the processes
+	if fsType == "devpts" {
+		return nil
+	}
+	// writes to the bound device are not stored
+	if m.Flags&unix.MS_BIND != 0 {
+		var st unix.Stat_t
+		if err := unix.Stat(unix.BytePtrToString(m.Source), &st); err == nil && st.Mode&unix.S_IFMT == unix.S_IFCHR {
+			return nil
+		}
+	}
+	return fmt.Errorf("unshare: writable mount %q in the shell, mount it read-only or by Runner.Mounts",
+		unix.BytePtrToString(m.Target))
+}
+
+// reset kills the processes remaining in the shell except the init by a
+// helper joining it, which kills them (kill(-1)) before it is ready
+func (s *Shell) reset() error {
+	h := &forkexec.Runner{
+		Setns:     s.ns,
+		Pdeathsig: unix.SIGKILL,
+		Hold:      true,
+	}
+	pid, err := h.Start()
+	if err != nil {
+		return err
+	}
+	return killWait(pid)
+}
+
+// alive reports whether the init is running, it is reaped if exited
+func (s *Shell) alive() bool {
+	if s.pid <= 0 {
+		return false
+	}
+	wpid, err := unix.Wait4(s.pid, nil, unix.WNOHANG|unix.WALL, nil)
+	for err == unix.EINTR {
+		wpid, err = unix.Wait4(s.pid, nil, unix.WNOHANG|unix.WALL, nil)
+	}
+	if wpid == s.pid || err != nil {
+		s.pid = 0
+		return false
+	}
+	return true
+}
+
+// Close kills the init (thus all processes in the shell) and releases the
+// namespaces
+func (s *Shell) Close() error {
+	for _, n := range s.ns {
+		unix.Close(int(n.Fd))
+	}
+	s.ns = nil
+	if s.pid <= 0 {
+		return nil
+	}
+	err := killWait(s.pid)
+	s.pid = 0
+	return err
+}
+
+// killWait kills the child and waits for it
+func killWait(pid int) error {
+	unix.Kill(pid, unix.SIGKILL)
+	_, err := unix.Wait4(pid, nil, unix.WALL, nil)
+	for err == unix.EINTR {
+		_, err = unix.Wait4(pid, nil, unix.WALL, nil)
+	}
+	return err
+}
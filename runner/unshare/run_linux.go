@@ -1,3 +1,4 @@
+//go:build linux
 // +build linux
 
 package unshare
@@ -28,28 +29,46 @@ func (r *Runner) Run(c context.Context) <-chan runner.Result {
 	return result
 }
 
+// cloneFlags unshares the network namespace as well with loopback
+func (r *Runner) cloneFlags() uintptr {
+	if r.Loopback {
+		return UnshareFlags | unix.CLONE_NEWNET
+	}
+	return UnshareFlags
+}
+
 // Trace tracks child processes
 func (r *Runner) trace(c context.Context) (result runner.Result) {
 	ch := &forkexec.Runner{
-		Args:       r.Args,
-		Env:        r.Env,
-		ExecFile:   r.ExecFile,
-		RLimits:    r.RLimits,
-		Files:      r.Files,
-		WorkDir:    r.WorkDir,
-		Seccomp:    r.Seccomp.SockFprog(),
-		NoNewPrivs: true,
-		CloneFlags: UnshareFlags,
-		Mounts:     r.Mounts,
-		HostName:   r.HostName,
-		DomainName: r.DomainName,
-		PivotRoot:  r.Root,
-		DropCaps:   true,
-		SyncFunc:   r.SyncFunc,
+		Args:         r.Args,
+		Env:          r.Env,
+		ExecFile:     r.ExecFile,
+		RLimits:      r.RLimits,
+		Files:        r.Files,
+		WorkDir:      r.WorkDir,
+		Seccomp:      r.Seccomp.SockFprog(),
+		NoNewPrivs:   true,
+		CloneFlags:   r.cloneFlags(),
+		Mounts:       r.Mounts,
+		HostName:     r.HostName,
+		DomainName:   r.DomainName,
+		Loopback:     r.Loopback,
+		PivotRoot:    r.Root,
+		OverlayLower: r.OverlayLower,
+		DropCaps:     true,
+		SyncFunc:     r.SyncFunc,
+		Pdeathsig:    unix.SIGKILL,
 
 		UnshareCgroupAfterSync: true,
 	}
 
+	// join the shell with a private copy of its mount namespace
+	if r.Shell != nil {
+		ch.CloneFlags = unix.CLONE_NEWNS
+		ch.Setns = r.Shell.ns
+		ch.PivotRoot, ch.OverlayLower = "", ""
+	}
+
 	var (
 		wstatus unix.WaitStatus // wait4 wait status
 		rusage  unix.Rusage     // wait4 rusage
@@ -73,15 +92,21 @@ func (r *Runner) trace(c context.Context) (result runner.Result) {
 	// handle cancel
 	go func() {
 		<-ctx.Done()
-		killAll(pgid)
+		r.killAll(pgid)
 	}()
 
 	// kill all tracee upon return
 	defer func() {
-		killAll(pgid)
+		r.killAll(pgid)
 		collectZombie(pgid)
 		result.SetUpTime = fTime.Sub(sTime)
 		result.RunningTime = time.Since(fTime)
+		// kill the processes left in the shell (e.g. escaped the group)
+		if r.Shell != nil {
+			if err := r.Shell.reset(); err != nil {
+				r.println("shell reset: ", err)
+			}
+		}
 	}()
 
 	fTime = time.Now()
@@ -145,8 +170,11 @@ func (r *Runner) trace(c context.Context) (result runner.Result) {
 	}
 }
 
-// kill all tracee according to pids
-func killAll(pgid int) {
+// kill all tracee according to cgroup or pgid
+func (r *Runner) killAll(pgid int) {
+	if r.KillFunc != nil && r.KillFunc() == nil {
+		return
+	}
 	unix.Kill(-pgid, unix.SIGKILL)
 }
 
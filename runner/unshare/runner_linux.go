@@ -34,15 +34,34 @@ type Runner struct {
 	// New root
 	Root string
 
+	// OverlayLower, if set, makes the new root a writable overlayfs of the
+	// lower directory (e.g. a rootfs image), changes are discarded after run
+	OverlayLower string
+
 	// Mount syscalls
 	Mounts []mount.SyscallParams
 
+	// Shell, if set, runs the program in the pre-created namespaces from Pool
+	// instead of creating them, thus Root, HostName, DomainName and Loopback
+	// are of the shell and OverlayLower is ignored. Mounts are performed on a
+	// private copy of the shell mounts, relative to / (e.g. writable tmpfs for
+	// each run), and discarded after the run
+	Shell *Shell
+
 	// hostname & domainname
 	HostName, DomainName string
 
+	// Loopback unshares the network namespace and brings up lo in it, so that
+	// only 127.0.0.1 is reachable
+	Loopback bool
+
 	// Show Details
 	ShowDetails bool
 
 	// Use by cgroup to add proc
 	SyncFunc func(pid int) error
+
+	// Use by cgroup to kill all processes in it (e.g. cgroup.kill), the
+	// process group is killed if not set or failed
+	KillFunc func() error
 }